@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/history"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+)
+
+type statusResponse struct {
+	Instance string          `json:"instance,omitempty"`
+	Health   health          `json:"health"`
+	Paused   bool            `json:"paused"`
+	DryRun   bool            `json:"dryRun"`
+	LastRun  *notify.Summary `json:"lastRun,omitempty"`
+	Statuses []targetStatus  `json:"statuses"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (u *updater) statusResponse() statusResponse {
+	return statusResponse{
+		Instance: u.name,
+		Health:   u.health(),
+		Paused:   u.isPaused(),
+		DryRun:   u.s.DryRun,
+		LastRun:  u.status.last(),
+		Statuses: u.status.list(),
+	}
+}
+
+// registerAPI adds the control api to mux, every route requires the token as
+// a bearer token. Routes about a single instance take it from the instance
+// query parameter, which may be left out when there is only one. Manual
+// checks and updates run until ctx is done, even if the client goes away.
+func registerAPI(ctx context.Context, mux *http.ServeMux, updaters []*updater, token string, ll zerolog.Logger) {
+	auth := func(h http.HandlerFunc) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"}, ll)
+				return
+			}
+			h(w, r)
+		})
+	}
+
+	pick := func(w http.ResponseWriter, r *http.Request) (*updater, bool) {
+		name := r.URL.Query().Get("instance")
+		u, err := selectUpdater(updaters, name)
+		if err != nil {
+			code := http.StatusBadRequest
+			if name != "" {
+				code = http.StatusNotFound
+			}
+			writeJSON(w, code, errorResponse{Error: err.Error()}, ll)
+			return nil, false
+		}
+		return u, true
+	}
+
+	// check, pause and resume apply to all instances unless one is given
+	selected := func(w http.ResponseWriter, r *http.Request) ([]*updater, bool) {
+		if r.URL.Query().Get("instance") == "" {
+			return updaters, true
+		}
+		u, ok := pick(w, r)
+		if !ok {
+			return nil, false
+		}
+		return []*updater{u}, true
+	}
+
+	mux.Handle("GET /api/instances", auth(func(w http.ResponseWriter, _ *http.Request) {
+		statuses := make([]statusResponse, 0, len(updaters))
+		for _, u := range updaters {
+			statuses = append(statuses, u.statusResponse())
+		}
+		writeJSON(w, http.StatusOK, statuses, ll)
+	}))
+
+	mux.Handle("GET /api/status", auth(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := pick(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, u.statusResponse(), ll)
+	}))
+
+	mux.Handle("GET /api/history", auth(func(w http.ResponseWriter, r *http.Request) {
+		// all instances share the history
+		hist := updaters[0].history
+		if hist == nil {
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "no history is kept"}, ll)
+			return
+		}
+
+		q, err := historyQuery(r.URL.Query())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()}, ll)
+			return
+		}
+
+		records, err := hist.Query(q)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()}, ll)
+			return
+		}
+		writeJSON(w, http.StatusOK, records, ll)
+	}))
+
+	mux.Handle("POST /api/check", auth(func(w http.ResponseWriter, r *http.Request) {
+		us, ok := selected(w, r)
+		if !ok {
+			return
+		}
+		for _, u := range us {
+			u.ll.Info().Msg("check triggered through api")
+			u.triggerRun()
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	mux.Handle("POST /api/stacks/{id}/check", auth(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := pick(w, r)
+		if !ok {
+			return
+		}
+
+		stackID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid stack id"}, ll)
+			return
+		}
+
+		// a check can update the stack, it isn't cut short when the client
+		// goes away either
+		checkCtx, cancel := detach(r.Context(), ctx)
+		defer cancel()
+		result, err := u.checkStack(checkCtx, stackID)
+		writeResult(w, result, err, ll)
+	}))
+
+	mux.Handle("POST /api/stacks/{id}/update", auth(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := pick(w, r)
+		if !ok {
+			return
+		}
+
+		stackID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid stack id"}, ll)
+			return
+		}
+
+		result, err := u.updateStack(r.Context(), ctx, stackID)
+		writeResult(w, result, err, ll)
+	}))
+
+	mux.Handle("POST /api/pause", auth(func(w http.ResponseWriter, r *http.Request) {
+		us, ok := selected(w, r)
+		if !ok {
+			return
+		}
+		for _, u := range us {
+			u.pause()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.Handle("POST /api/resume", auth(func(w http.ResponseWriter, r *http.Request) {
+		us, ok := selected(w, r)
+		if !ok {
+			return
+		}
+		for _, u := range us {
+			u.resume()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// writeResult answers with the result of a check or update, or the error
+// when the stack couldn't be looked up at all
+func writeResult(w http.ResponseWriter, result notify.Result, err error, ll zerolog.Logger) {
+	if result.Kind == "" && err != nil {
+		writeJSON(w, http.StatusBadGateway, errorResponse{Error: err.Error()}, ll)
+		return
+	}
+	writeJSON(w, http.StatusOK, result, ll)
+}
+
+// historyQuery reads the history filters from the query string, since is
+// either a duration such as 72h or a RFC 3339 time
+func historyQuery(values url.Values) (history.Query, error) {
+	q := history.Query{
+		Instance: values.Get("instance"),
+		Kind:     values.Get("kind"),
+		ID:       values.Get("id"),
+		Name:     values.Get("name"),
+		Action:   history.Action(values.Get("action")),
+		Limit:    50,
+	}
+
+	if v := values.Get("endpoint"); v != "" {
+		endpointID, err := strconv.Atoi(v)
+		if err != nil {
+			return q, errors.New("invalid endpoint")
+		}
+		q.EndpointID = endpointID
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return q, errors.New("invalid limit")
+		}
+		q.Limit = limit
+	}
+
+	if v := values.Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			q.Since = time.Now().Add(-d)
+		} else if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, errors.New("invalid since, expected a duration or RFC 3339 time")
+		}
+	}
+	return q, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}, ll zerolog.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		ll.Debug().Err(err).Msg("error writing api response")
+	}
+}
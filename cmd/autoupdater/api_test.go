@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+)
+
+const testAPIToken = "api-token"
+
+// newTestAPI serves the control api of u
+func newTestAPI(t *testing.T, u *updater) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	registerAPI(context.Background(), mux, []*updater{u}, testAPIToken, zerolog.Nop())
+	api := httptest.NewServer(mux)
+	t.Cleanup(api.Close)
+	return api
+}
+
+// apiRequest sends a request with token and decodes the response into out
+// when it's not nil
+func apiRequest(t *testing.T, api *httptest.Server, method, path, token string, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, api.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := api.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding response: %s", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	srv := newTestServer(t)
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+	api := newTestAPI(t, u)
+
+	for _, token := range []string{"", "wrong", testAPIToken + "x"} {
+		var resp errorResponse
+		if code := apiRequest(t, api, http.MethodGet, "/api/status", token, &resp); code != http.StatusUnauthorized || resp.Error != "unauthorized" {
+			t.Errorf("token %q: got %d %+v, want 401", token, code, resp)
+		}
+	}
+	if code := apiRequest(t, api, http.MethodPost, "/api/stacks/1/update", "wrong", nil); code != http.StatusUnauthorized {
+		t.Errorf("got %d updating with a wrong token, want 401", code)
+	}
+	if len(srv.Redeploys()) != 0 {
+		t.Errorf("unauthorized update redeployed: %+v", srv.Redeploys())
+	}
+
+	if code := apiRequest(t, api, http.MethodGet, "/api/status", testAPIToken, nil); code != http.StatusOK {
+		t.Errorf("got %d with the token, want 200", code)
+	}
+	if code := apiRequest(t, api, http.MethodGet, "/api/status?instance=staging", testAPIToken, nil); code != http.StatusNotFound {
+		t.Errorf("got %d for an unknown instance, want 404", code)
+	}
+}
+
+func TestAPICheckStack(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	s := testConfig()
+	s.DryRun = true
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	api := newTestAPI(t, u)
+
+	var result notify.Result
+	if code := apiRequest(t, api, http.MethodPost, "/api/stacks/1/check", testAPIToken, &result); code != http.StatusOK {
+		t.Fatalf("got %d checking the stack, want 200", code)
+	}
+	if result.Outcome != notify.OutcomeHeldBack || result.Reason != holdReasonDryRun || len(srv.Redeploys()) != 0 {
+		t.Errorf("got %+v with redeploys %+v, want the check to honor dry run", result, srv.Redeploys())
+	}
+
+	var resp errorResponse
+	if code := apiRequest(t, api, http.MethodPost, "/api/stacks/99/check", testAPIToken, &resp); code != http.StatusBadGateway || resp.Error == "" {
+		t.Errorf("got %d %+v checking an unknown stack, want 502 with the error", code, resp)
+	}
+	if code := apiRequest(t, api, http.MethodPost, "/api/stacks/web/check", testAPIToken, &resp); code != http.StatusBadRequest || resp.Error != "invalid stack id" {
+		t.Errorf("got %d %+v for a stack name, want 400", code, resp)
+	}
+}
+
+func TestAPIUpdateStackDryRun(t *testing.T) {
+	srv := newTestServer(t)
+	s := testConfig()
+	s.DryRun = true
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	api := newTestAPI(t, u)
+
+	// manual updates override dry run
+	var result notify.Result
+	if code := apiRequest(t, api, http.MethodPost, "/api/stacks/1/update", testAPIToken, &result); code != http.StatusOK {
+		t.Fatalf("got %d updating the stack, want 200", code)
+	}
+	if result.Outcome != notify.OutcomeUpdated || result.Name != "web" {
+		t.Errorf("got %+v, want the stack updated", result)
+	}
+	if redeploys := srv.Redeploys(); len(redeploys) != 1 || redeploys[0].Kind != fake.KindStack || redeploys[0].ID != "1" {
+		t.Errorf("got redeploys %+v, want the stack redeployed in dry run", redeploys)
+	}
+
+	// the update shows up in the status
+	var status statusResponse
+	apiRequest(t, api, http.MethodGet, "/api/status", testAPIToken, &status)
+	if !status.DryRun || len(status.Statuses) != 1 || status.Statuses[0].Outcome != notify.OutcomeUpdated {
+		t.Errorf("got status %+v, want the update recorded", status)
+	}
+}
+
+func TestAPIPauseResume(t *testing.T) {
+	srv := newTestServer(t)
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+	api := newTestAPI(t, u)
+
+	paused := func() bool {
+		t.Helper()
+		var status statusResponse
+		if code := apiRequest(t, api, http.MethodGet, "/api/status", testAPIToken, &status); code != http.StatusOK {
+			t.Fatalf("got %d getting the status", code)
+		}
+		return status.Paused
+	}
+
+	if paused() {
+		t.Fatal("want the updater running at first")
+	}
+	if code := apiRequest(t, api, http.MethodPost, "/api/pause", testAPIToken, nil); code != http.StatusNoContent {
+		t.Fatalf("got %d pausing, want 204", code)
+	}
+	if !paused() || !u.isPaused() {
+		t.Error("want the updater paused")
+	}
+	if code := apiRequest(t, api, http.MethodPost, "/api/resume", testAPIToken, nil); code != http.StatusNoContent {
+		t.Fatalf("got %d resuming, want 204", code)
+	}
+	if paused() {
+		t.Error("want the updater resumed")
+	}
+	if code := apiRequest(t, api, http.MethodGet, "/api/pause", testAPIToken, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d for GET /api/pause, want 405", code)
+	}
+}
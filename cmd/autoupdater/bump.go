@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/compose"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/registry"
+	"github.com/sjafferali/portainer-autoupdater/internal/tags"
+)
+
+// env vars read from stacks to override the tag policy and filters, the
+// label style names are accepted as well
+const (
+	envTagPolicy    = "AUTOUPDATER_TAG_POLICY"
+	envTagInclude   = "AUTOUPDATER_TAG_INCLUDE"
+	envTagExclude   = "AUTOUPDATER_TAG_EXCLUDE"
+	labelTagPolicy  = "autoupdater.tag-policy"
+	labelTagInclude = "autoupdater.tag-include"
+	labelTagExclude = "autoupdater.tag-exclude"
+)
+
+// tagBumper looks up newer version tags for the images stack files pin, such
+// as postgres:15.5 for postgres:15.4. A nil bumper never bumps.
+type tagBumper struct {
+	registry *registry.Client
+	policy   tags.Policy
+	include  string
+	exclude  string
+}
+
+func newTagBumper(registries *registry.Client, policy, include, exclude string) (*tagBumper, error) {
+	p, err := tags.ParsePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tags.ParseFilter(include, exclude); err != nil {
+		return nil, err
+	}
+	return &tagBumper{registry: registries, policy: p, include: include, exclude: exclude}, nil
+}
+
+// tagBump is a stack file with its images bumped to newer tags
+type tagBump struct {
+	// before is the file the stack was deployed with, without the pins of a
+	// rollback, after the file with the newer tags
+	before string
+	after  string
+	// images maps the bumped services to their new image
+	images map[string]string
+}
+
+// settings returns the tag policy and filter of a stack, stack env vars take
+// precedence over the global settings
+func (b *tagBumper) settings(stack portainerapi.Stack) (tags.Policy, tags.Filter, error) {
+	policy, include, exclude := string(b.policy), b.include, b.exclude
+	for _, pair := range stack.Env {
+		switch pair.Name {
+		case envTagPolicy, labelTagPolicy:
+			policy = pair.Value
+		case envTagInclude, labelTagInclude:
+			include = pair.Value
+		case envTagExclude, labelTagExclude:
+			exclude = pair.Value
+		}
+	}
+
+	p, err := tags.ParsePolicy(policy)
+	if err != nil {
+		return tags.PolicyNone, tags.Filter{}, err
+	}
+	filter, err := tags.ParseFilter(include, exclude)
+	if err != nil {
+		return tags.PolicyNone, tags.Filter{}, err
+	}
+	return p, filter, nil
+}
+
+// plan looks for newer tags of the images the file of a stack pins and
+// returns nil when there are none. The files of git stacks live in their
+// repository and aren't bumped.
+func (b *tagBumper) plan(
+	ctx context.Context,
+	client portainerapi.Client,
+	stack portainerapi.Stack,
+	ll zerolog.Logger,
+) (*tagBump, error) {
+	if b == nil || stack.GitConfig != nil {
+		return nil, nil
+	}
+
+	policy, filter, err := b.settings(stack)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading stack tag policy")
+	}
+	if policy == tags.PolicyNone {
+		return nil, nil
+	}
+
+	content, err := client.StackFileContent(ctx, int(stack.ID), ll)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting stack file contents")
+	}
+	// images pinned by a rollback are bumped from the tag they had
+	if content, err = compose.UnpinImages(content); err != nil {
+		return nil, err
+	}
+
+	images, err := b.bump(ctx, content, policy, filter, ll)
+	if err != nil || len(images) == 0 {
+		return nil, err
+	}
+
+	after, err := compose.ReplaceImages(content, images)
+	if err != nil {
+		return nil, err
+	}
+	return &tagBump{before: content, after: after, images: images}, nil
+}
+
+// bump returns the services of a compose file whose image has a newer tag
+// within policy, mapped to the image with that tag
+func (b *tagBumper) bump(
+	ctx context.Context,
+	content string,
+	policy tags.Policy,
+	filter tags.Filter,
+	ll zerolog.Logger,
+) (map[string]string, error) {
+	images, err := compose.ServiceImages(content)
+	if err != nil {
+		return nil, err
+	}
+
+	bumped := make(map[string]string)
+	listed := make(map[string][]string)
+	for _, service := range sortedKeys(images) {
+		image := images[service]
+		ll := ll.With().Str("service", service).Str("image", image).Logger()
+
+		if strings.Contains(image, "$") {
+			ll.Debug().Msg("not bumping image set through a variable")
+			continue
+		}
+		ref, err := registry.ParseReference(image)
+		if err != nil || ref.Digest != "" {
+			ll.Debug().Msg("not bumping image without a tag")
+			continue
+		}
+		if _, ok := tags.ParseVersion(ref.Tag); !ok {
+			ll.Trace().Msg("not bumping tag that isn't a version")
+			continue
+		}
+
+		candidates, ok := listed[ref.Name()]
+		if !ok {
+			if candidates, err = b.registry.Tags(ctx, ref); err != nil {
+				return nil, errors.Wrapf(err, "bumping image of service %s", service)
+			}
+			listed[ref.Name()] = candidates
+		}
+
+		tag, ok := tags.Newest(ref.Tag, candidates, policy, filter)
+		if !ok {
+			ll.Debug().Msg("image has the newest tag")
+			continue
+		}
+		ll.Info().Str("tag", tag).Str("policy", string(policy)).Msg("newer tag in registry")
+		bumped[service] = compose.Repository(image) + ":" + tag
+	}
+	return bumped, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+	"github.com/sjafferali/portainer-autoupdater/internal/registry"
+	registryfake "github.com/sjafferali/portainer-autoupdater/internal/registry/fake"
+)
+
+func TestTagBump(t *testing.T) {
+	reg := registryfake.NewRegistry()
+	t.Cleanup(reg.Close)
+	for _, tag := range []string{"15.4", "15.5", "16.1", "latest"} {
+		reg.Push("postgres", tag)
+	}
+	host := reg.Host()
+
+	srv := fake.NewServer(testAPIKey)
+	t.Cleanup(srv.Close)
+	srv.AddEndpoint(1, "docker", false)
+	file := "services:\n" +
+		"  db:\n    image: " + host + "/postgres:15.4\n" +
+		"  web:\n    image: " + host + "/web:${TAG}\n"
+	for id, env := range map[portainer.StackID][]portainer.Pair{
+		1: {{Name: "TAG", Value: "1"}},
+		2: {{Name: envTagPolicy, Value: "major"}},
+		3: {{Name: labelTagPolicy, Value: "none"}},
+	} {
+		srv.AddStack(fake.Stack{
+			Stack: portainerapi.Stack{Stack: portainer.Stack{
+				ID:         id,
+				Name:       fmt.Sprintf("db%d", id),
+				EndpointID: 1,
+				Type:       portainer.DockerComposeStack,
+				Env:        env,
+			}},
+			File:        file,
+			ImageStatus: fake.StatusUpdated,
+		})
+	}
+
+	s := testConfig()
+	s.EnableServices = false
+	s.EnableContainers = false
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	bumper, err := newTagBumper(registry.NewClient(), "minor", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.bumper = bumper
+
+	summary := u.run(context.Background(), 0)
+	for id, want := range map[int]struct {
+		tag     string
+		outcome notify.Outcome
+	}{
+		1: {tag: "15.5", outcome: notify.OutcomeUpdated},
+		2: {tag: "16.1", outcome: notify.OutcomeUpdated},
+		3: {tag: "15.4", outcome: notify.OutcomeUpToDate},
+	} {
+		if result := resultFor(t, summary, notify.KindStack, strconv.Itoa(id)); result.Outcome != want.outcome {
+			t.Errorf("stack %d: got %s, want %s", id, result.Outcome, want.outcome)
+		}
+
+		got := srv.StackFile(id)
+		if !strings.Contains(got, host+"/postgres:"+want.tag+"\n") {
+			t.Errorf("stack %d: got file\n%s\nwant postgres:%s", id, got, want.tag)
+		}
+		if !strings.Contains(got, host+"/web:${TAG}\n") {
+			t.Errorf("stack %d: image set through a variable was changed:\n%s", id, got)
+		}
+	}
+
+	redeploys := srv.Redeploys()
+	if len(redeploys) != 2 {
+		t.Fatalf("got %d redeploys, want 2", len(redeploys))
+	}
+	var payload struct {
+		PullImage bool `json:"pullImage"`
+	}
+	if err := json.Unmarshal(redeploys[0].Body, &payload); err != nil || !payload.PullImage {
+		t.Errorf("got redeploy %s, want the bumped images pulled", redeploys[0].Body)
+	}
+
+	// the stacks run the newest tags their policy allows now
+	summary = u.run(context.Background(), 0)
+	for _, id := range []string{"1", "2", "3"} {
+		if result := resultFor(t, summary, notify.KindStack, id); result.Outcome != notify.OutcomeUpToDate {
+			t.Errorf("stack %s: got %s on the second run, want %s", id, result.Outcome, notify.OutcomeUpToDate)
+		}
+	}
+	if len(srv.Redeploys()) != 2 {
+		t.Errorf("got %d redeploys after the second run, want 2", len(srv.Redeploys()))
+	}
+}
+
+func TestTagBumpRollback(t *testing.T) {
+	reg := registryfake.NewRegistry()
+	t.Cleanup(reg.Close)
+	reg.Push("nginx", "1.25")
+	reg.Push("nginx", "1.26")
+	host := reg.Host()
+
+	srv := fake.NewServer(testAPIKey)
+	t.Cleanup(srv.Close)
+	srv.AddEndpoint(1, "docker", false)
+	srv.AddStack(fake.Stack{
+		Stack: portainerapi.Stack{Stack: portainer.Stack{
+			ID:         1,
+			Name:       "web",
+			EndpointID: 1,
+			Type:       portainer.DockerComposeStack,
+		}},
+		File:        "services:\n  web:\n    image: " + host + "/nginx:1.25\n",
+		ImageStatus: fake.StatusUpdated,
+	})
+	srv.AddContainer(fake.Container{
+		Container: dockertypes.Container{
+			ID:      "dead",
+			Names:   []string{"/web-web-1"},
+			Image:   host + "/nginx:1.25",
+			ImageID: "sha256:old",
+			State:   "restarting",
+			Labels: map[string]string{
+				"com.docker.compose.project": "web",
+				"com.docker.compose.service": "web",
+			},
+		},
+		EndpointID: 1,
+	})
+	srv.AddImage(dockertypes.ImageInspect{
+		ID:          "sha256:old",
+		RepoDigests: []string{host + "/nginx@sha256:111"},
+	})
+
+	s := testConfig()
+	s.EnableContainers = false
+	s.EnableServices = false
+	verify := verifyConfig{
+		enabled:      true,
+		rollback:     true,
+		timeout:      time.Second,
+		pollInterval: time.Millisecond * 10,
+	}
+	u, _ := newTestUpdater(t, srv, s, verify)
+	if u.bumper, _ = newTagBumper(registry.NewClient(), "minor", "", ""); u.bumper == nil {
+		t.Fatal("no tag bumper")
+	}
+
+	summary := u.run(context.Background(), 0)
+	if result := resultFor(t, summary, notify.KindStack, "1"); result.Outcome != notify.OutcomeFailed {
+		t.Errorf("want failed update for unhealthy stack, got %+v", result)
+	}
+
+	redeploys := srv.Redeploys()
+	if len(redeploys) != 2 {
+		t.Fatalf("want update and rollback redeploys, got %d", len(redeploys))
+	}
+	if !strings.Contains(string(redeploys[0].Body), host+"/nginx:1.26") {
+		t.Errorf("got update %s, want the bumped tag deployed", redeploys[0].Body)
+	}
+	want := "services:\n  web:\n    # autoupdater: pinned by rollback, was " + host + "/nginx:1.25\n" +
+		"    image: " + host + "/nginx@sha256:111\n"
+	if srv.StackFile(1) != want {
+		t.Errorf("got stack file %q after rollback, want %q", srv.StackFile(1), want)
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/sjafferali/portainer-autoupdater/internal/history"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+)
+
+const usage = `Usage: autoupdater [--once] [--instance name] [command]
+
+Without a command the updater keeps checking for updates, configured through
+AUTOUPDATER_* env vars. When several instances are listed in the instances
+file, commands need --instance to select one.
+
+Commands:
+  list                  list endpoints, stacks and services with their IDs
+  check                 show the image status of stacks, services and containers
+  update <stack>        redeploy a stack by ID or name right away
+  explain               show which policy or filter selects or skips each stack
+  history               show past checks and updates, see history -h for filters
+
+list, check, explain and history accept -output json.
+
+Flags:
+`
+
+// runCommand runs a single command and returns the exit code, output goes to
+// stdout while logs stay on stderr
+func runCommand(ctx context.Context, u *updater, args []string) int {
+	var err error
+	code := exitNothingUpdated
+	switch args[0] {
+	case "list":
+		err = cmdList(ctx, u, args[1:], os.Stdout)
+	case "check":
+		code, err = cmdCheck(ctx, u, args[1:], os.Stdout)
+	case "update":
+		code, err = cmdUpdate(ctx, u, args[1:], os.Stdout)
+	case "explain":
+		err = cmdExplain(ctx, u, args[1:], os.Stdout)
+	case "history":
+		err = cmdHistory(u, args[1:], os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		flag.Usage()
+		return exitFailed
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err)
+		return exitFailed
+	}
+	return code
+}
+
+// parseOutput adds the flags shared by the read only commands to fs, parses
+// args and reports whether json output was requested
+func parseOutput(fs *flag.FlagSet, args []string) (bool, error) {
+	output := fs.String("output", "table", "output format, table or json")
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+	if fs.NArg() > 0 {
+		return false, errors.Errorf("unexpected arguments %s", strings.Join(fs.Args(), " "))
+	}
+
+	switch *output {
+	case "table":
+		return false, nil
+	case "json":
+		return true, nil
+	default:
+		return false, errors.Errorf("unknown output format %s", *output)
+	}
+}
+
+func writeIndentedJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+type listEndpoint struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Swarm bool   `json:"swarm"`
+}
+
+type listStack struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	EndpointID   int    `json:"endpointId"`
+	EndpointName string `json:"endpointName"`
+	Type         string `json:"type"`
+	Source       string `json:"source"`
+}
+
+type listService struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	EndpointID   int    `json:"endpointId"`
+	EndpointName string `json:"endpointName"`
+	Image        string `json:"image"`
+}
+
+type listOutput struct {
+	Endpoints []listEndpoint `json:"endpoints"`
+	Stacks    []listStack    `json:"stacks"`
+	Services  []listService  `json:"services"`
+}
+
+func cmdList(ctx context.Context, u *updater, args []string, w io.Writer) error {
+	asJSON, err := parseOutput(flag.NewFlagSet("list", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	endpoints, err := u.client.Endpoints(ctx, u.ll)
+	if err != nil {
+		return errors.Wrap(err, "error getting endpoints")
+	}
+	stacks, err := u.client.Stacks(ctx, u.ll)
+	if err != nil {
+		return errors.Wrap(err, "error getting stacks")
+	}
+
+	out := listOutput{
+		Endpoints: make([]listEndpoint, 0, len(endpoints)),
+		Stacks:    make([]listStack, 0, len(stacks)),
+		Services:  make([]listService, 0),
+	}
+	endpointNames := make(map[int]string, len(endpoints))
+	for _, endpoint := range endpoints {
+		swarm := len(endpoint.Snapshots) > 0 && endpoint.Snapshots[0].Swarm
+		endpointNames[int(endpoint.ID)] = endpoint.Name
+		out.Endpoints = append(out.Endpoints, listEndpoint{
+			ID:    int(endpoint.ID),
+			Name:  endpoint.Name,
+			URL:   endpoint.URL,
+			Swarm: swarm,
+		})
+		if !swarm {
+			continue
+		}
+
+		services, err := u.client.Services(ctx, int(endpoint.ID), u.ll)
+		if err != nil {
+			u.ll.Error().Err(err).Int("endpoint_id", int(endpoint.ID)).Msg("error getting services")
+			continue
+		}
+		for _, service := range services {
+			image := ""
+			if service.Spec.TaskTemplate.ContainerSpec != nil {
+				image = service.Spec.TaskTemplate.ContainerSpec.Image
+			}
+			out.Services = append(out.Services, listService{
+				ID:           service.ID,
+				Name:         service.Spec.Name,
+				EndpointID:   int(endpoint.ID),
+				EndpointName: endpoint.Name,
+				Image:        image,
+			})
+		}
+	}
+
+	for _, stack := range stacks {
+		out.Stacks = append(out.Stacks, listStack{
+			ID:           int(stack.ID),
+			Name:         stack.Name,
+			EndpointID:   int(stack.EndpointID),
+			EndpointName: endpointNames[int(stack.EndpointID)],
+			Type:         stackType(stack),
+			Source:       stackSource(stack),
+		})
+	}
+
+	if asJSON {
+		return writeIndentedJSON(w, out)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT ID\tNAME\tURL\tSWARM")
+	for _, e := range out.Endpoints {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\n", e.ID, e.Name, e.URL, e.Swarm)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "STACK ID\tNAME\tENDPOINT\tTYPE\tSOURCE")
+	for _, s := range out.Stacks {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", s.ID, s.Name, s.EndpointName, s.Type, s.Source)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "SERVICE ID\tNAME\tENDPOINT\tIMAGE")
+	for _, s := range out.Services {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.ID, s.Name, s.EndpointName, s.Image)
+	}
+	return tw.Flush()
+}
+
+func stackType(stack portainerapi.Stack) string {
+	switch stack.Type {
+	case portainer.DockerSwarmStack:
+		return "swarm"
+	case portainer.DockerComposeStack:
+		return "compose"
+	case portainer.KubernetesStack:
+		return "kubernetes"
+	default:
+		return strconv.Itoa(int(stack.Type))
+	}
+}
+
+func stackSource(stack portainerapi.Stack) string {
+	if stack.GitConfig != nil {
+		return "git"
+	}
+	return "file"
+}
+
+type checkRow struct {
+	notify.Target
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// cmdCheck reports the image status of everything that is enabled, ignoring
+// the filters, and fails when any status couldn't be read
+func cmdCheck(ctx context.Context, u *updater, args []string, w io.Writer) (int, error) {
+	asJSON, err := parseOutput(flag.NewFlagSet("check", flag.ContinueOnError), args)
+	if err != nil {
+		return exitFailed, err
+	}
+
+	endpoints, err := u.client.Endpoints(ctx, u.ll)
+	if err != nil {
+		return exitFailed, errors.Wrap(err, "error getting endpoints")
+	}
+	endpointNames := make(map[int]string, len(endpoints))
+	for _, endpoint := range endpoints {
+		endpointNames[int(endpoint.ID)] = endpoint.Name
+	}
+
+	rows := make([]checkRow, 0)
+	check := func(target notify.Target, status string, err error) {
+		row := checkRow{Target: target, Status: status}
+		if err != nil {
+			row.Error = err.Error()
+		}
+		rows = append(rows, row)
+	}
+
+	if u.s.EnableStacks {
+		stacks, err := u.client.Stacks(ctx, u.ll)
+		if err != nil {
+			return exitFailed, errors.Wrap(err, "error getting stacks")
+		}
+		for _, stack := range stacks {
+			status, _, err := stackStatus(ctx, u.client, u.bumper, u.credentials, true, stack, u.ll)
+			check(notify.Target{
+				Kind:         notify.KindStack,
+				ID:           strconv.Itoa(int(stack.ID)),
+				Name:         stack.Name,
+				EndpointID:   int(stack.EndpointID),
+				EndpointName: endpointNames[int(stack.EndpointID)],
+			}, status, err)
+		}
+	}
+
+	for _, endpoint := range endpoints {
+		endpointID := int(endpoint.ID)
+
+		if u.s.EnableServices && len(endpoint.Snapshots) > 0 && endpoint.Snapshots[0].Swarm {
+			services, err := u.client.Services(ctx, endpointID, u.ll)
+			if err != nil {
+				return exitFailed, errors.Wrap(err, "error getting services")
+			}
+			for _, service := range services {
+				status, err := u.client.ServiceImageStatus(ctx, service.ID, endpointID, u.ll)
+				check(notify.Target{
+					Kind:         notify.KindService,
+					ID:           service.ID,
+					Name:         service.Spec.Name,
+					EndpointID:   endpointID,
+					EndpointName: endpoint.Name,
+				}, status, err)
+			}
+		}
+
+		if u.s.EnableContainers && isDockerEndpoint(endpoint) {
+			containers, err := u.client.Containers(ctx, endpointID, u.ll)
+			if err != nil {
+				return exitFailed, errors.Wrap(err, "error getting containers")
+			}
+			for _, container := range containers {
+				if isManagedContainer(container) {
+					continue
+				}
+				status, err := u.client.ContainerImageStatus(ctx, container.ID, endpointID, u.ll)
+				check(notify.Target{
+					Kind:         notify.KindContainer,
+					ID:           container.ID,
+					Name:         containerName(container),
+					EndpointID:   endpointID,
+					EndpointName: endpoint.Name,
+				}, status, err)
+			}
+		}
+	}
+
+	code := exitNothingUpdated
+	for _, row := range rows {
+		if row.Error != "" {
+			code = exitFailed
+		}
+	}
+
+	if asJSON {
+		return code, writeIndentedJSON(w, rows)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tID\tNAME\tENDPOINT\tSTATUS")
+	for _, row := range rows {
+		status := row.Status
+		if row.Error != "" {
+			status = "error: " + row.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", row.Kind, shortID(row.ID), row.Name, row.EndpointName, status)
+	}
+	return code, tw.Flush()
+}
+
+// shortID shortens docker IDs the way the docker cli does
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// cmdUpdate redeploys a single stack, regardless of dry run, filters and
+// maintenance windows. It exits like --once, 3 when the stack was updated.
+func cmdUpdate(ctx context.Context, u *updater, args []string, w io.Writer) (int, error) {
+	if len(args) != 1 {
+		return exitFailed, errors.New("expected a single stack ID or name")
+	}
+
+	stackID, err := resolveStack(ctx, u, args[0])
+	if err != nil {
+		return exitFailed, err
+	}
+
+	// there's no client to go away, the update runs until shutdown
+	result, err := u.updateStack(ctx, ctx, stackID)
+	flushNotifier(ctx, u.notifier, u.ll)
+	if err != nil {
+		return exitFailed, err
+	}
+
+	if result.Outcome != notify.OutcomeUpdated {
+		fmt.Fprintf(w, "stack %s (id %s) not updated: %s\n", result.Name, result.ID, result.Reason)
+		return exitNothingUpdated, nil
+	}
+	fmt.Fprintf(w, "updated stack %s (id %s)\n", result.Name, result.ID)
+	return exitUpdated, nil
+}
+
+// resolveStack finds the ID of a stack given by ID or name
+func resolveStack(ctx context.Context, u *updater, ref string) (int, error) {
+	if id, err := strconv.Atoi(ref); err == nil {
+		return id, nil
+	}
+
+	stacks, err := u.client.Stacks(ctx, u.ll)
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting stacks")
+	}
+
+	var ids []string
+	stackID := 0
+	for _, stack := range stacks {
+		if stack.Name == ref {
+			stackID = int(stack.ID)
+			ids = append(ids, strconv.Itoa(stackID))
+		}
+	}
+
+	switch len(ids) {
+	case 0:
+		return 0, errors.Errorf("no stack named %s", ref)
+	case 1:
+		return stackID, nil
+	default:
+		return 0, errors.Errorf("several stacks are named %s, use one of the IDs %s", ref, strings.Join(ids, ", "))
+	}
+}
+
+type explainRow struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	EndpointID   int    `json:"endpointId"`
+	EndpointName string `json:"endpointName"`
+	Checked      bool   `json:"checked"`
+	HeldBack     string `json:"heldBack,omitempty"`
+	Policy       string `json:"policy,omitempty"`
+	Rule         string `json:"rule"`
+	// Pinned maps the services a rollback pinned to their image
+	Pinned map[string]string `json:"pinned,omitempty"`
+}
+
+func cmdExplain(ctx context.Context, u *updater, args []string, w io.Writer) error {
+	asJSON, err := parseOutput(flag.NewFlagSet("explain", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	if !u.s.EnableStacks {
+		u.ll.Warn().Msg("stack checks are disabled, no stack would be checked")
+	}
+
+	stacks, err := u.client.Stacks(ctx, u.ll)
+	if err != nil {
+		return errors.Wrap(err, "error getting stacks")
+	}
+	endpointNames, err := getEndpointNames(ctx, u.client, u.ll)
+	if err != nil {
+		return err
+	}
+
+	s := u.s
+	rows := make([]explainRow, 0, len(stacks))
+	for _, stack := range stacks {
+		ll := u.ll.With().Str("name", stack.Name).Int("stack_id", int(stack.ID)).Logger()
+		decision := selectStack(
+			ctx,
+			u.client,
+			stack,
+			s.ExcludeStackIds,
+			s.IncludeStackIds,
+			s.ExcludeStackNames,
+			s.IncludeStackNames,
+			s.CheckExcludedStacks,
+			s.OptIn,
+			ll,
+		)
+		pins, err := stackPins(ctx, u.client, stack, ll)
+		if err != nil {
+			ll.Warn().Err(err).Msg("error reading pinned images")
+		}
+		rows = append(rows, explainRow{
+			ID:           int(stack.ID),
+			Name:         stack.Name,
+			EndpointID:   int(stack.EndpointID),
+			EndpointName: endpointNames[int(stack.EndpointID)],
+			Checked:      !decision.skip,
+			HeldBack:     decision.holdReason,
+			Policy:       string(decision.policy),
+			Rule:         decision.rule,
+			Pinned:       pins,
+		})
+	}
+
+	if asJSON {
+		return writeIndentedJSON(w, rows)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STACK ID\tNAME\tENDPOINT\tPOLICY\tDECISION")
+	for _, row := range rows {
+		policy := row.Policy
+		if policy == "" {
+			policy = "-"
+		}
+		decision := row.Rule
+		if len(row.Pinned) > 0 {
+			decision += ", pinned " + describePins(row.Pinned) + " by a rollback"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", row.ID, row.Name, row.EndpointName, policy, decision)
+	}
+	return tw.Flush()
+}
+
+func cmdHistory(u *updater, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	kind := fs.String("kind", "", "only show stack, service or container records")
+	id := fs.String("id", "", "only show records of the stack, service or container with this ID")
+	name := fs.String("name", "", "only show records of the stack, service or container with this name")
+	since := fs.Duration("since", 0, "only show records newer than this, such as 72h")
+	limit := fs.Int("limit", 50, "maximum number of records to show, 0 shows all")
+	updates := fs.Bool("updates", false, "only show updates")
+	asJSON, err := parseOutput(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if u.history == nil {
+		return errors.New("no history is kept, set AUTOUPDATER_HISTORY_PATH")
+	}
+
+	q := history.Query{Instance: u.name, Kind: *kind, ID: *id, Name: *name, Limit: *limit}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	if *updates {
+		q.Action = history.ActionUpdate
+	}
+
+	records, err := u.history.Query(q)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return writeIndentedJSON(w, records)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tACTION\tKIND\tNAME\tENDPOINT\tSTATUS\tOUTCOME\tDURATION\tDETAILS")
+	for _, r := range records {
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Time.Local().Format(time.DateTime), r.Action, r.Kind, r.Name, r.EndpointName,
+			r.Status, r.Outcome, r.Duration.Round(time.Millisecond), recordDetails(r),
+		)
+	}
+	return tw.Flush()
+}
+
+// recordDetails summarizes why a record looks the way it does
+func recordDetails(r history.Record) string {
+	details := make([]string, 0)
+	if r.Error != "" {
+		details = append(details, r.Error)
+	} else if r.Reason != "" {
+		details = append(details, r.Reason)
+	}
+
+	if r.Update != nil {
+		services := make([]string, 0, len(r.Update.ImagesAfter))
+		for service := range r.Update.ImagesAfter {
+			services = append(services, service)
+		}
+		sort.Strings(services)
+
+		for _, service := range services {
+			before, after := r.Update.ImagesBefore[service], r.Update.ImagesAfter[service]
+			if before != after {
+				details = append(details, fmt.Sprintf("%s: %s -> %s", service, shortDigest(before), shortDigest(after)))
+			}
+		}
+	}
+	return strings.Join(details, "; ")
+}
+
+// shortDigest shortens the digest of an image reference for display
+func shortDigest(image string) string {
+	if image == "" {
+		return "none"
+	}
+	if _, digest, ok := strings.Cut(image, "@"); ok {
+		image = digest
+	}
+	if prefix, hex, ok := strings.Cut(image, ":"); ok && prefix == "sha256" {
+		return prefix + ":" + shortID(hex)
+	}
+	return image
+}
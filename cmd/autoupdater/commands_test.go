@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sjafferali/portainer-autoupdater/internal/history"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+)
+
+func TestCmdList(t *testing.T) {
+	srv := newTestServer(t)
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	if err := cmdList(ctx, u, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"STACK ID", "web", "compose", "file", "svc1", "api:1@sha256:aaa"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("want %q in the table:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := cmdList(ctx, u, []string{"-output", "json"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var list listOutput
+	if err := json.Unmarshal(out.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Endpoints) != 2 || len(list.Stacks) != 1 || len(list.Services) != 1 || list.Stacks[0].EndpointName != "docker" {
+		t.Errorf("got %+v, want both endpoints, the stack and the service", list)
+	}
+
+	for _, args := range [][]string{{"-output", "xml"}, {"extra"}} {
+		if err := cmdList(ctx, u, args, &out); err == nil {
+			t.Errorf("%v: want error", args)
+		}
+	}
+}
+
+func TestCmdCheck(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	s := testConfig()
+	// check ignores the filters
+	s.ExcludeStackNames = []string{"web"}
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	code, err := cmdCheck(ctx, u, []string{"-output", "json"}, &out)
+	if err != nil || code != exitNothingUpdated {
+		t.Fatalf("got exit code %d (%v), want %d", code, err, exitNothingUpdated)
+	}
+	var rows []checkRow
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]string)
+	for _, row := range rows {
+		statuses[row.Kind+"/"+row.ID] = row.Status
+	}
+	want := map[string]string{"stack/1": "outdated", "service/svc1": "updated", "container/beef": "updated"}
+	for key, status := range want {
+		if statuses[key] != status {
+			t.Errorf("got status %q for %s, want %q", statuses[key], key, status)
+		}
+	}
+	if len(srv.Redeploys()) != 0 {
+		t.Errorf("check must not redeploy: %+v", srv.Redeploys())
+	}
+
+	// a status that can't be read fails the check
+	srv.Inject(fake.Fault{Path: "/api/docker/*/services/*/image_status", Status: http.StatusInternalServerError})
+	out.Reset()
+	code, err = cmdCheck(ctx, u, nil, &out)
+	if err != nil || code != exitFailed {
+		t.Errorf("got exit code %d (%v), want %d", code, err, exitFailed)
+	}
+	if !strings.Contains(out.String(), "error: ") {
+		t.Errorf("want the error in the table:\n%s", out.String())
+	}
+
+	// so does listing
+	srv.Inject(fake.Fault{Path: "/api/endpoints", Status: http.StatusInternalServerError})
+	if code, err := cmdCheck(ctx, u, nil, &out); err == nil || code != exitFailed {
+		t.Errorf("got exit code %d (%v), want %d with an error", code, err, exitFailed)
+	}
+}
+
+func TestCmdUpdate(t *testing.T) {
+	srv := newTestServer(t)
+	s := testConfig()
+	s.DryRun = true
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	ctx := context.Background()
+
+	// updated right away, even in dry run
+	var out bytes.Buffer
+	code, err := cmdUpdate(ctx, u, []string{"web"}, &out)
+	if err != nil || code != exitUpdated {
+		t.Fatalf("got exit code %d (%v), want %d", code, err, exitUpdated)
+	}
+	if len(srv.Redeploys()) != 1 || !strings.Contains(out.String(), "updated stack web (id 1)") {
+		t.Errorf("got %q with redeploys %+v, want the stack updated", out.String(), srv.Redeploys())
+	}
+
+	for _, args := range [][]string{nil, {"web", "db"}, {"db"}} {
+		if code, err := cmdUpdate(ctx, u, args, &out); err == nil || code != exitFailed {
+			t.Errorf("%v: got exit code %d (%v), want %d with an error", args, code, err, exitFailed)
+		}
+	}
+
+	srv.Inject(fake.Fault{Method: http.MethodPut, Path: "/api/stacks/1", Status: http.StatusInternalServerError})
+	if code, err := cmdUpdate(ctx, u, []string{"1"}, &out); err == nil || code != exitFailed {
+		t.Errorf("got exit code %d (%v) for a failed update, want %d with an error", code, err, exitFailed)
+	}
+}
+
+func TestCmdExplain(t *testing.T) {
+	srv := newTestServer(t)
+	s := testConfig()
+	s.ExcludeStackNames = []string{"web"}
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	if err := cmdExplain(ctx, u, []string{"-output", "json"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var rows []explainRow
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Checked || rows[0].Rule != "skipped since stack name is excluded" || rows[0].EndpointName != "docker" {
+		t.Errorf("got %+v, want the stack skipped by name", rows)
+	}
+
+	s.CheckExcludedStacks = true
+	u.s = s
+	out.Reset()
+	if err := cmdExplain(ctx, u, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "held back since stack name is excluded") {
+		t.Errorf("want the stack held back in the table:\n%s", out.String())
+	}
+}
+
+func TestCmdHistory(t *testing.T) {
+	srv := newTestServer(t)
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+
+	var out bytes.Buffer
+	if err := cmdHistory(u, nil, &out); err == nil {
+		t.Error("want error without a history")
+	}
+
+	hist, err := history.Open(filepath.Join(t.TempDir(), "history.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.history = hist
+	checked := notify.Result{
+		Target:  notify.Target{Kind: notify.KindStack, ID: "1", Name: "web", EndpointID: 1, EndpointName: "docker"},
+		Status:  statusUpdated,
+		Outcome: notify.OutcomeUpToDate,
+	}
+	updated := checked
+	updated.Status = statusOutdated
+	updated.Outcome = notify.OutcomeUpdated
+	updated.Update = &notify.Update{
+		ImagesBefore: map[string]string{"web": "nginx@sha256:1111111111111111"},
+		ImagesAfter:  map[string]string{"web": "nginx@sha256:2222222222222222"},
+	}
+	if err := hist.Add(time.Now().Add(-2*time.Hour), checked); err != nil {
+		t.Fatal(err)
+	}
+	if err := hist.Add(time.Now(), updated); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmdHistory(u, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "web: sha256:111111111111 -> sha256:222222222222") {
+		t.Errorf("want the changed digests in the table:\n%s", out.String())
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want int
+	}{
+		{args: nil, want: 2},
+		{args: []string{"-updates"}, want: 1},
+		{args: []string{"-since", "1h"}, want: 1},
+		{args: []string{"-kind", "service"}, want: 0},
+		{args: []string{"-limit", "1"}, want: 1},
+	} {
+		out.Reset()
+		if err := cmdHistory(u, append(tc.args, "-output", "json"), &out); err != nil {
+			t.Fatalf("%v: %s", tc.args, err)
+		}
+		var records []history.Record
+		if err := json.Unmarshal(out.Bytes(), &records); err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != tc.want {
+			t.Errorf("%v: got %d records, want %d", tc.args, len(records), tc.want)
+		}
+	}
+}
+
+func TestRunCommandUnknown(t *testing.T) {
+	srv := newTestServer(t)
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+	if code := runCommand(context.Background(), u, []string{"upgrade"}); code != exitFailed {
+		t.Errorf("got exit code %d for an unknown command, want %d", code, exitFailed)
+	}
+}
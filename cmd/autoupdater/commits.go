@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/gitremote"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+)
+
+// newCommits reports whether the reference a git stack is deployed from has
+// moved past the commit portainer last deployed, which it keeps as the config
+// hash of the stack
+func newCommits(
+	ctx context.Context,
+	creds gitCredentials,
+	stack portainerapi.Stack,
+	ll zerolog.Logger,
+) (bool, error) {
+	cfg := stack.GitConfig
+	if cfg == nil {
+		return false, nil
+	}
+	if cfg.ConfigHash == "" {
+		ll.Debug().Msg("no deployed commit recorded, not checking for new commits")
+		return false, nil
+	}
+
+	opts, ok := gitOptions(creds, stack)
+	if !ok {
+		ll.Debug().Msg("no git credentials supplied for private repository, not checking for new commits")
+		return false, nil
+	}
+	head, err := gitremote.Resolve(ctx, cfg.URL, cfg.ReferenceName, opts)
+	if err != nil {
+		return false, errors.Wrapf(err, "resolving %s of %s", cfg.ReferenceName, cfg.URL)
+	}
+	if head == cfg.ConfigHash {
+		ll.Debug().Str("commit", shortCommit(head)).Msg("no new commits in repository")
+		return false, nil
+	}
+
+	ll.Info().
+		Str("deployed", shortCommit(cfg.ConfigHash)).
+		Str("head", shortCommit(head)).
+		Str("reference", cfg.ReferenceName).
+		Msg("new commits in repository")
+	return true, nil
+}
+
+// gitOptions returns how the repository of a git stack is reached. It
+// reports false for repositories portainer has credentials for when none were
+// supplied, portainer doesn't share them.
+func gitOptions(creds gitCredentials, stack portainerapi.Stack) (gitremote.Options, bool) {
+	opts := gitremote.Options{InsecureSkipVerify: stack.GitConfig.TLSSkipVerify}
+	username, password, ok := creds.lookup(stack)
+	if !ok {
+		return opts, stack.GitConfig.Authentication == nil
+	}
+	opts.Username = username
+	opts.Password = password
+	return opts, true
+}
+
+// logDeployedCommits logs the range of commits a redeploy of a git stack
+// deployed, before is the config hash the stack had until then
+func logDeployedCommits(
+	ctx context.Context,
+	client portainerapi.Client,
+	stack portainerapi.Stack,
+	ll zerolog.Logger,
+) {
+	before := stack.GitConfig.ConfigHash
+
+	deployed, err := client.Stack(ctx, int(stack.ID), ll)
+	if err != nil {
+		ll.Warn().Err(err).Msg("error getting deployed commit")
+		return
+	}
+	if deployed.GitConfig == nil {
+		return
+	}
+	after := deployed.GitConfig.ConfigHash
+
+	switch {
+	case after == "" || after == before:
+		ll.Info().Str("commit", shortCommit(after)).Msg("redeployed without new commits")
+	case before == "":
+		ll.Info().Str("commit", shortCommit(after)).Msg("deployed commit")
+	default:
+		ll.Info().Str("commits", shortCommit(before)+".."+shortCommit(after)).Msg("deployed new commits")
+	}
+}
+
+// shortCommit abbreviates a commit hash like git log --oneline does
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
+
+// gitOpsEnabled reports whether portainer redeploys the git stack itself,
+// polling its repository or through a webhook
+func gitOpsEnabled(stack portainerapi.Stack) bool {
+	auto := stack.AutoUpdate
+	return auto != nil && (auto.Interval != "" || auto.Webhook != "")
+}
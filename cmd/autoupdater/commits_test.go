@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	portainer "github.com/portainer/portainer/api"
+	gittypes "github.com/portainer/portainer/api/git/types"
+	"github.com/rs/zerolog"
+	forgefake "github.com/sjafferali/portainer-autoupdater/internal/forge/fake"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+)
+
+func TestNewCommits(t *testing.T) {
+	file := "services:\n  web:\n    image: nginx:1.25\n"
+	git := forgefake.NewServer("")
+	t.Cleanup(git.Close)
+	git.AddRepository("org/app", "main", map[string]string{"compose.yml": file})
+	deployed := git.Head("org/app", "main")
+
+	srv := fake.NewServer(testAPIKey)
+	t.Cleanup(srv.Close)
+	srv.AddEndpoint(1, "docker", false)
+	srv.AddStack(fake.Stack{
+		Stack: portainerapi.Stack{Stack: portainer.Stack{
+			ID:         1,
+			Name:       "app",
+			EndpointID: 1,
+			Type:       portainer.DockerComposeStack,
+			GitConfig: &gittypes.RepoConfig{
+				URL:            git.URL + "/org/app.git",
+				ReferenceName:  "refs/heads/main",
+				ConfigFilePath: "compose.yml",
+				ConfigHash:     deployed,
+			},
+		}},
+		RemoteHead: deployed,
+	})
+
+	s := testConfig()
+	s.EnableServices = false
+	s.EnableContainers = false
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	var logs bytes.Buffer
+	u.ll = zerolog.New(&logs)
+
+	ctx := context.Background()
+	result := resultFor(t, u.run(ctx, 0), notify.KindStack, "1")
+	if result.Outcome != notify.OutcomeUpToDate || len(srv.Redeploys()) != 0 {
+		t.Fatalf("got %s with %d redeploys, want the stack at the head commit left alone", result.Outcome, len(srv.Redeploys()))
+	}
+
+	// a push redeploys the stack although its images are up to date
+	head := git.Commit("org/app", "main", "compose.yml", strings.Replace(file, "1.25", "1.26", 1))
+	srv.SetStackRemoteHead(1, head)
+	result = resultFor(t, u.run(ctx, 0), notify.KindStack, "1")
+	if result.Outcome != notify.OutcomeUpdated {
+		t.Fatalf("got %s (%s) after a push, want the stack updated", result.Outcome, result.Error)
+	}
+	redeploys := srv.Redeploys()
+	if len(redeploys) != 1 || !redeploys[0].Git {
+		t.Fatalf("got redeploys %+v, want one git redeploy", redeploys)
+	}
+	if commits := shortCommit(deployed) + ".." + shortCommit(head); !strings.Contains(logs.String(), commits) {
+		t.Errorf("deployed commits %s weren't logged:\n%s", commits, logs.String())
+	}
+
+	// the deployed head isn't redeployed again
+	result = resultFor(t, u.run(ctx, 0), notify.KindStack, "1")
+	if result.Outcome != notify.OutcomeUpToDate || len(srv.Redeploys()) != 1 {
+		t.Errorf("got %s with %d redeploys, want the deployed head left alone", result.Outcome, len(srv.Redeploys()))
+	}
+
+	// a repository that can't be reached falls back to the image status
+	git.Close()
+	result = resultFor(t, u.run(ctx, 0), notify.KindStack, "1")
+	if result.Outcome != notify.OutcomeUpToDate {
+		t.Errorf("got %s (%s) with the repository down, want the image status", result.Outcome, result.Error)
+	}
+}
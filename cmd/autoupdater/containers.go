@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/grab/async"
+	"github.com/pkg/errors"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+)
+
+// labels that mark a container as being managed by a stack or a swarm service,
+// these are updated through their stack or service instead
+var managedContainerLabels = []string{
+	"com.docker.compose.project",
+	"com.docker.stack.namespace",
+	"com.docker.swarm.service.id",
+}
+
+func containerTasks(
+	ctx context.Context,
+	client portainerapi.Client,
+	notifier notify.Notifier,
+	gate *updateGate,
+	dryRun bool,
+	excludedIDs, includedIDs []string,
+	excludedNames, includedNames []string,
+	optIn bool,
+	logger zerolog.Logger,
+) ([]async.Task, []error) {
+	endpoints, err := client.Endpoints(ctx, logger)
+	if err != nil {
+		return nil, []error{errors.Wrap(err, "error getting endpoints")}
+	}
+
+	tasks := make([]async.Task, 0)
+	var errs []error
+	for _, endpoint := range endpoints {
+		endpointID := int(endpoint.ID)
+
+		ll := logger.With().
+			Int("endpoint_id", endpointID).
+			Str("endpoint_name", endpoint.Name).
+			Str("endpoint_url", endpoint.URL).
+			Logger()
+
+		if !isDockerEndpoint(endpoint) {
+			ll.Trace().Msg("skipping endpoint since not docker")
+			continue
+		}
+
+		containers, err := client.Containers(ctx, endpointID, ll)
+		if err != nil {
+			ll.Error().Err(err).Msg("error getting containers")
+			errs = append(errs, errors.Wrapf(err, "error getting containers of endpoint %s", endpoint.Name))
+			continue
+		}
+
+		for _, container := range containers {
+			name := containerName(container)
+
+			ll := ll.With().
+				Str("container_id", container.ID).
+				Str("container_name", name).
+				Logger()
+
+			if isManagedContainer(container) {
+				ll.Trace().Msg("skipped since container belongs to a stack or service")
+				continue
+			}
+
+			holdReason := ""
+			switch policy := policyFromLabels(container.Labels, ll); policy {
+			case policySkip:
+				ll.Trace().Msg("skipped by container update policy")
+				continue
+			case policyNotify:
+				holdReason = holdReasonPolicyNotify
+			case policyUpdate:
+				ll.Trace().Msg("included by container update policy")
+			default:
+				if optIn {
+					ll.Trace().Msg("skipped since container has not opted in")
+					continue
+				}
+
+				if includedIDs != nil && !containerIDInSlice(includedIDs, container.ID) {
+					ll.Trace().Msg("skipped since container ID is not included")
+					continue
+				}
+
+				if includedNames != nil && !inSlice(includedNames, name) {
+					ll.Trace().Msg("skipped since container name is not included")
+					continue
+				}
+
+				if excludedIDs != nil && containerIDInSlice(excludedIDs, container.ID) {
+					ll.Trace().Msg("skipped since container ID is excluded")
+					continue
+				}
+
+				if excludedNames != nil && inSlice(excludedNames, name) {
+					ll.Trace().Msg("skipped since container name is excluded")
+					continue
+				}
+			}
+
+			target := notify.Target{
+				Kind:         notify.KindContainer,
+				ID:           container.ID,
+				Name:         name,
+				EndpointID:   endpointID,
+				EndpointName: endpoint.Name,
+			}
+			task := getTaskForContainer(client, notifier, gate, dryRun, holdReason, container.ID, target, ll)
+			tasks = append(tasks, task)
+		}
+	}
+
+	logger.Info().Int("containers_to_check", len(tasks)).Msg("containers to check")
+	return tasks, errs
+}
+
+func getTaskForContainer(
+	client portainerapi.Client,
+	notifier notify.Notifier,
+	gate *updateGate,
+	dryRun bool,
+	holdReason string,
+	containerID string,
+	target notify.Target,
+	ll zerolog.Logger,
+) async.Task {
+	task := async.NewTask(func(ctx context.Context) (interface{}, error) {
+		result := notify.Result{Target: target, Outcome: notify.OutcomeUpToDate}
+		ll.Trace().Msg("checking container")
+		status, err := client.ContainerImageStatus(ctx, containerID, target.EndpointID, ll)
+		if err != nil {
+			ll.Error().Err(err).Msg("error getting image status")
+			return failedResult(result, err), err
+		}
+		ll = ll.With().Str("status", status).Logger()
+		result.Status = status
+
+		if status != statusOutdated {
+			ll.Debug().Msg("no update needed")
+			return result, nil
+		}
+		ll.Info().Msg("container needs update")
+		sendEvent(ctx, notifier, updateEvent(notify.EventUpdateAvailable, result, dryRun), ll)
+
+		if holdReason != "" {
+			ll.Info().Str("reason", holdReason).Msg("holding back update")
+			return heldBackResult(result, holdReason), nil
+		}
+
+		if dryRun {
+			return heldBackResult(result, holdReasonDryRun), nil
+		}
+
+		check := func(ctx context.Context) (string, error) {
+			return client.ContainerImageStatus(ctx, containerID, target.EndpointID, ll)
+		}
+		update := func(ctx context.Context) error {
+			return client.RecreateContainer(ctx, containerID, target.EndpointID, ll)
+		}
+
+		if !gate.open() {
+			return gate.hold(result, check, update, nil, ll), nil
+		}
+		if !gate.claim(target) {
+			ll.Info().Msg("update already in progress")
+			return heldBackResult(result, holdReasonInProgress), nil
+		}
+		defer gate.done(target)
+
+		return performUpdate(ctx, notifier, result, dryRun, update, nil, ll)
+	})
+	return task
+}
+
+func isDockerEndpoint(endpoint portainer.Endpoint) bool {
+	switch endpoint.Type {
+	case portainer.DockerEnvironment,
+		portainer.AgentOnDockerEnvironment,
+		portainer.EdgeAgentOnDockerEnvironment:
+		return true
+	default:
+		return false
+	}
+}
+
+func isManagedContainer(container dockertypes.Container) bool {
+	for _, label := range managedContainerLabels {
+		if _, ok := container.Labels[label]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containerName(container dockertypes.Container) string {
+	if len(container.Names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
+
+// shortIDLength is the length of the short container IDs docker shows,
+// shorter prefixes would match unrelated containers
+const shortIDLength = 12
+
+// containerIDInSlice matches either the full container ID or a prefix of it
+// at least as long as the short form
+func containerIDInSlice(elems []string, containerID string) bool {
+	for _, s := range elems {
+		if s == containerID || (len(s) >= shortIDLength && strings.HasPrefix(containerID, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateContainerIDs rejects container IDs too short to be matched
+func validateContainerIDs(ids []string) error {
+	for _, id := range ids {
+		if id != "" && len(id) < shortIDLength {
+			return errors.Errorf("invalid container id %q, use the full id or at least its first %d characters", id, shortIDLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestContainerIDInSlice(t *testing.T) {
+	id := "4c01db0b339c3e9a6b1e0f1d2c3b4a5968778695a4b3c2d1e0f1a2b3c4d5e6f7"
+	for _, tc := range []struct {
+		elems []string
+		want  bool
+	}{
+		{elems: []string{id}, want: true},
+		{elems: []string{"4c01db0b339c"}, want: true},
+		{elems: []string{"4c01db0b339c3e9a"}, want: true},
+		{elems: []string{"other", "4c01db0b339c"}, want: true},
+		{elems: []string{"4"}, want: false},
+		{elems: []string{"4c01db0b339"}, want: false},
+		{elems: []string{""}, want: false},
+		{elems: []string{"a8b2f1d7e6c3"}, want: false},
+		{elems: nil, want: false},
+	} {
+		if got := containerIDInSlice(tc.elems, id); got != tc.want {
+			t.Errorf("%q: got %t, want %t", tc.elems, got, tc.want)
+		}
+	}
+
+	// a short id matches itself
+	if !containerIDInSlice([]string{"c0ffee"}, "c0ffee") {
+		t.Error("want an exact match of a short id")
+	}
+}
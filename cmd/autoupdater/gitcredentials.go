@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+)
+
+// gitCredential is the username and password for the repository of a stack,
+// or for all repositories under a url
+type gitCredential struct {
+	stack    string
+	url      string
+	username string
+	password string
+}
+
+// gitCredentials are the credentials supplied to the updater for the
+// repositories of git stacks, portainer never returns the ones it stores
+type gitCredentials []gitCredential
+
+// loadGitCredentials parses the credentials of the env var and, when set,
+// of the credentials file such as a docker secret
+func loadGitCredentials(value, file string) (gitCredentials, error) {
+	creds, err := parseGitCredentials(value)
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		return creds, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading git credentials file")
+	}
+	fromFile, err := parseGitCredentials(string(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing git credentials file %s", file)
+	}
+	return append(creds, fromFile...), nil
+}
+
+// parseGitCredentials parses credentials separated by semicolons or newlines
+// such as 'app=robot:token' for the stack app or
+// 'https://git.example.com/org=robot:token' for the repositories under that
+// url. Lines starting with # are ignored.
+func parseGitCredentials(s string) (gitCredentials, error) {
+	var creds gitCredentials
+	for _, line := range strings.Split(s, "\n") {
+		for _, entry := range strings.Split(line, ";") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" || strings.HasPrefix(entry, "#") {
+				continue
+			}
+
+			// passwords are left out of errors
+			target, secret, ok := strings.Cut(entry, "=")
+			target = strings.TrimSpace(target)
+			if !ok || target == "" {
+				return nil, errors.Errorf("invalid git credential %d, use stack=username:password or url=username:password", len(creds)+1)
+			}
+			username, password, ok := strings.Cut(secret, ":")
+			if !ok || password == "" {
+				return nil, errors.Errorf("git credential for %s has no password, use username:password", target)
+			}
+
+			cred := gitCredential{username: username, password: password}
+			if strings.Contains(target, "://") {
+				cred.url = normalizeRepoURL(target)
+			} else {
+				cred.stack = target
+			}
+			creds = append(creds, cred)
+		}
+	}
+	return creds, nil
+}
+
+// lookup returns the credentials for the repository of a git stack. Those
+// for the stack come first, then those for the longest url the repository is
+// under.
+func (c gitCredentials) lookup(stack portainerapi.Stack) (string, string, bool) {
+	if stack.GitConfig == nil {
+		return "", "", false
+	}
+
+	repo := normalizeRepoURL(stack.GitConfig.URL)
+	var match *gitCredential
+	for i, cred := range c {
+		switch {
+		case cred.stack != "":
+			if cred.stack == stack.Name {
+				return cred.username, cred.password, true
+			}
+		case repo == cred.url || strings.HasPrefix(repo, cred.url+"/"):
+			if match == nil || len(cred.url) > len(match.url) {
+				match = &c[i]
+			}
+		}
+	}
+	if match == nil {
+		return "", "", false
+	}
+	return match.username, match.password, true
+}
+
+// normalizeRepoURL drops the parts of a repository url that don't change
+// which repository it is
+func normalizeRepoURL(u string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(u), "/"), ".git")
+}
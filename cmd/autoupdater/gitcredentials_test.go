@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	portainer "github.com/portainer/portainer/api"
+	gittypes "github.com/portainer/portainer/api/git/types"
+	forgefake "github.com/sjafferali/portainer-autoupdater/internal/forge/fake"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+)
+
+func TestGitCredentialsLookup(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "git_credentials")
+	content := "# docker secret\nhttps://git.lan/org/app.git=app-robot:app:token\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := loadGitCredentials("web=web-robot:web-token; https://git.lan/org/=org-robot:org-token", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stack := func(name, url string) portainerapi.Stack {
+		return portainerapi.Stack{Stack: portainer.Stack{Name: name, GitConfig: &gittypes.RepoConfig{URL: url}}}
+	}
+	for i, tt := range []struct {
+		stack    portainerapi.Stack
+		username string
+		password string
+	}{
+		{stack("web", "https://git.lan/org/web.git"), "web-robot", "web-token"},
+		{stack("app", "https://git.lan/org/app"), "app-robot", "app:token"},
+		{stack("api", "https://git.lan/org/api.git"), "org-robot", "org-token"},
+		{stack("api", "https://git.lan/organisation/api.git"), "", ""},
+		{portainerapi.Stack{Stack: portainer.Stack{Name: "web"}}, "", ""},
+	} {
+		username, password, ok := creds.lookup(tt.stack)
+		if username != tt.username || password != tt.password || ok != (tt.password != "") {
+			t.Errorf("%d: got %s:%s, want %s:%s", i, username, password, tt.username, tt.password)
+		}
+	}
+
+	for _, invalid := range []string{"robot:token", "web=robot", "web=robot:", "=robot:token"} {
+		_, err := parseGitCredentials(invalid)
+		if err == nil {
+			t.Errorf("%q: want an error", invalid)
+			continue
+		}
+		if strings.Contains(err.Error(), "token") {
+			t.Errorf("%q: error %q shows the password", invalid, err)
+		}
+	}
+}
+
+func TestGitCredentialsPrivateRepository(t *testing.T) {
+	git := forgefake.NewServer("secret")
+	t.Cleanup(git.Close)
+	git.AddRepository("org/app", "main", map[string]string{"compose.yml": "services:\n  web:\n    image: nginx:1.25\n"})
+	deployed := git.Head("org/app", "main")
+
+	srv := fake.NewServer(testAPIKey)
+	t.Cleanup(srv.Close)
+	srv.AddEndpoint(1, "docker", false)
+	srv.AddStack(fake.Stack{
+		Stack: portainerapi.Stack{Stack: portainer.Stack{
+			ID:         1,
+			Name:       "app",
+			EndpointID: 1,
+			Type:       portainer.DockerComposeStack,
+			GitConfig: &gittypes.RepoConfig{
+				URL:            git.URL + "/org/app.git",
+				ReferenceName:  "refs/heads/main",
+				ConfigFilePath: "compose.yml",
+				ConfigHash:     deployed,
+				Authentication: &gittypes.GitAuthentication{Username: "robot", Password: "secret"},
+			},
+		}},
+		RemoteHead: deployed,
+	})
+	head := git.Commit("org/app", "main", "compose.yml", "services:\n  web:\n    image: nginx:1.26\n")
+	srv.SetStackRemoteHead(1, head)
+
+	s := testConfig()
+	s.EnableServices = false
+	s.EnableContainers = false
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+
+	// portainer doesn't share the password, the repository isn't checked
+	ctx := context.Background()
+	result := resultFor(t, u.run(ctx, 0), notify.KindStack, "1")
+	if result.Outcome != notify.OutcomeUpToDate {
+		t.Fatalf("got %s (%s) without credentials, want the image status", result.Outcome, result.Error)
+	}
+
+	// a manual redeploy keeps the stored credentials
+	if _, err := u.updateStack(ctx, ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if auth := srv.StackGitAuthentication(1); auth == nil || auth.Password != "secret" {
+		t.Fatalf("got credentials %+v after redeploy, want the stored ones kept", auth)
+	}
+
+	head = git.Commit("org/app", "main", "compose.yml", "services:\n  web:\n    image: nginx:1.27\n")
+	srv.SetStackRemoteHead(1, head)
+	if u.credentials, _ = parseGitCredentials(git.URL + "/org=robot:secret"); len(u.credentials) != 1 {
+		t.Fatal("no git credentials")
+	}
+	u.client = portainerapi.NewPortainerAPIClient(testAPIKey, srv.URL,
+		portainerapi.WithRetries(portainerapi.RetryPolicy{Retries: 1, Delay: time.Millisecond}),
+		portainerapi.WithGitCredentials(u.credentials.lookup),
+	)
+	result = resultFor(t, u.run(ctx, 0), notify.KindStack, "1")
+	if result.Outcome != notify.OutcomeUpdated {
+		t.Fatalf("got %s (%s) with credentials, want the new commit deployed", result.Outcome, result.Error)
+	}
+	if auth := srv.StackGitAuthentication(1); auth == nil || auth.Username != "robot" || auth.Password != "secret" {
+		t.Errorf("got credentials %+v after redeploy, want the supplied ones", auth)
+	}
+	if got := len(srv.Redeploys()); got != 2 {
+		t.Errorf("got %d redeploys, want 2", got)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/history"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/schedule"
+	"github.com/sjafferali/portainer-autoupdater/internal/tags"
+	"gopkg.in/yaml.v3"
+)
+
+var instanceNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// instancesFile lists the portainer instances managed by one autoupdater
+type instancesFile struct {
+	Instances []instanceConfig `yaml:"instances"`
+}
+
+// instanceConfig holds the settings of one portainer instance, settings that
+// aren't set fall back to the AUTOUPDATER_* env vars
+type instanceConfig struct {
+	Name     string       `yaml:"name"`
+	Endpoint string       `yaml:"endpoint"`
+	Token    string       `yaml:"token"`
+	Username string       `yaml:"username"`
+	Password string       `yaml:"password"`
+	TLS      *instanceTLS `yaml:"tls"`
+
+	DryRun             *bool          `yaml:"dryRun"`
+	OptIn              *bool          `yaml:"optIn"`
+	Interval           *time.Duration `yaml:"interval"`
+	Schedule           *string        `yaml:"schedule"`
+	MaintenanceWindows *string        `yaml:"maintenanceWindows"`
+	ImageCheck         *string        `yaml:"imageCheck"`
+	TagPolicy          *string        `yaml:"tagPolicy"`
+	TagInclude         *string        `yaml:"tagInclude"`
+	TagExclude         *string        `yaml:"tagExclude"`
+	GitStackMode       *string        `yaml:"gitStackMode"`
+	GitProvider        *string        `yaml:"gitProvider"`
+	GitApiUrl          *string        `yaml:"gitApiUrl"`
+	GitToken           *string        `yaml:"gitToken"`
+	GitCredentials     *string        `yaml:"gitCredentials"`
+	GitCredentialsFile *string        `yaml:"gitCredentialsFile"`
+
+	EnableStacks        *bool     `yaml:"enableStacks"`
+	ExcludeStackIds     *[]int    `yaml:"excludeStackIds"`
+	IncludeStackIds     *[]int    `yaml:"includeStackIds"`
+	ExcludeStackNames   *[]string `yaml:"excludeStackNames"`
+	IncludeStackNames   *[]string `yaml:"includeStackNames"`
+	CheckExcludedStacks *bool     `yaml:"checkExcludedStacks"`
+
+	EnableServices      *bool     `yaml:"enableServices"`
+	ExcludeServiceIds   *[]string `yaml:"excludeServiceIds"`
+	IncludeServiceIds   *[]string `yaml:"includeServiceIds"`
+	ExcludeServiceNames *[]string `yaml:"excludeServiceNames"`
+	IncludeServiceNames *[]string `yaml:"includeServiceNames"`
+
+	EnableContainers      *bool     `yaml:"enableContainers"`
+	ExcludeContainerIds   *[]string `yaml:"excludeContainerIds"`
+	IncludeContainerIds   *[]string `yaml:"includeContainerIds"`
+	ExcludeContainerNames *[]string `yaml:"excludeContainerNames"`
+	IncludeContainerNames *[]string `yaml:"includeContainerNames"`
+}
+
+// instanceTLS replaces the global tls settings as a whole
+type instanceTLS struct {
+	CAFile      string `yaml:"caFile"`
+	CertFile    string `yaml:"certFile"`
+	KeyFile     string `yaml:"keyFile"`
+	Fingerprint string `yaml:"fingerprint"`
+	Insecure    bool   `yaml:"insecure"`
+}
+
+// instance is a portainer instance with its settings resolved, the name is
+// empty when only the instance from the env vars is managed
+type instance struct {
+	name string
+	s    ConfigSpecification
+}
+
+// loadInstances reads the instances file, resolving the settings of every
+// instance against s
+func loadInstances(path string, s ConfigSpecification) ([]instance, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading instances file")
+	}
+
+	var file instancesFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, errors.Wrapf(err, "parsing instances file %s", path)
+	}
+	if len(file.Instances) == 0 {
+		return nil, errors.Errorf("no instances in %s", path)
+	}
+
+	instances := make([]instance, 0, len(file.Instances))
+	seen := make(map[string]bool)
+	for i, c := range file.Instances {
+		switch {
+		case c.Name == "":
+			return nil, errors.Errorf("instance %d has no name", i+1)
+		case !instanceNameRe.MatchString(c.Name):
+			return nil, errors.Errorf("invalid instance name %q, use letters, digits, '.', '_' and '-'", c.Name)
+		case seen[c.Name]:
+			return nil, errors.Errorf("instance %s is listed twice", c.Name)
+		case c.Endpoint == "":
+			return nil, errors.Errorf("instance %s has no endpoint", c.Name)
+		}
+		seen[c.Name] = true
+		instances = append(instances, instance{name: c.Name, s: c.apply(s)})
+	}
+	return instances, nil
+}
+
+// apply returns s with the settings of the instance
+func (c instanceConfig) apply(s ConfigSpecification) ConfigSpecification {
+	s.Endpoint = c.Endpoint
+	if c.Token != "" || c.Username != "" {
+		s.Token = c.Token
+		s.Username = c.Username
+		s.Password = c.Password
+	}
+	if c.TLS != nil {
+		s.TlsCaFile = c.TLS.CAFile
+		s.TlsCertFile = c.TLS.CertFile
+		s.TlsKeyFile = c.TLS.KeyFile
+		s.TlsFingerprint = c.TLS.Fingerprint
+		s.TlsInsecure = c.TLS.Insecure
+	}
+
+	override(&s.DryRun, c.DryRun)
+	override(&s.OptIn, c.OptIn)
+	override(&s.Interval, c.Interval)
+	override(&s.Schedule, c.Schedule)
+	override(&s.MaintenanceWindows, c.MaintenanceWindows)
+	override(&s.ImageCheck, c.ImageCheck)
+	override(&s.TagPolicy, c.TagPolicy)
+	override(&s.TagInclude, c.TagInclude)
+	override(&s.TagExclude, c.TagExclude)
+	override(&s.GitStackMode, c.GitStackMode)
+	override(&s.GitProvider, c.GitProvider)
+	override(&s.GitApiUrl, c.GitApiUrl)
+	override(&s.GitToken, c.GitToken)
+	override(&s.GitCredentials, c.GitCredentials)
+	override(&s.GitCredentialsFile, c.GitCredentialsFile)
+
+	override(&s.EnableStacks, c.EnableStacks)
+	overrideList(&s.ExcludeStackIds, c.ExcludeStackIds)
+	overrideList(&s.IncludeStackIds, c.IncludeStackIds)
+	overrideList(&s.ExcludeStackNames, c.ExcludeStackNames)
+	overrideList(&s.IncludeStackNames, c.IncludeStackNames)
+	override(&s.CheckExcludedStacks, c.CheckExcludedStacks)
+
+	override(&s.EnableServices, c.EnableServices)
+	overrideList(&s.ExcludeServiceIds, c.ExcludeServiceIds)
+	overrideList(&s.IncludeServiceIds, c.IncludeServiceIds)
+	overrideList(&s.ExcludeServiceNames, c.ExcludeServiceNames)
+	overrideList(&s.IncludeServiceNames, c.IncludeServiceNames)
+
+	override(&s.EnableContainers, c.EnableContainers)
+	overrideList(&s.ExcludeContainerIds, c.ExcludeContainerIds)
+	overrideList(&s.IncludeContainerIds, c.IncludeContainerIds)
+	overrideList(&s.ExcludeContainerNames, c.ExcludeContainerNames)
+	overrideList(&s.IncludeContainerNames, c.IncludeContainerNames)
+	return s
+}
+
+func override[T any](dst *T, v *T) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// overrideList sets a filter, an empty list removes the filter like an unset
+// env var does
+func overrideList[T any](dst *[]T, v *[]T) {
+	if v == nil {
+		return
+	}
+	*dst = nil
+	if len(*v) > 0 {
+		*dst = *v
+	}
+}
+
+// newInstanceUpdater sets up the client, schedule and maintenance windows of
+// an instance. Events go to the shared sinks labelled with the instance name.
+func newInstanceUpdater(
+	inst instance,
+	sinks notify.Notifier,
+	hist *history.Store,
+	logger zerolog.Logger,
+) (*updater, error) {
+	s := inst.s
+	ll := logger
+	if inst.name != "" {
+		ll = logger.With().Str("instance", inst.name).Logger()
+	}
+
+	// failed runs would be retried right away
+	if s.FailedRunBackoff <= 0 {
+		return nil, errors.Errorf("invalid failed run backoff %s, it must be positive", s.FailedRunBackoff)
+	}
+
+	for _, ids := range [][]string{s.IncludeContainerIds, s.ExcludeContainerIds} {
+		if err := validateContainerIDs(ids); err != nil {
+			return nil, err
+		}
+	}
+
+	creds, err := loadGitCredentials(s.GitCredentials, s.GitCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newClient(inst.name, s, creds, ll)
+	if err != nil {
+		return nil, err
+	}
+
+	registries := newRegistryClient(client, s.InsecureRegistries, ll)
+	switch s.ImageCheck {
+	case imageCheckPortainer:
+	case imageCheckRegistry:
+		client = newRegistryStatusClient(client, registries)
+	default:
+		return nil, errors.Errorf("invalid image check %q, use %s or %s", s.ImageCheck, imageCheckPortainer, imageCheckRegistry)
+	}
+
+	bumper, err := newTagBumper(registries, s.TagPolicy, s.TagInclude, s.TagExclude)
+	if err != nil {
+		return nil, err
+	}
+	proposer, err := newProposer(bumper, s.GitStackMode, s.GitProvider, s.GitApiUrl, s.GitToken)
+	if err != nil {
+		return nil, err
+	}
+	if proposer != nil && bumper.policy == tags.PolicyNone {
+		ll.Warn().Msg("no tag policy set, pull requests are only opened for git stacks that set their own")
+	}
+
+	status := newStatusStore()
+	notifier := notify.Multi(sinks, status)
+	if hist != nil {
+		notifier = notify.Multi(notifier, hist)
+	}
+	notifier = notify.WithInstance(notifier, inst.name)
+
+	var cron *schedule.Cron
+	if s.Schedule != "" {
+		if cron, err = schedule.ParseCron(s.Schedule); err != nil {
+			return nil, err
+		}
+	}
+
+	windows, err := schedule.ParseWindows(s.MaintenanceWindows)
+	if err != nil {
+		return nil, err
+	}
+	gate := newUpdateGate(windows, notifier, s.ShutdownGracePeriod)
+
+	verify := verifyConfig{
+		enabled:      s.VerifyUpdates,
+		rollback:     s.Rollback,
+		timeout:      s.VerifyTimeout,
+		pollInterval: s.VerifyPollInterval,
+	}
+
+	return newUpdater(inst.name, s, client, notifier, gate, verify, bumper, proposer, creds, cron, status, hist, ll), nil
+}
+
+func newClient(name string, s ConfigSpecification, creds gitCredentials, ll zerolog.Logger) (portainerapi.Client, error) {
+	tlsConfig, err := portainerapi.TLSConfig{
+		CAFile:      s.TlsCaFile,
+		CertFile:    s.TlsCertFile,
+		KeyFile:     s.TlsKeyFile,
+		Fingerprint: s.TlsFingerprint,
+		Insecure:    s.TlsInsecure,
+	}.Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "configuring tls")
+	}
+	if s.TlsInsecure {
+		ll.Warn().
+			Str("endpoint", s.Endpoint).
+			Msg("TLS VERIFICATION IS DISABLED: portainer credentials are sent to whoever answers on the endpoint, set a ca file or fingerprint instead")
+	}
+
+	opts := []portainerapi.Option{
+		portainerapi.WithRetries(portainerapi.RetryPolicy{
+			Retries:  s.RequestRetries,
+			Delay:    s.RequestRetryDelay,
+			MaxDelay: s.RequestRetryMaxDelay,
+		}),
+		portainerapi.WithTLS(tlsConfig),
+		portainerapi.WithInstance(name),
+	}
+	if len(creds) > 0 {
+		opts = append(opts, portainerapi.WithGitCredentials(creds.lookup))
+	}
+
+	var client portainerapi.Client
+	switch {
+	case s.Token != "":
+		client = portainerapi.NewPortainerAPIClient(s.Token, s.Endpoint, opts...)
+	case s.Username != "" && s.Password != "":
+		ll.Debug().Str("username", s.Username).Msg("using username and password authentication")
+		client = portainerapi.NewPortainerAPIClientWithCredentials(s.Username, s.Password, s.Endpoint, opts...)
+	default:
+		return nil, errors.New("either token or username and password must be set")
+	}
+
+	return client, nil
+}
+
+// selectUpdater returns the updater of the named instance, the name may be
+// left out when there is only one
+func selectUpdater(updaters []*updater, name string) (*updater, error) {
+	if name == "" {
+		if len(updaters) == 1 {
+			return updaters[0], nil
+		}
+		return nil, errors.Errorf("several instances are configured, select one of %s", strings.Join(instanceNames(updaters), ", "))
+	}
+
+	for _, u := range updaters {
+		if u.name == name {
+			return u, nil
+		}
+	}
+	return nil, errors.Errorf("unknown instance %s", name)
+}
+
+func instanceNames(updaters []*updater) []string {
+	names := make([]string, 0, len(updaters))
+	for _, u := range updaters {
+		names = append(names, u.name)
+	}
+	return names
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+)
+
+func writeInstancesFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "instances.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadInstances(t *testing.T) {
+	path := writeInstancesFile(t, `
+instances:
+  - name: prod
+    endpoint: https://prod:9443
+    token: prod-token
+    dryRun: false
+    schedule: "0 3 * * *"
+    excludeStackNames: [db]
+    tls:
+      fingerprint: "ab:cd"
+  - name: lab
+    endpoint: https://lab:9443
+    username: admin
+    password: secret
+    includeStackIds: []
+    enableContainers: true
+`)
+
+	global := testConfig()
+	global.DryRun = true
+	global.Token = "global-token"
+	global.IncludeStackIds = []int{1}
+	global.TlsCaFile = "/ca.pem"
+
+	instances, err := loadInstances(path, global)
+	if err != nil {
+		t.Fatalf("loading instances: %s", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("got %d instances, want 2", len(instances))
+	}
+
+	prod := instances[0]
+	switch {
+	case prod.name != "prod" || prod.s.Endpoint != "https://prod:9443" || prod.s.Token != "prod-token":
+		t.Errorf("unexpected prod connection settings: %+v", prod)
+	case prod.s.DryRun || prod.s.Schedule != "0 3 * * *":
+		t.Errorf("prod should override dry run and schedule: %+v", prod.s)
+	case len(prod.s.ExcludeStackNames) != 1 || len(prod.s.IncludeStackIds) != 1:
+		t.Errorf("prod should add its exclude and inherit the include filter: %+v", prod.s)
+	case prod.s.TlsCaFile != "" || prod.s.TlsFingerprint != "ab:cd":
+		t.Errorf("prod tls settings should replace the global ones: %+v", prod.s)
+	}
+
+	lab := instances[1]
+	switch {
+	case lab.s.Token != "" || lab.s.Username != "admin" || lab.s.Password != "secret":
+		t.Errorf("lab should use its own credentials: %+v", lab.s)
+	case !lab.s.DryRun || lab.s.TlsCaFile != "/ca.pem":
+		t.Errorf("lab should inherit dry run and tls settings: %+v", lab.s)
+	case lab.s.IncludeStackIds != nil:
+		t.Errorf("an empty list should remove the include filter: %v", lab.s.IncludeStackIds)
+	case !lab.s.EnableContainers:
+		t.Error("lab should enable containers")
+	}
+}
+
+func TestLoadInstancesErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":          "instances: []\n",
+		"no name":        "instances:\n  - endpoint: http://a\n",
+		"no endpoint":    "instances:\n  - name: a\n",
+		"invalid name":   "instances:\n  - name: a b\n    endpoint: http://a\n",
+		"duplicate name": "instances:\n  - name: a\n    endpoint: http://a\n  - name: a\n    endpoint: http://b\n",
+		"unknown field":  "instances:\n  - name: a\n    endpoint: http://a\n    dry_run: true\n",
+	} {
+		if _, err := loadInstances(writeInstancesFile(t, content), testConfig()); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestInstances(t *testing.T) {
+	prod := newTestServer(t)
+	prod.SetStackImageStatus(1, fake.StatusOutdated)
+	lab := newTestServer(t)
+	lab.SetStackImageStatus(1, fake.StatusOutdated)
+
+	s := testConfig()
+	s.Token = testAPIKey
+	s.RequestRetries = 1
+	s.RequestRetryDelay = time.Millisecond
+
+	prodConfig := s
+	prodConfig.Endpoint = prod.URL
+	labConfig := s
+	labConfig.Endpoint = lab.URL
+	labConfig.DryRun = true
+
+	rec := &recorder{}
+	var updaters []*updater
+	for _, inst := range []instance{{name: "prod", s: prodConfig}, {name: "lab", s: labConfig}} {
+		u, err := newInstanceUpdater(inst, rec, nil, zerolog.Nop())
+		if err != nil {
+			t.Fatalf("configuring %s: %s", inst.name, err)
+		}
+		updaters = append(updaters, u)
+	}
+
+	if code := runOnce(context.Background(), updaters); code != exitUpdated {
+		t.Errorf("got exit code %d, want %d", code, exitUpdated)
+	}
+	if len(prod.Redeploys()) != 1 || len(lab.Redeploys()) != 0 {
+		t.Errorf("want prod updated and lab held back by dry run, got %d and %d redeploys", len(prod.Redeploys()), len(lab.Redeploys()))
+	}
+
+	rec.mu.Lock()
+	for _, event := range rec.events {
+		if event.Instance == "" {
+			t.Errorf("%s event without instance", event.Type)
+		}
+		if event.Target != nil && event.Target.Instance != event.Instance {
+			t.Errorf("%s event target of instance %q, want %q", event.Type, event.Target.Instance, event.Instance)
+		}
+		if event.Type == notify.EventRunSummary {
+			for _, r := range event.Summary.Results {
+				if r.Instance != event.Instance {
+					t.Errorf("result of instance %q in summary of %q", r.Instance, event.Instance)
+				}
+			}
+		}
+	}
+	rec.mu.Unlock()
+
+	labUpdater, err := selectUpdater(updaters, "lab")
+	if err != nil {
+		t.Fatalf("selecting lab: %s", err)
+	}
+	statuses := labUpdater.status.list()
+	if len(statuses) == 0 || statuses[0].Instance != "lab" {
+		t.Errorf("want lab statuses labelled with the instance, got %+v", statuses)
+	}
+
+	if _, err := selectUpdater(updaters, ""); err == nil {
+		t.Error("want error selecting without a name from several instances")
+	}
+	if _, err := selectUpdater(updaters, "staging"); err == nil {
+		t.Error("want error selecting an unknown instance")
+	}
+}
+
+func TestInstanceFailedRunBackoff(t *testing.T) {
+	srv := newTestServer(t)
+	s := testConfig()
+	s.Endpoint = srv.URL
+	s.Token = testAPIKey
+
+	for _, backoff := range []time.Duration{0, -time.Second} {
+		s.FailedRunBackoff = backoff
+		if _, err := newInstanceUpdater(instance{s: s}, &recorder{}, nil, zerolog.Nop()); err == nil {
+			t.Errorf("want error for a failed run backoff of %s", backoff)
+		}
+	}
+
+	s.FailedRunBackoff = time.Second
+	if _, err := newInstanceUpdater(instance{s: s}, &recorder{}, nil, zerolog.Nop()); err != nil {
+		t.Errorf("configuring updater: %s", err)
+	}
+}
+
+func TestInstanceContainerIDs(t *testing.T) {
+	srv := newTestServer(t)
+	s := testConfig()
+	s.Endpoint = srv.URL
+	s.Token = testAPIKey
+
+	s.IncludeContainerIds = []string{"4c01db0b339c"}
+	s.ExcludeContainerIds = []string{"a"}
+	if _, err := newInstanceUpdater(instance{s: s}, &recorder{}, nil, zerolog.Nop()); err == nil {
+		t.Error("want error for a container id shorter than the short form")
+	}
+
+	s.ExcludeContainerIds = []string{"a8b2f1d7e6c3", ""}
+	if _, err := newInstanceUpdater(instance{s: s}, &recorder{}, nil, zerolog.Nop()); err != nil {
+		t.Errorf("configuring updater: %s", err)
+	}
+}
@@ -2,39 +2,149 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/sjafferali/portainer-autoupdater/internal/history"
 	"github.com/sjafferali/portainer-autoupdater/internal/meta"
-	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
 )
 
 type ConfigSpecification struct {
 	Interval time.Duration `default:"300s" desc:"how often to run app"`
 	DryRun   bool          `default:"true" split_words:"true" desc:"only print updates that will be performed"`
-	Endpoint string        `required:"true" desc:"portainer api endpoint"`
-	Token    string        `required:"true" desc:"portainer token to use for authentication"`
+	Endpoint string        `desc:"portainer api endpoint; required unless an instances file is set"`
+	Token    string        `desc:"portainer token to use for authentication"`
+	Username string        `desc:"portainer username to use for authentication when no token is set"`
+	Password string        `desc:"portainer password to use for authentication when no token is set"`
 	LogLevel string        `default:"INFO" desc:"loglevel to print logs with"`
+	OptIn    bool          `split_words:"true" desc:"only check stacks, services and containers that opted in through an autoupdater.enable or autoupdater.policy label or stack env var"`
 
-	EnableStacks      bool     `default:"true" split_words:"true" desc:"enable checking for stack updates"`
-	ExcludeStackIds   []int    `split_words:"true" desc:"stack IDs of stacks that should be excluded from auto update"`
-	IncludeStackIds   []int    `split_words:"true" desc:"stack IDs of stacks that should be included from checks; if not set, all stacks are included"`
-	ExcludeStackNames []string `split_words:"true" desc:"stack names of stacks that should be excluded from auto update"`
-	IncludeStackNames []string `split_words:"true" desc:"stack names of stacks that should be included from checks; if not set, all stacks are included"`
+	InstancesFile string `split_words:"true" desc:"yaml file listing several portainer instances to manage, each with its own endpoint, credentials, filters and schedule; settings not set for an instance are taken from the env vars"`
+
+	TlsCaFile      string `split_words:"true" desc:"pem bundle of CAs trusted in addition to the system roots when verifying portainer"`
+	TlsCertFile    string `split_words:"true" desc:"client certificate sent to portainer for mutual tls"`
+	TlsKeyFile     string `split_words:"true" desc:"key of the client certificate"`
+	TlsFingerprint string `split_words:"true" desc:"sha256 fingerprint of the portainer server certificate to trust even when no CA vouches for it"`
+	TlsInsecure    bool   `split_words:"true" desc:"skip verifying the portainer server certificate, credentials are sent to whoever answers on the endpoint"`
+
+	ImageCheck         string   `default:"portainer" split_words:"true" desc:"how outdated images are found: portainer asks portainer's image status api, registry compares the digests of the running images with their registries using the registry credentials from portainer"`
+	InsecureRegistries []string `split_words:"true" desc:"registries reached over plain http by the registry image check and tag bumping; loopback registries always are"`
+
+	TagPolicy  string `default:"none" split_words:"true" desc:"how far pinned version tags of file stacks are bumped to newer tags in their registry: none, patch, minor or major"`
+	TagInclude string `split_words:"true" desc:"regular expression tags have to match to be bumped to"`
+	TagExclude string `split_words:"true" desc:"regular expression of tags never bumped to"`
+
+	GitStackMode string `default:"redeploy" split_words:"true" desc:"what happens to git stacks with updates: redeploy redeploys them from their repository, pull-request opens pull requests bumping their tags instead"`
+	GitProvider  string `split_words:"true" desc:"api of the git hosting service pull requests are opened on: github, gitea or gitlab; guessed from the repository host when empty"`
+	GitApiUrl    string `split_words:"true" desc:"address of the git hosting service api, derived from the repository host when empty"`
+	GitToken     string `split_words:"true" desc:"access token pull requests are opened with"`
+
+	GitCredentials     string `split_words:"true" desc:"semicolon separated credentials for the repositories of git stacks, such as 'app=robot:token' for the stack app or 'https://git.example.com/org=robot:token' for the repositories under that url; used to check for new commits and to redeploy stacks without a saved git credential"`
+	GitCredentialsFile string `split_words:"true" desc:"file with git credentials in the same format, one per line, such as a docker secret"`
+
+	RequestRetries       int           `default:"3" split_words:"true" desc:"how often to retry portainer api reads that failed with a network or server error"`
+	RequestRetryDelay    time.Duration `default:"1s" split_words:"true" desc:"backoff before the first retry, doubled on every retry"`
+	RequestRetryMaxDelay time.Duration `default:"30s" split_words:"true" desc:"maximum backoff between retries"`
+	FailedRunBackoff     time.Duration `default:"10s" split_words:"true" desc:"how soon to run again after portainer couldn't be reached, doubled on every failed run up to the interval"`
+
+	VerifyUpdates      bool          `split_words:"true" desc:"wait for updated stacks to become healthy"`
+	VerifyTimeout      time.Duration `default:"5m" split_words:"true" desc:"how long an updated stack may take to become healthy"`
+	VerifyPollInterval time.Duration `default:"10s" split_words:"true" desc:"how often to check the health of an updated stack"`
+	Rollback           bool          `default:"true" desc:"redeploy stacks with their previous image digests pinned when they are unhealthy after an update"`
+
+	ShutdownGracePeriod time.Duration `default:"30s" split_words:"true" desc:"how long updates in progress may take to finish after SIGTERM"`
+
+	ListenAddress string `split_words:"true" desc:"address to serve /metrics, /healthz and the api on, such as :8080; if not set, no http server is started"`
+	EnableApi     bool   `split_words:"true" desc:"serve the control api for status, manual checks and pausing"`
+	ApiToken      string `split_words:"true" desc:"bearer token required by the control api"`
+
+	HistoryPath      string        `split_words:"true" desc:"file to keep the history of checks and updates in, such as /data/history.db; if not set, no history is kept"`
+	HistoryRetention time.Duration `default:"2160h" split_words:"true" desc:"how long to keep history records; if 0, records are kept forever"`
+
+	Schedule           string `desc:"cron expression for when to run checks; if not set, checks run back to back"`
+	MaintenanceWindows string `split_words:"true" desc:"semicolon separated list of windows such as 'weekend=Sun 02:00-05:00 Europe/Berlin' in which updates may be performed; if not set, updates are performed right away"`
+
+	EnableStacks        bool     `default:"true" split_words:"true" desc:"enable checking for stack updates"`
+	ExcludeStackIds     []int    `split_words:"true" desc:"stack IDs of stacks that should be excluded from auto update"`
+	IncludeStackIds     []int    `split_words:"true" desc:"stack IDs of stacks that should be included from checks; if not set, all stacks are included"`
+	ExcludeStackNames   []string `split_words:"true" desc:"stack names of stacks that should be excluded from auto update"`
+	IncludeStackNames   []string `split_words:"true" desc:"stack names of stacks that should be included from checks; if not set, all stacks are included"`
+	CheckExcludedStacks bool     `split_words:"true" desc:"still check excluded stacks and report them as held back when outdated"`
 
 	EnableServices      bool     `default:"true" split_words:"true" desc:"enable checking for service updates (swarm only)"`
 	ExcludeServiceIds   []string `split_words:"true" desc:"service IDs of services that should be excluded from auto update"`
 	IncludeServiceIds   []string `split_words:"true" desc:"service IDs of services that should be included from checks; if not set, all services are included"`
 	ExcludeServiceNames []string `split_words:"true" desc:"service names of services that should be excluded from auto update"`
 	IncludeServiceNames []string `split_words:"true" desc:"service names of services that should be included from checks; if not set, all services are included"`
+
+	EnableContainers      bool     `default:"false" split_words:"true" desc:"enable checking for standalone container updates"`
+	ExcludeContainerIds   []string `split_words:"true" desc:"container IDs of containers that should be excluded from auto update"`
+	IncludeContainerIds   []string `split_words:"true" desc:"container IDs of containers that should be included from checks; if not set, all containers are included"`
+	ExcludeContainerNames []string `split_words:"true" desc:"container names of containers that should be excluded from auto update"`
+	IncludeContainerNames []string `split_words:"true" desc:"container names of containers that should be included from checks; if not set, all containers are included"`
+
+	NotifyWebhookUrl      string            `split_words:"true" desc:"url to send notification events to"`
+	NotifyWebhookMethod   string            `default:"POST" split_words:"true" desc:"http method used for the notification webhook"`
+	NotifyWebhookHeaders  map[string]string `split_words:"true" desc:"extra headers sent with the notification webhook, as key:value pairs"`
+	NotifyWebhookTemplate string            `split_words:"true" desc:"go template for the webhook body; if not set, the event is sent as json"`
+	NotifyWebhookEvents   []string          `split_words:"true" desc:"event types sent to the webhook; if not set, all events are sent"`
+
+	NotifySmtpHost     string        `split_words:"true" desc:"smtp server to send digest mails through"`
+	NotifySmtpPort     int           `default:"587" split_words:"true" desc:"smtp server port"`
+	NotifySmtpUsername string        `split_words:"true" desc:"smtp username; if not set, no authentication is used"`
+	NotifySmtpPassword string        `split_words:"true" desc:"smtp password"`
+	NotifySmtpFrom     string        `split_words:"true" desc:"sender address of digest mails"`
+	NotifySmtpTo       []string      `split_words:"true" desc:"recipient addresses of digest mails"`
+	NotifySmtpPeriod   time.Duration `default:"0s" split_words:"true" desc:"how often to send a digest mail; if 0, one mail is sent per run"`
+
+	NotifySlackUrl      string   `split_words:"true" desc:"slack incoming webhook url"`
+	NotifySlackEvents   []string `default:"run_summary" split_words:"true" desc:"event types posted to slack"`
+	NotifyDiscordUrl    string   `split_words:"true" desc:"discord webhook url"`
+	NotifyDiscordEvents []string `default:"run_summary" split_words:"true" desc:"event types posted to discord"`
+	NotifyTeamsUrl      string   `split_words:"true" desc:"microsoft teams incoming webhook url"`
+	NotifyTeamsEvents   []string `default:"run_summary" split_words:"true" desc:"event types posted to microsoft teams"`
+
+	NotifyNtfyUrl            string            `split_words:"true" desc:"ntfy topic url to publish to"`
+	NotifyNtfyToken          string            `split_words:"true" desc:"ntfy access token"`
+	NotifyNtfyEvents         []string          `default:"update_succeeded,update_failed" split_words:"true" desc:"event types published to ntfy"`
+	NotifyNtfyPriorities     map[string]string `default:"update_failed:high,update_succeeded:low" split_words:"true" desc:"ntfy priority per event type (off, min, low, default, high, max)"`
+	NotifyGotifyUrl          string            `split_words:"true" desc:"gotify server url"`
+	NotifyGotifyToken        string            `split_words:"true" desc:"gotify application token"`
+	NotifyGotifyEvents       []string          `default:"update_succeeded,update_failed" split_words:"true" desc:"event types sent to gotify"`
+	NotifyGotifyPriorities   map[string]string `default:"update_failed:high,update_succeeded:low" split_words:"true" desc:"gotify priority per event type (off, min, low, default, high, max)"`
+	NotifyTelegramToken      string            `split_words:"true" desc:"telegram bot token"`
+	NotifyTelegramChatId     string            `split_words:"true" desc:"telegram chat id to send messages to"`
+	NotifyTelegramEvents     []string          `default:"update_succeeded,update_failed" split_words:"true" desc:"event types sent to telegram"`
+	NotifyTelegramPriorities map[string]string `default:"update_failed:high,update_succeeded:low" split_words:"true" desc:"telegram priority per event type; below default is sent silently"`
 }
 
+// exit codes of --once runs, 2 is left out since go uses it for panics
+const (
+	exitNothingUpdated = 0
+	exitFailed         = 1
+	exitUpdated        = 3
+)
+
 func main() {
+	once := flag.Bool("once", false, "run a single check without spreading it over the interval and exit; exits 0 when nothing was updated, 3 when updates were applied and 1 when anything failed")
+	instanceName := flag.String("instance", "", "name of the instance from the instances file to run or run commands against; by default all instances run")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	var s ConfigSpecification
 	if err := envconfig.Process("autoupdater", &s); err != nil {
 		if err2 := envconfig.Usage("autoupdater", &s); err2 != nil {
@@ -49,42 +159,155 @@ func main() {
 	}
 	zerolog.SetGlobalLevel(level)
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	ll := log.With().Str("version", meta.Version).Logger()
 	ll.Trace().Dur("interval", s.Interval).Msg("interval")
 
-	client := portainerapi.NewPortainerAPIClient(s.Token, s.Endpoint)
-	for {
-		if s.EnableStacks {
-			if err := upgradeStacks(
-				ctx,
-				client,
-				s.DryRun,
-				s.ExcludeStackIds,
-				s.IncludeStackIds,
-				s.ExcludeStackNames,
-				s.IncludeStackNames,
-				s.Interval,
-				ll,
-			); err != nil {
-				log.Fatal().Err(err).Msg("error running through stacks")
+	instances := []instance{{s: s}}
+	switch {
+	case s.InstancesFile != "" && s.Endpoint != "":
+		panic(errors.New("endpoint can't be set along with an instances file, list the instance in the file"))
+	case s.InstancesFile != "":
+		if instances, err = loadInstances(s.InstancesFile, s); err != nil {
+			panic(err)
+		}
+	case s.Endpoint == "":
+		panic(errors.New("either endpoint or instances file must be set"))
+	}
+
+	// notifications, metrics and history are shared by all instances
+	sinks, err := buildNotifier(s)
+	if err != nil {
+		panic(err)
+	}
+
+	var hist *history.Store
+	if s.HistoryPath != "" {
+		if hist, err = history.Open(s.HistoryPath, s.HistoryRetention); err != nil {
+			panic(err)
+		}
+	}
+
+	if s.EnableApi && (s.ListenAddress == "" || s.ApiToken == "") {
+		panic(errors.New("the api requires listen address and api token to be set"))
+	}
+
+	updaters := make([]*updater, 0, len(instances))
+	for _, inst := range instances {
+		u, err := newInstanceUpdater(inst, sinks, hist, ll)
+		if err != nil {
+			if inst.name != "" {
+				err = errors.Wrapf(err, "configuring instance %s", inst.name)
 			}
+			panic(err)
+		}
+		updaters = append(updaters, u)
+	}
+
+	if flag.NArg() > 0 {
+		u, err := selectUpdater(updaters, *instanceName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(exitFailed)
+		}
+		os.Exit(runCommand(ctx, u, flag.Args()))
+	}
+
+	if *instanceName != "" {
+		u, err := selectUpdater(updaters, *instanceName)
+		if err != nil {
+			panic(err)
+		}
+		updaters = []*updater{u}
+	}
+
+	if *once {
+		// updates queued for a maintenance window are reported as held back
+		code := runOnce(ctx, updaters)
+		flushNotifier(ctx, sinks, ll)
+		os.Exit(code)
+	}
+
+	var wg sync.WaitGroup
+	for _, u := range updaters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.gate.run(ctx, u.s.DryRun, u.isPaused, u.record, u.ll)
+		}()
+	}
+	if s.ListenAddress != "" {
+		apiToken := ""
+		if s.EnableApi {
+			apiToken = s.ApiToken
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(ctx, s.ListenAddress, updaters, apiToken, s.ShutdownGracePeriod, ll)
+		}()
+	}
+
+	var loops sync.WaitGroup
+	for _, u := range updaters {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			u.loop(ctx)
+		}()
+	}
+	loops.Wait()
+	ll.Info().Dur("grace_period", s.ShutdownGracePeriod).Msg("shutting down, waiting for updates in progress")
+	wg.Wait()
+
+	// history is written as results come in, only notifications are buffered
+	flushNotifier(ctx, sinks, ll)
+	ll.Info().Msg("shut down")
+}
+
+// runOnce runs all instances once at the same time and returns the exit code
+// of the worst run
+func runOnce(ctx context.Context, updaters []*updater) int {
+	codes := make([]int, len(updaters))
+	var wg sync.WaitGroup
+	for i, u := range updaters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = exitCode(u.run(ctx, 0))
+		}()
+	}
+	wg.Wait()
+
+	// nothing performs the queue after exiting
+	for _, u := range updaters {
+		for _, r := range u.gate.queued() {
+			u.ll.Warn().Str("kind", r.Kind).Str("name", r.Name).Int("endpoint_id", r.EndpointID).
+				Msg("update left queued for a maintenance window, not performed")
+		}
+	}
+
+	code := exitNothingUpdated
+	for _, c := range codes {
+		switch {
+		case c == exitFailed:
+			return exitFailed
+		case c == exitUpdated:
+			code = exitUpdated
+		}
+	}
+	return code
+}
 
-		//if s.EnableServices {
-		//	if err := upgradeServices(
-		//	ctx,
-		//	client,
-		//	s.DryRun,
-		//		s.ExcludeServiceIds,
-		//		s.IncludeServiceIds,
-		//		s.ExcludeServiceNames,
-		//		s.IncludeServiceNames,
-		//		ll,
-		//	); err != nil {
-		//		log.Fatal().Err(err).Msg("error running through services")
-		//	}
-		//}
+func exitCode(summary notify.Summary) int {
+	switch {
+	case summary.Failed():
+		return exitFailed
+	case summary.Count(notify.OutcomeUpdated) > 0:
+		return exitUpdated
+	default:
+		return exitNothingUpdated
 	}
 }
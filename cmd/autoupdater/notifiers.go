@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/metrics"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+)
+
+// buildNotifier returns a notifier sending to every configured sink
+func buildNotifier(s ConfigSpecification) (notify.Notifier, error) {
+	notifiers := []notify.Notifier{metrics.NewNotifier()}
+
+	if s.NotifyWebhookUrl != "" {
+		webhook, err := notify.NewWebhook(
+			s.NotifyWebhookUrl,
+			s.NotifyWebhookMethod,
+			s.NotifyWebhookHeaders,
+			s.NotifyWebhookTemplate,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "configuring webhook notifier")
+		}
+
+		events, err := notify.ParseEventTypes(s.NotifyWebhookEvents)
+		if err != nil {
+			return nil, errors.Wrap(err, "configuring webhook notifier")
+		}
+		notifiers = append(notifiers, notify.Filter(webhook, events...))
+	}
+
+	if s.NotifySmtpHost != "" {
+		mail, err := notify.NewSMTP(
+			s.NotifySmtpHost,
+			s.NotifySmtpPort,
+			s.NotifySmtpUsername,
+			s.NotifySmtpPassword,
+			s.NotifySmtpFrom,
+			s.NotifySmtpTo,
+			s.NotifySmtpPeriod,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "configuring smtp notifier")
+		}
+		notifiers = append(notifiers, mail)
+	}
+
+	chats := []struct {
+		name   string
+		url    string
+		events []string
+		build  func(url string) (*notify.Chat, error)
+	}{
+		{"slack", s.NotifySlackUrl, s.NotifySlackEvents, notify.NewSlack},
+		{"discord", s.NotifyDiscordUrl, s.NotifyDiscordEvents, notify.NewDiscord},
+		{"teams", s.NotifyTeamsUrl, s.NotifyTeamsEvents, notify.NewTeams},
+	}
+	for _, c := range chats {
+		if c.url == "" {
+			continue
+		}
+
+		chat, err := c.build(c.url)
+		if err != nil {
+			return nil, errors.Wrapf(err, "configuring %s notifier", c.name)
+		}
+
+		events, err := notify.ParseEventTypes(c.events)
+		if err != nil {
+			return nil, errors.Wrapf(err, "configuring %s notifier", c.name)
+		}
+		notifiers = append(notifiers, notify.Filter(chat, events...))
+	}
+
+	pushes := []struct {
+		name       string
+		enabled    bool
+		events     []string
+		priorities map[string]string
+		build      func(priorities map[notify.EventType]notify.Priority) (*notify.Push, error)
+	}{
+		{
+			"ntfy", s.NotifyNtfyUrl != "", s.NotifyNtfyEvents, s.NotifyNtfyPriorities,
+			func(p map[notify.EventType]notify.Priority) (*notify.Push, error) {
+				return notify.NewNtfy(s.NotifyNtfyUrl, s.NotifyNtfyToken, p)
+			},
+		},
+		{
+			"gotify", s.NotifyGotifyUrl != "", s.NotifyGotifyEvents, s.NotifyGotifyPriorities,
+			func(p map[notify.EventType]notify.Priority) (*notify.Push, error) {
+				return notify.NewGotify(s.NotifyGotifyUrl, s.NotifyGotifyToken, p)
+			},
+		},
+		{
+			"telegram", s.NotifyTelegramToken != "", s.NotifyTelegramEvents, s.NotifyTelegramPriorities,
+			func(p map[notify.EventType]notify.Priority) (*notify.Push, error) {
+				return notify.NewTelegram(s.NotifyTelegramToken, s.NotifyTelegramChatId, p)
+			},
+		},
+	}
+	for _, p := range pushes {
+		if !p.enabled {
+			continue
+		}
+
+		priorities, err := notify.ParsePriorities(p.priorities)
+		if err != nil {
+			return nil, errors.Wrapf(err, "configuring %s notifier", p.name)
+		}
+
+		push, err := p.build(priorities)
+		if err != nil {
+			return nil, errors.Wrapf(err, "configuring %s notifier", p.name)
+		}
+
+		events, err := notify.ParseEventTypes(p.events)
+		if err != nil {
+			return nil, errors.Wrapf(err, "configuring %s notifier", p.name)
+		}
+		notifiers = append(notifiers, notify.Filter(push, events...))
+	}
+
+	return notify.Multi(notifiers...), nil
+}
+
+// how long sending buffered notifications may take before exiting
+const flushTimeout = time.Second * 30
+
+// flushNotifier sends buffered notifications such as digests, even when ctx
+// is already done
+func flushNotifier(ctx context.Context, notifier notify.Notifier, ll zerolog.Logger) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), flushTimeout)
+	defer cancel()
+
+	if err := notify.Flush(ctx, notifier); err != nil {
+		ll.Error().Err(err).Msg("error flushing notifications")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+)
+
+// updatePolicy lets stack, service and container owners override the global
+// include/exclude filters through labels or stack env vars
+type updatePolicy string
+
+const (
+	policyUnset  updatePolicy = ""
+	policyUpdate updatePolicy = "update"
+	policyNotify updatePolicy = "notify"
+	policySkip   updatePolicy = "skip"
+)
+
+// labels read from containers and services
+const (
+	labelEnable = "autoupdater.enable"
+	labelPolicy = "autoupdater.policy"
+)
+
+// env vars read from stacks, the label names are accepted there as well
+const (
+	envEnable = "AUTOUPDATER_ENABLE"
+	envPolicy = "AUTOUPDATER_POLICY"
+)
+
+const holdReasonPolicyNotify = "update policy is notify"
+
+// policyStrictness orders policies so conflicting settings resolve to the
+// most restrictive one
+var policyStrictness = map[updatePolicy]int{
+	policyUnset:  0,
+	policyUpdate: 1,
+	policyNotify: 2,
+	policySkip:   3,
+}
+
+func stricterPolicy(a, b updatePolicy) updatePolicy {
+	if policyStrictness[b] > policyStrictness[a] {
+		return b
+	}
+	return a
+}
+
+// parsePolicy reads the enable and policy settings, an explicit policy wins
+// over the enable flag
+func parsePolicy(enable, policy string, ll zerolog.Logger) updatePolicy {
+	if policy != "" {
+		switch p := updatePolicy(strings.ToLower(strings.TrimSpace(policy))); p {
+		case policyUpdate, policyNotify, policySkip:
+			return p
+		default:
+			ll.Warn().Str("policy", policy).Msg("ignoring unknown update policy")
+		}
+	}
+
+	if enable != "" {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(enable))
+		if err != nil {
+			ll.Warn().Str("enable", enable).Msg("ignoring invalid enable setting")
+			return policyUnset
+		}
+		if enabled {
+			return policyUpdate
+		}
+		return policySkip
+	}
+
+	return policyUnset
+}
+
+func policyFromLabels(labels map[string]string, ll zerolog.Logger) updatePolicy {
+	return parsePolicy(labels[labelEnable], labels[labelPolicy], ll)
+}
+
+func policyFromEnv(env []portainer.Pair, ll zerolog.Logger) updatePolicy {
+	var enable, policy string
+	for _, pair := range env {
+		switch pair.Name {
+		case envEnable, labelEnable:
+			enable = pair.Value
+		case envPolicy, labelPolicy:
+			policy = pair.Value
+		}
+	}
+	return parsePolicy(enable, policy, ll)
+}
+
+// servicePolicy resolves the policy of a service from its own labels and the
+// labels of its containers
+func servicePolicy(service swarm.Service, ll zerolog.Logger) updatePolicy {
+	policy := policyFromLabels(service.Spec.Labels, ll)
+	if service.Spec.TaskTemplate.ContainerSpec != nil {
+		policy = stricterPolicy(policy, policyFromLabels(service.Spec.TaskTemplate.ContainerSpec.Labels, ll))
+	}
+	return policy
+}
+
+// stackPolicy resolves the policy of a stack. Stack env vars take precedence,
+// otherwise the strictest policy found on the stack's containers or services
+// is used.
+func stackPolicy(
+	ctx context.Context,
+	client portainerapi.Client,
+	stack portainerapi.Stack,
+	ll zerolog.Logger,
+) (updatePolicy, error) {
+	if policy := policyFromEnv(stack.Env, ll); policy != policyUnset {
+		return policy, nil
+	}
+
+	policy := policyUnset
+	if stack.Type == portainer.DockerSwarmStack {
+		services, err := client.ServicesForStack(ctx, stack, ll)
+		if err != nil {
+			return policyUnset, err
+		}
+		for _, service := range services {
+			policy = stricterPolicy(policy, servicePolicy(service, ll))
+		}
+		return policy, nil
+	}
+
+	containers, err := client.ContainersForStack(ctx, stack, ll)
+	if err != nil {
+		return policyUnset, err
+	}
+	for _, container := range containers {
+		policy = stricterPolicy(policy, policyFromLabels(container.Labels, ll))
+	}
+	return policy, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/compose"
+	"github.com/sjafferali/portainer-autoupdater/internal/forge"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/tags"
+)
+
+// what happens to git stacks with updates
+const (
+	gitStackRedeploy    = "redeploy"
+	gitStackPullRequest = "pull-request"
+)
+
+// pullRequestBranchPrefix starts the names of the branches pull requests are
+// opened from
+const pullRequestBranchPrefix = "autoupdater/"
+
+var branchNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// proposer opens pull requests bumping the tags of git stacks in their
+// repository instead of redeploying them. A nil proposer leaves git stacks to
+// be redeployed.
+type proposer struct {
+	bumper *tagBumper
+	// kind is the hosting service of all repositories, guessed from their
+	// host when empty
+	kind   forge.Kind
+	apiURL string
+	token  string
+
+	mu      sync.Mutex
+	clients map[string]forge.Client
+}
+
+func newProposer(bumper *tagBumper, mode, provider, apiURL, token string) (*proposer, error) {
+	switch mode {
+	case gitStackRedeploy:
+		return nil, nil
+	case gitStackPullRequest:
+	default:
+		return nil, errors.Errorf("invalid git stack mode %q, use %s or %s", mode, gitStackRedeploy, gitStackPullRequest)
+	}
+
+	kind, err := forge.ParseKind(provider)
+	if err != nil {
+		return nil, err
+	}
+	if apiURL != "" && kind == "" {
+		return nil, errors.New("the git provider must be set along with the git api url")
+	}
+	return &proposer{
+		bumper:  bumper,
+		kind:    kind,
+		apiURL:  apiURL,
+		token:   token,
+		clients: make(map[string]forge.Client),
+	}, nil
+}
+
+// client returns a client for the hosting service of repo
+func (p *proposer) client(repo forge.Repository) (forge.Client, error) {
+	kind := p.kind
+	if kind == "" {
+		detected, ok := forge.Detect(repo.Host)
+		if !ok {
+			return nil, errors.Errorf("can't tell which git provider %s is, set the git provider", repo.Host)
+		}
+		kind = detected
+	}
+	apiURL := p.apiURL
+	if apiURL == "" {
+		apiURL = forge.APIURL(kind, repo.Host)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := string(kind) + " " + apiURL
+	if c, ok := p.clients[key]; ok {
+		return c, nil
+	}
+	c, err := forge.New(kind, apiURL, p.token)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[key] = c
+	return c, nil
+}
+
+// proposal is a pull request bumping the tags of a git stack
+type proposal struct {
+	client forge.Client
+	repo   forge.Repository
+	change forge.Change
+	// images maps the bumped services to their new image
+	images map[string]string
+}
+
+// plan reads the stack file from the branch the stack is deployed from and
+// returns the pull request bumping its tags, nil when there are no newer tags
+func (p *proposer) plan(ctx context.Context, stack portainerapi.Stack, ll zerolog.Logger) (*proposal, error) {
+	policy, filter, err := p.bumper.settings(stack)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading stack tag policy")
+	}
+	if policy == tags.PolicyNone {
+		ll.Debug().Msg("git stack has no tag policy, not looking for newer tags")
+		return nil, nil
+	}
+
+	cfg := stack.GitConfig
+	if strings.HasPrefix(cfg.ReferenceName, "refs/tags/") {
+		return nil, errors.Errorf("stack is deployed from tag %s, pull requests need a branch", cfg.ReferenceName)
+	}
+	repo, err := forge.ParseRepository(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	client, err := p.client(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimPrefix(cfg.ReferenceName, "refs/heads/")
+	if base == "" {
+		if base, err = client.DefaultBranch(ctx, repo.Path); err != nil {
+			return nil, errors.Wrapf(err, "getting default branch of %s", repo)
+		}
+	}
+	file, err := client.File(ctx, repo.Path, base, cfg.ConfigFilePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading stack file from %s", repo)
+	}
+
+	images, err := p.bumper.bump(ctx, file.Content, policy, filter, ll)
+	if err != nil || len(images) == 0 {
+		return nil, err
+	}
+	content, err := compose.ReplaceImages(file.Content, images)
+	if err != nil {
+		return nil, err
+	}
+	before, err := compose.ServiceImages(file.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	title, body := pullRequestText(stack, before, images)
+	return &proposal{
+		client: client,
+		repo:   repo,
+		change: forge.Change{
+			Base:    base,
+			Head:    pullRequestBranch(stack, images),
+			Path:    cfg.ConfigFilePath,
+			Content: content,
+			Version: file.Version,
+			Message: title,
+			Title:   title,
+			Body:    body,
+		},
+		images: images,
+	}, nil
+}
+
+// pullRequestBranch names the branch after the stack and the images it bumps
+// to, so the pull request for the same tags is found again on later runs
+func pullRequestBranch(stack portainerapi.Stack, images map[string]string) string {
+	services := sortedKeys(images)
+	h := sha256.New()
+	for _, service := range services {
+		fmt.Fprintf(h, "%s=%s\n", service, images[service])
+	}
+	name := strings.Trim(branchNameRe.ReplaceAllString(stack.Name, "-"), "-.")
+	return pullRequestBranchPrefix + name + "-" + hex.EncodeToString(h.Sum(nil))[:8]
+}
+
+func pullRequestText(stack portainerapi.Stack, before, after map[string]string) (string, string) {
+	services := sortedKeys(after)
+
+	title := fmt.Sprintf("Bump images of stack %s", stack.Name)
+	if len(services) == 1 {
+		title = fmt.Sprintf("Bump %s to %s", services[0], after[services[0]])
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Newer tags were found for the images of the portainer stack `%s`:\n\n", stack.Name)
+	for _, service := range services {
+		fmt.Fprintf(&body, "- `%s`: `%s` → `%s`\n", service, before[service], after[service])
+	}
+	body.WriteString("\nThe stack is redeployed once this is merged and portainer picks up the change.\n")
+	return title, body.String()
+}
+
+// proposeStack opens a pull request for newer tags of a git stack, the result
+// is up to date when there are none. The stack isn't redeployed, the merged
+// change is picked up once there are no newer tags left to propose. A pull
+// request that was closed isn't opened again.
+func proposeStack(
+	ctx context.Context,
+	proposer *proposer,
+	notifier notify.Notifier,
+	dryRun bool,
+	holdReason string,
+	stack portainerapi.Stack,
+	result notify.Result,
+	ll zerolog.Logger,
+) (notify.Result, error) {
+	ll.Trace().Msg("checking git stack for newer tags")
+	prop, err := proposer.plan(ctx, stack, ll)
+	if err != nil {
+		ll.Error().Err(err).Msg("error looking for newer tags")
+		return failedResult(result, err), err
+	}
+	if prop == nil {
+		result.Status = statusUpdated
+		ll.Debug().Msg("no update needed")
+		return result, nil
+	}
+
+	result.Status = statusOutdated
+	ll = ll.With().
+		Str("status", result.Status).
+		Str("repository", prop.repo.String()).
+		Str("branch", prop.change.Head).
+		Logger()
+	ll.Info().Interface("images", prop.images).Msg("git stack has newer tags")
+
+	// the update was announced when the open pull request was opened
+	var existing *forge.PullRequest
+	if holdReason == "" && !dryRun {
+		if existing, err = prop.client.FindPullRequest(ctx, prop.repo.Path, prop.change.Head); err != nil {
+			ll.Error().Err(err).Msg("error looking for pull request")
+			return failedResult(result, err), err
+		}
+		if existing != nil && existing.Open {
+			ll.Debug().Str("url", existing.URL).Msg("pull request already open")
+			return heldBackResult(result, "pull request open: "+existing.URL), nil
+		}
+	}
+	sendEvent(ctx, notifier, updateEvent(notify.EventUpdateAvailable, result, dryRun), ll)
+
+	if holdReason != "" {
+		ll.Info().Str("reason", holdReason).Msg("holding back update")
+		return heldBackResult(result, holdReason), nil
+	}
+	if dryRun {
+		return heldBackResult(result, holdReasonDryRun), nil
+	}
+	if existing != nil {
+		ll.Info().Str("url", existing.URL).Msg("pull request for these tags was closed, not opening it again")
+		return heldBackResult(result, "pull request closed: "+existing.URL), nil
+	}
+
+	url, err := prop.client.Propose(ctx, prop.repo.Path, prop.change)
+	if err != nil {
+		ll.Error().Err(err).Msg("error opening pull request")
+		result = failedResult(result, err)
+		sendEvent(ctx, notifier, updateEvent(notify.EventUpdateFailed, result, false), ll)
+		return result, err
+	}
+
+	ll.Info().Str("url", url).Msg("opened pull request")
+	event := updateEvent(notify.EventPullRequestOpened, result, false)
+	event.URL = url
+	sendEvent(ctx, notifier, event, ll)
+	return heldBackResult(result, "opened pull request "+url), nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	portainer "github.com/portainer/portainer/api"
+	gittypes "github.com/portainer/portainer/api/git/types"
+	"github.com/sjafferali/portainer-autoupdater/internal/forge"
+	forgefake "github.com/sjafferali/portainer-autoupdater/internal/forge/fake"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+	"github.com/sjafferali/portainer-autoupdater/internal/registry"
+	registryfake "github.com/sjafferali/portainer-autoupdater/internal/registry/fake"
+)
+
+func TestPullRequest(t *testing.T) {
+	reg := registryfake.NewRegistry()
+	t.Cleanup(reg.Close)
+	for _, tag := range []string{"15.4", "15.5", "16.1"} {
+		reg.Push("postgres", tag)
+	}
+	file := "services:\n  db:\n    image: " + reg.Host() + "/postgres:15.4\n"
+
+	git := forgefake.NewServer("secret")
+	t.Cleanup(git.Close)
+	git.AddRepository("org/app", "main", map[string]string{"deploy/compose.yml": file})
+
+	srv := fake.NewServer(testAPIKey)
+	t.Cleanup(srv.Close)
+	srv.AddEndpoint(1, "docker", false)
+	srv.AddStack(fake.Stack{
+		Stack: portainerapi.Stack{Stack: portainer.Stack{
+			ID:         1,
+			Name:       "app",
+			EndpointID: 1,
+			Type:       portainer.DockerComposeStack,
+			GitConfig: &gittypes.RepoConfig{
+				URL:            git.URL + "/org/app.git",
+				ReferenceName:  "refs/heads/main",
+				ConfigFilePath: "deploy/compose.yml",
+			},
+		}},
+		ImageStatus: fake.StatusOutdated,
+	})
+
+	s := testConfig()
+	s.EnableServices = false
+	s.EnableContainers = false
+	s.GitStackMode = gitStackPullRequest
+	u, rec := newTestUpdater(t, srv, s, verifyConfig{})
+	if u.bumper, _ = newTagBumper(registry.NewClient(), "minor", "", ""); u.bumper == nil {
+		t.Fatal("no tag bumper")
+	}
+	var err error
+	if u.proposer, err = newProposer(u.bumper, s.GitStackMode, "gitea", git.APIURL(forge.KindGitea), "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	result := resultFor(t, u.run(ctx, 0), notify.KindStack, "1")
+	if result.Outcome != notify.OutcomeHeldBack || !strings.HasPrefix(result.Reason, "opened pull request ") {
+		t.Fatalf("got %s (%s), want a pull request opened", result.Outcome, result.Reason)
+	}
+
+	pulls := git.PullRequests()
+	if len(pulls) != 1 {
+		t.Fatalf("got %d pull requests, want 1", len(pulls))
+	}
+	pull := pulls[0]
+	if pull.Base != "main" || !strings.HasPrefix(pull.Head, pullRequestBranchPrefix+"app-") {
+		t.Errorf("got pull request from %s to %s", pull.Head, pull.Base)
+	}
+	if got, _ := git.File("org/app", pull.Head, "deploy/compose.yml"); got != strings.Replace(file, "15.4", "15.5", 1) {
+		t.Errorf("got bumped file %q", got)
+	}
+	if len(srv.Redeploys()) != 0 {
+		t.Errorf("git stack was redeployed %d times, want the merged pull request to be picked up", len(srv.Redeploys()))
+	}
+
+	var opened []notify.Event
+	for _, event := range rec.events {
+		if event.Type == notify.EventPullRequestOpened {
+			opened = append(opened, event)
+		}
+	}
+	if len(opened) != 1 || opened[0].URL != pull.URL {
+		t.Errorf("got pull request events %+v, want one linking to %s", opened, pull.URL)
+	}
+
+	// the open pull request isn't opened again or announced again, nor
+	// opened once it was closed
+	available := countEvents(rec, notify.EventUpdateAvailable)
+	result = resultFor(t, u.run(ctx, 0), notify.KindStack, "1")
+	if result.Reason != "pull request open: "+pull.URL {
+		t.Errorf("got reason %q on the second run, want the open pull request", result.Reason)
+	}
+	if got := countEvents(rec, notify.EventUpdateAvailable); got != available {
+		t.Errorf("got %d update available events while the pull request is open", got-available)
+	}
+	git.ClosePullRequests()
+	result = resultFor(t, u.run(ctx, 0), notify.KindStack, "1")
+	if result.Reason != "pull request closed: "+pull.URL {
+		t.Errorf("got reason %q after closing the pull request, want it left closed", result.Reason)
+	}
+	if len(git.PullRequests()) != 1 {
+		t.Errorf("got %d pull requests, want 1", len(git.PullRequests()))
+	}
+
+	// dry runs only report the newer tags
+	writes := git.Writes()
+	u.s.DryRun = true
+	result = resultFor(t, u.run(ctx, 0), notify.KindStack, "1")
+	if result.Reason != holdReasonDryRun || git.Writes() != writes {
+		t.Errorf("got reason %q and %d writes in a dry run", result.Reason, git.Writes()-writes)
+	}
+}
+
+func countEvents(rec *recorder, eventType notify.EventType) int {
+	count := 0
+	for _, t := range rec.types() {
+		if t == eventType {
+			count++
+		}
+	}
+	return count
+}
+
+func TestPullRequestMerged(t *testing.T) {
+	reg := registryfake.NewRegistry()
+	t.Cleanup(reg.Close)
+	for _, tag := range []string{"15.4", "15.5"} {
+		reg.Push("postgres", tag)
+	}
+	file := "services:\n  db:\n    image: " + reg.Host() + "/postgres:15.4\n"
+
+	git := forgefake.NewServer("secret")
+	t.Cleanup(git.Close)
+	git.AddRepository("org/app", "main", map[string]string{"compose.yml": file})
+	deployed := git.Head("org/app", "main")
+
+	srv := fake.NewServer(testAPIKey)
+	t.Cleanup(srv.Close)
+	srv.AddEndpoint(1, "docker", false)
+	for _, id := range []portainer.StackID{1, 2} {
+		stack := fake.Stack{
+			Stack: portainerapi.Stack{Stack: portainer.Stack{
+				ID:         id,
+				Name:       fmt.Sprintf("app%d", id),
+				EndpointID: 1,
+				Type:       portainer.DockerComposeStack,
+				GitConfig: &gittypes.RepoConfig{
+					URL:            git.URL + "/org/app.git",
+					ReferenceName:  "refs/heads/main",
+					ConfigFilePath: "compose.yml",
+					ConfigHash:     deployed,
+				},
+			}},
+			RemoteHead: deployed,
+		}
+		if id == 2 {
+			// portainer polls the repository of this one itself
+			stack.AutoUpdate = &portainer.AutoUpdateSettings{Interval: "5m"}
+		}
+		srv.AddStack(stack)
+	}
+
+	s := testConfig()
+	s.EnableServices = false
+	s.EnableContainers = false
+	s.GitStackMode = gitStackPullRequest
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	if u.bumper, _ = newTagBumper(registry.NewClient(), "minor", "", ""); u.bumper == nil {
+		t.Fatal("no tag bumper")
+	}
+	var err error
+	if u.proposer, err = newProposer(u.bumper, s.GitStackMode, "gitea", git.APIURL(forge.KindGitea), "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if u.credentials, err = parseGitCredentials(git.URL + "/org=robot:secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	summary := u.run(ctx, 0)
+	for _, id := range []string{"1", "2"} {
+		if result := resultFor(t, summary, notify.KindStack, id); result.Outcome != notify.OutcomeHeldBack {
+			t.Errorf("stack %s: got %s, want held back for the pull request", id, result.Outcome)
+		}
+	}
+
+	// merging the pull request leaves no newer tags and new commits
+	pull := git.PullRequests()[0]
+	merged, _ := git.File("org/app", pull.Head, "compose.yml")
+	head := git.Commit("org/app", "main", "compose.yml", merged)
+	srv.SetStackRemoteHead(1, head)
+	srv.SetStackRemoteHead(2, head)
+
+	summary = u.run(ctx, 0)
+	if result := resultFor(t, summary, notify.KindStack, "1"); result.Outcome != notify.OutcomeUpdated {
+		t.Errorf("got %s (%s) after the merge, want the stack redeployed", result.Outcome, result.Error)
+	}
+	if result := resultFor(t, summary, notify.KindStack, "2"); result.Outcome != notify.OutcomeUpToDate {
+		t.Errorf("got %s for the auto updated stack, want it left to portainer", result.Outcome)
+	}
+	redeploys := srv.Redeploys()
+	if len(redeploys) != 1 || redeploys[0].ID != "1" || !redeploys[0].Git {
+		t.Errorf("got redeploys %+v, want one git redeploy of stack 1", redeploys)
+	}
+}
+
+func TestPullRequestBranch(t *testing.T) {
+	stack := portainerapi.Stack{Stack: portainer.Stack{Name: "My App!"}}
+	a := pullRequestBranch(stack, map[string]string{"db": "postgres:15.5", "web": "nginx:1.26"})
+	b := pullRequestBranch(stack, map[string]string{"web": "nginx:1.26", "db": "postgres:15.5"})
+	c := pullRequestBranch(stack, map[string]string{"db": "postgres:15.6", "web": "nginx:1.26"})
+	if a != b {
+		t.Errorf("got branches %s and %s for the same images", a, b)
+	}
+	if a == c {
+		t.Errorf("got branch %s for different images", a)
+	}
+	if !strings.HasPrefix(a, "autoupdater/My-App-") {
+		t.Errorf("got branch %s", a)
+	}
+
+	for mode, ok := range map[string]bool{gitStackRedeploy: true, gitStackPullRequest: true, "merge": false} {
+		if _, err := newProposer(&tagBumper{}, mode, "", "", ""); (err == nil) != ok {
+			t.Errorf("mode %s: got error %v", mode, err)
+		}
+	}
+	if _, err := newProposer(&tagBumper{}, gitStackPullRequest, "", "https://git.lan/api/v1", ""); err == nil {
+		t.Error("want error for an api url without a provider")
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/compose"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/registry"
+)
+
+// ways of finding outdated images
+const (
+	imageCheckPortainer = "portainer"
+	imageCheckRegistry  = "registry"
+)
+
+// image statuses as reported by portainer
+const (
+	statusOutdated = "outdated"
+	statusUpdated  = "updated"
+	statusSkipped  = "skipped"
+)
+
+// how long the registry credentials listed by portainer are reused
+const registryCredentialsTTL = time.Minute
+
+// registryStatusClient answers image status requests by comparing the digests
+// of the running images with the digests their tags point to in the registry,
+// instead of asking portainer. Everything else goes to portainer.
+type registryStatusClient struct {
+	portainerapi.Client
+	registry *registry.Client
+}
+
+func newRegistryStatusClient(client portainerapi.Client, registries *registry.Client) *registryStatusClient {
+	return &registryStatusClient{Client: client, registry: registries}
+}
+
+// registryCredentials hands out the credentials of the registries configured
+// in portainer
+type registryCredentials struct {
+	client portainerapi.Client
+	ll     zerolog.Logger
+
+	mu         sync.Mutex
+	registries []portainer.Registry
+	fetched    time.Time
+}
+
+// newRegistryClient returns a registry client that authenticates with the
+// registries configured in portainer
+func newRegistryClient(client portainerapi.Client, insecureRegistries []string, ll zerolog.Logger) *registry.Client {
+	creds := &registryCredentials{client: client, ll: ll}
+	return registry.NewClient(
+		registry.WithCredentials(creds.credential),
+		registry.WithInsecureRegistries(insecureRegistries),
+	)
+}
+
+// imageCheck is an image to compare with the registry
+type imageCheck struct {
+	// image is the reference the image was deployed with
+	image string
+	// digests are the digests the running image is known by in its
+	// repository, empty for images that weren't pulled from a registry
+	digests []string
+}
+
+func (c *registryStatusClient) StackImageStatus(ctx context.Context, stackID int, ll zerolog.Logger) (string, error) {
+	stack, err := c.Stack(ctx, stackID, ll)
+	if err != nil {
+		return "", err
+	}
+
+	var checks []imageCheck
+	if stack.Type == portainer.DockerSwarmStack {
+		services, err := c.ServicesForStack(ctx, *stack, ll)
+		if err != nil {
+			return "", errors.Wrap(err, "getting stack services")
+		}
+		for _, service := range services {
+			if service.Spec.TaskTemplate.ContainerSpec != nil {
+				checks = append(checks, serviceImageCheck(service.Spec.TaskTemplate.ContainerSpec.Image))
+			}
+		}
+		return c.compare(ctx, checks, ll)
+	}
+
+	content, err := c.StackFileContent(ctx, stackID, ll)
+	if err != nil {
+		return "", errors.Wrap(err, "getting stack file contents")
+	}
+	images, err := compose.ServiceImages(content)
+	if err != nil {
+		return "", err
+	}
+	env := make(map[string]string, len(stack.Env))
+	for _, pair := range stack.Env {
+		env[pair.Name] = pair.Value
+	}
+
+	containers, err := c.ContainersForStack(ctx, *stack, ll)
+	if err != nil {
+		return "", errors.Wrap(err, "getting stack containers")
+	}
+
+	seen := make(map[string]bool)
+	for _, container := range containers {
+		service := container.Labels["com.docker.compose.service"]
+		if seen[service] {
+			continue
+		}
+		seen[service] = true
+
+		// the compose file holds the reference the container was created
+		// with, docker lists the image ID once the tag moved on
+		image := container.Image
+		if configured, ok := images[service]; ok {
+			image = compose.Interpolate(configured, env)
+		}
+
+		check, err := c.containerImageCheck(ctx, int(stack.EndpointID), image, container.ImageID, ll)
+		if err != nil {
+			return "", errors.Wrapf(err, "inspecting image of service %s", service)
+		}
+		checks = append(checks, check)
+	}
+	return c.compare(ctx, checks, ll)
+}
+
+func (c *registryStatusClient) ServiceImageStatus(ctx context.Context, serviceID string, endpointID int, ll zerolog.Logger) (string, error) {
+	services, err := c.Services(ctx, endpointID, ll)
+	if err != nil {
+		return "", errors.Wrap(err, "getting services")
+	}
+
+	for _, service := range services {
+		if service.ID != serviceID {
+			continue
+		}
+		if service.Spec.TaskTemplate.ContainerSpec == nil {
+			return statusSkipped, nil
+		}
+		return c.compare(ctx, []imageCheck{serviceImageCheck(service.Spec.TaskTemplate.ContainerSpec.Image)}, ll)
+	}
+	return "", errors.Errorf("service %s not found", serviceID)
+}
+
+func (c *registryStatusClient) ContainerImageStatus(ctx context.Context, containerID string, endpointID int, ll zerolog.Logger) (string, error) {
+	containers, err := c.Containers(ctx, endpointID, ll)
+	if err != nil {
+		return "", errors.Wrap(err, "getting containers")
+	}
+
+	for _, container := range containers {
+		if container.ID != containerID {
+			continue
+		}
+		check, err := c.containerImageCheck(ctx, endpointID, container.Image, container.ImageID, ll)
+		if err != nil {
+			return "", errors.Wrap(err, "inspecting image")
+		}
+		return c.compare(ctx, []imageCheck{check}, ll)
+	}
+	return "", errors.Errorf("container %s not found", containerID)
+}
+
+// serviceImageCheck reads the digest swarm pinned when deploying the service
+func serviceImageCheck(image string) imageCheck {
+	check := imageCheck{image: image}
+	if _, digest, ok := strings.Cut(image, "@"); ok {
+		check.digests = []string{digest}
+	}
+	return check
+}
+
+// containerImageCheck inspects the image of a container for the digests it
+// was pulled by
+func (c *registryStatusClient) containerImageCheck(ctx context.Context, endpointID int, image, imageID string, ll zerolog.Logger) (imageCheck, error) {
+	inspect, err := c.Image(ctx, endpointID, imageID, ll)
+	if err != nil {
+		return imageCheck{}, err
+	}
+
+	if strings.HasPrefix(image, "sha256:") {
+		if len(inspect.RepoTags) == 0 {
+			return imageCheck{image: image}, nil
+		}
+		image = inspect.RepoTags[0]
+	}
+
+	check := imageCheck{image: image}
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return check, nil
+	}
+	for _, rd := range inspect.RepoDigests {
+		repo, digest, ok := strings.Cut(rd, "@")
+		if !ok {
+			continue
+		}
+		if local, err := registry.ParseReference(repo); err == nil && local.Name() == ref.Name() {
+			check.digests = append(check.digests, digest)
+		}
+	}
+	return check, nil
+}
+
+// compare resolves the tag of every image and reports the stack, service or
+// container as outdated when any of them moved on. Images that are pinned to
+// a digest or weren't pulled from a registry are skipped.
+func (c *registryStatusClient) compare(ctx context.Context, checks []imageCheck, ll zerolog.Logger) (string, error) {
+	status := statusSkipped
+	for _, check := range checks {
+		ll := ll.With().Str("image", check.image).Logger()
+
+		ref, err := registry.ParseReference(check.image)
+		if err != nil {
+			ll.Debug().Msg("skipping image without a reference")
+			continue
+		}
+		if ref.Tag == "" {
+			ll.Debug().Msg("skipping image pinned to a digest")
+			continue
+		}
+		if len(check.digests) == 0 {
+			ll.Debug().Msg("skipping image that wasn't pulled from a registry")
+			continue
+		}
+
+		remote, err := c.registry.Digest(ctx, ref)
+		if err != nil {
+			return "", errors.Wrapf(err, "checking image %s", check.image)
+		}
+
+		if inSlice(check.digests, remote) {
+			ll.Debug().Str("digest", remote).Msg("image is up to date")
+			if status == statusSkipped {
+				status = statusUpdated
+			}
+			continue
+		}
+		ll.Info().
+			Strs("local_digests", check.digests).
+			Str("remote_digest", remote).
+			Msg("newer image in registry")
+		status = statusOutdated
+	}
+	return status, nil
+}
+
+// credential looks up the portainer registry for ref. Registries with a path
+// in their URL only match images below it, the most specific match wins.
+func (c *registryCredentials) credential(ctx context.Context, ref registry.Reference) (registry.Credential, error) {
+	name := ref.Name()
+	best, bestLength := registry.Credential{}, -1
+	for _, r := range c.portainerRegistries(ctx) {
+		// ecr registries hold aws keys that have to be exchanged for a
+		// registry password first, they are pulled from anonymously
+		if !r.Authentication || r.Type == portainer.EcrRegistry {
+			continue
+		}
+
+		prefix := registryPrefix(r)
+		if (name == prefix || strings.HasPrefix(name, prefix+"/")) && len(prefix) > bestLength {
+			best = registry.Credential{Username: r.Username, Password: r.Password}
+			bestLength = len(prefix)
+		}
+	}
+	return best, nil
+}
+
+// portainerRegistries returns the registries from portainer, listing them
+// fails for users that aren't administrators and images are then pulled from
+// anonymously
+func (c *registryCredentials) portainerRegistries(ctx context.Context) []portainer.Registry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fetched.IsZero() && time.Since(c.fetched) < registryCredentialsTTL {
+		return c.registries
+	}
+
+	registries, err := c.client.Registries(ctx, c.ll)
+	if err != nil {
+		c.ll.Warn().Err(err).Msg("error listing portainer registries, checking images without credentials")
+	}
+	c.registries = registries
+	c.fetched = time.Now()
+	return c.registries
+}
+
+// registryPrefix normalizes the URL of a portainer registry to the registry
+// and repository prefix of the images it serves
+func registryPrefix(r portainer.Registry) string {
+	prefix := r.URL
+	prefix = strings.TrimPrefix(prefix, "https://")
+	prefix = strings.TrimPrefix(prefix, "http://")
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	host, path, _ := strings.Cut(prefix, "/")
+	switch host = strings.ToLower(host); host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		host = registry.DockerHub
+	}
+	if r.Type == portainer.DockerHubRegistry {
+		host, path = registry.DockerHub, ""
+	}
+
+	if path == "" {
+		return host
+	}
+	return host + "/" + path
+}
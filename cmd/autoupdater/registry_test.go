@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+	"github.com/sjafferali/portainer-autoupdater/internal/registry"
+	registryfake "github.com/sjafferali/portainer-autoupdater/internal/registry/fake"
+)
+
+// newRegistryTestServer serves a compose stack, a service and a standalone
+// container whose images come from reg, which requires the credentials
+// portainer lists for it
+func newRegistryTestServer(t *testing.T, reg *registryfake.Registry) *fake.Server {
+	t.Helper()
+	srv := fake.NewServer(testAPIKey)
+	t.Cleanup(srv.Close)
+
+	host := reg.Host()
+	web := reg.Push("web", "1")
+	db := reg.Push("db", "16")
+	api := reg.Push("api", "2")
+	reg.Push("proxy", "3")
+
+	srv.AddRegistry(portainer.Registry{
+		ID:             1,
+		Type:           portainer.CustomRegistry,
+		URL:            host,
+		Authentication: true,
+		Username:       reg.Username,
+		Password:       reg.Password,
+	})
+	srv.AddEndpoint(1, "docker", false)
+	srv.AddEndpoint(2, "swarm", true)
+
+	srv.AddStack(fake.Stack{
+		Stack: portainerapi.Stack{Stack: portainer.Stack{
+			ID:         1,
+			Name:       "web",
+			EndpointID: 1,
+			Type:       portainer.DockerComposeStack,
+			Env:        []portainer.Pair{{Name: "TAG", Value: "1"}},
+		}},
+		File: "services:\n" +
+			"  web:\n    image: " + host + "/web:${TAG}\n" +
+			"  db:\n    image: " + host + "/db:16\n" +
+			"  cache:\n    image: " + host + "/cache@sha256:ccc\n",
+	})
+	for service, image := range map[string]string{
+		// docker lists the image ID once the tag moved on
+		"web":   "sha256:web1",
+		"db":    host + "/db:16",
+		"cache": host + "/cache@sha256:ccc",
+	} {
+		srv.AddContainer(fake.Container{
+			Container: dockertypes.Container{
+				ID:      service,
+				Image:   image,
+				ImageID: "sha256:" + service,
+				Labels: map[string]string{
+					"com.docker.compose.project": "web",
+					"com.docker.compose.service": service,
+				},
+			},
+			EndpointID: 1,
+		})
+	}
+	srv.AddImage(dockertypes.ImageInspect{ID: "sha256:web", RepoDigests: []string{host + "/web@" + web}})
+	srv.AddImage(dockertypes.ImageInspect{ID: "sha256:db", RepoDigests: []string{host + "/db@" + db}})
+	srv.AddImage(dockertypes.ImageInspect{ID: "sha256:cache", RepoDigests: []string{host + "/cache@sha256:ccc"}})
+
+	srv.AddContainer(fake.Container{
+		Container: dockertypes.Container{
+			ID:      "proxy",
+			Names:   []string{"/proxy"},
+			Image:   host + "/proxy:3",
+			ImageID: "sha256:proxy",
+		},
+		EndpointID: 1,
+	})
+	srv.AddImage(dockertypes.ImageInspect{ID: "sha256:proxy", RepoDigests: []string{host + "/proxy@sha256:stale"}})
+
+	srv.AddService(fake.Service{
+		Service: swarm.Service{
+			ID: "svc1",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{Name: "api"},
+				TaskTemplate: swarm.TaskSpec{
+					ContainerSpec: &swarm.ContainerSpec{Image: host + "/api:2@" + api},
+				},
+			},
+		},
+		EndpointID: 2,
+	})
+	return srv
+}
+
+func newRegistryTestClient(srv *fake.Server) *registryStatusClient {
+	client := portainerapi.NewPortainerAPIClient(testAPIKey, srv.URL, portainerapi.WithRetries(portainerapi.RetryPolicy{
+		Retries: 1,
+		Delay:   time.Millisecond,
+	}))
+	return newRegistryStatusClient(client, newRegistryClient(client, nil, zerolog.Nop()))
+}
+
+func TestRegistryImageCheck(t *testing.T) {
+	reg := registryfake.NewRegistry()
+	t.Cleanup(reg.Close)
+	reg.Auth = registryfake.AuthToken
+	reg.Username, reg.Password = "robot", "secret"
+
+	srv := newRegistryTestServer(t, reg)
+	c := newRegistryTestClient(srv)
+	ctx := context.Background()
+
+	for name, check := range map[string]struct {
+		status func() (string, error)
+		want   string
+	}{
+		"stack": {
+			status: func() (string, error) { return c.StackImageStatus(ctx, 1, zerolog.Nop()) },
+			want:   statusUpdated,
+		},
+		"service": {
+			status: func() (string, error) { return c.ServiceImageStatus(ctx, "svc1", 2, zerolog.Nop()) },
+			want:   statusUpdated,
+		},
+		"container": {
+			status: func() (string, error) { return c.ContainerImageStatus(ctx, "proxy", 1, zerolog.Nop()) },
+			want:   statusOutdated,
+		},
+	} {
+		status, err := check.status()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if status != check.want {
+			t.Errorf("%s: got status %s, want %s", name, status, check.want)
+		}
+	}
+
+	reg.Push("web", "1")
+	reg.Push("api", "2")
+	if status, err := c.StackImageStatus(ctx, 1, zerolog.Nop()); err != nil || status != statusOutdated {
+		t.Errorf("got stack status %s (%v) after pushing web:1, want %s", status, err, statusOutdated)
+	}
+	if status, err := c.ServiceImageStatus(ctx, "svc1", 2, zerolog.Nop()); err != nil || status != statusOutdated {
+		t.Errorf("got service status %s (%v) after pushing api:2, want %s", status, err, statusOutdated)
+	}
+
+	for _, r := range srv.Requests() {
+		if strings.HasSuffix(r.Path, "image_status") || strings.HasSuffix(r.Path, "images_status") {
+			t.Errorf("portainer was asked for the image status: %s %s", r.Method, r.Path)
+		}
+	}
+	for _, r := range reg.Requests() {
+		if strings.Contains(r.Path, "/cache/") {
+			t.Errorf("image pinned to a digest was checked: %s %s", r.Method, r.Path)
+		}
+	}
+}
+
+func TestRegistryImageCheckRun(t *testing.T) {
+	reg := registryfake.NewRegistry()
+	t.Cleanup(reg.Close)
+	srv := newRegistryTestServer(t, reg)
+	reg.Push("web", "1")
+
+	s := testConfig()
+	s.ImageCheck = imageCheckRegistry
+	s.EnableServices = false
+	s.EnableContainers = false
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	u.client = newRegistryTestClient(srv)
+
+	summary := u.run(context.Background(), 0)
+	result := resultFor(t, summary, "stack", "1")
+	if result.Outcome != notify.OutcomeUpdated || result.Status != statusOutdated {
+		t.Errorf("got %s with status %s, want the stack updated", result.Outcome, result.Status)
+	}
+	if len(srv.Redeploys()) != 1 {
+		t.Errorf("got %d redeploys, want 1", len(srv.Redeploys()))
+	}
+}
+
+func TestRegistryCredential(t *testing.T) {
+	srv := fake.NewServer(testAPIKey)
+	t.Cleanup(srv.Close)
+	for i, r := range []portainer.Registry{
+		{Type: portainer.DockerHubRegistry, URL: "docker.io", Username: "hub"},
+		{Type: portainer.CustomRegistry, URL: "https://ghcr.io/", Username: "ghcr"},
+		{Type: portainer.CustomRegistry, URL: "ghcr.io/org", Username: "org"},
+		{Type: portainer.CustomRegistry, URL: "registry.local:5000", Username: "anonymous"},
+		{Type: portainer.EcrRegistry, URL: "1234.dkr.ecr.eu-west-1.amazonaws.com", Username: "ecr"},
+	} {
+		r.ID = portainer.RegistryID(i + 1)
+		r.Authentication = r.Username != "anonymous"
+		srv.AddRegistry(r)
+	}
+	client := portainerapi.NewPortainerAPIClient(testAPIKey, srv.URL)
+	c := &registryCredentials{client: client, ll: zerolog.Nop()}
+
+	for image, want := range map[string]string{
+		"nginx":                                    "hub",
+		"grafana/grafana:10":                       "hub",
+		"ghcr.io/other/app":                        "ghcr",
+		"ghcr.io/org/app:1":                        "org",
+		"ghcr.io/organization/app":                 "ghcr",
+		"registry.local:5000/app":                  "",
+		"1234.dkr.ecr.eu-west-1.amazonaws.com/app": "",
+		"quay.io/org/app":                          "",
+	} {
+		ref, err := registry.ParseReference(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cred, err := c.credential(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("%s: %s", image, err)
+		}
+		if cred.Username != want {
+			t.Errorf("%s: got credential of %q, want %q", image, cred.Username, want)
+		}
+	}
+
+	var listed int
+	for _, r := range srv.Requests() {
+		if r.Path == "/api/registries" {
+			listed++
+		}
+	}
+	if listed != 1 {
+		t.Errorf("registries listed %d times, want them cached", listed)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/pkg/errors"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/compose"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+)
+
+// number of checks in a row a stack has to pass before it counts as healthy
+const healthyChecksRequired = 3
+
+var exitCodeRe = regexp.MustCompile(`^Exited \((\d+)\)`)
+
+// verifyConfig controls the health check after a stack update
+type verifyConfig struct {
+	enabled      bool
+	rollback     bool
+	timeout      time.Duration
+	pollInterval time.Duration
+}
+
+// stackSnapshot holds what is needed to redeploy a stack with the images it
+// ran before an update
+type stackSnapshot struct {
+	// content is the file without the pins of an earlier rollback
+	content string
+	images  map[string]string
+}
+
+// updateStackVerified updates the stack, deploying the bumped file when bump
+// is set, and, when enabled, waits for it to become healthy, rolling back to
+// the previous file with its images pinned if it doesn't
+func updateStackVerified(
+	ctx context.Context,
+	client portainerapi.Client,
+	notifier notify.Notifier,
+	verify verifyConfig,
+	stack portainerapi.Stack,
+	bump *tagBump,
+	result notify.Result,
+	ll zerolog.Logger,
+) error {
+	if !verify.enabled {
+		return deployStack(ctx, client, stack, bump, ll)
+	}
+
+	var snapshot *stackSnapshot
+	var snapshotErr error
+	if verify.rollback {
+		if stack.GitConfig != nil {
+			snapshotErr = errors.New("rollback isn't supported for git stacks")
+		} else if snapshot, snapshotErr = snapshotStack(ctx, client, stack, ll); snapshotErr != nil {
+			ll.Warn().Err(snapshotErr).Msg("error recording running images, rollback won't be possible")
+			snapshotErr = errors.Wrap(snapshotErr, "no previous images recorded")
+		}
+		if snapshot != nil && bump != nil {
+			// roll back to the tags the stack ran before they were bumped
+			snapshot.content = bump.before
+		}
+	}
+
+	if err := deployStack(ctx, client, stack, bump, ll); err != nil {
+		return err
+	}
+
+	ll.Debug().Dur("timeout", verify.timeout).Msg("waiting for stack to become healthy")
+	verifyErr := verifyStack(ctx, client, stack, verify, ll)
+	if verifyErr == nil {
+		ll.Info().Msg("stack healthy after update")
+		return nil
+	}
+	if ctx.Err() != nil {
+		// shutting down, the stack may still become healthy
+		return errors.Wrap(verifyErr, "interrupted while verifying the stack")
+	}
+	ll.Error().Err(verifyErr).Msg("stack unhealthy after update")
+
+	if !verify.rollback {
+		return errors.Wrap(verifyErr, "stack unhealthy after update")
+	}
+
+	rollbackErr := snapshotErr
+	if snapshot != nil {
+		rollbackErr = rollbackStack(ctx, client, stack, snapshot, ll)
+	}
+	rolledBack := "rolled back to previous images"
+	if rollbackErr == nil {
+		rolledBack = "rolled back, pinned " + describePins(snapshot.images) + " until the next update"
+	}
+
+	event := updateEvent(notify.EventUpdateRolledBack, result, false)
+	event.Error = fmt.Sprintf("%s; %s", verifyErr, rolledBack)
+	if rollbackErr != nil {
+		ll.Error().Err(rollbackErr).Msg("error rolling back stack")
+		event.Error = fmt.Sprintf("%s; rollback failed: %s", verifyErr, rollbackErr)
+		sendEvent(ctx, notifier, event, ll)
+		return errors.Errorf("stack unhealthy after update: %s; rollback failed: %s", verifyErr, rollbackErr)
+	}
+
+	ll.Info().Interface("pinned", snapshot.images).Msg("rolled back stack to previous images")
+	sendEvent(ctx, notifier, event, ll)
+	return errors.Wrap(verifyErr, "stack unhealthy after update, "+rolledBack)
+}
+
+// describePins lists the pinned images of the services
+func describePins(images map[string]string) string {
+	pins := make([]string, 0, len(images))
+	for _, service := range sortedKeys(images) {
+		pins = append(pins, service+" to "+images[service])
+	}
+	return strings.Join(pins, ", ")
+}
+
+// deployStack redeploys the stack with its file unchanged, or with the
+// bumped file pulling the newer images. Images pinned by a rollback are
+// restored to the tags they had.
+func deployStack(
+	ctx context.Context,
+	client portainerapi.Client,
+	stack portainerapi.Stack,
+	bump *tagBump,
+	ll zerolog.Logger,
+) error {
+	if bump == nil && stack.GitConfig == nil {
+		content, err := client.StackFileContent(ctx, int(stack.ID), ll)
+		if err != nil {
+			return errors.Wrap(err, "getting stack file contents")
+		}
+		unpinned, err := compose.UnpinImages(content)
+		if err != nil {
+			return err
+		}
+		if unpinned != content {
+			ll.Info().Msg("deploying stack with the images pinned by a rollback restored")
+			return client.UpdateStackFile(ctx, int(stack.ID), unpinned, true, ll)
+		}
+	}
+	if bump == nil {
+		if err := client.UpdateStack(ctx, int(stack.ID), ll); err != nil {
+			return err
+		}
+		if stack.GitConfig != nil {
+			logDeployedCommits(ctx, client, stack, ll)
+		}
+		return nil
+	}
+	ll.Info().Interface("images", bump.images).Msg("deploying stack with bumped tags")
+	return client.UpdateStackFile(ctx, int(stack.ID), bump.after, true, ll)
+}
+
+// snapshotStack records the digests of the images the stack is running
+func snapshotStack(
+	ctx context.Context,
+	client portainerapi.Client,
+	stack portainerapi.Stack,
+	ll zerolog.Logger,
+) (*stackSnapshot, error) {
+	if stack.GitConfig != nil {
+		return nil, errors.New("git stacks can't be rolled back")
+	}
+
+	content, err := client.StackFileContent(ctx, int(stack.ID), ll)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting stack file contents")
+	}
+	if content, err = compose.UnpinImages(content); err != nil {
+		return nil, err
+	}
+
+	fileImages, err := compose.ServiceImages(content)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &stackSnapshot{content: content, images: make(map[string]string)}
+	if stack.Type == portainer.DockerSwarmStack {
+		services, err := client.ServicesForStack(ctx, stack, ll)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting stack services")
+		}
+
+		for _, service := range services {
+			name := strings.TrimPrefix(service.Spec.Name, stack.Name+"_")
+			if _, ok := fileImages[name]; !ok || service.Spec.TaskTemplate.ContainerSpec == nil {
+				continue
+			}
+
+			// swarm resolves tags to digests when deploying
+			image := service.Spec.TaskTemplate.ContainerSpec.Image
+			if _, digest, ok := strings.Cut(image, "@"); ok {
+				snapshot.images[name] = compose.Repository(fileImages[name]) + "@" + digest
+			}
+		}
+		return snapshot, nil
+	}
+
+	containers, err := client.ContainersForStack(ctx, stack, ll)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting stack containers")
+	}
+
+	for _, container := range containers {
+		name := container.Labels["com.docker.compose.service"]
+		fileImage, ok := fileImages[name]
+		if !ok {
+			continue
+		}
+		if _, pinned := snapshot.images[name]; pinned {
+			continue
+		}
+
+		image, err := client.Image(ctx, int(stack.EndpointID), container.ImageID, ll)
+		if err != nil {
+			return nil, errors.Wrapf(err, "inspecting image of service %s", name)
+		}
+
+		if digest := repoDigest(image.RepoDigests, compose.Repository(fileImage)); digest != "" {
+			snapshot.images[name] = compose.Repository(fileImage) + "@" + digest
+		} else {
+			// locally built images have no digest, they are still present on the host
+			snapshot.images[name] = image.ID
+		}
+	}
+	return snapshot, nil
+}
+
+// repoDigest picks the digest belonging to repository, or any digest when
+// none matches since the same image may be known under several names
+func repoDigest(repoDigests []string, repository string) string {
+	short := repository[strings.LastIndex(repository, "/")+1:]
+
+	fallback := ""
+	for _, rd := range repoDigests {
+		repo, digest, ok := strings.Cut(rd, "@")
+		if !ok {
+			continue
+		}
+		if repo == repository || repo[strings.LastIndex(repo, "/")+1:] == short {
+			return digest
+		}
+		if fallback == "" {
+			fallback = digest
+		}
+	}
+	return fallback
+}
+
+// rollbackStack redeploys the stack with the recorded images pinned, the file
+// records the images they replace so the next update restores them
+func rollbackStack(
+	ctx context.Context,
+	client portainerapi.Client,
+	stack portainerapi.Stack,
+	snapshot *stackSnapshot,
+	ll zerolog.Logger,
+) error {
+	if len(snapshot.images) == 0 {
+		return errors.New("no previous images recorded")
+	}
+
+	content, err := compose.PinImages(snapshot.content, snapshot.images)
+	if err != nil {
+		return err
+	}
+
+	ll.Info().Interface("images", snapshot.images).Msg("rolling back stack")
+
+	// the previous images are still on the host, except on other swarm nodes
+	pullImage := stack.Type == portainer.DockerSwarmStack
+	return client.UpdateStackFile(ctx, int(stack.ID), content, pullImage, ll)
+}
+
+// stackPins returns the services of a stack whose image a rollback pinned,
+// mapped to the pinned image
+func stackPins(
+	ctx context.Context,
+	client portainerapi.Client,
+	stack portainerapi.Stack,
+	ll zerolog.Logger,
+) (map[string]string, error) {
+	if stack.GitConfig != nil {
+		return nil, nil
+	}
+
+	content, err := client.StackFileContent(ctx, int(stack.ID), ll)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting stack file contents")
+	}
+	pinned, err := compose.PinnedImages(content)
+	if err != nil || len(pinned) == 0 {
+		return nil, err
+	}
+	images, err := compose.ServiceImages(content)
+	if err != nil {
+		return nil, err
+	}
+
+	pins := make(map[string]string, len(pinned))
+	for service := range pinned {
+		pins[service] = images[service]
+	}
+	return pins, nil
+}
+
+// verifyStack polls the stack until it has been healthy for several checks in
+// a row, returning an error as soon as something fails or the timeout passes
+func verifyStack(
+	ctx context.Context,
+	client portainerapi.Client,
+	stack portainerapi.Stack,
+	verify verifyConfig,
+	ll zerolog.Logger,
+) error {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, verify.timeout)
+	defer cancel()
+
+	healthyChecks := 0
+	lastReason := "no health check completed"
+	for {
+		select {
+		case <-ctx.Done():
+			if parent.Err() != nil {
+				return parent.Err()
+			}
+			return errors.Errorf("not healthy within %s: %s", verify.timeout, lastReason)
+		case <-time.After(verify.pollInterval):
+		}
+
+		var healthy bool
+		var reason string
+		var err error
+		if stack.Type == portainer.DockerSwarmStack {
+			var services []swarm.Service
+			if services, err = client.ServicesForStack(ctx, stack, ll); err == nil {
+				healthy, reason, err = servicesHealth(services)
+			}
+		} else {
+			var containers []dockertypes.Container
+			if containers, err = client.ContainersForStack(ctx, stack, ll); err == nil {
+				healthy, reason, err = containersHealth(containers)
+			}
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			return err
+		}
+
+		if !healthy {
+			healthyChecks = 0
+			lastReason = reason
+			ll.Trace().Str("reason", reason).Msg("stack not healthy yet")
+			continue
+		}
+
+		healthyChecks++
+		if healthyChecks >= healthyChecksRequired {
+			return nil
+		}
+	}
+}
+
+// containersHealth reports whether all containers are up, a returned error
+// means the stack has failed
+func containersHealth(containers []dockertypes.Container) (bool, string, error) {
+	if len(containers) == 0 {
+		return false, "no containers found", nil
+	}
+
+	for _, c := range containers {
+		name := containerName(c)
+		switch c.State {
+		case "running":
+			if strings.Contains(c.Status, "(unhealthy)") {
+				return false, "", errors.Errorf("container %s is unhealthy", name)
+			}
+			if strings.Contains(c.Status, "(health: starting)") {
+				return false, fmt.Sprintf("container %s health check is starting", name), nil
+			}
+		case "restarting":
+			return false, "", errors.Errorf("container %s is restarting", name)
+		case "exited":
+			// one-off containers such as migrations are expected to exit cleanly
+			if m := exitCodeRe.FindStringSubmatch(c.Status); m != nil {
+				if code, _ := strconv.Atoi(m[1]); code == 0 {
+					continue
+				}
+			}
+			return false, "", errors.Errorf("container %s exited: %s", name, c.Status)
+		case "dead":
+			return false, "", errors.Errorf("container %s is dead", name)
+		default:
+			return false, fmt.Sprintf("container %s is %s", name, c.State), nil
+		}
+	}
+	return true, "", nil
+}
+
+// servicesHealth reports whether all services run their desired tasks, a
+// returned error means the stack has failed
+func servicesHealth(services []swarm.Service) (bool, string, error) {
+	if len(services) == 0 {
+		return false, "no services found", nil
+	}
+
+	for _, s := range services {
+		if s.UpdateStatus != nil {
+			switch s.UpdateStatus.State {
+			case swarm.UpdateStatePaused,
+				swarm.UpdateStateRollbackStarted,
+				swarm.UpdateStateRollbackPaused,
+				swarm.UpdateStateRollbackCompleted:
+				return false, "", errors.Errorf("service %s update %s: %s", s.Spec.Name, s.UpdateStatus.State, s.UpdateStatus.Message)
+			case swarm.UpdateStateUpdating:
+				return false, fmt.Sprintf("service %s is updating", s.Spec.Name), nil
+			}
+		}
+
+		if s.ServiceStatus == nil {
+			continue
+		}
+		if s.ServiceStatus.RunningTasks < s.ServiceStatus.DesiredTasks {
+			return false, fmt.Sprintf(
+				"service %s has %d of %d tasks running",
+				s.Spec.Name, s.ServiceStatus.RunningTasks, s.ServiceStatus.DesiredTasks,
+			), nil
+		}
+	}
+	return true, "", nil
+}
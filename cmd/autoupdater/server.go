@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/metrics"
+)
+
+// instancesHealth is the health of several instances, degraded when any
+// instance is
+type instancesHealth struct {
+	Status    string   `json:"status"`
+	Instances []health `json:"instances"`
+}
+
+// serve runs the http server for metrics, health checks and, when an api
+// token is set, the control api until ctx is done and open requests finished
+func serve(ctx context.Context, addr string, updaters []*updater, apiToken string, grace time.Duration, ll zerolog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if len(updaters) == 1 {
+			h := updaters[0].health()
+			code := http.StatusOK
+			if h.Status != healthOK {
+				code = http.StatusServiceUnavailable
+			}
+			writeJSON(w, code, h, ll)
+			return
+		}
+
+		h := instancesHealth{Status: healthOK}
+		code := http.StatusOK
+		for _, u := range updaters {
+			uh := u.health()
+			if uh.Status != healthOK {
+				h.Status = healthDegraded
+				code = http.StatusServiceUnavailable
+			}
+			h.Instances = append(h.Instances, uh)
+		}
+		writeJSON(w, code, h, ll)
+	})
+	if apiToken != "" {
+		registerAPI(ctx, mux, updaters, apiToken, ll)
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ll.Info().Str("addr", addr).Msg("starting http server")
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		if err != http.ErrServerClosed {
+			ll.Error().Err(err).Msg("http server failed")
+		}
+		return
+	case <-ctx.Done():
+	}
+
+	// manual updates through the api get the grace period to finish
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), grace)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		ll.Error().Err(err).Msg("error shutting down http server")
+	}
+}
@@ -1,27 +1,34 @@
-//nolint:all
 package main
 
 import (
 	"context"
 
 	"github.com/docker/docker/api/types/swarm"
+	"github.com/grab/async"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
 	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
 )
 
-func upgradeServices(
+func serviceTasks(
 	ctx context.Context,
 	client portainerapi.Client,
+	notifier notify.Notifier,
+	gate *updateGate,
 	dryRun bool,
 	excludedIDs, includedIDs []string,
 	excludedNames, includedNames []string,
+	optIn bool,
 	logger zerolog.Logger,
-) error {
+) ([]async.Task, []error) {
 	endpoints, err := client.Endpoints(ctx, logger)
 	if err != nil {
-		return err
+		return nil, []error{errors.Wrap(err, "error getting endpoints")}
 	}
 
+	tasks := make([]async.Task, 0)
+	var errs []error
 	for _, endpoint := range endpoints {
 		ll := logger.With().
 			Int("endpoint_id", int(endpoint.ID)).
@@ -41,83 +48,180 @@ func upgradeServices(
 
 		services, err := client.Services(ctx, int(endpoint.ID), ll)
 		if err != nil {
-			return err
+			ll.Error().Err(err).Msg("error getting services")
+			errs = append(errs, errors.Wrapf(err, "error getting services of endpoint %s", endpoint.Name))
+			continue
 		}
 
-		if err := processServiceList(
+		tasks = append(tasks, processServiceList(
 			ctx,
 			client,
+			notifier,
+			gate,
 			services,
 			excludedIDs, includedIDs,
 			excludedNames, includedNames,
+			optIn,
+			endpoint.Name,
 			int(endpoint.ID),
 			dryRun,
 			ll,
-		); err != nil {
-			return err
-		}
+		)...)
 	}
-	return err
+
+	logger.Info().Int("services_to_check", len(tasks)).Msg("services to check")
+	return tasks, errs
 }
 
 func processServiceList(
 	ctx context.Context,
 	client portainerapi.Client,
+	notifier notify.Notifier,
+	gate *updateGate,
 	services []swarm.Service,
 	excludedIDs, includedIDs []string,
 	excludedNames, includedNames []string,
+	optIn bool,
+	endpointName string,
 	endpointID int,
 	dryRun bool,
-	ll zerolog.Logger,
-) error {
+	logger zerolog.Logger,
+) []async.Task {
+	tasks := make([]async.Task, 0)
 	for _, service := range services {
-		ll = ll.With().
+		ll := logger.With().
 			Str("service_id", service.ID).
 			Str("service_name", service.Spec.Name).
 			Logger()
 
-		if includedIDs != nil && !inSlice(includedIDs, service.ID) {
-			ll.Trace().Msg("skipping since service ID is not included")
+		holdReason := ""
+		switch policy := servicePolicy(service, ll); policy {
+		case policySkip:
+			ll.Trace().Msg("skipping by service update policy")
 			continue
+		case policyNotify:
+			holdReason = holdReasonPolicyNotify
+		case policyUpdate:
+			ll.Trace().Msg("included by service update policy")
+		default:
+			if optIn {
+				ll.Trace().Msg("skipping since service has not opted in")
+				continue
+			}
+
+			if includedIDs != nil && !inSlice(includedIDs, service.ID) {
+				ll.Trace().Msg("skipping since service ID is not included")
+				continue
+			}
+
+			if includedNames != nil && !inSlice(includedNames, service.Spec.Name) {
+				ll.Trace().Msg("skipping since service name is not included")
+				continue
+			}
+
+			if excludedIDs != nil && inSlice(excludedIDs, service.ID) {
+				ll.Trace().Msg("skipping since service ID is excluded")
+				continue
+			}
+
+			if excludedNames != nil && inSlice(excludedNames, service.Spec.Name) {
+				ll.Trace().Msg("skipping since service name is excluded")
+				continue
+			}
 		}
 
-		if includedNames != nil && !inSlice(includedNames, service.Spec.Name) {
-			ll.Trace().Msg("skipping since service name is not included")
-			continue
+		target := notify.Target{
+			Kind:         notify.KindService,
+			ID:           service.ID,
+			Name:         service.Spec.Name,
+			EndpointID:   endpointID,
+			EndpointName: endpointName,
 		}
+		task := getTaskForService(client, notifier, gate, dryRun, holdReason, service.ID, target, ll)
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
 
-		if excludedIDs != nil && inSlice(excludedIDs, service.ID) {
-			ll.Trace().Msg("skipping since service ID is excluded")
-			continue
+func getTaskForService(
+	client portainerapi.Client,
+	notifier notify.Notifier,
+	gate *updateGate,
+	dryRun bool,
+	holdReason string,
+	serviceID string,
+	target notify.Target,
+	ll zerolog.Logger,
+) async.Task {
+	task := async.NewTask(func(ctx context.Context) (interface{}, error) {
+		result := notify.Result{Target: target, Outcome: notify.OutcomeUpToDate}
+		ll.Trace().Msg("checking service")
+		status, err := client.ServiceImageStatus(ctx, serviceID, target.EndpointID, ll)
+		if err != nil {
+			ll.Error().Err(err).Msg("error getting image status")
+			return failedResult(result, err), err
 		}
+		ll = ll.With().Str("image_status", status).Logger()
+		result.Status = status
 
-		if excludedNames != nil && inSlice(excludedNames, service.Spec.Name) {
-			ll.Trace().Msg("skipping since service ID is excluded")
-			continue
+		if status != statusOutdated {
+			ll.Debug().Msg("no update needed")
+			return result, nil
 		}
+		ll.Info().Msg("service requires update")
+		sendEvent(ctx, notifier, updateEvent(notify.EventUpdateAvailable, result, dryRun), ll)
 
-		status, err := client.ServiceImageStatus(ctx, service.ID, endpointID, ll)
-		if err != nil {
-			return err
+		if holdReason != "" {
+			ll.Info().Str("reason", holdReason).Msg("holding back update")
+			return heldBackResult(result, holdReason), nil
 		}
 
-		ll := ll.With().Str("image_status", status).Logger()
-
-		if status == "updated" {
-			ll.Trace().Msg("skipping service since no update needed")
-			continue
+		if dryRun {
+			return heldBackResult(result, holdReasonDryRun), nil
 		}
 
-		ll.Info().Msg("service requires update")
+		check := func(ctx context.Context) (string, error) {
+			return client.ServiceImageStatus(ctx, serviceID, target.EndpointID, ll)
+		}
+		update := func(ctx context.Context) error {
+			return client.UpdateService(ctx, serviceID, target.EndpointID, ll)
+		}
+		images := func(ctx context.Context) (map[string]string, error) {
+			return serviceImages(ctx, client, serviceID, target.EndpointID, ll)
+		}
 
-		if dryRun {
-			continue
+		if !gate.open() {
+			return gate.hold(result, check, update, images, ll), nil
+		}
+		if !gate.claim(target) {
+			ll.Info().Msg("update already in progress")
+			return heldBackResult(result, holdReasonInProgress), nil
 		}
+		defer gate.done(target)
+
+		return performUpdate(ctx, notifier, result, dryRun, update, images, ll)
+	})
+	return task
+}
 
-		ll.Info().Msg("updating service")
-		if err := client.UpdateService(ctx, service.ID, endpointID, ll); err != nil {
-			return err
+// serviceImages returns the image of a service, swarm pins it to a digest
+func serviceImages(
+	ctx context.Context,
+	client portainerapi.Client,
+	serviceID string,
+	endpointID int,
+	ll zerolog.Logger,
+) (map[string]string, error) {
+	services, err := client.Services(ctx, endpointID, ll)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting services")
+	}
+
+	for _, service := range services {
+		if service.ID != serviceID || service.Spec.TaskTemplate.ContainerSpec == nil {
+			continue
 		}
+		return map[string]string{service.Spec.Name: service.Spec.TaskTemplate.ContainerSpec.Image}, nil
 	}
-	return nil
+	return nil, errors.Errorf("service %s not found", serviceID)
 }
@@ -2,30 +2,46 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/grab/async"
 	"github.com/pkg/errors"
+	portainer "github.com/portainer/portainer/api"
 	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/compose"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
 	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
-	"time"
 )
 
-func upgradeStacks(
+func stackTasks(
 	ctx context.Context,
 	client portainerapi.Client,
+	notifier notify.Notifier,
+	gate *updateGate,
+	verify verifyConfig,
+	bumper *tagBumper,
+	proposer *proposer,
+	creds gitCredentials,
 	dryRun bool,
 	excludedIDs, includedIDs []int,
 	excludedNames, includedNames []string,
-	interval time.Duration,
+	checkExcluded bool,
+	optIn bool,
 	logger zerolog.Logger,
-) error {
+) ([]async.Task, []error) {
 
 	stacks, err := client.Stacks(ctx, logger)
 	if err != nil {
-		return errors.Wrap(err, "error getting stacks")
+		return nil, []error{errors.Wrap(err, "error getting stacks")}
 	}
 	logger.Info().Int("stacks_count", len(stacks)).Msg("found stacks")
 
+	endpointNames, err := getEndpointNames(ctx, client, logger)
+	if err != nil {
+		return nil, []error{err}
+	}
+
 	tasks := make([]async.Task, 0)
 	for _, i := range stacks {
 		stackID := int(i.ID)
@@ -35,78 +51,309 @@ func upgradeStacks(
 			Int("stack_id", stackID).
 			Logger()
 
-		if includedIDs != nil && !inSlice(includedIDs, stackID) {
-			ll.Trace().Msg("skipped since stack ID is not included")
-			continue
+		decision := selectStack(ctx, client, i, excludedIDs, includedIDs, excludedNames, includedNames, checkExcluded, optIn, ll)
+		if decision.policy != policyUnset {
+			ll = ll.With().Str("policy", string(decision.policy)).Logger()
 		}
+		ll.Trace().Msg(decision.rule)
 
-		if includedNames != nil && !inSlice(includedNames, i.Name) {
-			ll.Trace().Msg("skipped since stack name is not included")
-			continue
+		target := notify.Target{
+			Kind:         notify.KindStack,
+			ID:           strconv.Itoa(stackID),
+			Name:         i.Name,
+			EndpointID:   int(i.EndpointID),
+			EndpointName: endpointNames[int(i.EndpointID)],
 		}
-
-		if excludedIDs != nil && inSlice(excludedIDs, stackID) {
-			ll.Trace().Msg("skipped since stack id is excluded")
+		if decision.err != nil {
+			tasks = append(tasks, failedStackTask(target, decision.err))
 			continue
 		}
-
-		if excludedNames != nil && inSlice(excludedNames, i.Name) {
-			ll.Trace().Msg("skipped since stack name is excluded")
+		if decision.skip {
 			continue
 		}
-
-		task := getTaskForStack(ctx, client, dryRun, stackID, ll)
+		task := getTaskForStack(client, notifier, gate, verify, bumper, proposer, creds, dryRun, decision.holdReason, i, target, ll)
 		tasks = append(tasks, task)
 	}
 
 	logger.Info().Int("stacks_to_check", len(tasks)).Msg("stacks to check")
-	tasktracker := async.Spread(ctx, interval, tasks)
-	_, _ = tasktracker.Outcome() // Wait
+	return tasks, nil
+}
+
+// stackDecision is the outcome of the update policy and filters for a stack
+type stackDecision struct {
+	skip       bool
+	holdReason string
+	policy     updatePolicy
+	// rule describes which setting decided
+	rule string
+	// err is why the policy couldn't be read, the stack is skipped since
+	// it may have opted out
+	err error
+}
+
+// selectStack applies the stack update policy and the include and exclude
+// filters to a stack
+func selectStack(
+	ctx context.Context,
+	client portainerapi.Client,
+	stack portainerapi.Stack,
+	excludedIDs, includedIDs []int,
+	excludedNames, includedNames []string,
+	checkExcluded bool,
+	optIn bool,
+	ll zerolog.Logger,
+) stackDecision {
+	stackID := int(stack.ID)
+
+	policy, err := stackPolicy(ctx, client, stack, ll)
+	if err != nil {
+		ll.Error().Err(err).Msg("error reading stack update policy, skipping stack")
+		return stackDecision{
+			skip: true,
+			rule: "skipped since the stack update policy couldn't be read",
+			err:  errors.Wrap(err, "reading stack update policy"),
+		}
+	}
+
+	switch policy {
+	case policySkip:
+		return stackDecision{skip: true, policy: policy, rule: "skipped by stack update policy"}
+	case policyNotify:
+		return stackDecision{holdReason: holdReasonPolicyNotify, policy: policy, rule: "held back by stack update policy"}
+	case policyUpdate:
+		return stackDecision{policy: policy, rule: "included by stack update policy"}
+	}
 
-	// Make sure all tasks are done
-	for _, singletask := range tasks {
-		v, _ := singletask.Outcome()
-		fmt.Println(v)
+	if optIn {
+		return stackDecision{skip: true, rule: "skipped since stack has not opted in"}
 	}
-	return nil
+
+	if includedIDs != nil && !inSlice(includedIDs, stackID) {
+		return stackDecision{skip: true, rule: "skipped since stack ID is not included"}
+	}
+
+	if includedNames != nil && !inSlice(includedNames, stack.Name) {
+		return stackDecision{skip: true, rule: "skipped since stack name is not included"}
+	}
+
+	decision := stackDecision{rule: "included since no filter excludes it"}
+	switch {
+	case includedIDs != nil:
+		decision.rule = "included since stack ID is included"
+	case includedNames != nil:
+		decision.rule = "included since stack name is included"
+	}
+
+	if excludedIDs != nil && inSlice(excludedIDs, stackID) {
+		if !checkExcluded {
+			return stackDecision{skip: true, rule: "skipped since stack ID is excluded"}
+		}
+		decision.holdReason = "stack id is excluded"
+		decision.rule = "held back since stack ID is excluded"
+	}
+
+	if excludedNames != nil && inSlice(excludedNames, stack.Name) {
+		if !checkExcluded {
+			return stackDecision{skip: true, rule: "skipped since stack name is excluded"}
+		}
+		decision.holdReason = "stack name is excluded"
+		decision.rule = "held back since stack name is excluded"
+	}
+
+	return decision
+}
+
+// failedStackTask reports a stack that can't be checked as failed
+func failedStackTask(target notify.Target, err error) async.Task {
+	return async.NewTask(func(context.Context) (interface{}, error) {
+		return failedResult(notify.Result{Target: target}, err), err
+	})
 }
 
 func getTaskForStack(
-	ctx context.Context,
 	client portainerapi.Client,
+	notifier notify.Notifier,
+	gate *updateGate,
+	verify verifyConfig,
+	bumper *tagBumper,
+	proposer *proposer,
+	creds gitCredentials,
 	dryRun bool,
-	stackID int,
+	holdReason string,
+	stack portainerapi.Stack,
+	target notify.Target,
 	ll zerolog.Logger,
 ) async.Task {
-	task := async.NewTask(func(context.Context) (interface{}, error) {
-		updated := false
+	task := async.NewTask(func(ctx context.Context) (interface{}, error) {
+		result := notify.Result{Target: target, Outcome: notify.OutcomeUpToDate}
+		checkCommits := true
+		if stack.GitConfig != nil && proposer != nil {
+			proposed, err := proposeStack(ctx, proposer, notifier, dryRun, holdReason, stack, result, ll)
+			if err != nil || proposed.Outcome != notify.OutcomeUpToDate {
+				return proposed, err
+			}
+			// without newer tags the stack is redeployed like any other, which
+			// deploys merged pull requests, unless portainer's own auto
+			// update picks up new commits
+			checkCommits = !gitOpsEnabled(stack)
+		}
+
 		ll.Trace().Msg("checking stack")
-		status, err := client.StackImageStatus(ctx, stackID, ll)
+		status, bump, err := stackStatus(ctx, client, bumper, creds, checkCommits, stack, ll)
 		if err != nil {
 			ll.Error().Err(err).Msg("error getting image status")
-			return nil, err
+			return failedResult(result, err), err
 		}
 		ll = ll.With().Str("status", status).Logger()
+		result.Status = status
+
+		// only verified updates are rolled back, reading the file on every
+		// check isn't worth it otherwise unless the stack is about to update
+		if verify.enabled || status == statusOutdated {
+			pins, err := stackPins(ctx, client, stack, ll)
+			if err != nil {
+				ll.Warn().Err(err).Msg("error reading pinned images")
+			}
+			if len(pins) > 0 {
+				ll.Info().Interface("pinned", pins).Msg("stack is pinned to the images of a rollback until the next update")
+				result.Pinned = pins
+			}
+		}
 
-		if status != "outdated" {
+		if status != statusOutdated {
 			ll.Debug().Msg("no update needed")
-			return nil, err
+			return result, nil
 		}
 		ll.Info().Msg("stack needs update")
-		if !dryRun {
-			ll.Info().Msg("updating")
-			if err := client.UpdateStack(ctx, stackID, ll); err != nil {
-				ll.Error().Err(err).Msg("error updating stack")
-				return nil, err
+		sendEvent(ctx, notifier, updateEvent(notify.EventUpdateAvailable, result, dryRun), ll)
+
+		if holdReason != "" {
+			ll.Info().Str("reason", holdReason).Msg("holding back update")
+			return heldBackResult(result, holdReason), nil
+		}
+
+		if dryRun {
+			return heldBackResult(result, holdReasonDryRun), nil
+		}
+
+		// queued updates are checked again before they are performed, the
+		// bump found then is the one deployed
+		check := func(ctx context.Context) (string, error) {
+			if stack.GitConfig != nil {
+				// the stack may have been redeployed in the meantime
+				fresh, err := client.Stack(ctx, int(stack.ID), ll)
+				if err != nil {
+					return "", err
+				}
+				stack = *fresh
 			}
-			updated = true
+			status, queued, err := stackStatus(ctx, client, bumper, creds, checkCommits, stack, ll)
+			bump = queued
+			return status, err
+		}
+		update := func(ctx context.Context) error {
+			return updateStackVerified(ctx, client, notifier, verify, stack, bump, result, ll)
+		}
+		images := func(ctx context.Context) (map[string]string, error) {
+			return stackImages(ctx, client, stack, ll)
 		}
 
-		msg := fmt.Sprintf("stack %d not updated", stackID)
-		if updated {
-			msg = fmt.Sprintf("stack %d updated", stackID)
+		if !gate.open() {
+			return gate.hold(result, check, update, images, ll), nil
+		}
+		if !gate.claim(target) {
+			ll.Info().Msg("update already in progress")
+			return heldBackResult(result, holdReasonInProgress), nil
 		}
-		return msg, nil
+		defer gate.done(target)
+
+		return performUpdate(ctx, notifier, result, dryRun, update, images, ll)
 	})
 	return task
 }
+
+// stackStatus returns the image status of a stack and the newer tags its
+// file may be bumped to. A stack with newer tags is outdated, as is a git
+// stack whose branch has new commits when checkCommits is set.
+func stackStatus(
+	ctx context.Context,
+	client portainerapi.Client,
+	bumper *tagBumper,
+	creds gitCredentials,
+	checkCommits bool,
+	stack portainerapi.Stack,
+	ll zerolog.Logger,
+) (string, *tagBump, error) {
+	status, err := client.StackImageStatus(ctx, int(stack.ID), ll)
+	if err != nil {
+		return "", nil, err
+	}
+
+	bump, err := bumper.plan(ctx, client, stack, ll)
+	if err != nil {
+		return "", nil, err
+	}
+	if bump != nil {
+		status = statusOutdated
+	}
+
+	if status != statusOutdated && checkCommits && stack.GitConfig != nil {
+		outdated, err := newCommits(ctx, creds, stack, ll)
+		if err != nil {
+			ll.Warn().Err(err).Msg("error checking repository for new commits")
+		}
+		if outdated {
+			status = statusOutdated
+		}
+	}
+	return status, bump, nil
+}
+
+// stackImages returns the images the services of a stack run, including their
+// digests where known
+func stackImages(
+	ctx context.Context,
+	client portainerapi.Client,
+	stack portainerapi.Stack,
+	ll zerolog.Logger,
+) (map[string]string, error) {
+	images := make(map[string]string)
+	if stack.Type == portainer.DockerSwarmStack {
+		services, err := client.ServicesForStack(ctx, stack, ll)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting stack services")
+		}
+
+		for _, service := range services {
+			if service.Spec.TaskTemplate.ContainerSpec != nil {
+				name := strings.TrimPrefix(service.Spec.Name, stack.Name+"_")
+				images[name] = service.Spec.TaskTemplate.ContainerSpec.Image
+			}
+		}
+		return images, nil
+	}
+
+	containers, err := client.ContainersForStack(ctx, stack, ll)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting stack containers")
+	}
+
+	for _, container := range containers {
+		name := container.Labels["com.docker.compose.service"]
+		if _, ok := images[name]; ok || name == "" {
+			continue
+		}
+
+		image, err := client.Image(ctx, int(stack.EndpointID), container.ImageID, ll)
+		if err != nil {
+			return nil, errors.Wrapf(err, "inspecting image of service %s", name)
+		}
+
+		if digest := repoDigest(image.RepoDigests, compose.Repository(container.Image)); digest != "" {
+			images[name] = compose.Repository(container.Image) + "@" + digest
+		} else {
+			images[name] = image.ID
+		}
+	}
+	return images, nil
+}
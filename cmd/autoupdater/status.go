@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+)
+
+// targetStatus is the latest known state of a stack, service or container
+type targetStatus struct {
+	notify.Result
+	Checked time.Time `json:"checked"`
+}
+
+// statusStore keeps the latest result per target for the control api
+type statusStore struct {
+	mu       sync.RWMutex
+	statuses map[string]targetStatus
+	lastRun  *notify.Summary
+}
+
+func newStatusStore() *statusStore {
+	return &statusStore{statuses: make(map[string]targetStatus)}
+}
+
+func (s *statusStore) Notify(_ context.Context, event notify.Event) error {
+	if event.Type != notify.EventRunSummary || event.Summary == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range event.Summary.Results {
+		s.statuses[targetKey(r.Target)] = targetStatus{Result: r, Checked: event.Summary.Finished}
+	}
+	summary := *event.Summary
+	summary.Results = nil
+	s.lastRun = &summary
+	return nil
+}
+
+// record stores the result of a manual check or update
+func (s *statusStore) record(result notify.Result) {
+	if result.Kind == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[targetKey(result.Target)] = targetStatus{Result: result, Checked: time.Now()}
+}
+
+// list returns all known statuses ordered by kind, endpoint and name
+func (s *statusStore) list() []targetStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statuses := make([]targetStatus, 0, len(s.statuses))
+	for _, st := range s.statuses {
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.EndpointID != b.EndpointID {
+			return a.EndpointID < b.EndpointID
+		}
+		return a.Name < b.Name
+	})
+	return statuses
+}
+
+func (s *statusStore) last() *notify.Summary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastRun
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/grab/async"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+)
+
+// runTasks spreads the tasks over interval until stop is done, waits for all
+// started tasks and returns the results they produced and the errors of tasks
+// that didn't produce a result. Tasks run with ctx.
+func runTasks(stop, ctx context.Context, interval time.Duration, tasks []async.Task) ([]notify.Result, []error) {
+	results := make([]notify.Result, 0, len(tasks))
+	if len(tasks) == 0 {
+		return results, nil
+	}
+
+	// like async.Spread, but a stopped run doesn't sleep out the interval and
+	// tasks that never started are cancelled so they don't block below
+	sleep := interval / time.Duration(len(tasks))
+	for i, singletask := range tasks {
+		singletask.Run(ctx)
+		select {
+		case <-stop.Done():
+			async.CancelAll(tasks[i+1:])
+		case <-time.After(sleep):
+			continue
+		}
+		break
+	}
+
+	// Make sure all tasks are done
+	var errs []error
+	for _, singletask := range tasks {
+		v, err := singletask.Outcome()
+		if result, ok := v.(notify.Result); ok {
+			result.Duration = taskDuration(singletask)
+			results = append(results, result)
+			continue
+		}
+
+		// tasks of a stopped run are cancelled, that's not an error
+		if err != nil && stop.Err() == nil {
+			errs = append(errs, err)
+		}
+	}
+	return results, errs
+}
+
+// graceful returns a context that outlives ctx by grace, so work that
+// already started can finish after a shutdown was requested
+func graceful(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		select {
+		case <-work.Done():
+			return
+		case <-ctx.Done():
+		}
+
+		select {
+		case <-work.Done():
+		case <-time.After(grace):
+			cancel()
+		}
+	}()
+	return work, cancel
+}
+
+// detach returns a context with the values of ctx that is only cancelled
+// once shutdown is done, so work isn't cut short when the client that asked
+// for it goes away
+func detach(ctx, shutdown context.Context) (context.Context, context.CancelFunc) {
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(shutdown, cancel)
+	return work, func() {
+		stop()
+		cancel()
+	}
+}
+
+// taskDuration returns how long a finished task ran, the task interface
+// doesn't expose it but the implementation does
+func taskDuration(task async.Task) time.Duration {
+	if timed, ok := task.(interface{ Duration() time.Duration }); ok {
+		return timed.Duration()
+	}
+	return 0
+}
+
+const (
+	holdReasonDryRun     = "dry run"
+	holdReasonInProgress = "update already in progress"
+)
+
+func heldBackResult(result notify.Result, reason string) notify.Result {
+	result.Outcome = notify.OutcomeHeldBack
+	result.Reason = reason
+	return result
+}
+
+func failedResult(result notify.Result, err error) notify.Result {
+	result.Outcome = notify.OutcomeFailed
+	result.Error = err.Error()
+	return result
+}
+
+func updateEvent(eventType notify.EventType, result notify.Result, dryRun bool) notify.Event {
+	target := result.Target
+	event := notify.NewEvent(eventType, &target)
+	event.Status = result.Status
+	event.Error = result.Error
+	event.DryRun = dryRun
+	return event
+}
+
+func sendEvent(ctx context.Context, notifier notify.Notifier, event notify.Event, ll zerolog.Logger) {
+	if err := notifier.Notify(ctx, event); err != nil {
+		ll.Error().Err(err).Str("event", string(event.Type)).Msg("error sending notification")
+	}
+}
+
+type updateFunc func(ctx context.Context) error
+
+// imagesFunc returns the images a target runs, keyed by service
+type imagesFunc func(ctx context.Context) (map[string]string, error)
+
+// performUpdate runs update and sends the events around it, recording the
+// images before and after when images is set
+func performUpdate(
+	ctx context.Context,
+	notifier notify.Notifier,
+	result notify.Result,
+	dryRun bool,
+	update updateFunc,
+	images imagesFunc,
+	ll zerolog.Logger,
+) (notify.Result, error) {
+	ll.Info().Msg("updating")
+	sendEvent(ctx, notifier, updateEvent(notify.EventUpdateStarted, result, dryRun), ll)
+
+	details := &notify.Update{}
+	result.Update = details
+	if images != nil {
+		var err error
+		if details.ImagesBefore, err = images(ctx); err != nil {
+			ll.Warn().Err(err).Msg("error recording images before update")
+		}
+	}
+
+	start := time.Now()
+	err := update(ctx)
+	details.Duration = time.Since(start)
+
+	if images != nil {
+		var imagesErr error
+		if details.ImagesAfter, imagesErr = images(ctx); imagesErr != nil {
+			ll.Warn().Err(imagesErr).Msg("error recording images after update")
+		}
+	}
+
+	if err != nil {
+		ll.Error().Err(err).Msgf("error updating %s", result.Kind)
+		result = failedResult(result, err)
+		sendEvent(ctx, notifier, updateEvent(notify.EventUpdateFailed, result, dryRun), ll)
+		return result, err
+	}
+
+	result.Outcome = notify.OutcomeUpdated
+	result.Reason = ""
+	sendEvent(ctx, notifier, updateEvent(notify.EventUpdateSucceeded, result, dryRun), ll)
+	return result, nil
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grab/async"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/history"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/schedule"
+)
+
+// updater runs the checks on a schedule and can be paused, resumed or
+// triggered from the control api
+type updater struct {
+	// name of the portainer instance, empty unless several are managed
+	name     string
+	s        ConfigSpecification
+	client   portainerapi.Client
+	notifier notify.Notifier
+	gate     *updateGate
+	verify   verifyConfig
+	bumper   *tagBumper
+	proposer *proposer
+	// credentials are the git credentials supplied for git stacks
+	credentials gitCredentials
+	cron        *schedule.Cron
+	status      *statusStore
+	history     *history.Store
+	ll          zerolog.Logger
+
+	trigger chan struct{}
+	wake    chan struct{}
+
+	mu          sync.Mutex
+	paused      bool
+	cancelRun   context.CancelFunc
+	failures    int
+	lastError   string
+	lastSuccess time.Time
+}
+
+func newUpdater(
+	name string,
+	s ConfigSpecification,
+	client portainerapi.Client,
+	notifier notify.Notifier,
+	gate *updateGate,
+	verify verifyConfig,
+	bumper *tagBumper,
+	proposer *proposer,
+	credentials gitCredentials,
+	cron *schedule.Cron,
+	status *statusStore,
+	hist *history.Store,
+	ll zerolog.Logger,
+) *updater {
+	return &updater{
+		name:        name,
+		s:           s,
+		client:      client,
+		notifier:    notifier,
+		gate:        gate,
+		verify:      verify,
+		bumper:      bumper,
+		proposer:    proposer,
+		credentials: credentials,
+		cron:        cron,
+		status:      status,
+		history:     hist,
+		ll:          ll,
+		trigger:     make(chan struct{}, 1),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// loop runs checks until ctx is done
+func (u *updater) loop(ctx context.Context) {
+	var lastStart time.Time
+	for {
+		triggered, ok := u.wait(ctx, lastStart)
+		if !ok {
+			return
+		}
+
+		// triggered runs check everything right away instead of spreading it
+		interval := u.s.Interval
+		if triggered {
+			interval = 0
+		}
+
+		lastStart = time.Now()
+		u.run(ctx, interval)
+	}
+}
+
+// wait blocks until the next run is due and reports whether it was triggered
+func (u *updater) wait(ctx context.Context, lastStart time.Time) (bool, bool) {
+	for {
+		var timer <-chan time.Time
+		if !u.isPaused() {
+			next := u.nextRun(lastStart)
+			if u.cron != nil {
+				u.ll.Debug().Time("next_run", next).Str("schedule", u.cron.String()).Msg("waiting for next scheduled run")
+			}
+			timer = time.After(time.Until(next))
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, false
+		case <-u.trigger:
+			return true, true
+		case <-u.wake:
+			continue
+		case <-timer:
+			return false, true
+		}
+	}
+}
+
+func (u *updater) nextRun(lastStart time.Time) time.Time {
+	// runs spread their checks over the interval, this only waits when there
+	// was nothing to spread
+	next := lastStart.Add(u.s.Interval)
+	if u.cron != nil {
+		next = u.cron.Next(time.Now())
+	}
+
+	// retry sooner when portainer couldn't be reached
+	u.mu.Lock()
+	failures := u.failures
+	u.mu.Unlock()
+	if failures > 0 {
+		if retry := lastStart.Add(u.failedRunBackoff(failures)); retry.Before(next) {
+			return retry
+		}
+	}
+	return next
+}
+
+// run checks everything once, spreading the checks over interval. Once ctx is
+// done no more checks are started, the ones already running get the grace
+// period to finish.
+func (u *updater) run(ctx context.Context, interval time.Duration) notify.Summary {
+	// cancelling the run stops starting new checks, checks and updates that
+	// already started are allowed to finish
+	runCtx, cancel := context.WithCancel(ctx)
+	u.mu.Lock()
+	u.cancelRun = cancel
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.cancelRun = nil
+		u.mu.Unlock()
+		cancel()
+	}()
+
+	work, cancelWork := graceful(ctx, u.s.ShutdownGracePeriod)
+	defer cancelWork()
+
+	s := u.s
+	summary := notify.Summary{Started: time.Now(), DryRun: s.DryRun}
+	tasks := make([]async.Task, 0)
+	var errs []error
+
+	if s.EnableStacks {
+		stackTasks, stackErrs := stackTasks(
+			ctx,
+			u.client,
+			u.notifier,
+			u.gate,
+			u.verify,
+			u.bumper,
+			u.proposer,
+			u.credentials,
+			s.DryRun,
+			s.ExcludeStackIds,
+			s.IncludeStackIds,
+			s.ExcludeStackNames,
+			s.IncludeStackNames,
+			s.CheckExcludedStacks,
+			s.OptIn,
+			u.ll,
+		)
+		tasks = append(tasks, stackTasks...)
+		errs = append(errs, stackErrs...)
+	}
+
+	if s.EnableContainers {
+		containerTasks, containerErrs := containerTasks(
+			ctx,
+			u.client,
+			u.notifier,
+			u.gate,
+			s.DryRun,
+			s.ExcludeContainerIds,
+			s.IncludeContainerIds,
+			s.ExcludeContainerNames,
+			s.IncludeContainerNames,
+			s.OptIn,
+			u.ll,
+		)
+		tasks = append(tasks, containerTasks...)
+		errs = append(errs, containerErrs...)
+	}
+
+	if s.EnableServices {
+		serviceTasks, serviceErrs := serviceTasks(
+			ctx,
+			u.client,
+			u.notifier,
+			u.gate,
+			s.DryRun,
+			s.ExcludeServiceIds,
+			s.IncludeServiceIds,
+			s.ExcludeServiceNames,
+			s.IncludeServiceNames,
+			s.OptIn,
+			u.ll,
+		)
+		tasks = append(tasks, serviceTasks...)
+		errs = append(errs, serviceErrs...)
+	}
+
+	results, taskErrs := runTasks(runCtx, work, interval, tasks)
+	summary.Results = results
+	errs = append(errs, taskErrs...)
+	for _, err := range errs {
+		u.ll.Error().Err(err).Msg("error during run")
+		summary.Errors = append(summary.Errors, err.Error())
+	}
+
+	summary.Finished = time.Now()
+	u.ll.Info().
+		Int("checked", len(summary.Results)).
+		Int("updated", summary.Count(notify.OutcomeUpdated)).
+		Int("held_back", summary.Count(notify.OutcomeHeldBack)).
+		Int("failed", summary.Count(notify.OutcomeFailed)).
+		Int("errors", len(summary.Errors)).
+		Msg("run finished")
+	u.recordHealth(summary)
+
+	// the summary is sent even when shutting down
+	event := notify.NewEvent(notify.EventRunSummary, nil)
+	event.DryRun = s.DryRun
+	event.Summary = &summary
+	sendEvent(context.WithoutCancel(ctx), u.notifier, event, u.ll)
+	return summary
+}
+
+// health tells whether the updater can reach portainer
+type health struct {
+	Instance            string     `json:"instance,omitempty"`
+	Status              string     `json:"status"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+}
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+)
+
+// recordHealth counts runs in a row that couldn't check everything, single
+// failed updates don't make the updater degraded
+func (u *updater) recordHealth(summary notify.Summary) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(summary.Errors) == 0 {
+		u.failures = 0
+		u.lastError = ""
+		u.lastSuccess = summary.Finished
+		return
+	}
+
+	u.failures++
+	u.lastError = summary.Errors[0]
+	u.ll.Warn().Int("consecutive_failures", u.failures).Dur("retry_in", u.failedRunBackoff(u.failures)).Msg("run incomplete, retrying early")
+}
+
+func (u *updater) health() health {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	h := health{Instance: u.name, Status: healthOK, ConsecutiveFailures: u.failures, LastError: u.lastError}
+	if u.failures > 0 {
+		h.Status = healthDegraded
+	}
+	if !u.lastSuccess.IsZero() {
+		lastSuccess := u.lastSuccess
+		h.LastSuccess = &lastSuccess
+	}
+	return h
+}
+
+// failedRunBackoff returns how long to wait before retrying after failed runs
+// in a row, doubling up to the regular interval
+func (u *updater) failedRunBackoff(failures int) time.Duration {
+	d := u.s.FailedRunBackoff
+	for i := 1; i < failures && d < u.s.Interval; i++ {
+		d *= 2
+	}
+	if d > u.s.Interval {
+		d = u.s.Interval
+	}
+	return d
+}
+
+func (u *updater) isPaused() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.paused
+}
+
+// stopRun stops the current run from starting further checks
+func (u *updater) stopRun() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.cancelRun != nil {
+		u.cancelRun()
+	}
+}
+
+// triggerRun starts a run that checks everything right away
+func (u *updater) triggerRun() {
+	select {
+	case u.trigger <- struct{}{}:
+	default:
+	}
+	u.stopRun()
+}
+
+func (u *updater) pause() {
+	u.mu.Lock()
+	u.paused = true
+	u.mu.Unlock()
+	u.stopRun()
+	u.ll.Info().Msg("paused")
+}
+
+func (u *updater) resume() {
+	u.mu.Lock()
+	u.paused = false
+	u.mu.Unlock()
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+	u.ll.Info().Msg("resumed")
+}
+
+func (u *updater) stackTarget(ctx context.Context, stack portainerapi.Stack) notify.Target {
+	target := notify.Target{
+		Kind:       notify.KindStack,
+		ID:         strconv.Itoa(int(stack.ID)),
+		Name:       stack.Name,
+		EndpointID: int(stack.EndpointID),
+	}
+	if names, err := getEndpointNames(ctx, u.client, u.ll); err == nil {
+		target.EndpointName = names[target.EndpointID]
+	}
+	return target
+}
+
+// checkStack checks a single stack right away, honoring dry run, the
+// maintenance windows, the update policy and the filters
+func (u *updater) checkStack(ctx context.Context, stackID int) (notify.Result, error) {
+	stack, err := u.client.Stack(ctx, stackID, u.ll)
+	if err != nil {
+		return notify.Result{}, err
+	}
+
+	ll := u.ll.With().Str("name", stack.Name).Int("stack_id", stackID).Logger()
+	s := u.s
+	decision := selectStack(
+		ctx,
+		u.client,
+		*stack,
+		s.ExcludeStackIds,
+		s.IncludeStackIds,
+		s.ExcludeStackNames,
+		s.IncludeStackNames,
+		s.CheckExcludedStacks,
+		s.OptIn,
+		ll,
+	)
+	target := u.stackTarget(ctx, *stack)
+	if decision.err != nil {
+		result := failedResult(notify.Result{Target: target}, decision.err)
+		u.record(result)
+		return result, decision.err
+	}
+	if decision.skip {
+		ll.Info().Msg(decision.rule)
+		return heldBackResult(notify.Result{Target: target}, decision.rule), nil
+	}
+
+	task := getTaskForStack(u.client, u.notifier, u.gate, u.verify, u.bumper, u.proposer, u.credentials, s.DryRun, decision.holdReason, *stack, target, ll)
+	v, err := task.Run(ctx).Outcome()
+
+	result, _ := v.(notify.Result)
+	result.Duration = taskDuration(task)
+	u.record(result)
+	return result, err
+}
+
+// updateStack redeploys a stack right away, even in dry run or outside of
+// the maintenance windows. The update isn't cancelled with ctx, once started
+// it gets the grace period to finish when shutdown is done.
+func (u *updater) updateStack(ctx, shutdown context.Context, stackID int) (notify.Result, error) {
+	ctx, cancelDetached := detach(ctx, shutdown)
+	defer cancelDetached()
+	ctx, cancel := graceful(ctx, u.s.ShutdownGracePeriod)
+	defer cancel()
+
+	stack, err := u.client.Stack(ctx, stackID, u.ll)
+	if err != nil {
+		return notify.Result{}, err
+	}
+
+	ll := u.ll.With().Str("name", stack.Name).Int("stack_id", stackID).Logger()
+	result := notify.Result{Target: u.stackTarget(ctx, *stack)}
+	update := func(ctx context.Context) error {
+		bump, err := u.bumper.plan(ctx, u.client, *stack, ll)
+		if err != nil {
+			return err
+		}
+		return updateStackVerified(ctx, u.client, u.notifier, u.verify, *stack, bump, result, ll)
+	}
+	images := func(ctx context.Context) (map[string]string, error) {
+		return stackImages(ctx, u.client, *stack, ll)
+	}
+
+	ll.Info().Msg("manual update requested")
+	if !u.gate.claim(result.Target) {
+		ll.Info().Msg("update already in progress")
+		return heldBackResult(result, holdReasonInProgress), nil
+	}
+	result, err = performUpdate(ctx, u.notifier, result, false, update, images, ll)
+	u.gate.done(result.Target)
+	u.record(result)
+	return result, err
+}
+
+// record keeps the result of a manual check or update, results of runs are
+// recorded through the notifier
+func (u *updater) record(result notify.Result) {
+	result.Instance = u.name
+	u.status.record(result)
+	if u.history == nil || result.Kind == "" {
+		return
+	}
+	if err := u.history.Add(time.Now(), result); err != nil {
+		u.ll.Error().Err(err).Msg("error recording history")
+	}
+}
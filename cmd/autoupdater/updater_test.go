@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	portainer "github.com/portainer/portainer/api"
+	gittypes "github.com/portainer/portainer/api/git/types"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+)
+
+const testAPIKey = "test-key"
+
+// recorder keeps the events sent during a test
+type recorder struct {
+	mu     sync.Mutex
+	events []notify.Event
+}
+
+func (r *recorder) Notify(_ context.Context, event notify.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *recorder) types() []notify.EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := make([]notify.EventType, 0, len(r.events))
+	for _, event := range r.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// testConfig checks stacks, services and containers and updates right away
+func testConfig() ConfigSpecification {
+	return ConfigSpecification{
+		ImageCheck:          imageCheckPortainer,
+		GitStackMode:        gitStackRedeploy,
+		Interval:            time.Minute,
+		EnableStacks:        true,
+		EnableServices:      true,
+		EnableContainers:    true,
+		FailedRunBackoff:    time.Second * 10,
+		ShutdownGracePeriod: time.Second * 5,
+	}
+}
+
+func newTestUpdater(t *testing.T, srv *fake.Server, s ConfigSpecification, verify verifyConfig) (*updater, *recorder) {
+	t.Helper()
+	client := portainerapi.NewPortainerAPIClient(testAPIKey, srv.URL, portainerapi.WithRetries(portainerapi.RetryPolicy{
+		Retries: 1,
+		Delay:   time.Millisecond,
+	}))
+	rec := &recorder{}
+	status := newStatusStore()
+	notifier := notify.Multi(rec, status)
+	return newUpdater("", s, client, notifier, nil, verify, nil, nil, nil, nil, status, nil, zerolog.Nop()), rec
+}
+
+// newTestServer serves a compose stack, a standalone container on a docker
+// endpoint and a service on a swarm endpoint, all up to date
+func newTestServer(t *testing.T) *fake.Server {
+	t.Helper()
+	srv := fake.NewServer(testAPIKey)
+	t.Cleanup(srv.Close)
+
+	srv.AddEndpoint(1, "docker", false)
+	srv.AddEndpoint(2, "swarm", true)
+	srv.AddStack(fake.Stack{
+		Stack: portainerapi.Stack{Stack: portainer.Stack{
+			ID:         1,
+			Name:       "web",
+			EndpointID: 1,
+			Type:       portainer.DockerComposeStack,
+		}},
+		File: "services:\n  web:\n    image: nginx:1.25\n",
+	})
+	srv.AddContainer(fake.Container{
+		Container: dockertypes.Container{
+			ID:      "c0ffee",
+			Names:   []string{"/web-web-1"},
+			Image:   "nginx:1.25",
+			ImageID: "sha256:old",
+			State:   "running",
+			Status:  "Up 2 hours",
+			Labels: map[string]string{
+				"com.docker.compose.project": "web",
+				"com.docker.compose.service": "web",
+			},
+		},
+		EndpointID: 1,
+	})
+	srv.AddContainer(fake.Container{
+		Container: dockertypes.Container{
+			ID:    "beef",
+			Names: []string{"/proxy"},
+			Image: "traefik:3",
+			State: "running",
+		},
+		EndpointID: 1,
+	})
+	srv.AddService(fake.Service{
+		Service: swarm.Service{
+			ID: "svc1",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{Name: "api"},
+				TaskTemplate: swarm.TaskSpec{
+					ContainerSpec: &swarm.ContainerSpec{Image: "api:1@sha256:aaa"},
+				},
+			},
+		},
+		EndpointID: 2,
+	})
+	srv.AddImage(dockertypes.ImageInspect{
+		ID:          "sha256:old",
+		RepoDigests: []string{"nginx@sha256:111"},
+	})
+	return srv
+}
+
+func resultFor(t *testing.T, summary notify.Summary, kind, id string) notify.Result {
+	t.Helper()
+	for _, result := range summary.Results {
+		if result.Kind == kind && result.ID == id {
+			return result
+		}
+	}
+	t.Fatalf("no result for %s %s in %+v", kind, id, summary.Results)
+	return notify.Result{}
+}
+
+func TestRunUpToDate(t *testing.T) {
+	srv := newTestServer(t)
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+
+	summary := u.run(context.Background(), 0)
+	if len(summary.Results) != 3 {
+		t.Fatalf("got %d results, want 3: %+v", len(summary.Results), summary.Results)
+	}
+	if got := summary.Count(notify.OutcomeUpToDate); got != 3 {
+		t.Errorf("got %d up to date, want 3", got)
+	}
+	if len(srv.Redeploys()) != 0 {
+		t.Errorf("nothing should be redeployed: %+v", srv.Redeploys())
+	}
+	if summary.Failed() {
+		t.Errorf("run should not fail: %v", summary.Errors)
+	}
+}
+
+func TestRunUpdatesOutdated(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	srv.SetContainerImageStatus("beef", fake.StatusOutdated)
+	srv.SetServiceImageStatus("svc1", fake.StatusOutdated)
+	u, rec := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+
+	summary := u.run(context.Background(), 0)
+	if got := summary.Count(notify.OutcomeUpdated); got != 3 {
+		t.Fatalf("got %d updated, want 3: %+v", got, summary.Results)
+	}
+
+	kinds := make(map[string]string)
+	for _, r := range srv.Redeploys() {
+		kinds[r.Kind] = r.ID
+	}
+	want := map[string]string{fake.KindStack: "1", fake.KindContainer: "beef", fake.KindService: "svc1"}
+	for kind, id := range want {
+		if kinds[kind] != id {
+			t.Errorf("want %s %s redeployed, got %+v", kind, id, srv.Redeploys())
+		}
+	}
+
+	stack := resultFor(t, summary, notify.KindStack, "1")
+	if stack.Update == nil || stack.Update.ImagesBefore["web"] != "nginx@sha256:111" {
+		t.Errorf("stack images not recorded: %+v", stack.Update)
+	}
+
+	succeeded := 0
+	for _, eventType := range rec.types() {
+		if eventType == notify.EventUpdateSucceeded {
+			succeeded++
+		}
+	}
+	if succeeded != 3 {
+		t.Errorf("got %d update succeeded events, want 3", succeeded)
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	s := testConfig()
+	s.DryRun = true
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+
+	summary := u.run(context.Background(), 0)
+	stack := resultFor(t, summary, notify.KindStack, "1")
+	if stack.Outcome != notify.OutcomeHeldBack || stack.Reason != holdReasonDryRun {
+		t.Errorf("want stack held back by dry run, got %+v", stack)
+	}
+	if len(srv.Redeploys()) != 0 {
+		t.Errorf("dry run must not redeploy: %+v", srv.Redeploys())
+	}
+}
+
+func TestRunFilters(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	srv.SetContainerImageStatus("beef", fake.StatusOutdated)
+
+	s := testConfig()
+	s.ExcludeStackNames = []string{"web"}
+	s.ExcludeContainerNames = []string{"proxy"}
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+
+	summary := u.run(context.Background(), 0)
+	if len(summary.Results) != 1 || summary.Results[0].Kind != notify.KindService {
+		t.Errorf("want only the service checked, got %+v", summary.Results)
+	}
+
+	s.CheckExcludedStacks = true
+	u, _ = newTestUpdater(t, srv, s, verifyConfig{})
+	summary = u.run(context.Background(), 0)
+	stack := resultFor(t, summary, notify.KindStack, "1")
+	if stack.Outcome != notify.OutcomeHeldBack {
+		t.Errorf("want excluded stack held back, got %+v", stack)
+	}
+	if len(srv.Redeploys()) != 0 {
+		t.Errorf("excluded targets must not be redeployed: %+v", srv.Redeploys())
+	}
+}
+
+func TestRunStackPolicy(t *testing.T) {
+	srv := newTestServer(t)
+	srv.AddStack(fake.Stack{
+		Stack: portainerapi.Stack{Stack: portainer.Stack{
+			ID:         2,
+			Name:       "db",
+			EndpointID: 1,
+			Type:       portainer.DockerComposeStack,
+			Env:        []portainer.Pair{{Name: envPolicy, Value: string(policyNotify)}},
+		}},
+		ImageStatus: fake.StatusOutdated,
+	})
+
+	s := testConfig()
+	s.OptIn = true
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+
+	summary := u.run(context.Background(), 0)
+	if len(summary.Results) != 1 {
+		t.Fatalf("want only the stack that opted in, got %+v", summary.Results)
+	}
+	stack := resultFor(t, summary, notify.KindStack, "2")
+	if stack.Outcome != notify.OutcomeHeldBack || stack.Reason != holdReasonPolicyNotify {
+		t.Errorf("want stack held back by policy, got %+v", stack)
+	}
+}
+
+func TestRunStackPolicyUnreadable(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	// the policy labels of the stack containers can't be read
+	srv.Inject(fake.Fault{Path: "/api/endpoints/*/docker/containers/json", Status: http.StatusInternalServerError})
+
+	s := testConfig()
+	s.EnableServices = false
+	s.EnableContainers = false
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+
+	summary := u.run(context.Background(), 0)
+	stack := resultFor(t, summary, notify.KindStack, "1")
+	if stack.Outcome != notify.OutcomeFailed || !strings.Contains(stack.Error, "update policy") {
+		t.Errorf("want stack failed for its unreadable policy, got %+v", stack)
+	}
+	if len(srv.Redeploys()) != 0 {
+		t.Errorf("stack that may have opted out was redeployed %d times", len(srv.Redeploys()))
+	}
+}
+
+func TestRunCheckFailure(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Inject(fake.Fault{Path: "/api/stacks/1/images_status", Status: http.StatusInternalServerError})
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+
+	summary := u.run(context.Background(), 0)
+	stack := resultFor(t, summary, notify.KindStack, "1")
+	if stack.Outcome != notify.OutcomeFailed || stack.Error == "" {
+		t.Errorf("want failed stack check, got %+v", stack)
+	}
+	if !summary.Failed() {
+		t.Error("run with a failed check should fail")
+	}
+}
+
+func TestRunUpdateFailure(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetServiceImageStatus("svc1", fake.StatusOutdated)
+	srv.Inject(fake.Fault{Method: http.MethodPut, Path: "/api/endpoints/*/forceupdateservice", Status: http.StatusBadGateway})
+	u, rec := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+
+	summary := u.run(context.Background(), 0)
+	service := resultFor(t, summary, notify.KindService, "svc1")
+	if service.Outcome != notify.OutcomeFailed {
+		t.Errorf("want failed service update, got %+v", service)
+	}
+
+	failed := false
+	for _, eventType := range rec.types() {
+		failed = failed || eventType == notify.EventUpdateFailed
+	}
+	if !failed {
+		t.Errorf("want update failed event, got %v", rec.types())
+	}
+}
+
+func TestRunOutage(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Inject(fake.Fault{Status: http.StatusServiceUnavailable})
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+
+	summary := u.run(context.Background(), 0)
+	if len(summary.Errors) == 0 {
+		t.Fatal("want run errors while portainer is down")
+	}
+	if h := u.health(); h.Status != healthDegraded || h.ConsecutiveFailures != 1 {
+		t.Errorf("want degraded health after outage, got %+v", h)
+	}
+
+	start := time.Now()
+	if next := u.nextRun(start); next.After(start.Add(u.s.FailedRunBackoff)) {
+		t.Errorf("next run at %s, want a retry within the backoff", next)
+	}
+
+	srv.ClearFaults()
+	summary = u.run(context.Background(), 0)
+	if summary.Failed() {
+		t.Fatalf("run should recover: %v", summary.Errors)
+	}
+	if h := u.health(); h.Status != healthOK || h.ConsecutiveFailures != 0 {
+		t.Errorf("want ok health after recovery, got %+v", h)
+	}
+}
+
+func TestRunTruncatedResponse(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Inject(fake.Fault{Path: "/api/stacks", Truncate: true})
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+
+	summary := u.run(context.Background(), 0)
+	if len(summary.Errors) == 0 {
+		t.Fatal("want a run error for the truncated stack list")
+	}
+
+	// the other kinds are still checked
+	resultFor(t, summary, notify.KindService, "svc1")
+	resultFor(t, summary, notify.KindContainer, "beef")
+}
+
+func TestRunShutdown(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Inject(fake.Fault{Path: "/api/docker/*/containers/*/image_status", Latency: time.Second})
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+
+	// a long interval spreads the checks, a shutdown must not sleep it out
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+
+	start := time.Now()
+	summary := u.run(ctx, time.Hour)
+	if elapsed := time.Since(start); elapsed > time.Second*3 {
+		t.Errorf("run took %s after shutdown", elapsed)
+	}
+	if len(summary.Results) == 0 {
+		t.Error("checks that started before the shutdown should finish")
+	}
+}
+
+func TestUpdateStackRollback(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	srv.AddContainer(fake.Container{
+		Container: dockertypes.Container{
+			ID:      "dead",
+			Names:   []string{"/web-worker-1"},
+			Image:   "nginx:1.25",
+			ImageID: "sha256:old",
+			State:   "restarting",
+			Labels: map[string]string{
+				"com.docker.compose.project": "web",
+				"com.docker.compose.service": "worker",
+			},
+		},
+		EndpointID: 1,
+	})
+
+	s := testConfig()
+	s.EnableContainers = false
+	s.EnableServices = false
+	verify := verifyConfig{
+		enabled:      true,
+		rollback:     true,
+		timeout:      time.Second,
+		pollInterval: time.Millisecond * 10,
+	}
+	u, rec := newTestUpdater(t, srv, s, verify)
+
+	summary := u.run(context.Background(), 0)
+	stack := resultFor(t, summary, notify.KindStack, "1")
+	if stack.Outcome != notify.OutcomeFailed {
+		t.Errorf("want failed update for unhealthy stack, got %+v", stack)
+	}
+
+	redeploys := srv.Redeploys()
+	if len(redeploys) != 2 {
+		t.Fatalf("want update and rollback redeploys, got %d", len(redeploys))
+	}
+	want := "services:\n  web:\n    # autoupdater: pinned by rollback, was nginx:1.25\n    image: nginx@sha256:111\n"
+	if srv.StackFile(1) != want {
+		t.Errorf("got stack file %q after rollback, want %q", srv.StackFile(1), want)
+	}
+	if !strings.Contains(stack.Error, "pinned web to nginx@sha256:111") {
+		t.Errorf("want pin in the error, got %q", stack.Error)
+	}
+
+	rolledBack := false
+	for _, eventType := range rec.types() {
+		rolledBack = rolledBack || eventType == notify.EventUpdateRolledBack
+	}
+	if !rolledBack {
+		t.Errorf("want rolled back event, got %v", rec.types())
+	}
+
+	// the pin shows up in later checks and is undone by the next update
+	summary = u.run(context.Background(), 0)
+	stack = resultFor(t, summary, notify.KindStack, "1")
+	if stack.Pinned["web"] != "nginx@sha256:111" {
+		t.Errorf("want pinned image in the result, got %+v", stack)
+	}
+
+	u.verify = verifyConfig{}
+	ctx := context.Background()
+	if _, err := u.updateStack(ctx, ctx, 1); err != nil {
+		t.Fatalf("updating stack: %s", err)
+	}
+	if want := "services:\n  web:\n    image: nginx:1.25\n"; srv.StackFile(1) != want {
+		t.Errorf("got stack file %q after update, want %q", srv.StackFile(1), want)
+	}
+}
+
+func TestUpdateStackRollbackGit(t *testing.T) {
+	srv := fake.NewServer(testAPIKey)
+	t.Cleanup(srv.Close)
+	srv.AddEndpoint(1, "docker", false)
+	srv.AddStack(fake.Stack{
+		Stack: portainerapi.Stack{Stack: portainer.Stack{
+			ID:         1,
+			Name:       "app",
+			EndpointID: 1,
+			Type:       portainer.DockerComposeStack,
+			GitConfig: &gittypes.RepoConfig{
+				URL:            "https://git.example.com/org/app.git",
+				ReferenceName:  "refs/heads/main",
+				ConfigFilePath: "compose.yml",
+			},
+		}},
+	})
+	srv.AddContainer(fake.Container{
+		Container: dockertypes.Container{
+			ID:    "dead",
+			Names: []string{"/app-web-1"},
+			Image: "nginx:1.25",
+			State: "restarting",
+			Labels: map[string]string{
+				"com.docker.compose.project": "app",
+				"com.docker.compose.service": "web",
+			},
+		},
+		EndpointID: 1,
+	})
+
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{
+		enabled:      true,
+		rollback:     true,
+		timeout:      time.Second,
+		pollInterval: time.Millisecond * 10,
+	})
+	ctx := context.Background()
+	result, err := u.updateStack(ctx, ctx, 1)
+	if err == nil || result.Outcome != notify.OutcomeFailed {
+		t.Fatalf("want failed update for unhealthy stack, got %+v (%v)", result, err)
+	}
+	if !strings.Contains(result.Error, "rollback isn't supported for git stacks") {
+		t.Errorf("want rollback of git stacks reported as unsupported, got %q", result.Error)
+	}
+	if len(srv.Redeploys()) != 1 {
+		t.Errorf("got %d redeploys, want only the update", len(srv.Redeploys()))
+	}
+}
+
+func TestStackPinsRead(t *testing.T) {
+	fileReads := func(srv *fake.Server) int {
+		n := 0
+		for _, r := range srv.Requests() {
+			if r.Method == http.MethodGet && r.Path == "/api/stacks/1/file" {
+				n++
+			}
+		}
+		return n
+	}
+
+	s := testConfig()
+	s.EnableContainers = false
+	s.EnableServices = false
+	ctx := context.Background()
+
+	// up to date without verification, only rollbacks pin images
+	srv := newTestServer(t)
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	u.run(ctx, 0)
+	if n := fileReads(srv); n != 0 {
+		t.Errorf("got %d stack file reads checking an up to date stack, want none", n)
+	}
+
+	u.verify = verifyConfig{enabled: true, timeout: time.Second, pollInterval: time.Millisecond * 10}
+	u.run(ctx, 0)
+	if n := fileReads(srv); n != 1 {
+		t.Errorf("got %d stack file reads with verification enabled, want 1", n)
+	}
+
+	// about to update, the pins are reported before they're undone
+	srv = newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	u, _ = newTestUpdater(t, srv, s, verifyConfig{})
+	u.run(ctx, 0)
+	if n := fileReads(srv); n == 0 {
+		t.Error("want the stack file read before updating")
+	}
+}
+
+func TestCheckAndUpdateStack(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	s := testConfig()
+	s.DryRun = true
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	ctx := context.Background()
+
+	// checks honor dry run, manual updates don't
+	result, err := u.checkStack(ctx, 1)
+	if err != nil {
+		t.Fatalf("checking stack: %s", err)
+	}
+	if result.Status != fake.StatusOutdated || result.Outcome != notify.OutcomeHeldBack || len(srv.Redeploys()) != 0 {
+		t.Errorf("check should only report the stack outdated, got %+v", result)
+	}
+
+	result, err = u.updateStack(ctx, ctx, 1)
+	if err != nil {
+		t.Fatalf("updating stack: %s", err)
+	}
+	if result.Outcome != notify.OutcomeUpdated || len(srv.Redeploys()) != 1 {
+		t.Errorf("want stack updated once, got %+v", result)
+	}
+
+	statuses := u.status.list()
+	if len(statuses) != 1 || statuses[0].Outcome != notify.OutcomeUpdated {
+		t.Errorf("want update in status, got %+v", statuses)
+	}
+
+	if _, err := u.checkStack(ctx, 42); err == nil {
+		t.Error("want error checking unknown stack")
+	}
+}
+
+func TestUpdateStackOutlivesRequest(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+
+	// the client went away, the update still runs until shutdown
+	request, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := u.updateStack(request, context.Background(), 1)
+	if err != nil {
+		t.Fatalf("updating stack: %s", err)
+	}
+	if result.Outcome != notify.OutcomeUpdated || len(srv.Redeploys()) != 1 {
+		t.Errorf("want stack updated once, got %+v", result)
+	}
+}
+
+func TestCheckStackFilters(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	s := testConfig()
+	s.ExcludeStackNames = []string{"web"}
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+
+	result, err := u.checkStack(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("checking stack: %s", err)
+	}
+	if result.Outcome != notify.OutcomeHeldBack || !strings.Contains(result.Reason, "excluded") {
+		t.Errorf("want excluded stack held back, got %+v", result)
+	}
+	if len(srv.Redeploys()) != 0 {
+		t.Errorf("excluded stack was redeployed %d times", len(srv.Redeploys()))
+	}
+}
+
+func TestResolveStack(t *testing.T) {
+	srv := newTestServer(t)
+	u, _ := newTestUpdater(t, srv, testConfig(), verifyConfig{})
+
+	for _, ref := range []string{"1", "web"} {
+		id, err := resolveStack(context.Background(), u, ref)
+		if err != nil || id != 1 {
+			t.Errorf("resolving %q: got %d, %v", ref, id, err)
+		}
+	}
+	if _, err := resolveStack(context.Background(), u, "missing"); err == nil {
+		t.Error("want error for unknown stack name")
+	}
+}
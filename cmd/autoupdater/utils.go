@@ -1,5 +1,14 @@
 package main
 
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+)
+
 func inSlice[T comparable](elems []T, v T) bool {
 	for _, s := range elems {
 		if v == s {
@@ -8,3 +17,27 @@ func inSlice[T comparable](elems []T, v T) bool {
 	}
 	return false
 }
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// getEndpointNames maps endpoint IDs to their names
+func getEndpointNames(ctx context.Context, client portainerapi.Client, ll zerolog.Logger) (map[int]string, error) {
+	endpoints, err := client.Endpoints(ctx, ll)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting endpoints")
+	}
+
+	names := make(map[int]string, len(endpoints))
+	for _, endpoint := range endpoints {
+		names[int(endpoint.ID)] = endpoint.Name
+	}
+	return names, nil
+}
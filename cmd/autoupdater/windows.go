@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/schedule"
+)
+
+type checkFunc func(ctx context.Context) (string, error)
+
+type pendingUpdate struct {
+	result notify.Result
+	check  checkFunc
+	update updateFunc
+	images imagesFunc
+	ll     zerolog.Logger
+}
+
+// updateGate holds back updates found outside of the maintenance windows and
+// performs them once a window opens. A nil gate lets every update through.
+type updateGate struct {
+	windows  schedule.Windows
+	notifier notify.Notifier
+	grace    time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]pendingUpdate
+	order   []string
+	// targets being updated, by a run, a manual update or a drain
+	busy map[string]bool
+}
+
+func newUpdateGate(windows schedule.Windows, notifier notify.Notifier, grace time.Duration) *updateGate {
+	if len(windows) == 0 {
+		return nil
+	}
+	return &updateGate{
+		windows:  windows,
+		notifier: notifier,
+		grace:    grace,
+		now:      time.Now,
+		pending:  make(map[string]pendingUpdate),
+		busy:     make(map[string]bool),
+	}
+}
+
+func targetKey(t notify.Target) string {
+	return fmt.Sprintf("%s/%d/%s", t.Kind, t.EndpointID, t.ID)
+}
+
+// open reports whether updates may be performed now
+func (g *updateGate) open() bool {
+	if g == nil {
+		return true
+	}
+	_, ok := g.windows.Active(g.now())
+	return ok
+}
+
+// hold queues an update until the next window opens and returns the held back result
+func (g *updateGate) hold(result notify.Result, check checkFunc, update updateFunc, images imagesFunc, ll zerolog.Logger) notify.Result {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := targetKey(result.Target)
+	if _, ok := g.pending[key]; !ok {
+		g.order = append(g.order, key)
+	}
+	g.pending[key] = pendingUpdate{result: result, check: check, update: update, images: images, ll: ll}
+
+	next, window := g.windows.NextOpen(g.now())
+	ll.Info().Time("window_opens", next).Str("window", window.Name).Msg("update queued until maintenance window")
+	return heldBackResult(result, fmt.Sprintf("waiting for maintenance window %s", window.Name))
+}
+
+// claim drops a queued update of target and marks it as being updated, it
+// returns false when another update of target is already in progress. Every
+// successful claim is followed by done.
+func (g *updateGate) claim(target notify.Target) bool {
+	if g == nil {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := targetKey(target)
+	if g.busy[key] {
+		return false
+	}
+	g.busy[key] = true
+	if _, ok := g.pending[key]; ok {
+		delete(g.pending, key)
+		g.order = slices.DeleteFunc(g.order, func(k string) bool { return k == key })
+	}
+	return true
+}
+
+// done ends an update started with claim or next
+func (g *updateGate) done(target notify.Target) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.busy, targetKey(target))
+}
+
+// next takes the oldest queued update whose target isn't being updated and
+// marks it as being updated
+func (g *updateGate) next() (pendingUpdate, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// updates queued again while their target is being updated keep their place
+	order := g.order[:0]
+	defer func() { g.order = order }()
+	for i, key := range g.order {
+		p, ok := g.pending[key]
+		if !ok {
+			continue
+		}
+		if g.busy[key] {
+			order = append(order, key)
+			continue
+		}
+		delete(g.pending, key)
+		g.busy[key] = true
+		order = append(order, g.order[i+1:]...)
+		return p, true
+	}
+	return pendingUpdate{}, false
+}
+
+// requeue puts an update taken with next back in front of the queue
+func (g *updateGate) requeue(p pendingUpdate) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := targetKey(p.result.Target)
+	if _, ok := g.pending[key]; !ok {
+		g.order = append([]string{key}, g.order...)
+		g.pending[key] = p
+	}
+}
+
+// queued returns the results of the updates still waiting for a window
+func (g *updateGate) queued() []notify.Result {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var results []notify.Result
+	for _, key := range g.order {
+		if p, ok := g.pending[key]; ok {
+			results = append(results, p.result)
+		}
+	}
+	return results
+}
+
+// run performs queued updates whenever a maintenance window opens until ctx
+// is done. Nothing is performed while paused. The results are recorded with
+// record, the notifier only gets the events of each update.
+func (g *updateGate) run(ctx context.Context, dryRun bool, paused func() bool, record func(notify.Result), ll zerolog.Logger) {
+	if g == nil {
+		return
+	}
+
+	for {
+		next, window := g.windows.NextOpen(g.now())
+		if next.IsZero() {
+			ll.Error().Msg("maintenance windows never open, queued updates are not performed")
+			return
+		}
+
+		wait := next.Sub(g.now())
+		if wait <= 0 {
+			// already in a window, look again once the queue had time to fill
+			wait = time.Minute
+			if paused() {
+				ll.Debug().Msg("paused, keeping updates queued")
+			} else {
+				g.drain(ctx, dryRun, record, ll.With().Str("window", window.Name).Logger())
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// drain performs queued updates while the window stays open and ctx isn't
+// done, an update that already started gets the grace period to finish
+func (g *updateGate) drain(ctx context.Context, dryRun bool, record func(notify.Result), ll zerolog.Logger) {
+	work, cancel := graceful(ctx, g.grace)
+	defer cancel()
+
+	var summary notify.Summary
+	for g.open() && ctx.Err() == nil {
+		p, ok := g.next()
+		if !ok {
+			break
+		}
+
+		result, ok := g.perform(ctx, work, dryRun, p)
+		g.done(p.result.Target)
+		if !ok {
+			break
+		}
+		if result.Kind != "" {
+			record(result)
+			summary.Results = append(summary.Results, result)
+		}
+	}
+
+	if len(summary.Results) > 0 {
+		ll.Info().Int("updated", summary.Count(notify.OutcomeUpdated)).
+			Int("failed", summary.Count(notify.OutcomeFailed)).
+			Msg("performed queued updates")
+	}
+}
+
+// perform checks a queued update again and performs it when still needed.
+// It returns false when the status can't be read, the update is queued again
+// then.
+func (g *updateGate) perform(ctx, work context.Context, dryRun bool, p pendingUpdate) (notify.Result, bool) {
+	// the target may have been updated some other way while it was queued
+	status, err := p.check(ctx)
+	if err != nil {
+		p.ll.Error().Err(err).Msg("error getting image status, keeping update queued")
+		g.requeue(p)
+		return notify.Result{}, false
+	}
+	if status != statusOutdated {
+		p.ll.Debug().Str("status", status).Msg("queued update no longer needed")
+		return notify.Result{}, true
+	}
+
+	result, _ := performUpdate(work, g.notifier, p.result, dryRun, p.update, p.images, p.ll)
+	return result, true
+}
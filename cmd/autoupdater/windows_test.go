@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+	"github.com/sjafferali/portainer-autoupdater/internal/schedule"
+)
+
+// testClock is a clock for the update gate that only moves when set
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// newTestGate gives u a nightly window from 02:00 to 04:00 UTC and starts the
+// clock outside of it
+func newTestGate(t *testing.T, u *updater) (*updateGate, *testClock) {
+	t.Helper()
+	windows, err := schedule.ParseWindows("nightly=daily 02:00-04:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{now: time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)}
+	gate := newUpdateGate(windows, u.notifier, time.Second)
+	gate.now = clock.Now
+	u.gate = gate
+	return gate, clock
+}
+
+func stackRedeploys(srv *fake.Server) int {
+	n := 0
+	for _, r := range srv.Redeploys() {
+		if r.Kind == fake.KindStack {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUpdateGate(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	s := testConfig()
+	s.EnableServices = false
+	s.EnableContainers = false
+	u, rec := newTestUpdater(t, srv, s, verifyConfig{})
+	gate, clock := newTestGate(t, u)
+	ctx := context.Background()
+
+	summary := u.run(ctx, 0)
+	stack := resultFor(t, summary, notify.KindStack, "1")
+	if stack.Outcome != notify.OutcomeHeldBack || stack.Reason != "waiting for maintenance window nightly" {
+		t.Fatalf("want the stack held back for the window, got %+v", stack)
+	}
+	if queued := gate.queued(); len(queued) != 1 || queued[0].ID != "1" {
+		t.Fatalf("want the stack queued, got %+v", queued)
+	}
+
+	// checked again outside the window, the stack is queued once
+	u.run(ctx, 0)
+	if queued := gate.queued(); len(queued) != 1 {
+		t.Fatalf("want the stack queued once, got %+v", queued)
+	}
+	if n := stackRedeploys(srv); n != 0 {
+		t.Fatalf("got %d redeploys outside the window, want none", n)
+	}
+
+	var recorded []notify.Result
+	record := func(r notify.Result) { recorded = append(recorded, r) }
+
+	clock.Set(time.Date(2024, 6, 4, 2, 30, 0, 0, time.UTC))
+	gate.drain(ctx, false, record, zerolog.Nop())
+	gate.drain(ctx, false, record, zerolog.Nop())
+	if n := stackRedeploys(srv); n != 1 {
+		t.Fatalf("got %d redeploys once the window opened, want 1", n)
+	}
+	if len(gate.queued()) != 0 {
+		t.Errorf("want the queue empty, got %+v", gate.queued())
+	}
+	if len(recorded) != 1 || recorded[0].Outcome != notify.OutcomeUpdated || recorded[0].Update == nil {
+		t.Errorf("want the update recorded, got %+v", recorded)
+	}
+	if countEvents(rec, notify.EventUpdateSucceeded) != 1 || countEvents(rec, notify.EventRunSummary) != 2 {
+		t.Errorf("want an update event and no summary for the queued update, got %v", rec.types())
+	}
+}
+
+func TestUpdateGateInProgress(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	s := testConfig()
+	s.EnableServices = false
+	s.EnableContainers = false
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	gate, clock := newTestGate(t, u)
+	ctx := context.Background()
+	nop := func(notify.Result) {}
+
+	u.run(ctx, 0)
+	clock.Set(time.Date(2024, 6, 4, 2, 30, 0, 0, time.UTC))
+
+	// a run or manual update is redeploying the stack, the queued update
+	// waits for it
+	target := gate.queued()[0].Target
+	if !gate.claim(target) {
+		t.Fatal("want the stack claimed")
+	}
+	if gate.claim(target) {
+		t.Error("want a second claim refused")
+	}
+	gate.drain(ctx, false, nop, zerolog.Nop())
+	if n := stackRedeploys(srv); n != 0 {
+		t.Fatalf("got %d redeploys while the stack is updated elsewhere, want none", n)
+	}
+
+	// runs and manual updates leave the stack alone as well
+	summary := u.run(ctx, 0)
+	if r := resultFor(t, summary, notify.KindStack, "1"); r.Reason != holdReasonInProgress {
+		t.Errorf("want the run held back while the stack is updated, got %+v", r)
+	}
+	if r, err := u.updateStack(ctx, ctx, 1); err != nil || r.Reason != holdReasonInProgress {
+		t.Errorf("want the manual update held back while the stack is updated, got %+v (%v)", r, err)
+	}
+	gate.done(target)
+
+	// the claim dropped the queued update, the next run performs it
+	u.run(ctx, 0)
+	if n := stackRedeploys(srv); n != 1 {
+		t.Fatalf("got %d redeploys, want 1", n)
+	}
+	gate.drain(ctx, false, nop, zerolog.Nop())
+	if n := stackRedeploys(srv); n != 1 {
+		t.Errorf("got %d redeploys after draining, want the update performed once", n)
+	}
+}
+
+func TestUpdateGatePaused(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	s := testConfig()
+	s.EnableServices = false
+	s.EnableContainers = false
+	u, _ := newTestUpdater(t, srv, s, verifyConfig{})
+	gate, clock := newTestGate(t, u)
+
+	u.run(context.Background(), 0)
+	clock.Set(time.Date(2024, 6, 4, 2, 30, 0, 0, time.UTC))
+	u.pause()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	paused := func() bool {
+		// stop after the first look at the queue
+		defer cancel()
+		return u.isPaused()
+	}
+	gate.run(ctx, false, paused, func(notify.Result) {}, zerolog.Nop())
+
+	if n := stackRedeploys(srv); n != 0 {
+		t.Errorf("got %d redeploys while paused, want none", n)
+	}
+	if len(gate.queued()) != 1 {
+		t.Errorf("want the update kept queued, got %+v", gate.queued())
+	}
+}
@@ -0,0 +1,297 @@
+// Package compose reads and rewrites the images of compose files while
+// keeping their formatting and comments intact.
+package compose
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// pinComment marks an image that was pinned to a digest by a rollback, it is
+// followed by the image the file had before
+const pinComment = "# autoupdater: pinned by rollback, was "
+
+// imageNode is the position of a service's image key and value in the file
+type imageNode struct {
+	service string
+	key     *yaml.Node
+	node    *yaml.Node
+}
+
+func imageNodes(content string) ([]imageNode, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return nil, errors.Wrap(err, "parsing compose file")
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	services := mappingValue(doc.Content[0], "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	nodes := make([]imageNode, 0)
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		key, image := mappingEntry(services.Content[i+1], "image")
+		if image == nil || image.Kind != yaml.ScalarNode {
+			continue
+		}
+		nodes = append(nodes, imageNode{service: services.Content[i].Value, key: key, node: image})
+	}
+	return nodes, nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	_, value := mappingEntry(node, key)
+	return value
+}
+
+func mappingEntry(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// ServiceImages returns the image of every service that sets one
+func ServiceImages(content string) (map[string]string, error) {
+	nodes, err := imageNodes(content)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make(map[string]string, len(nodes))
+	for _, n := range nodes {
+		images[n.service] = n.node.Value
+	}
+	return images, nil
+}
+
+// ReplaceImages sets the image of the services in images, services that are
+// not part of the file are ignored
+func ReplaceImages(content string, images map[string]string) (string, error) {
+	nodes, err := imageNodes(content)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(content, "\n")
+
+	// replace from the end so earlier positions stay valid
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := nodes[i]
+		image, ok := images[n.service]
+		if !ok || image == n.node.Value {
+			continue
+		}
+
+		if err := replaceScalar(lines, n.node, image); err != nil {
+			return "", errors.Wrapf(err, "replacing image of service %s", n.service)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// PinImages sets the image of the services in images like ReplaceImages,
+// adding a comment above each of them with the image the file had, so
+// UnpinImages can restore it. Images that are pinned already keep the image
+// they were pinned from.
+func PinImages(content string, images map[string]string) (string, error) {
+	nodes, err := imageNodes(content)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(content, "\n")
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := nodes[i]
+		image, ok := images[n.service]
+		if !ok || image == n.node.Value {
+			continue
+		}
+
+		if err := replaceScalar(lines, n.node, image); err != nil {
+			return "", errors.Wrapf(err, "pinning image of service %s", n.service)
+		}
+		if _, pinned := pinnedFrom(lines, n); pinned {
+			continue
+		}
+
+		line := lines[n.key.Line-1]
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		lines = append(lines[:n.key.Line-1], append([]string{indent + pinComment + n.node.Value}, lines[n.key.Line-1:]...)...)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// PinnedImages returns the services whose image was pinned by PinImages,
+// mapped to the image they were pinned from
+func PinnedImages(content string) (map[string]string, error) {
+	nodes, err := imageNodes(content)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(content, "\n")
+	pinned := make(map[string]string)
+	for _, n := range nodes {
+		if image, ok := pinnedFrom(lines, n); ok {
+			pinned[n.service] = image
+		}
+	}
+	return pinned, nil
+}
+
+// UnpinImages restores the images pinned by PinImages and removes their
+// comments, files without pinned images are returned as they are
+func UnpinImages(content string) (string, error) {
+	nodes, err := imageNodes(content)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(content, "\n")
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := nodes[i]
+		image, ok := pinnedFrom(lines, n)
+		if !ok {
+			continue
+		}
+
+		if err := replaceScalar(lines, n.node, image); err != nil {
+			return "", errors.Wrapf(err, "unpinning image of service %s", n.service)
+		}
+		lines = append(lines[:n.key.Line-2], lines[n.key.Line-1:]...)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// pinnedFrom reads the pin comment on the line above the image key
+func pinnedFrom(lines []string, n imageNode) (string, bool) {
+	if n.key.Line < 2 || n.key.Line > len(lines) {
+		return "", false
+	}
+	return strings.CutPrefix(strings.TrimSpace(lines[n.key.Line-2]), pinComment)
+}
+
+func replaceScalar(lines []string, node *yaml.Node, value string) error {
+	if node.Line < 1 || node.Line > len(lines) {
+		return fmt.Errorf("invalid line %d", node.Line)
+	}
+
+	line := []rune(lines[node.Line-1])
+	start := node.Column - 1
+
+	var raw, replacement string
+	switch node.Style {
+	case yaml.DoubleQuotedStyle:
+		raw = `"` + node.Value + `"`
+		replacement = `"` + value + `"`
+	case yaml.SingleQuotedStyle:
+		raw = `'` + node.Value + `'`
+		replacement = `'` + value + `'`
+	case 0:
+		raw = node.Value
+		replacement = value
+	default:
+		return fmt.Errorf("unsupported yaml style for image")
+	}
+
+	end := start + len([]rune(raw))
+	if start < 0 || end > len(line) || string(line[start:end]) != raw {
+		return fmt.Errorf("image %q not found at line %d", node.Value, node.Line)
+	}
+
+	lines[node.Line-1] = string(line[:start]) + replacement + string(line[end:])
+	return nil
+}
+
+// Repository returns the image reference without its tag or digest
+func Repository(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
+
+// Tag returns the tag of the image reference, or "latest" when it has none
+func Tag(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+	return "latest"
+}
+
+// Interpolate substitutes $VAR, ${VAR}, ${VAR:-default} and ${VAR-default}
+// in value like compose does, unset variables become empty and $$ is a
+// literal $
+func Interpolate(value string, env map[string]string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(value, '$')
+		if i < 0 || i == len(value)-1 {
+			b.WriteString(value)
+			return b.String()
+		}
+		b.WriteString(value[:i])
+		value = value[i+1:]
+
+		switch {
+		case value[0] == '$':
+			b.WriteByte('$')
+			value = value[1:]
+		case value[0] == '{':
+			end := strings.IndexByte(value, '}')
+			if end < 0 {
+				b.WriteString("$" + value)
+				return b.String()
+			}
+			b.WriteString(expand(value[1:end], env))
+			value = value[end+1:]
+		default:
+			end := 0
+			for end < len(value) && isNameChar(value[end], end == 0) {
+				end++
+			}
+			if end == 0 {
+				b.WriteByte('$')
+				continue
+			}
+			b.WriteString(env[value[:end]])
+			value = value[end:]
+		}
+	}
+}
+
+// expand resolves the expression inside ${...}
+func expand(expr string, env map[string]string) string {
+	if name, def, ok := strings.Cut(expr, ":-"); ok {
+		if v := env[name]; v != "" {
+			return v
+		}
+		return def
+	}
+	if name, def, ok := strings.Cut(expr, "-"); ok {
+		if v, set := env[name]; set {
+			return v
+		}
+		return def
+	}
+	return env[expr]
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
@@ -0,0 +1,251 @@
+package compose_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sjafferali/portainer-autoupdater/internal/compose"
+)
+
+func TestServiceImages(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{
+			name:    "images",
+			content: "services:\n  web:\n    image: nginx:1.25\n  db:\n    image: \"postgres:16\"\n",
+			want:    map[string]string{"web": "nginx:1.25", "db": "postgres:16"},
+		},
+		{
+			name:    "build without image",
+			content: "services:\n  app:\n    build: .\n  web:\n    image: nginx\n",
+			want:    map[string]string{"web": "nginx"},
+		},
+		{
+			name:    "variables are kept",
+			content: "services:\n  app:\n    image: ${REGISTRY:-ghcr.io}/app:${TAG}\n",
+			want:    map[string]string{"app": "${REGISTRY:-ghcr.io}/app:${TAG}"},
+		},
+		{
+			name: "anchors",
+			content: "x-base: &base\n  image: nginx:1.25\nservices:\n" +
+				"  web: &web\n    image: caddy:2\n  merged:\n    <<: *base\n  alias: *web\n",
+			want: map[string]string{"web": "caddy:2"},
+		},
+		{
+			name:    "comments",
+			content: "# stack\nservices:\n  web:\n    # pinned for now\n    image: nginx:1.25 # latest breaks\n",
+			want:    map[string]string{"web": "nginx:1.25"},
+		},
+		{
+			name:    "no services",
+			content: "version: \"3\"\n",
+			want:    map[string]string{},
+		},
+		{
+			name:    "empty",
+			content: "",
+			want:    map[string]string{},
+		},
+	} {
+		got, err := compose.ServiceImages(tc.content)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		// files without services give a nil map
+		if len(got) != len(tc.want) || (len(got) > 0 && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := compose.ServiceImages("services: [\n"); err == nil {
+		t.Error("want error for invalid yaml")
+	}
+}
+
+func TestReplaceImages(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		images  map[string]string
+		want    string
+	}{
+		{
+			name:    "plain",
+			content: "services:\n  web:\n    image: nginx:1.25\n  db:\n    image: postgres:16\n",
+			images:  map[string]string{"web": "nginx:1.27"},
+			want:    "services:\n  web:\n    image: nginx:1.27\n  db:\n    image: postgres:16\n",
+		},
+		{
+			name:    "quoted",
+			content: "services:\n  web:\n    image: \"nginx:1.25\"\n  db:\n    image: 'postgres:16'\n",
+			images:  map[string]string{"web": "nginx:1.27", "db": "postgres:17"},
+			want:    "services:\n  web:\n    image: \"nginx:1.27\"\n  db:\n    image: 'postgres:17'\n",
+		},
+		{
+			name:    "comments are kept",
+			content: "services:\n  web:\n    # pinned for now\n    image: nginx:1.25 # latest breaks\n",
+			images:  map[string]string{"web": "nginx:1.27"},
+			want:    "services:\n  web:\n    # pinned for now\n    image: nginx:1.27 # latest breaks\n",
+		},
+		{
+			name:    "variables",
+			content: "services:\n  app:\n    image: ghcr.io/app:${TAG:-1.0}\n",
+			images:  map[string]string{"app": "ghcr.io/app:1.1"},
+			want:    "services:\n  app:\n    image: ghcr.io/app:1.1\n",
+		},
+		{
+			name:    "anchors are left alone",
+			content: "x-base: &base\n  image: nginx:1.25\nservices:\n  web:\n    <<: *base\n",
+			images:  map[string]string{"web": "nginx:1.27"},
+			want:    "x-base: &base\n  image: nginx:1.25\nservices:\n  web:\n    <<: *base\n",
+		},
+		{
+			name:    "unknown and build services",
+			content: "services:\n  app:\n    build: .\n",
+			images:  map[string]string{"app": "app:1", "other": "nginx"},
+			want:    "services:\n  app:\n    build: .\n",
+		},
+		{
+			name:    "flow mapping",
+			content: "services:\n  web: {image: nginx:1.25, restart: always}\n",
+			images:  map[string]string{"web": "nginx:1.27"},
+			want:    "services:\n  web: {image: nginx:1.27, restart: always}\n",
+		},
+	} {
+		got, err := compose.ReplaceImages(tc.content, tc.images)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPinImages(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		images  map[string]string
+		want    string
+	}{
+		{
+			name:    "pinned",
+			content: "services:\n  web:\n    image: nginx:latest\n  db:\n    image: postgres:16\n",
+			images:  map[string]string{"web": "nginx@sha256:111"},
+			want: "services:\n  web:\n    # autoupdater: pinned by rollback, was nginx:latest\n" +
+				"    image: nginx@sha256:111\n  db:\n    image: postgres:16\n",
+		},
+		{
+			name:    "comments and variables",
+			content: "services:\n  app:\n    # keep\n    image: \"${REGISTRY}/app\" # main\n",
+			images:  map[string]string{"app": "ghcr.io/app@sha256:222"},
+			want: "services:\n  app:\n    # keep\n    # autoupdater: pinned by rollback, was ${REGISTRY}/app\n" +
+				"    image: \"ghcr.io/app@sha256:222\" # main\n",
+		},
+		{
+			name:    "flow mapping",
+			content: "services:\n  web: {image: nginx}\n",
+			images:  map[string]string{"web": "nginx@sha256:111"},
+			want:    "services:\n  # autoupdater: pinned by rollback, was nginx\n  web: {image: nginx@sha256:111}\n",
+		},
+	} {
+		got, err := compose.PinImages(tc.content, tc.images)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+
+		// the pinned file stays valid and the pin can be undone
+		images, err := compose.ServiceImages(got)
+		if err != nil {
+			t.Errorf("%s: reading pinned file: %s", tc.name, err)
+		}
+		pinned, err := compose.PinnedImages(got)
+		if err != nil {
+			t.Errorf("%s: reading pins: %s", tc.name, err)
+		}
+		for service, image := range tc.images {
+			if images[service] != image || pinned[service] == "" {
+				t.Errorf("%s: want %s pinned to %s, got %q pinned from %q", tc.name, service, image, images[service], pinned[service])
+			}
+		}
+		unpinned, err := compose.UnpinImages(got)
+		if err != nil || unpinned != tc.content {
+			t.Errorf("%s: unpinned to %q (%v), want %q", tc.name, unpinned, err, tc.content)
+		}
+	}
+}
+
+func TestPinImagesTwice(t *testing.T) {
+	content := "services:\n  web:\n    image: nginx:latest\n"
+	once, err := compose.PinImages(content, map[string]string{"web": "nginx@sha256:111"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := compose.PinImages(once, map[string]string{"web": "nginx@sha256:222"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned, err := compose.PinnedImages(twice)
+	if err != nil || pinned["web"] != "nginx:latest" {
+		t.Errorf("want pin from the original image, got %v (%v)", pinned, err)
+	}
+	if unpinned, _ := compose.UnpinImages(twice); unpinned != content {
+		t.Errorf("got %q after unpinning, want %q", unpinned, content)
+	}
+}
+
+func TestRepositoryAndTag(t *testing.T) {
+	for _, tc := range []struct {
+		image string
+		repo  string
+		tag   string
+	}{
+		{image: "nginx", repo: "nginx", tag: "latest"},
+		{image: "nginx:1.25", repo: "nginx", tag: "1.25"},
+		{image: "registry:5000/team/app", repo: "registry:5000/team/app", tag: "latest"},
+		{image: "registry:5000/team/app:2", repo: "registry:5000/team/app", tag: "2"},
+		{image: "nginx:1.25@sha256:111", repo: "nginx", tag: "1.25"},
+		{image: "nginx@sha256:111", repo: "nginx", tag: "latest"},
+	} {
+		if repo := compose.Repository(tc.image); repo != tc.repo {
+			t.Errorf("%s: got repository %q, want %q", tc.image, repo, tc.repo)
+		}
+		if tag := compose.Tag(tc.image); tag != tc.tag {
+			t.Errorf("%s: got tag %q, want %q", tc.image, tag, tc.tag)
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"TAG": "1.2", "EMPTY": "", "REGISTRY": "ghcr.io"}
+	for value, want := range map[string]string{
+		"nginx:1.25":                    "nginx:1.25",
+		"app:$TAG":                      "app:1.2",
+		"app:${TAG}":                    "app:1.2",
+		"${REGISTRY}/app:${TAG}-alpine": "ghcr.io/app:1.2-alpine",
+		"app:${UNSET}":                  "app:",
+		"app:${UNSET:-latest}":          "app:latest",
+		"app:${EMPTY:-latest}":          "app:latest",
+		"app:${EMPTY-latest}":           "app:",
+		"app:${UNSET-latest}":           "app:latest",
+		"app:$$TAG":                     "app:$TAG",
+		"app:$":                         "app:$",
+		"app:${TAG":                     "app:${TAG",
+		"app:$1":                        "app:$1",
+	} {
+		if got := compose.Interpolate(value, env); got != want {
+			t.Errorf("%q: got %q, want %q", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,586 @@
+// Package fake provides an in-process git hosting service for tests. It
+// speaks the parts of the GitHub, Gitea and GitLab APIs the forge package
+// uses, all backed by the same repositories, and advertises their branches
+// over smart http like git ls-remote expects.
+package fake
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sjafferali/portainer-autoupdater/internal/forge"
+)
+
+// PullRequest is a pull request opened on the server
+type PullRequest struct {
+	Repository string
+	Base       string
+	Head       string
+	Title      string
+	Body       string
+	Open       bool
+	URL        string
+}
+
+type repository struct {
+	defaultBranch string
+	// branches maps branch names to their files
+	branches map[string]map[string]string
+	// heads maps branch names to their head commit
+	heads map[string]string
+}
+
+// Server is a fake git hosting service. Add repositories before pointing a
+// client at APIURL.
+type Server struct {
+	*httptest.Server
+
+	token string
+
+	mu     sync.Mutex
+	repos  map[string]*repository
+	pulls  []PullRequest
+	writes int
+	// failPulls is the number of pull requests still to refuse
+	failPulls int
+}
+
+// NewServer starts a fake hosting service accepting token, it's closed when
+// the caller calls Close
+func NewServer(token string) *Server {
+	s := &Server{token: token, repos: make(map[string]*repository)}
+	s.Server = httptest.NewServer(s.routes())
+	return s
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	github := "/api/v3/repos/{owner}/{name}"
+	mux.HandleFunc("GET "+github, s.authorized(forge.KindGitHub, s.getRepository))
+	mux.HandleFunc("GET "+github+"/contents/{path...}", s.authorized(forge.KindGitHub, s.getContents))
+	mux.HandleFunc("PUT "+github+"/contents/{path...}", s.authorized(forge.KindGitHub, s.putContents))
+	mux.HandleFunc("GET "+github+"/git/ref/heads/{branch...}", s.authorized(forge.KindGitHub, s.getRef))
+	mux.HandleFunc("POST "+github+"/git/refs", s.authorized(forge.KindGitHub, s.createRef))
+	mux.HandleFunc("PATCH "+github+"/git/refs/heads/{branch...}", s.authorized(forge.KindGitHub, s.updateRef))
+	mux.HandleFunc("GET "+github+"/pulls", s.authorized(forge.KindGitHub, s.listPulls))
+	mux.HandleFunc("POST "+github+"/pulls", s.authorized(forge.KindGitHub, s.createPull))
+
+	gitea := "/api/v1/repos/{owner}/{name}"
+	mux.HandleFunc("GET "+gitea, s.authorized(forge.KindGitea, s.getRepository))
+	mux.HandleFunc("GET "+gitea+"/contents/{path...}", s.authorized(forge.KindGitea, s.getContents))
+	mux.HandleFunc("PUT "+gitea+"/contents/{path...}", s.authorized(forge.KindGitea, s.putContents))
+	mux.HandleFunc("DELETE "+gitea+"/branches/{branch...}", s.authorized(forge.KindGitea, s.deleteBranch))
+	mux.HandleFunc("GET "+gitea+"/pulls", s.authorized(forge.KindGitea, s.listPulls))
+	mux.HandleFunc("POST "+gitea+"/pulls", s.authorized(forge.KindGitea, s.createPull))
+
+	gitlab := "/api/v4/projects/{id}"
+	mux.HandleFunc("GET "+gitlab, s.authorized(forge.KindGitLab, s.getRepository))
+	mux.HandleFunc("GET "+gitlab+"/repository/files/{path}", s.authorized(forge.KindGitLab, s.getContents))
+	mux.HandleFunc("POST "+gitlab+"/repository/commits", s.authorized(forge.KindGitLab, s.createCommit))
+	mux.HandleFunc("DELETE "+gitlab+"/repository/branches/{branch}", s.authorized(forge.KindGitLab, s.deleteBranch))
+	mux.HandleFunc("GET "+gitlab+"/merge_requests", s.authorized(forge.KindGitLab, s.listPulls))
+	mux.HandleFunc("POST "+gitlab+"/merge_requests", s.authorized(forge.KindGitLab, s.createPull))
+
+	mux.HandleFunc("GET /{owner}/{name}/info/refs", s.advertiseRefs)
+	return mux
+}
+
+// APIURL is the address clients of kind talk to
+func (s *Server) APIURL(kind forge.Kind) string {
+	switch kind {
+	case forge.KindGitHub:
+		return s.URL + "/api/v3"
+	case forge.KindGitLab:
+		return s.URL + "/api/v4"
+	default:
+		return s.URL + "/api/v1"
+	}
+}
+
+// AddRepository adds a repository such as org/app with files on its default
+// branch
+func (s *Server) AddRepository(path, defaultBranch string, files map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	branch := make(map[string]string, len(files))
+	for name, content := range files {
+		branch[name] = content
+	}
+	s.repos[path] = &repository{
+		defaultBranch: defaultBranch,
+		branches:      map[string]map[string]string{defaultBranch: branch},
+		heads:         map[string]string{defaultBranch: version("ref " + defaultBranch)},
+	}
+}
+
+// Commit changes a file on a branch as if someone pushed to it and returns
+// the new head commit
+func (s *Server) Commit(repo, branch, path, content string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.repos[repo]
+	if !ok {
+		return ""
+	}
+	if _, ok := r.branches[branch]; !ok {
+		return ""
+	}
+	r.branches[branch][path] = content
+	return advance(r, branch, path, content)
+}
+
+// Head returns the head commit of a branch
+func (s *Server) Head(repo, branch string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.repos[repo]; ok {
+		return r.heads[branch]
+	}
+	return ""
+}
+
+// File returns a file from a branch
+func (s *Server) File(repo, branch, path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.repos[repo]
+	if !ok {
+		return "", false
+	}
+	content, ok := r.branches[branch][path]
+	return content, ok
+}
+
+// PullRequests returns all pull requests opened so far
+func (s *Server) PullRequests() []PullRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PullRequest(nil), s.pulls...)
+}
+
+// Branches returns the branches of a repository
+func (s *Server) Branches(repo string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	branches := make([]string, 0)
+	if r, ok := s.repos[repo]; ok {
+		for branch := range r.branches {
+			branches = append(branches, branch)
+		}
+	}
+	sort.Strings(branches)
+	return branches
+}
+
+// ClosePullRequests closes every pull request without merging it
+func (s *Server) ClosePullRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.pulls {
+		s.pulls[i].Open = false
+	}
+}
+
+// FailPullRequests makes the next n requests opening a pull request fail,
+// after the branch for it was pushed
+func (s *Server) FailPullRequests(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failPulls = n
+}
+
+// Writes returns the number of requests that changed something
+func (s *Server) Writes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes
+}
+
+// authorized checks the token the way kind sends it and passes on the
+// repository the request is about
+func (s *Server) authorized(kind forge.Kind, next func(http.ResponseWriter, *http.Request, string, *repository)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		switch kind {
+		case forge.KindGitHub:
+			token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		case forge.KindGitea:
+			token = strings.TrimPrefix(r.Header.Get("Authorization"), "token ")
+		case forge.KindGitLab:
+			token = r.Header.Get("PRIVATE-TOKEN")
+		}
+		if token != s.token {
+			writeError(w, http.StatusUnauthorized, "bad credentials")
+			return
+		}
+
+		name := r.PathValue("id")
+		if name == "" {
+			name = r.PathValue("owner") + "/" + r.PathValue("name")
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		repo, ok := s.repos[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "repository not found")
+			return
+		}
+		if r.Method != http.MethodGet {
+			s.writes++
+		}
+		next(w, r, name, repo)
+	}
+}
+
+func (s *Server) getRepository(w http.ResponseWriter, _ *http.Request, _ string, repo *repository) {
+	writeJSON(w, http.StatusOK, map[string]string{"default_branch": repo.defaultBranch})
+}
+
+func (s *Server) getContents(w http.ResponseWriter, r *http.Request, _ string, repo *repository) {
+	branch := r.URL.Query().Get("ref")
+	if branch == "" {
+		branch = repo.defaultBranch
+	}
+	content, ok := repo.branches[branch][r.PathValue("path")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"content":        base64.StdEncoding.EncodeToString([]byte(content)),
+		"sha":            version(content),
+		"last_commit_id": version(content),
+	})
+}
+
+// putContents updates a file like GitHub and Gitea do, Gitea creates
+// new_branch off branch first
+func (s *Server) putContents(w http.ResponseWriter, r *http.Request, _ string, repo *repository) {
+	var payload struct {
+		Content   string `json:"content"`
+		SHA       string `json:"sha"`
+		Branch    string `json:"branch"`
+		NewBranch string `json:"new_branch"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	content, err := base64.StdEncoding.DecodeString(payload.Content)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid content")
+		return
+	}
+
+	branch := payload.Branch
+	if payload.NewBranch != "" {
+		if !createBranch(repo, payload.Branch, payload.NewBranch) {
+			writeError(w, http.StatusUnprocessableEntity, "branch exists or base not found")
+			return
+		}
+		branch = payload.NewBranch
+	}
+	if code, msg := commit(repo, branch, r.PathValue("path"), string(content), payload.SHA); code != http.StatusOK {
+		writeError(w, code, msg)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (s *Server) getRef(w http.ResponseWriter, r *http.Request, _ string, repo *repository) {
+	branch := r.PathValue("branch")
+	if _, ok := repo.branches[branch]; !ok {
+		writeError(w, http.StatusNotFound, "reference not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"object": map[string]string{"sha": repo.heads[branch]}})
+}
+
+func (s *Server) createRef(w http.ResponseWriter, r *http.Request, _ string, repo *repository) {
+	var payload struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	for base, head := range repo.heads {
+		if head == payload.SHA {
+			if !createBranch(repo, base, strings.TrimPrefix(payload.Ref, "refs/heads/")) {
+				writeError(w, http.StatusUnprocessableEntity, "reference already exists")
+				return
+			}
+			writeJSON(w, http.StatusCreated, map[string]interface{}{})
+			return
+		}
+	}
+	writeError(w, http.StatusUnprocessableEntity, "object does not exist")
+}
+
+// updateRef moves a branch to the head of another one, GitHub only allows
+// moving it back in history when forced
+func (s *Server) updateRef(w http.ResponseWriter, r *http.Request, _ string, repo *repository) {
+	var payload struct {
+		SHA   string `json:"sha"`
+		Force bool   `json:"force"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	branch := r.PathValue("branch")
+	if _, ok := repo.branches[branch]; !ok {
+		writeError(w, http.StatusUnprocessableEntity, "reference does not exist")
+		return
+	}
+	if !payload.Force {
+		writeError(w, http.StatusUnprocessableEntity, "update is not a fast forward")
+		return
+	}
+	for base, head := range repo.heads {
+		if head == payload.SHA && base != branch {
+			delete(repo.branches, branch)
+			createBranch(repo, base, branch)
+			writeJSON(w, http.StatusOK, map[string]interface{}{})
+			return
+		}
+	}
+	writeError(w, http.StatusUnprocessableEntity, "object does not exist")
+}
+
+// deleteBranch deletes a branch like Gitea and GitLab do
+func (s *Server) deleteBranch(w http.ResponseWriter, r *http.Request, _ string, repo *repository) {
+	branch := r.PathValue("branch")
+	if _, ok := repo.branches[branch]; !ok || branch == repo.defaultBranch {
+		writeError(w, http.StatusNotFound, "branch not found")
+		return
+	}
+	delete(repo.branches, branch)
+	delete(repo.heads, branch)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createCommit commits like GitLab does, creating branch off start_branch
+func (s *Server) createCommit(w http.ResponseWriter, r *http.Request, _ string, repo *repository) {
+	var payload struct {
+		Branch      string `json:"branch"`
+		StartBranch string `json:"start_branch"`
+		Actions     []struct {
+			Action       string `json:"action"`
+			FilePath     string `json:"file_path"`
+			Content      string `json:"content"`
+			LastCommitID string `json:"last_commit_id"`
+		} `json:"actions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || len(payload.Actions) != 1 || payload.Actions[0].Action != "update" {
+		writeError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	if payload.StartBranch != "" && payload.StartBranch != payload.Branch {
+		if !createBranch(repo, payload.StartBranch, payload.Branch) {
+			writeError(w, http.StatusBadRequest, "branch exists or start branch not found")
+			return
+		}
+	}
+	action := payload.Actions[0]
+	if code, msg := commit(repo, payload.Branch, action.FilePath, action.Content, action.LastCommitID); code != http.StatusOK {
+		writeError(w, code, msg)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{})
+}
+
+// advertiseRefs lists the branches of a repository cloned over http, the
+// token is the password when the server has one
+func (s *Server) advertiseRefs(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("service") != "git-upload-pack" {
+		http.Error(w, "dumb http isn't supported", http.StatusForbidden)
+		return
+	}
+	if _, password, _ := r.BasicAuth(); password != s.token {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repo, ok := s.repos[r.PathValue("owner")+"/"+strings.TrimSuffix(r.PathValue("name"), ".git")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var b strings.Builder
+	writePktLine(&b, "# service=git-upload-pack\n")
+	b.WriteString("0000")
+	writePktLine(&b, fmt.Sprintf("%s HEAD\x00symref=HEAD:refs/heads/%s\n", repo.heads[repo.defaultBranch], repo.defaultBranch))
+	branches := make([]string, 0, len(repo.heads))
+	for branch := range repo.heads {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+	for _, branch := range branches {
+		writePktLine(&b, fmt.Sprintf("%s refs/heads/%s\n", repo.heads[branch], branch))
+	}
+	b.WriteString("0000")
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// listPulls lists the pull requests of a repository in the format of the
+// API the request came through
+func (s *Server) listPulls(w http.ResponseWriter, r *http.Request, name string, _ *repository) {
+	query := r.URL.Query()
+	gitlab := r.PathValue("id") != ""
+
+	head := query.Get("source_branch")
+	if h := query.Get("head"); h != "" {
+		// GitHub prefixes the head branch with its owner
+		_, head, _ = strings.Cut(h, ":")
+	}
+	if page := query.Get("page"); page != "" && page != "1" {
+		writeJSON(w, http.StatusOK, []interface{}{})
+		return
+	}
+
+	pulls := make([]map[string]interface{}, 0)
+	for _, p := range s.pulls {
+		if p.Repository != name || (head != "" && p.Head != head) {
+			continue
+		}
+		state := "closed"
+		if p.Open {
+			state = "open"
+			if gitlab {
+				state = "opened"
+			}
+		}
+		pulls = append(pulls, map[string]interface{}{
+			"html_url": p.URL,
+			"web_url":  p.URL,
+			"state":    state,
+			"head":     map[string]string{"ref": p.Head},
+		})
+	}
+	writeJSON(w, http.StatusOK, pulls)
+}
+
+func (s *Server) createPull(w http.ResponseWriter, r *http.Request, name string, repo *repository) {
+	var payload struct {
+		Title        string `json:"title"`
+		Body         string `json:"body"`
+		Description  string `json:"description"`
+		Head         string `json:"head"`
+		Base         string `json:"base"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	p := PullRequest{
+		Repository: name,
+		Base:       payload.Base + payload.TargetBranch,
+		Head:       payload.Head + payload.SourceBranch,
+		Title:      payload.Title,
+		Body:       payload.Body + payload.Description,
+		Open:       true,
+		URL:        fmt.Sprintf("%s/%s/pulls/%d", s.URL, name, len(s.pulls)+1),
+	}
+	for _, branch := range []string{p.Base, p.Head} {
+		if _, ok := repo.branches[branch]; !ok {
+			writeError(w, http.StatusUnprocessableEntity, "branch not found: "+branch)
+			return
+		}
+	}
+	if s.failPulls > 0 {
+		s.failPulls--
+		writeError(w, http.StatusInternalServerError, "injected failure")
+		return
+	}
+	s.pulls = append(s.pulls, p)
+	writeJSON(w, http.StatusCreated, map[string]string{"html_url": p.URL, "web_url": p.URL})
+}
+
+// createBranch copies base to a new branch, it reports false when base
+// doesn't exist or branch does
+func createBranch(repo *repository, base, branch string) bool {
+	files, ok := repo.branches[base]
+	if _, exists := repo.branches[branch]; !ok || exists {
+		return false
+	}
+	copied := make(map[string]string, len(files))
+	for name, content := range files {
+		copied[name] = content
+	}
+	repo.branches[branch] = copied
+	repo.heads[branch] = repo.heads[base]
+	return true
+}
+
+// commit updates an existing file when it's still at the version the change
+// is based on
+func commit(repo *repository, branch, path, content, base string) (int, string) {
+	files, ok := repo.branches[branch]
+	if !ok {
+		return http.StatusNotFound, "branch not found"
+	}
+	current, ok := files[path]
+	if !ok {
+		return http.StatusNotFound, "file not found"
+	}
+	if version(current) != base {
+		return http.StatusConflict, "file changed since " + base
+	}
+	files[path] = content
+	advance(repo, branch, path, content)
+	return http.StatusOK, ""
+}
+
+// advance moves a branch to a new commit changing path
+func advance(repo *repository, branch, path, content string) string {
+	head := version(repo.heads[branch] + "\n" + path + "\n" + content)
+	repo.heads[branch] = head
+	return head
+}
+
+func version(content string) string {
+	sum := sha1.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func writePktLine(b *strings.Builder, line string) {
+	fmt.Fprintf(b, "%04x%s", len(line)+4, line)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"message": message})
+}
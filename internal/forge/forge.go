@@ -0,0 +1,273 @@
+// Package forge opens pull requests on git hosting services. GitHub, Gitea
+// and GitLab are supported through their REST APIs.
+package forge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kind is the type of a git hosting service
+type Kind string
+
+const (
+	KindGitHub Kind = "github"
+	KindGitea  Kind = "gitea"
+	KindGitLab Kind = "gitlab"
+)
+
+// ParseKind reads the name of a hosting service, the empty string leaves it
+// to Detect
+func ParseKind(name string) (Kind, error) {
+	switch k := Kind(strings.ToLower(strings.TrimSpace(name))); k {
+	case "", KindGitHub, KindGitea, KindGitLab:
+		return k, nil
+	default:
+		return "", errors.Errorf("unknown git provider %q, use github, gitea or gitlab", name)
+	}
+}
+
+// Detect guesses the hosting service from the host of a repository
+func Detect(host string) (Kind, bool) {
+	host = strings.ToLower(host)
+	switch {
+	case host == "github.com" || strings.HasPrefix(host, "github."):
+		return KindGitHub, true
+	case host == "gitlab.com" || strings.HasPrefix(host, "gitlab."):
+		return KindGitLab, true
+	case host == "codeberg.org" || strings.HasPrefix(host, "gitea."):
+		return KindGitea, true
+	}
+	return "", false
+}
+
+// APIURL returns the address of the API of a hosting service on host
+func APIURL(kind Kind, host string) string {
+	switch kind {
+	case KindGitHub:
+		if strings.EqualFold(host, "github.com") {
+			return "https://api.github.com"
+		}
+		return "https://" + host + "/api/v3"
+	case KindGitLab:
+		return "https://" + host + "/api/v4"
+	default:
+		return "https://" + host + "/api/v1"
+	}
+}
+
+// Repository is a repository on a hosting service
+type Repository struct {
+	Host string
+	// Path is the owner and name of the repository, such as org/app, and
+	// may include subgroups on GitLab
+	Path string
+}
+
+func (r Repository) String() string {
+	return r.Host + "/" + r.Path
+}
+
+// ParseRepository reads the clone URL of a repository, both
+// https://host/org/app.git and git@host:org/app.git
+func ParseRepository(cloneURL string) (Repository, error) {
+	raw := strings.TrimSpace(cloneURL)
+	if !strings.Contains(raw, "://") {
+		// scp like syntax of ssh remotes
+		if at := strings.Index(raw, "@"); at >= 0 {
+			raw = raw[at+1:]
+		}
+		raw = "ssh://" + strings.Replace(raw, ":", "/", 1)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Repository{}, errors.Wrapf(err, "parsing repository url %s", cloneURL)
+	}
+	path := strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if u.Hostname() == "" || !strings.Contains(path, "/") {
+		return Repository{}, errors.Errorf("repository url %s has no owner and name", cloneURL)
+	}
+
+	host := u.Hostname()
+	if u.Scheme == "http" || u.Scheme == "https" {
+		host = u.Host
+	}
+	return Repository{Host: host, Path: path}, nil
+}
+
+// File is a file read from a branch
+type File struct {
+	Content string
+	// Version identifies the revision that was read, updates based on it
+	// fail when the file changed since
+	Version string
+}
+
+// Change is a file to commit to a new branch and propose for merging
+type Change struct {
+	// Base is the branch the pull request targets, Head the branch created
+	// for it
+	Base string
+	Head string
+
+	Path    string
+	Content string
+	// Version is the version of the file the change is based on
+	Version string
+
+	Message string
+	Title   string
+	Body    string
+}
+
+// PullRequest is a pull request, or merge request on GitLab
+type PullRequest struct {
+	URL  string
+	Open bool
+}
+
+// Client talks to a hosting service. Repositories are named by their path.
+type Client interface {
+	// DefaultBranch returns the branch a repository checks out by default
+	DefaultBranch(ctx context.Context, repo string) (string, error)
+	// File reads a file from a branch
+	File(ctx context.Context, repo, branch, path string) (File, error)
+	// FindPullRequest returns the pull request from the head branch, open or
+	// not, and nil when there is none
+	FindPullRequest(ctx context.Context, repo, head string) (*PullRequest, error)
+	// Propose commits the change to a new branch and opens a pull request for
+	// it, returning the pull request URL. A head branch left over from an
+	// attempt that failed before opening the pull request is started over
+	// from the base.
+	Propose(ctx context.Context, repo string, change Change) (string, error)
+}
+
+// New returns a client for the API at apiURL authenticating with token
+func New(kind Kind, apiURL, token string) (Client, error) {
+	a := api{
+		base: strings.TrimSuffix(apiURL, "/"),
+		http: &http.Client{Timeout: 30 * time.Second},
+	}
+	switch kind {
+	case KindGitHub:
+		a.header = func(h http.Header) {
+			h.Set("Accept", "application/vnd.github+json")
+			if token != "" {
+				h.Set("Authorization", "Bearer "+token)
+			}
+		}
+		return &github{api: a}, nil
+	case KindGitea:
+		a.header = func(h http.Header) {
+			if token != "" {
+				h.Set("Authorization", "token "+token)
+			}
+		}
+		return &gitea{api: a}, nil
+	case KindGitLab:
+		a.header = func(h http.Header) {
+			if token != "" {
+				h.Set("PRIVATE-TOKEN", token)
+			}
+		}
+		return &gitlab{api: a}, nil
+	default:
+		return nil, errors.Errorf("unknown git provider %q", kind)
+	}
+}
+
+// StatusError is returned for requests the API answered with an error
+type StatusError struct {
+	Method  string
+	Path    string
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.Path, e.Code, http.StatusText(e.Code), e.Message)
+}
+
+// IsNotFound reports whether err is a 404 response
+func IsNotFound(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+// isUnprocessable reports whether err is a 422 response, which GitHub sends
+// for refs that already exist
+func isUnprocessable(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusUnprocessableEntity
+}
+
+// api does the JSON requests all hosting services share
+type api struct {
+	base   string
+	header func(http.Header)
+	http   *http.Client
+}
+
+// do sends in as the JSON body of a request to path, which has to be
+// escaped already, and decodes the response into out when it's not nil
+func (a api) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	u := a.base + "/" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return errors.Wrap(err, "encoding request")
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	a.header(req.Header)
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "%s %s", method, path)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{Method: method, Path: path, Code: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Wrapf(err, "decoding response of %s %s", method, path)
+	}
+	return nil
+}
+
+// escapePath escapes every segment of a slash separated path
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,210 @@
+package forge_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sjafferali/portainer-autoupdater/internal/forge"
+	"github.com/sjafferali/portainer-autoupdater/internal/forge/fake"
+)
+
+func TestParseRepository(t *testing.T) {
+	for raw, want := range map[string]forge.Repository{
+		"https://github.com/org/app.git":              {Host: "github.com", Path: "org/app"},
+		"https://github.com/org/app":                  {Host: "github.com", Path: "org/app"},
+		"http://gitea.lan:3000/org/app.git":           {Host: "gitea.lan:3000", Path: "org/app"},
+		"https://gitlab.com/group/sub/app.git":        {Host: "gitlab.com", Path: "group/sub/app"},
+		"git@github.com:org/app.git":                  {Host: "github.com", Path: "org/app"},
+		"ssh://git@gitea.lan:2222/org/app.git":        {Host: "gitea.lan", Path: "org/app"},
+		"https://user@git.example.com/org/app.git/":   {Host: "git.example.com", Path: "org/app"},
+		"https://git.example.com/org/app.git?ref=foo": {Host: "git.example.com", Path: "org/app"},
+	} {
+		got, err := forge.ParseRepository(raw)
+		if err != nil {
+			t.Errorf("%s: %s", raw, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", raw, got, want)
+		}
+	}
+
+	for _, raw := range []string{"", "https://github.com/app", "app"} {
+		if _, err := forge.ParseRepository(raw); err == nil {
+			t.Errorf("%q: want error", raw)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	for host, want := range map[string]forge.Kind{
+		"github.com":        forge.KindGitHub,
+		"gitlab.com":        forge.KindGitLab,
+		"gitlab.corp.local": forge.KindGitLab,
+		"codeberg.org":      forge.KindGitea,
+		"gitea.lan:3000":    forge.KindGitea,
+		"git.example.com":   "",
+	} {
+		if got, _ := forge.Detect(host); got != want {
+			t.Errorf("%s: got %q, want %q", host, got, want)
+		}
+	}
+
+	if got := forge.APIURL(forge.KindGitHub, "github.com"); got != "https://api.github.com" {
+		t.Errorf("got github api %s", got)
+	}
+	if got := forge.APIURL(forge.KindGitHub, "github.corp"); got != "https://github.corp/api/v3" {
+		t.Errorf("got github enterprise api %s", got)
+	}
+}
+
+const compose = "services:\n  db:\n    image: postgres:15.4\n"
+
+func TestPropose(t *testing.T) {
+	for _, kind := range []forge.Kind{forge.KindGitHub, forge.KindGitea, forge.KindGitLab} {
+		t.Run(string(kind), func(t *testing.T) {
+			srv := fake.NewServer("secret")
+			t.Cleanup(srv.Close)
+			srv.AddRepository("org/app", "main", map[string]string{"deploy/compose.yml": compose})
+
+			c, err := forge.New(kind, srv.APIURL(kind), "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+
+			branch, err := c.DefaultBranch(ctx, "org/app")
+			if err != nil || branch != "main" {
+				t.Fatalf("got default branch %q (%v), want main", branch, err)
+			}
+
+			file, err := c.File(ctx, "org/app", "main", "deploy/compose.yml")
+			if err != nil {
+				t.Fatalf("reading file: %s", err)
+			}
+			if file.Content != compose {
+				t.Errorf("got file %q, want %q", file.Content, compose)
+			}
+
+			if pr, err := c.FindPullRequest(ctx, "org/app", "bump"); err != nil || pr != nil {
+				t.Fatalf("got pull request %+v (%v) before proposing, want none", pr, err)
+			}
+
+			bumped := strings.Replace(compose, "15.4", "15.5", 1)
+			change := forge.Change{
+				Base:    "main",
+				Head:    "bump",
+				Path:    "deploy/compose.yml",
+				Content: bumped,
+				Version: file.Version,
+				Message: "Bump postgres to 15.5",
+				Title:   "Bump postgres to 15.5",
+				Body:    "db: postgres:15.5",
+			}
+			url, err := c.Propose(ctx, "org/app", change)
+			if err != nil {
+				t.Fatalf("proposing change: %s", err)
+			}
+
+			pulls := srv.PullRequests()
+			if len(pulls) != 1 || pulls[0].URL != url || pulls[0].Base != "main" || pulls[0].Head != "bump" || pulls[0].Body != change.Body {
+				t.Fatalf("got pull requests %+v, want one from bump to main at %s", pulls, url)
+			}
+			if got, _ := srv.File("org/app", "bump", "deploy/compose.yml"); got != bumped {
+				t.Errorf("got file %q on the head branch, want %q", got, bumped)
+			}
+			if got, _ := srv.File("org/app", "main", "deploy/compose.yml"); got != compose {
+				t.Errorf("base branch was changed to %q", got)
+			}
+
+			pr, err := c.FindPullRequest(ctx, "org/app", "bump")
+			if err != nil || pr == nil || pr.URL != url || !pr.Open {
+				t.Fatalf("got pull request %+v (%v), want the open pull request", pr, err)
+			}
+			srv.ClosePullRequests()
+			if pr, err := c.FindPullRequest(ctx, "org/app", "bump"); err != nil || pr == nil || pr.Open {
+				t.Fatalf("got pull request %+v (%v), want the closed pull request", pr, err)
+			}
+
+			// the file changed on main since it was read
+			change.Head = "stale"
+			change.Version = "0000"
+			if _, err := c.Propose(ctx, "org/app", change); err == nil {
+				t.Error("want error proposing a change to an outdated file")
+			}
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	srv := fake.NewServer("secret")
+	t.Cleanup(srv.Close)
+	srv.AddRepository("org/app", "main", nil)
+
+	for _, kind := range []forge.Kind{forge.KindGitHub, forge.KindGitea, forge.KindGitLab} {
+		c, err := forge.New(kind, srv.APIURL(kind), "wrong")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.DefaultBranch(context.Background(), "org/app"); err == nil {
+			t.Errorf("%s: want error for a wrong token", kind)
+		}
+		c, _ = forge.New(kind, srv.APIURL(kind), "secret")
+		if _, err := c.File(context.Background(), "org/app", "main", "missing.yml"); !forge.IsNotFound(err) {
+			t.Errorf("%s: got %v for a missing file, want not found", kind, err)
+		}
+	}
+}
+
+func TestProposeRetry(t *testing.T) {
+	for _, kind := range []forge.Kind{forge.KindGitHub, forge.KindGitea, forge.KindGitLab} {
+		t.Run(string(kind), func(t *testing.T) {
+			srv := fake.NewServer("secret")
+			t.Cleanup(srv.Close)
+			srv.AddRepository("org/app", "main", map[string]string{"deploy/compose.yml": compose})
+
+			c, err := forge.New(kind, srv.APIURL(kind), "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+
+			file, err := c.File(ctx, "org/app", "main", "deploy/compose.yml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bumped := strings.Replace(compose, "15.4", "15.5", 1)
+			change := forge.Change{
+				Base:    "main",
+				Head:    "autoupdater/db-1234",
+				Path:    "deploy/compose.yml",
+				Content: bumped,
+				Version: file.Version,
+				Message: "Bump postgres to 15.5",
+				Title:   "Bump postgres to 15.5",
+			}
+
+			// the branch is pushed, opening the pull request fails
+			srv.FailPullRequests(1)
+			if _, err := c.Propose(ctx, "org/app", change); err == nil {
+				t.Fatal("want error when the pull request can't be opened")
+			}
+			if branches := srv.Branches("org/app"); len(branches) != 2 || len(srv.PullRequests()) != 0 {
+				t.Fatalf("got branches %v and pull requests %+v, want the head branch left over", branches, srv.PullRequests())
+			}
+
+			url, err := c.Propose(ctx, "org/app", change)
+			if err != nil {
+				t.Fatalf("proposing again over the left over branch: %s", err)
+			}
+			pulls := srv.PullRequests()
+			if len(pulls) != 1 || pulls[0].URL != url || pulls[0].Head != change.Head {
+				t.Fatalf("got pull requests %+v, want one from %s", pulls, change.Head)
+			}
+			if got, _ := srv.File("org/app", change.Head, "deploy/compose.yml"); got != bumped {
+				t.Errorf("got file %q on the head branch, want %q", got, bumped)
+			}
+		})
+	}
+}
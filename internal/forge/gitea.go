@@ -0,0 +1,109 @@
+package forge
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// maximum number of pull request pages searched on Gitea, which can't filter
+// pull requests by their head branch
+const giteaMaxPages = 20
+
+// gitea talks to the REST API of Gitea and Forgejo
+type gitea struct {
+	api
+}
+
+func (c *gitea) DefaultBranch(ctx context.Context, repo string) (string, error) {
+	var r struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := c.do(ctx, http.MethodGet, "repos/"+escapePath(repo), nil, nil, &r); err != nil {
+		return "", errors.Wrap(err, "getting repository")
+	}
+	return r.DefaultBranch, nil
+}
+
+func (c *gitea) File(ctx context.Context, repo, branch, path string) (File, error) {
+	var f struct {
+		Content string `json:"content"`
+		SHA     string `json:"sha"`
+	}
+	err := c.do(ctx, http.MethodGet, "repos/"+escapePath(repo)+"/contents/"+escapePath(path),
+		url.Values{"ref": {branch}}, nil, &f)
+	if err != nil {
+		return File{}, errors.Wrapf(err, "getting file %s", path)
+	}
+	content, err := decodeContent(f.Content)
+	if err != nil {
+		return File{}, errors.Wrapf(err, "decoding file %s", path)
+	}
+	return File{Content: content, Version: f.SHA}, nil
+}
+
+func (c *gitea) FindPullRequest(ctx context.Context, repo, head string) (*PullRequest, error) {
+	for page := 1; page <= giteaMaxPages; page++ {
+		var pulls []struct {
+			HTMLURL string `json:"html_url"`
+			State   string `json:"state"`
+			Head    struct {
+				Ref string `json:"ref"`
+			} `json:"head"`
+		}
+		err := c.do(ctx, http.MethodGet, "repos/"+escapePath(repo)+"/pulls",
+			url.Values{"state": {"all"}, "page": {strconv.Itoa(page)}, "limit": {"50"}}, nil, &pulls)
+		if err != nil {
+			return nil, errors.Wrap(err, "listing pull requests")
+		}
+		for _, pull := range pulls {
+			if pull.Head.Ref == head {
+				return &PullRequest{URL: pull.HTMLURL, Open: pull.State == "open"}, nil
+			}
+		}
+		if len(pulls) == 0 {
+			break
+		}
+	}
+	return nil, nil
+}
+
+func (c *gitea) Propose(ctx context.Context, repo string, change Change) (string, error) {
+	path := "repos/" + escapePath(repo)
+
+	// left over from an attempt that failed before opening the pull request
+	err := c.do(ctx, http.MethodDelete, path+"/branches/"+escapePath(change.Head), nil, nil, nil)
+	if err != nil && !IsNotFound(err) {
+		return "", errors.Wrapf(err, "deleting branch %s", change.Head)
+	}
+
+	// updating the file on a new branch creates the branch
+	err = c.do(ctx, http.MethodPut, path+"/contents/"+escapePath(change.Path), nil, map[string]string{
+		"message":    change.Message,
+		"content":    base64.StdEncoding.EncodeToString([]byte(change.Content)),
+		"sha":        change.Version,
+		"branch":     change.Base,
+		"new_branch": change.Head,
+	}, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "committing %s", change.Path)
+	}
+
+	var pull struct {
+		HTMLURL string `json:"html_url"`
+	}
+	err = c.do(ctx, http.MethodPost, path+"/pulls", nil, map[string]string{
+		"title": change.Title,
+		"body":  change.Body,
+		"head":  change.Head,
+		"base":  change.Base,
+	}, &pull)
+	if err != nil {
+		return "", errors.Wrap(err, "opening pull request")
+	}
+	return pull.HTMLURL, nil
+}
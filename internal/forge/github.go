@@ -0,0 +1,119 @@
+package forge
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// github talks to the REST API of GitHub and GitHub Enterprise
+type github struct {
+	api
+}
+
+func (c *github) DefaultBranch(ctx context.Context, repo string) (string, error) {
+	var r struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := c.do(ctx, http.MethodGet, "repos/"+escapePath(repo), nil, nil, &r); err != nil {
+		return "", errors.Wrap(err, "getting repository")
+	}
+	return r.DefaultBranch, nil
+}
+
+func (c *github) File(ctx context.Context, repo, branch, path string) (File, error) {
+	var f struct {
+		Content string `json:"content"`
+		SHA     string `json:"sha"`
+	}
+	err := c.do(ctx, http.MethodGet, "repos/"+escapePath(repo)+"/contents/"+escapePath(path),
+		url.Values{"ref": {branch}}, nil, &f)
+	if err != nil {
+		return File{}, errors.Wrapf(err, "getting file %s", path)
+	}
+	content, err := decodeContent(f.Content)
+	if err != nil {
+		return File{}, errors.Wrapf(err, "decoding file %s", path)
+	}
+	return File{Content: content, Version: f.SHA}, nil
+}
+
+func (c *github) FindPullRequest(ctx context.Context, repo, head string) (*PullRequest, error) {
+	owner, _, _ := strings.Cut(repo, "/")
+	var pulls []struct {
+		HTMLURL string `json:"html_url"`
+		State   string `json:"state"`
+	}
+	err := c.do(ctx, http.MethodGet, "repos/"+escapePath(repo)+"/pulls",
+		url.Values{"state": {"all"}, "head": {owner + ":" + head}}, nil, &pulls)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing pull requests")
+	}
+	if len(pulls) == 0 {
+		return nil, nil
+	}
+	return &PullRequest{URL: pulls[0].HTMLURL, Open: pulls[0].State == "open"}, nil
+}
+
+func (c *github) Propose(ctx context.Context, repo string, change Change) (string, error) {
+	path := "repos/" + escapePath(repo)
+
+	var base struct {
+		Object struct {
+			SHA string `json:"sha"`
+		} `json:"object"`
+	}
+	if err := c.do(ctx, http.MethodGet, path+"/git/ref/heads/"+escapePath(change.Base), nil, nil, &base); err != nil {
+		return "", errors.Wrapf(err, "getting branch %s", change.Base)
+	}
+
+	err := c.do(ctx, http.MethodPost, path+"/git/refs", nil, map[string]string{
+		"ref": "refs/heads/" + change.Head,
+		"sha": base.Object.SHA,
+	}, nil)
+	if isUnprocessable(err) {
+		// left over from an attempt that failed before opening the pull
+		// request, start it over from the base
+		err = c.do(ctx, http.MethodPatch, path+"/git/refs/heads/"+escapePath(change.Head), nil, map[string]interface{}{
+			"sha":   base.Object.SHA,
+			"force": true,
+		}, nil)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "creating branch %s", change.Head)
+	}
+
+	err = c.do(ctx, http.MethodPut, path+"/contents/"+escapePath(change.Path), nil, map[string]string{
+		"message": change.Message,
+		"content": base64.StdEncoding.EncodeToString([]byte(change.Content)),
+		"sha":     change.Version,
+		"branch":  change.Head,
+	}, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "committing %s", change.Path)
+	}
+
+	var pull struct {
+		HTMLURL string `json:"html_url"`
+	}
+	err = c.do(ctx, http.MethodPost, path+"/pulls", nil, map[string]string{
+		"title": change.Title,
+		"body":  change.Body,
+		"head":  change.Head,
+		"base":  change.Base,
+	}, &pull)
+	if err != nil {
+		return "", errors.Wrap(err, "opening pull request")
+	}
+	return pull.HTMLURL, nil
+}
+
+// decodeContent decodes base64 file contents, GitHub wraps them in lines
+func decodeContent(content string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(content, "\n", ""))
+	return string(b), err
+}
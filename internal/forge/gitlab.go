@@ -0,0 +1,103 @@
+package forge
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// gitlab talks to the REST API of GitLab, where pull requests are called
+// merge requests and repositories projects
+type gitlab struct {
+	api
+}
+
+// project returns the API path of a project, its full path is escaped
+// into a single segment
+func project(repo string) string {
+	return "projects/" + url.PathEscape(repo)
+}
+
+func (c *gitlab) DefaultBranch(ctx context.Context, repo string) (string, error) {
+	var p struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := c.do(ctx, http.MethodGet, project(repo), nil, nil, &p); err != nil {
+		return "", errors.Wrap(err, "getting project")
+	}
+	return p.DefaultBranch, nil
+}
+
+func (c *gitlab) File(ctx context.Context, repo, branch, path string) (File, error) {
+	var f struct {
+		Content      string `json:"content"`
+		LastCommitID string `json:"last_commit_id"`
+	}
+	err := c.do(ctx, http.MethodGet, project(repo)+"/repository/files/"+url.PathEscape(path),
+		url.Values{"ref": {branch}}, nil, &f)
+	if err != nil {
+		return File{}, errors.Wrapf(err, "getting file %s", path)
+	}
+	content, err := decodeContent(f.Content)
+	if err != nil {
+		return File{}, errors.Wrapf(err, "decoding file %s", path)
+	}
+	return File{Content: content, Version: f.LastCommitID}, nil
+}
+
+func (c *gitlab) FindPullRequest(ctx context.Context, repo, head string) (*PullRequest, error) {
+	var mrs []struct {
+		WebURL string `json:"web_url"`
+		State  string `json:"state"`
+	}
+	err := c.do(ctx, http.MethodGet, project(repo)+"/merge_requests",
+		url.Values{"state": {"all"}, "source_branch": {head}}, nil, &mrs)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing merge requests")
+	}
+	if len(mrs) == 0 {
+		return nil, nil
+	}
+	return &PullRequest{URL: mrs[0].WebURL, Open: mrs[0].State == "opened"}, nil
+}
+
+func (c *gitlab) Propose(ctx context.Context, repo string, change Change) (string, error) {
+	// left over from an attempt that failed before opening the merge request
+	err := c.do(ctx, http.MethodDelete, project(repo)+"/repository/branches/"+url.PathEscape(change.Head), nil, nil, nil)
+	if err != nil && !IsNotFound(err) {
+		return "", errors.Wrapf(err, "deleting branch %s", change.Head)
+	}
+
+	// a commit with a start branch creates the branch
+	err = c.do(ctx, http.MethodPost, project(repo)+"/repository/commits", nil, map[string]interface{}{
+		"branch":         change.Head,
+		"start_branch":   change.Base,
+		"commit_message": change.Message,
+		"actions": []map[string]string{{
+			"action":         "update",
+			"file_path":      change.Path,
+			"content":        change.Content,
+			"last_commit_id": change.Version,
+		}},
+	}, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "committing %s", change.Path)
+	}
+
+	var mr struct {
+		WebURL string `json:"web_url"`
+	}
+	err = c.do(ctx, http.MethodPost, project(repo)+"/merge_requests", nil, map[string]interface{}{
+		"source_branch":        change.Head,
+		"target_branch":        change.Base,
+		"title":                change.Title,
+		"description":          change.Body,
+		"remove_source_branch": true,
+	}, &mr)
+	if err != nil {
+		return "", errors.Wrap(err, "opening merge request")
+	}
+	return mr.WebURL, nil
+}
@@ -0,0 +1,181 @@
+// Package gitremote looks up the references of remote git repositories like
+// git ls-remote does. It speaks the smart http protocol, so no git binary is
+// needed, and repositories reached over ssh aren't supported.
+package gitremote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HEAD is the reference to the default branch of a repository
+const HEAD = "HEAD"
+
+// peeledSuffix marks the commit an annotated tag points to
+const peeledSuffix = "^{}"
+
+// Options control how the repository is reached
+type Options struct {
+	// Username and Password are sent with basic authentication when the
+	// password is set
+	Username string
+	Password string
+	// InsecureSkipVerify skips verifying the certificate of the server
+	InsecureSkipVerify bool
+}
+
+// ListRefs returns the references of the repository at repoURL mapped to
+// the commits they point to. Annotated tags are mapped to the commit they
+// tag rather than to the tag object.
+func ListRefs(ctx context.Context, repoURL string, opts Options) (map[string]string, error) {
+	if !strings.HasPrefix(repoURL, "https://") && !strings.HasPrefix(repoURL, "http://") {
+		return nil, errors.Errorf("only http and https repositories can be checked, not %s", repoURL)
+	}
+
+	u := strings.TrimSuffix(repoURL, "/") + "/info/refs?service=git-upload-pack"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("User-Agent", "git/portainer-autoupdater")
+	if opts.Password != "" {
+		req.SetBasicAuth(opts.Username, opts.Password)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	if opts.InsecureSkipVerify {
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing references")
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, errors.Errorf("listing references: %s, check the repository credentials", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, errors.Errorf("listing references: %s", resp.Status)
+	case !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-git-upload-pack-advertisement"):
+		return nil, errors.New("listing references: not a smart http git server")
+	}
+	return parseAdvertisement(resp.Body)
+}
+
+// Resolve returns the commit ref points to. ref may be a full reference such
+// as refs/heads/main, a branch or tag name, or empty for the default branch.
+func Resolve(ctx context.Context, repoURL, ref string, opts Options) (string, error) {
+	refs, err := ListRefs(ctx, repoURL, opts)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := []string{ref}
+	switch {
+	case ref == "":
+		candidates = []string{HEAD}
+	case ref != HEAD && !strings.HasPrefix(ref, "refs/"):
+		candidates = []string{"refs/heads/" + ref, "refs/tags/" + ref}
+	}
+	for _, name := range candidates {
+		if commit, ok := refs[name]; ok {
+			return commit, nil
+		}
+	}
+	return "", errors.Errorf("reference %s not found", candidates[0])
+}
+
+// parseAdvertisement reads the references a server advertises in pkt-line
+// format: a service announcement, then one line per reference, the first
+// carrying the capabilities after a NUL byte
+func parseAdvertisement(r io.Reader) (map[string]string, error) {
+	br := bufio.NewReader(r)
+	refs := make(map[string]string)
+	peeled := make(map[string]string)
+
+	first := true
+	for {
+		line, flush, err := readPktLine(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			continue
+		}
+		if first && bytes.HasPrefix(line, []byte("# service=")) {
+			first = false
+			continue
+		}
+		first = false
+
+		line, _, _ = bytes.Cut(line, []byte{0})
+		commit, name, ok := strings.Cut(strings.TrimSuffix(string(line), "\n"), " ")
+		if !ok || (len(commit) != 40 && len(commit) != 64) {
+			return nil, errors.Errorf("invalid reference line %q", line)
+		}
+		if _, err := hex.DecodeString(commit); err != nil {
+			return nil, errors.Errorf("invalid reference line %q", line)
+		}
+
+		switch tag, ok := strings.CutSuffix(name, peeledSuffix); {
+		case name == "capabilities"+peeledSuffix:
+			// empty repositories advertise only their capabilities
+		case ok:
+			peeled[tag] = commit
+		default:
+			refs[name] = commit
+		}
+	}
+
+	for name, commit := range peeled {
+		refs[name] = commit
+	}
+	return refs, nil
+}
+
+// readPktLine reads a line prefixed with its length in four hex digits, 0000
+// is a flush packet
+func readPktLine(r *bufio.Reader) ([]byte, bool, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, false, errors.New("truncated pkt-line")
+		}
+		return nil, false, err
+	}
+
+	n, err := strconv.ParseUint(string(prefix[:]), 16, 16)
+	if err != nil {
+		return nil, false, errors.Errorf("invalid pkt-line length %q", prefix)
+	}
+	if n == 0 {
+		return nil, true, nil
+	}
+	if n < 4 {
+		return nil, false, errors.Errorf("invalid pkt-line length %d", n)
+	}
+
+	line := make([]byte, n-4)
+	if _, err := io.ReadFull(r, line); err != nil {
+		return nil, false, errors.New("truncated pkt-line")
+	}
+	return line, false, nil
+}
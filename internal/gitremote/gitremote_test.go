@@ -0,0 +1,115 @@
+package gitremote_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sjafferali/portainer-autoupdater/internal/gitremote"
+)
+
+const (
+	mainCommit   = "1111111111111111111111111111111111111111"
+	devCommit    = "2222222222222222222222222222222222222222"
+	tagObject    = "3333333333333333333333333333333333333333"
+	taggedCommit = "4444444444444444444444444444444444444444"
+	lightCommit  = "5555555555555555555555555555555555555555"
+)
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+// newServer serves a reference advertisement like git http-backend does, the
+// password is required when it's set
+func newServer(t *testing.T, password string, lines ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/org/app.git/info/refs" || r.URL.Query().Get("service") != "git-upload-pack" {
+			http.NotFound(w, r)
+			return
+		}
+		if _, pass, _ := r.BasicAuth(); pass != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		body := pktLine("# service=git-upload-pack\n") + "0000"
+		for _, line := range lines {
+			body += pktLine(line)
+		}
+		_, _ = w.Write([]byte(body + "0000"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResolve(t *testing.T) {
+	srv := newServer(t, "",
+		mainCommit+" HEAD\x00multi_ack symref=HEAD:refs/heads/main\n",
+		mainCommit+" refs/heads/main\n",
+		devCommit+" refs/heads/dev\n",
+		tagObject+" refs/tags/v1\n",
+		taggedCommit+" refs/tags/v1^{}\n",
+		lightCommit+" refs/tags/dev-build\n",
+	)
+	url := srv.URL + "/org/app.git"
+
+	for ref, want := range map[string]string{
+		"":                    mainCommit,
+		"HEAD":                mainCommit,
+		"refs/heads/main":     mainCommit,
+		"main":                mainCommit,
+		"dev":                 devCommit,
+		"refs/tags/v1":        taggedCommit,
+		"v1":                  taggedCommit,
+		"dev-build":           lightCommit,
+		"refs/tags/dev-build": lightCommit,
+	} {
+		got, err := gitremote.Resolve(context.Background(), url, ref, gitremote.Options{})
+		if err != nil {
+			t.Errorf("%q: %s", ref, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: got %s, want %s", ref, got, want)
+		}
+	}
+
+	if _, err := gitremote.Resolve(context.Background(), url, "refs/heads/missing", gitremote.Options{}); err == nil {
+		t.Error("want error for a missing reference")
+	}
+	if _, err := gitremote.Resolve(context.Background(), "git@github.com:org/app.git", "", gitremote.Options{}); err == nil {
+		t.Error("want error for an ssh repository")
+	}
+}
+
+func TestListRefsAuthentication(t *testing.T) {
+	srv := newServer(t, "secret", mainCommit+" refs/heads/main\x00agent=git/2\n")
+	url := srv.URL + "/org/app.git"
+
+	if _, err := gitremote.ListRefs(context.Background(), url, gitremote.Options{}); err == nil || !strings.Contains(err.Error(), "credentials") {
+		t.Errorf("got %v without credentials, want an authentication error", err)
+	}
+	refs, err := gitremote.ListRefs(context.Background(), url, gitremote.Options{Username: "robot", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs["refs/heads/main"] != mainCommit || len(refs) != 1 {
+		t.Errorf("got refs %v", refs)
+	}
+}
+
+func TestListRefsEmpty(t *testing.T) {
+	srv := newServer(t, "", strings.Repeat("0", 40)+" capabilities^{}\x00agent=git/2\n")
+	refs, err := gitremote.ListRefs(context.Background(), srv.URL+"/org/app.git", gitremote.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 0 {
+		t.Errorf("got refs %v for an empty repository", refs)
+	}
+}
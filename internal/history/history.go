@@ -0,0 +1,221 @@
+package history
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+	bolt "go.etcd.io/bbolt"
+)
+
+var recordsBucket = []byte("records")
+
+// how long to wait for another process holding the database
+var lockTimeout = time.Second * 10
+
+// Action tells whether a record is a plain check or an update
+type Action string
+
+const (
+	ActionCheck  Action = "check"
+	ActionUpdate Action = "update"
+)
+
+// Record is a single check or update of a stack, service or container
+type Record struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Action Action    `json:"action"`
+	notify.Result
+}
+
+// Query selects records, zero values match everything
+type Query struct {
+	Instance   string
+	Kind       string
+	ID         string
+	Name       string
+	EndpointID int
+	Action     Action
+	Since      time.Time
+	Limit      int
+}
+
+func (q Query) matches(r Record) bool {
+	switch {
+	case q.Instance != "" && r.Instance != q.Instance:
+		return false
+	case q.Kind != "" && r.Kind != q.Kind:
+		return false
+	case q.ID != "" && r.ID != q.ID:
+		return false
+	case q.Name != "" && r.Name != q.Name:
+		return false
+	case q.EndpointID != 0 && r.EndpointID != q.EndpointID:
+		return false
+	case q.Action != "" && r.Action != q.Action:
+		return false
+	}
+	return true
+}
+
+// Store keeps the history in a bbolt database. The file is only opened while
+// reading or writing so the history command can read it while the updater runs.
+type Store struct {
+	path      string
+	retention time.Duration
+
+	mu sync.Mutex
+}
+
+// Open returns a store writing to path, records older than retention are
+// dropped, a zero retention keeps everything
+func Open(path string, retention time.Duration) (*Store, error) {
+	s := &Store{path: path, retention: retention}
+	err := s.update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(recordsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) open(readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: lockTimeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening history %s", s.path)
+	}
+	return db, nil
+}
+
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// Notify records the results of every run
+func (s *Store) Notify(_ context.Context, event notify.Event) error {
+	if event.Type != notify.EventRunSummary || event.Summary == nil {
+		return nil
+	}
+	return s.Add(event.Summary.Finished, event.Summary.Results...)
+}
+
+// Add records results that were produced at t
+func (s *Store) Add(t time.Time, results ...notify.Result) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	err := s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recordsBucket)
+		for _, result := range results {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			r := Record{Seq: seq, Time: t, Action: ActionCheck, Result: result}
+			if result.Update != nil {
+				r.Action = ActionUpdate
+			}
+
+			value, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key(seq), value); err != nil {
+				return err
+			}
+		}
+		return s.prune(b)
+	})
+	return errors.Wrap(err, "writing history")
+}
+
+// prune drops records past the retention, they are stored oldest first
+func (s *Store) prune(b *bolt.Bucket) error {
+	if s.retention <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().Add(-s.retention)
+	c := b.Cursor()
+	// a delete moves the cursor, the oldest record left is the next one
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		var r Record
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		if !r.Time.Before(cutoff) {
+			return nil
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns matching records, newest first
+func (s *Store) Query(q Query) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	db, err := s.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	records := make([]Record, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recordsBucket)
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.Time.Before(q.Since) {
+				break
+			}
+			if !q.matches(r) {
+				continue
+			}
+
+			records = append(records, r)
+			if q.Limit > 0 && len(records) >= q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading history")
+	}
+	return records, nil
+}
+
+func key(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
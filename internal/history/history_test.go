@@ -0,0 +1,230 @@
+package history
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+)
+
+func testStore(t *testing.T, retention time.Duration) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"), retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func result(instance, kind, id, name string, endpointID int) notify.Result {
+	return notify.Result{
+		Target: notify.Target{
+			Instance:   instance,
+			Kind:       kind,
+			ID:         id,
+			Name:       name,
+			EndpointID: endpointID,
+		},
+		Outcome: notify.OutcomeUpToDate,
+	}
+}
+
+func TestQueryMatches(t *testing.T) {
+	r := Record{
+		Action: ActionUpdate,
+		Result: result("prod", notify.KindStack, "1", "web", 2),
+	}
+	for _, tc := range []struct {
+		name  string
+		query Query
+		want  bool
+	}{
+		{name: "empty", query: Query{}, want: true},
+		{name: "all fields", query: Query{Instance: "prod", Kind: notify.KindStack, ID: "1", Name: "web", EndpointID: 2, Action: ActionUpdate}, want: true},
+		{name: "instance", query: Query{Instance: "staging"}, want: false},
+		{name: "kind", query: Query{Kind: notify.KindService}, want: false},
+		{name: "id", query: Query{ID: "2"}, want: false},
+		{name: "name", query: Query{Name: "db"}, want: false},
+		{name: "endpoint", query: Query{EndpointID: 1}, want: false},
+		{name: "action", query: Query{Action: ActionCheck}, want: false},
+		{name: "one mismatch", query: Query{Kind: notify.KindStack, Name: "db"}, want: false},
+		// since and limit are applied while reading
+		{name: "since", query: Query{Since: time.Now()}, want: true},
+		{name: "limit", query: Query{Limit: 1}, want: true},
+	} {
+		if got := tc.query.matches(r); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAddAndQuery(t *testing.T) {
+	s := testStore(t, 0)
+	now := time.Now().Truncate(time.Second)
+
+	updated := result("", notify.KindStack, "1", "web", 1)
+	updated.Outcome = notify.OutcomeUpdated
+	updated.Update = &notify.Update{ImagesBefore: map[string]string{"web": "nginx@sha256:111"}}
+	if err := s.Add(now.Add(-2*time.Hour), result("", notify.KindStack, "1", "web", 1), result("", notify.KindContainer, "c0ffee", "proxy", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(now.Add(-time.Hour), updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(now, result("", notify.KindStack, "1", "web", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(now); err != nil {
+		t.Fatalf("adding nothing: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		query Query
+		want  []uint64
+	}{
+		{name: "everything newest first", query: Query{}, want: []uint64{4, 3, 2, 1}},
+		{name: "limit", query: Query{Limit: 2}, want: []uint64{4, 3}},
+		{name: "since", query: Query{Since: now.Add(-time.Hour)}, want: []uint64{4, 3}},
+		{name: "since is inclusive", query: Query{Since: now}, want: []uint64{4}},
+		{name: "kind", query: Query{Kind: notify.KindContainer}, want: []uint64{2}},
+		{name: "updates", query: Query{Action: ActionUpdate}, want: []uint64{3}},
+		{name: "limit applies to matches", query: Query{ID: "1", Limit: 2}, want: []uint64{4, 3}},
+		{name: "since and kind", query: Query{Kind: notify.KindContainer, Since: now.Add(-time.Hour)}, want: nil},
+	} {
+		records, err := s.Query(tc.query)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		var got []uint64
+		for _, r := range records {
+			got = append(got, r.Seq)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got records %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: got records %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+
+	records, err := s.Query(Query{Action: ActionUpdate})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("got %v (%v), want the update", records, err)
+	}
+	r := records[0]
+	if !r.Time.Equal(now.Add(-time.Hour)) || r.Outcome != notify.OutcomeUpdated || r.Update.ImagesBefore["web"] != "nginx@sha256:111" {
+		t.Errorf("got record %+v, want the update as added", r)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	s := testStore(t, 0)
+	ctx := context.Background()
+
+	if err := s.Notify(ctx, notify.NewEvent(notify.EventUpdateAvailable, nil)); err != nil {
+		t.Fatal(err)
+	}
+	summary := &notify.Summary{
+		Finished: time.Now(),
+		Results:  []notify.Result{result("", notify.KindStack, "1", "web", 1)},
+	}
+	event := notify.NewEvent(notify.EventRunSummary, nil)
+	event.Summary = summary
+	if err := s.Notify(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := s.Query(Query{})
+	if err != nil || len(records) != 1 || records[0].Action != ActionCheck {
+		t.Errorf("got %+v (%v), want the check of the run summary only", records, err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	s := testStore(t, 24*time.Hour)
+	now := time.Now()
+
+	// records past the retention are dropped when the next ones are added
+	for _, age := range []time.Duration{72 * time.Hour, 48 * time.Hour, 30 * time.Hour, 2 * time.Hour} {
+		if err := s.Add(now.Add(-age), result("", notify.KindStack, "1", "web", 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := s.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Seq != 4 {
+		t.Errorf("got %d records, want only the one within the retention", len(records))
+	}
+
+	if err := s.Add(now, result("", notify.KindStack, "1", "web", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := s.Query(Query{}); len(records) != 2 {
+		t.Errorf("got %d records, want records within the retention kept", len(records))
+	}
+
+	// without a retention everything is kept, until one is set
+	path := filepath.Join(t.TempDir(), "history.db")
+	keep, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, age := range []time.Duration{365 * 24 * time.Hour, 72 * time.Hour, 48 * time.Hour, 0} {
+		if err := keep.Add(now.Add(-age), result("", notify.KindStack, "1", "web", 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if records, _ := keep.Query(Query{}); len(records) != 4 {
+		t.Errorf("got %d records without retention, want 4", len(records))
+	}
+
+	pruned, err := Open(path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pruned.Add(now, result("", notify.KindStack, "1", "web", 1)); err != nil {
+		t.Fatal(err)
+	}
+	records, err = pruned.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Seq != 5 || records[1].Seq != 4 {
+		t.Errorf("got %d records, want all records past the retention dropped at once", len(records))
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	s, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(time.Now(), result("", notify.KindStack, "1", "web", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the history command opens the file next to the running updater
+	reader, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records, err := reader.Query(Query{}); err != nil || len(records) != 1 {
+		t.Errorf("got %d records (%v) from a second store, want 1", len(records), err)
+	}
+	if err := s.Add(time.Now(), result("", notify.KindStack, "1", "web", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := reader.Query(Query{}); len(records) != 2 {
+		t.Errorf("got %d records after another write, want 2", len(records))
+	}
+}
@@ -0,0 +1,169 @@
+// Package metrics exposes prometheus metrics about checks, updates and calls
+// to the portainer api.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+)
+
+const namespace = "portainer_autoupdater"
+
+// instance is empty unless several portainer instances are managed, prometheus
+// treats empty labels as missing
+var resourceLabels = []string{"instance", "kind", "endpoint", "name"}
+
+var (
+	checked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "checked_total",
+		Help:      "Number of image status checks.",
+	}, resourceLabels)
+
+	outdatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outdated_total",
+		Help:      "Number of checks that found outdated images.",
+	}, resourceLabels)
+
+	outdated = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "outdated",
+		Help:      "Whether the images were outdated at the last check.",
+	}, resourceLabels)
+
+	updated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updated_total",
+		Help:      "Number of updates performed.",
+	}, resourceLabels)
+
+	failed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failed_total",
+		Help:      "Number of failed checks or updates.",
+	}, resourceLabels)
+
+	rolledBack = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rolled_back_total",
+		Help:      "Number of updates that were rolled back.",
+	}, resourceLabels)
+
+	lastRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Time the last run finished.",
+	}, []string{"instance"})
+
+	lastSuccessfulRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_run_timestamp_seconds",
+		Help:      "Time the last run without any failures finished.",
+	}, []string{"instance"})
+
+	apiRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "portainer_api_request_duration_seconds",
+		Help:      "Latency of portainer api requests.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"instance", "method", "path", "code"})
+)
+
+var (
+	numericSegment = regexp.MustCompile(`^\d+$`)
+	idSegment      = regexp.MustCompile(`^(sha256:)?[0-9a-f]{12,64}$|^[0-9a-z]{25}$`)
+)
+
+// PathTemplate replaces the IDs in an api path so requests can be grouped,
+// api/stacks/12/file becomes api/stacks/{id}/file
+func PathTemplate(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if numericSegment.MatchString(s) || idSegment.MatchString(s) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// ObserveAPIRequest records the duration of a portainer api request, a code
+// of 0 means no response was received
+func ObserveAPIRequest(instance, method, path string, code int, duration time.Duration) {
+	apiRequestDuration.
+		WithLabelValues(instance, method, PathTemplate(path), strconv.Itoa(code)).
+		Observe(duration.Seconds())
+}
+
+// Handler serves the metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Notifier updates the metrics from update events and run summaries
+type Notifier struct{}
+
+func NewNotifier() *Notifier {
+	return &Notifier{}
+}
+
+func (n *Notifier) Notify(_ context.Context, event notify.Event) error {
+	switch event.Type {
+	case notify.EventUpdateRolledBack:
+		if event.Target != nil {
+			rolledBack.WithLabelValues(targetLabels(*event.Target)...).Inc()
+		}
+	case notify.EventRunSummary:
+		if event.Summary != nil {
+			observeSummary(event.Summary)
+		}
+	}
+	return nil
+}
+
+func observeSummary(summary *notify.Summary) {
+	for _, r := range summary.Results {
+		labels := targetLabels(r.Target)
+
+		checked.WithLabelValues(labels...).Inc()
+		if r.Status == "outdated" {
+			outdatedTotal.WithLabelValues(labels...).Inc()
+		}
+
+		switch r.Outcome {
+		case notify.OutcomeUpdated:
+			updated.WithLabelValues(labels...).Inc()
+			outdated.WithLabelValues(labels...).Set(0)
+		case notify.OutcomeFailed:
+			failed.WithLabelValues(labels...).Inc()
+		case notify.OutcomeHeldBack:
+			outdated.WithLabelValues(labels...).Set(1)
+		case notify.OutcomeUpToDate:
+			outdated.WithLabelValues(labels...).Set(0)
+		}
+	}
+
+	finished := float64(summary.Finished.Unix())
+	lastRun.WithLabelValues(summary.Instance).Set(finished)
+	if !summary.Failed() {
+		lastSuccessfulRun.WithLabelValues(summary.Instance).Set(finished)
+	}
+}
+
+func targetLabels(t notify.Target) []string {
+	endpoint := t.EndpointName
+	if endpoint == "" {
+		endpoint = strconv.Itoa(t.EndpointID)
+	}
+	return []string{t.Instance, t.Kind, endpoint, t.Name}
+}
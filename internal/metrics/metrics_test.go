@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sjafferali/portainer-autoupdater/internal/notify"
+)
+
+func TestPathTemplate(t *testing.T) {
+	for path, want := range map[string]string{
+		"api/stacks":                            "api/stacks",
+		"api/stacks/12/file":                    "api/stacks/{id}/file",
+		"api/stacks/12/images_status?refresh=1": "api/stacks/{id}/images_status",
+		"api/endpoints/2/docker/containers/4c01db0b339c/json":                       "api/endpoints/{id}/docker/containers/{id}/json",
+		"api/endpoints/2/docker/images/sha256:" + strings.Repeat("a", 64) + "/json": "api/endpoints/{id}/docker/images/{id}/json",
+		"api/endpoints/2/docker/services/x3ti8nmx5v1eq2cfkdgqhy5b7":                 "api/endpoints/{id}/docker/services/{id}",
+		"api/docker/2/services/web/image_status":                                    "api/docker/{id}/services/web/image_status",
+	} {
+		if got := PathTemplate(path); got != want {
+			t.Errorf("%s: got %s, want %s", path, got, want)
+		}
+	}
+}
+
+func result(instance, name string, status string, outcome notify.Outcome) notify.Result {
+	return notify.Result{
+		Target: notify.Target{
+			Instance:     instance,
+			Kind:         notify.KindStack,
+			ID:           name,
+			Name:         name,
+			EndpointID:   1,
+			EndpointName: "docker",
+		},
+		Status:  status,
+		Outcome: outcome,
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	// metrics are global, the instance label keeps the series of this test apart
+	const instance = "notifier-test"
+	n := NewNotifier()
+	ctx := context.Background()
+	labels := func(name string) []string { return []string{instance, notify.KindStack, "docker", name} }
+
+	finished := time.Unix(1700000000, 0)
+	summary := &notify.Summary{
+		Instance: instance,
+		Finished: finished,
+		Results: []notify.Result{
+			result(instance, "updated", "outdated", notify.OutcomeUpdated),
+			result(instance, "held", "outdated", notify.OutcomeHeldBack),
+			result(instance, "failed", "", notify.OutcomeFailed),
+			result(instance, "current", "updated", notify.OutcomeUpToDate),
+		},
+	}
+	event := notify.NewEvent(notify.EventRunSummary, nil)
+	event.Summary = summary
+	if err := n.Notify(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		checked  float64
+		outdated float64
+		gauge    float64
+		updated  float64
+		failed   float64
+	}{
+		{name: "updated", checked: 1, outdated: 1, gauge: 0, updated: 1},
+		{name: "held", checked: 1, outdated: 1, gauge: 1},
+		{name: "failed", checked: 1, failed: 1},
+		{name: "current", checked: 1},
+	} {
+		l := labels(tc.name)
+		for metric, got := range map[string]float64{
+			"checked":        testutil.ToFloat64(checked.WithLabelValues(l...)),
+			"outdated_total": testutil.ToFloat64(outdatedTotal.WithLabelValues(l...)),
+			"outdated":       testutil.ToFloat64(outdated.WithLabelValues(l...)),
+			"updated":        testutil.ToFloat64(updated.WithLabelValues(l...)),
+			"failed":         testutil.ToFloat64(failed.WithLabelValues(l...)),
+		} {
+			want := map[string]float64{
+				"checked":        tc.checked,
+				"outdated_total": tc.outdated,
+				"outdated":       tc.gauge,
+				"updated":        tc.updated,
+				"failed":         tc.failed,
+			}[metric]
+			if got != want {
+				t.Errorf("%s: got %s %v, want %v", tc.name, metric, got, want)
+			}
+		}
+	}
+
+	// a failed result keeps the last successful run
+	if got := testutil.ToFloat64(lastRun.WithLabelValues(instance)); got != float64(finished.Unix()) {
+		t.Errorf("got last run %v, want %d", got, finished.Unix())
+	}
+	if got := testutil.ToFloat64(lastSuccessfulRun.WithLabelValues(instance)); got != 0 {
+		t.Errorf("got last successful run %v for a failed run, want 0", got)
+	}
+	summary.Results = summary.Results[:1]
+	if err := n.Notify(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(lastSuccessfulRun.WithLabelValues(instance)); got != float64(finished.Unix()) {
+		t.Errorf("got last successful run %v, want %d", got, finished.Unix())
+	}
+	if got := testutil.ToFloat64(updated.WithLabelValues(labels("updated")...)); got != 2 {
+		t.Errorf("got %v updates after the second run, want 2", got)
+	}
+
+	// only rollbacks are counted from update events
+	target := result(instance, "updated", "outdated", notify.OutcomeFailed).Target
+	for _, eventType := range []notify.EventType{notify.EventUpdateSucceeded, notify.EventUpdateRolledBack} {
+		if err := n.Notify(ctx, notify.NewEvent(eventType, &target)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(rolledBack.WithLabelValues(labels("updated")...)); got != 1 {
+		t.Errorf("got %v rollbacks, want 1", got)
+	}
+	if got := testutil.ToFloat64(updated.WithLabelValues(labels("updated")...)); got != 2 {
+		t.Errorf("got %v updates after an update event, want it left to run summaries", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ObserveAPIRequest("handler-test", "GET", "api/stacks/3/file", 200, 20*time.Millisecond)
+	ObserveAPIRequest("handler-test", "GET", "api/stacks", 0, time.Second)
+
+	srv := httptest.NewServer(Handler())
+	t.Cleanup(srv.Close)
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`portainer_autoupdater_portainer_api_request_duration_seconds_count{code="200",instance="handler-test",method="GET",path="api/stacks/{id}/file"} 1`,
+		`portainer_autoupdater_portainer_api_request_duration_seconds_count{code="0",instance="handler-test",method="GET",path="api/stacks"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("want %s in the metrics", want)
+		}
+	}
+}
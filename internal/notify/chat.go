@@ -0,0 +1,152 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// limits of the chat platforms for a single message
+const (
+	slackTextLimit   = 3000
+	discordDescLimit = 4096
+	teamsTextLimit   = 20000
+)
+
+// Chat posts formatted messages to a Slack, Discord or Microsoft Teams
+// incoming webhook. Run summaries are sent as a single grouped message.
+type Chat struct {
+	client  *http.Client
+	url     string
+	payload func(m message) interface{}
+}
+
+func newChat(url string, payload func(m message) interface{}) (*Chat, error) {
+	if url == "" {
+		return nil, errors.New("webhook url is required")
+	}
+	return &Chat{
+		client:  &http.Client{Timeout: defaultWebhookTimeout},
+		url:     url,
+		payload: payload,
+	}, nil
+}
+
+// NewSlack returns a notifier posting to a slack incoming webhook
+func NewSlack(url string) (*Chat, error) {
+	return newChat(url, slackPayload)
+}
+
+// NewDiscord returns a notifier posting to a discord webhook
+func NewDiscord(url string) (*Chat, error) {
+	return newChat(url, discordPayload)
+}
+
+// NewTeams returns a notifier posting to a microsoft teams incoming webhook
+func NewTeams(url string) (*Chat, error) {
+	return newChat(url, teamsPayload)
+}
+
+func (c *Chat) Notify(ctx context.Context, event Event) error {
+	m := newMessage(event)
+
+	// a summary of a run where everything was up to date isn't worth a message
+	if event.Type == EventRunSummary && len(m.Lines) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(c.payload(m))
+	if err != nil {
+		return errors.Wrap(err, "marshalling chat message to json")
+	}
+
+	return postBody(ctx, c.client, http.MethodPost, c.url, "application/json", nil, body)
+}
+
+var severityColors = map[Severity]string{
+	SeverityInfo:    "439FE0",
+	SeveritySuccess: "2EB67D",
+	SeverityWarning: "ECB22E",
+	SeverityError:   "E01E5A",
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+type slackAttachment struct {
+	Color string `json:"color"`
+	Text  string `json:"text"`
+}
+
+func slackPayload(m message) interface{} {
+	msg := slackMessage{Text: "*" + m.Title + "*"}
+	if len(m.Lines) > 0 {
+		msg.Attachments = []slackAttachment{{
+			Color: "#" + severityColors[m.Severity],
+			Text:  truncate(bulletList(m.Lines), slackTextLimit),
+		}}
+	}
+	return msg
+}
+
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Color       int    `json:"color"`
+}
+
+func discordPayload(m message) interface{} {
+	return discordMessage{Embeds: []discordEmbed{{
+		Title:       m.Title,
+		Description: truncate(bulletList(m.Lines), discordDescLimit),
+		Color:       hexColor(severityColors[m.Severity]),
+	}}}
+}
+
+type teamsMessage struct {
+	Type       string `json:"@type"`
+	Context    string `json:"@context"`
+	ThemeColor string `json:"themeColor"`
+	Summary    string `json:"summary"`
+	Title      string `json:"title"`
+	Text       string `json:"text,omitempty"`
+}
+
+func teamsPayload(m message) interface{} {
+	return teamsMessage{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		ThemeColor: severityColors[m.Severity],
+		Summary:    m.Title,
+		Title:      m.Title,
+		// teams only breaks lines on blank lines in markdown
+		Text: truncate(strings.Join(prefixLines(m.Lines, "- "), "\n\n"), teamsTextLimit),
+	}
+}
+
+func bulletList(lines []string) string {
+	return strings.Join(prefixLines(lines, "• "), "\n")
+}
+
+func prefixLines(lines []string, prefix string) []string {
+	prefixed := make([]string, 0, len(lines))
+	for _, l := range lines {
+		prefixed = append(prefixed, prefix+l)
+	}
+	return prefixed
+}
+
+func hexColor(hex string) int {
+	c, _ := strconv.ParseInt(hex, 16, 32)
+	return int(c)
+}
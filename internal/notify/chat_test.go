@@ -0,0 +1,104 @@
+package notify
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSlack(t *testing.T) {
+	rcv := newReceiver(t)
+	n, err := NewSlack(rcv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), testEvent(EventUpdateFailed)); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg slackMessage
+	req := rcv.decode(t, &msg)
+	if req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got content type %q", req.Header.Get("Content-Type"))
+	}
+	if msg.Text != "*Update of stack web failed*" || len(msg.Attachments) != 1 {
+		t.Fatalf("got message %+v", msg)
+	}
+	if a := msg.Attachments[0]; a.Color != "#E01E5A" || a.Text != "• Endpoint: local\n• Status: outdated" {
+		t.Errorf("got attachment %+v", a)
+	}
+}
+
+func TestDiscord(t *testing.T) {
+	rcv := newReceiver(t)
+	n, err := NewDiscord(rcv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), testEvent(EventUpdateSucceeded)); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg discordMessage
+	rcv.decode(t, &msg)
+	if len(msg.Embeds) != 1 {
+		t.Fatalf("got message %+v", msg)
+	}
+	if e := msg.Embeds[0]; e.Title != "Updated stack web" || e.Color != 0x2EB67D || !strings.HasPrefix(e.Description, "• Endpoint: local") {
+		t.Errorf("got embed %+v", e)
+	}
+}
+
+func TestTeams(t *testing.T) {
+	rcv := newReceiver(t)
+	n, err := NewTeams(rcv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	heldBack := result("2", OutcomeHeldBack)
+	heldBack.Reason = "dry run"
+	if err := n.Notify(context.Background(), testSummary(result("1", OutcomeUpdated), heldBack)); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg teamsMessage
+	rcv.decode(t, &msg)
+	if msg.Type != "MessageCard" || msg.ThemeColor != "ECB22E" {
+		t.Errorf("got card %+v", msg)
+	}
+	if msg.Title != "Autoupdater run: 2 checked, 1 updated, 0 failed, 1 held back" || msg.Summary != msg.Title {
+		t.Errorf("got title %q", msg.Title)
+	}
+	want := "- stack stack1 on local: updated\n\n- stack stack2 on local: held back: dry run"
+	if msg.Text != want {
+		t.Errorf("got text %q, want %q", msg.Text, want)
+	}
+}
+
+func TestChatSkipsQuietRuns(t *testing.T) {
+	rcv := newReceiver(t)
+	n, err := NewSlack(rcv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), testSummary(result("1", OutcomeUpToDate))); err != nil {
+		t.Fatal(err)
+	}
+	if len(rcv.received()) != 0 {
+		t.Error("a run where everything was up to date was posted")
+	}
+	if _, err := NewSlack(""); err == nil {
+		t.Error("want error without an url")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	long := strings.Repeat("ä", 100)
+	got := truncate(long, 51)
+	if len(got) > 51 || !strings.HasSuffix(got, "\n…") || !strings.HasPrefix(long, strings.TrimSuffix(got, "\n…")) {
+		t.Errorf("got %q", got)
+	}
+	if truncate("short", 10) != "short" {
+		t.Error("short text was truncated")
+	}
+}
@@ -0,0 +1,155 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity is how urgent a message is
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeveritySuccess
+	SeverityWarning
+	SeverityError
+)
+
+// message is a human readable rendering of an event shared by the chat and
+// push sinks
+type message struct {
+	Title    string
+	Lines    []string
+	Severity Severity
+}
+
+// Text returns the message lines joined with newlines
+func (m message) Text() string {
+	return strings.Join(m.Lines, "\n")
+}
+
+func newMessage(event Event) message {
+	if event.Type == EventRunSummary && event.Summary != nil {
+		return summaryMessage(event.Summary)
+	}
+
+	m := message{Severity: SeverityInfo}
+	name := "unknown"
+	if event.Target != nil {
+		name = fmt.Sprintf("%s %s", event.Target.Kind, event.Target.Name)
+	}
+
+	switch event.Type {
+	case EventUpdateAvailable:
+		m.Title = fmt.Sprintf("Update available for %s", name)
+		m.Severity = SeverityWarning
+	case EventUpdateStarted:
+		m.Title = fmt.Sprintf("Updating %s", name)
+	case EventUpdateSucceeded:
+		m.Title = fmt.Sprintf("Updated %s", name)
+		m.Severity = SeveritySuccess
+	case EventUpdateFailed:
+		m.Title = fmt.Sprintf("Update of %s failed", name)
+		m.Severity = SeverityError
+	case EventUpdateRolledBack:
+		m.Title = fmt.Sprintf("Rolled back %s", name)
+		m.Severity = SeverityError
+	case EventPullRequestOpened:
+		m.Title = fmt.Sprintf("Opened pull request for %s", name)
+	default:
+		m.Title = fmt.Sprintf("%s: %s", event.Type, name)
+	}
+
+	if event.Target != nil {
+		m.Lines = append(m.Lines, fmt.Sprintf("Endpoint: %s", endpointLabel(*event.Target)))
+	}
+	if event.Status != "" {
+		m.Lines = append(m.Lines, fmt.Sprintf("Status: %s", event.Status))
+	}
+	if event.URL != "" {
+		m.Lines = append(m.Lines, fmt.Sprintf("Pull request: %s", event.URL))
+	}
+	if event.DryRun {
+		m.Lines = append(m.Lines, "Dry run: no changes are made")
+	}
+	if event.Error != "" {
+		m.Lines = append(m.Lines, fmt.Sprintf("Error: %s", event.Error))
+	}
+	return m
+}
+
+func summaryMessage(summary *Summary) message {
+	updated := summary.Count(OutcomeUpdated)
+	failed := summary.Count(OutcomeFailed)
+	heldBack := summary.Count(OutcomeHeldBack)
+
+	run := "Autoupdater run"
+	if summary.Instance != "" {
+		run += " on " + summary.Instance
+	}
+	m := message{
+		Title: fmt.Sprintf(
+			"%s: %d checked, %d updated, %d failed, %d held back",
+			run, len(summary.Results), updated, failed, heldBack,
+		),
+		Severity: SeverityInfo,
+	}
+	if len(summary.Errors) > 0 {
+		m.Title += fmt.Sprintf(", %d errors", len(summary.Errors))
+	}
+	switch {
+	case summary.Failed():
+		m.Severity = SeverityError
+	case heldBack > 0:
+		m.Severity = SeverityWarning
+	case updated > 0:
+		m.Severity = SeveritySuccess
+	}
+
+	for _, r := range summary.Results {
+		if r.Outcome == OutcomeUpToDate {
+			continue
+		}
+		m.Lines = append(m.Lines, resultLine(r))
+	}
+	for _, err := range summary.Errors {
+		m.Lines = append(m.Lines, fmt.Sprintf("error: %s", err))
+	}
+	return m
+}
+
+func resultLine(r Result) string {
+	line := fmt.Sprintf("%s %s on %s", r.Kind, r.Name, endpointLabel(r.Target))
+	if r.Status != "" {
+		line += fmt.Sprintf(" (%s)", r.Status)
+	}
+
+	switch r.Outcome {
+	case OutcomeFailed:
+		return fmt.Sprintf("%s: failed: %s", line, r.Error)
+	case OutcomeHeldBack:
+		return fmt.Sprintf("%s: held back: %s", line, r.Reason)
+	default:
+		return fmt.Sprintf("%s: %s", line, strings.ReplaceAll(string(r.Outcome), "_", " "))
+	}
+}
+
+func endpointLabel(t Target) string {
+	label := t.EndpointName
+	if label == "" {
+		label = fmt.Sprintf("endpoint %d", t.EndpointID)
+	}
+	if t.Instance != "" {
+		label = fmt.Sprintf("%s of %s", label, t.Instance)
+	}
+	return label
+}
+
+// truncate shortens s to at most max bytes, marking that it was cut
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	const marker = "\n…"
+	return strings.ToValidUTF8(s[:max-len(marker)], "") + marker
+}
@@ -0,0 +1,265 @@
+// Package notify delivers structured update events to external sinks.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EventType identifies what an Event is about
+type EventType string
+
+const (
+	EventUpdateAvailable   EventType = "update_available"
+	EventUpdateStarted     EventType = "update_started"
+	EventUpdateSucceeded   EventType = "update_succeeded"
+	EventUpdateFailed      EventType = "update_failed"
+	EventUpdateRolledBack  EventType = "update_rolled_back"
+	EventPullRequestOpened EventType = "pull_request_opened"
+	EventRunSummary        EventType = "run_summary"
+)
+
+// Kinds of resources an event can be about
+const (
+	KindStack     = "stack"
+	KindService   = "service"
+	KindContainer = "container"
+)
+
+// Outcome is the final result of checking a single resource
+type Outcome string
+
+const (
+	OutcomeUpToDate Outcome = "up_to_date"
+	OutcomeHeldBack Outcome = "held_back"
+	OutcomeUpdated  Outcome = "updated"
+	OutcomeFailed   Outcome = "failed"
+)
+
+// Target describes the stack, service or container an event is about
+type Target struct {
+	// Instance is the name of the portainer instance, empty unless several
+	// instances are managed
+	Instance     string `json:"instance,omitempty"`
+	Kind         string `json:"kind"`
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	EndpointID   int    `json:"endpointId"`
+	EndpointName string `json:"endpointName,omitempty"`
+}
+
+// Result is the outcome of checking a single target during a run
+type Result struct {
+	Target
+	Status  string  `json:"status,omitempty"`
+	Outcome Outcome `json:"outcome"`
+	Reason  string  `json:"reason,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	// Duration is how long checking and updating took
+	Duration time.Duration `json:"duration,omitempty"`
+	// Update is set when an update was attempted
+	Update *Update `json:"update,omitempty"`
+	// Pinned maps the services of a stack that a rollback pinned to the
+	// image they are held at until the next update
+	Pinned map[string]string `json:"pinned,omitempty"`
+}
+
+// Update describes an update that was attempted. Images map the services of
+// a stack, or the service itself, to the image reference including its digest.
+type Update struct {
+	Duration     time.Duration     `json:"duration"`
+	ImagesBefore map[string]string `json:"imagesBefore,omitempty"`
+	ImagesAfter  map[string]string `json:"imagesAfter,omitempty"`
+}
+
+// Summary collects the results of a complete run
+type Summary struct {
+	Instance string    `json:"instance,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	DryRun   bool      `json:"dryRun"`
+	Results  []Result  `json:"results"`
+	// Errors kept parts of the run from being checked, such as portainer
+	// being unreachable while listing stacks
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Failed reports whether anything in the run went wrong
+func (s *Summary) Failed() bool {
+	return len(s.Errors) > 0 || s.Count(OutcomeFailed) > 0
+}
+
+// Count returns the number of results with the given outcome
+func (s *Summary) Count(outcome Outcome) int {
+	count := 0
+	for _, r := range s.Results {
+		if r.Outcome == outcome {
+			count++
+		}
+	}
+	return count
+}
+
+// WithOutcome returns the results with the given outcome
+func (s *Summary) WithOutcome(outcome Outcome) []Result {
+	results := make([]Result, 0)
+	for _, r := range s.Results {
+		if r.Outcome == outcome {
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+// Event is sent to notifiers whenever something of interest happens
+type Event struct {
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance,omitempty"`
+	Target   *Target   `json:"target,omitempty"`
+	Status   string    `json:"status,omitempty"`
+	DryRun   bool      `json:"dryRun"`
+	Error    string    `json:"error,omitempty"`
+	// URL links to the pull request of a pull_request_opened event
+	URL     string   `json:"url,omitempty"`
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// NewEvent returns an event of the given type about target, which may be nil
+func NewEvent(eventType EventType, target *Target) Event {
+	return Event{
+		Type:   eventType,
+		Time:   time.Now(),
+		Target: target,
+	}
+}
+
+// Notifier receives events
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// Flusher is implemented by notifiers that buffer events, such as digests
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Flush sends whatever n has buffered, notifiers that don't buffer are ignored
+func Flush(ctx context.Context, n Notifier) error {
+	if f, ok := n.(Flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+type multiNotifier []Notifier
+
+// Multi returns a notifier that sends every event to all notifiers
+func Multi(notifiers ...Notifier) Notifier {
+	return multiNotifier(notifiers)
+}
+
+func (m multiNotifier) Notify(ctx context.Context, event Event) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiNotifier) Flush(ctx context.Context) error {
+	var errs []error
+	for _, n := range m {
+		if err := Flush(ctx, n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type filteredNotifier struct {
+	notifier Notifier
+	types    []EventType
+}
+
+// Filter returns a notifier that only forwards events of the given types,
+// when no types are given all events are forwarded
+func Filter(notifier Notifier, types ...EventType) Notifier {
+	if len(types) == 0 {
+		return notifier
+	}
+	return &filteredNotifier{notifier: notifier, types: types}
+}
+
+func (f *filteredNotifier) Notify(ctx context.Context, event Event) error {
+	for _, t := range f.types {
+		if t == event.Type {
+			return f.notifier.Notify(ctx, event)
+		}
+	}
+	return nil
+}
+
+func (f *filteredNotifier) Flush(ctx context.Context) error {
+	return Flush(ctx, f.notifier)
+}
+
+type instanceNotifier struct {
+	notifier Notifier
+	instance string
+}
+
+// WithInstance returns a notifier that labels events, their targets and
+// summaries with the name of the portainer instance they come from
+func WithInstance(notifier Notifier, instance string) Notifier {
+	if instance == "" {
+		return notifier
+	}
+	return &instanceNotifier{notifier: notifier, instance: instance}
+}
+
+func (i *instanceNotifier) Notify(ctx context.Context, event Event) error {
+	// targets and summaries are shared with the sender, label copies
+	event.Instance = i.instance
+	if event.Target != nil {
+		target := *event.Target
+		target.Instance = i.instance
+		event.Target = &target
+	}
+	if event.Summary != nil {
+		summary := *event.Summary
+		summary.Instance = i.instance
+		summary.Results = make([]Result, len(event.Summary.Results))
+		for j, r := range event.Summary.Results {
+			r.Instance = i.instance
+			summary.Results[j] = r
+		}
+		event.Summary = &summary
+	}
+	return i.notifier.Notify(ctx, event)
+}
+
+func (i *instanceNotifier) Flush(ctx context.Context) error {
+	return Flush(ctx, i.notifier)
+}
+
+// ParseEventTypes converts a list of event type names, ignoring empty entries
+func ParseEventTypes(names []string) ([]EventType, error) {
+	types := make([]EventType, 0, len(names))
+	for _, name := range names {
+		switch t := EventType(name); t {
+		case "":
+			continue
+		case EventUpdateAvailable, EventUpdateStarted, EventUpdateSucceeded, EventUpdateFailed,
+			EventUpdateRolledBack, EventPullRequestOpened, EventRunSummary:
+			types = append(types, t)
+		default:
+			return nil, fmt.Errorf("unknown event type: %s", name)
+		}
+	}
+	return types, nil
+}
@@ -0,0 +1,270 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// request is a request a receiver got
+type request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// receiver records the requests sinks send, answering with status
+type receiver struct {
+	*httptest.Server
+	status int
+
+	mu       sync.Mutex
+	requests []request
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+	r := &receiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, request{
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Header: req.Header.Clone(),
+			Body:   body,
+		})
+		status := r.status
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]request(nil), r.requests...)
+}
+
+// decode unmarshals the body of the only request received into v
+func (r *receiver) decode(t *testing.T, v interface{}) request {
+	t.Helper()
+	requests := r.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	if err := json.Unmarshal(requests[0].Body, v); err != nil {
+		t.Fatalf("decoding %s: %s", requests[0].Body, err)
+	}
+	return requests[0]
+}
+
+func testTarget() *Target {
+	return &Target{Kind: KindStack, ID: "1", Name: "web", EndpointID: 2, EndpointName: "local"}
+}
+
+func testEvent(eventType EventType) Event {
+	event := NewEvent(eventType, testTarget())
+	event.Time = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	event.Status = "outdated"
+	return event
+}
+
+func testSummary(results ...Result) Event {
+	event := NewEvent(EventRunSummary, nil)
+	event.Summary = &Summary{
+		Started:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Finished: time.Date(2024, 5, 1, 12, 1, 0, 0, time.UTC),
+		Results:  results,
+	}
+	return event
+}
+
+func TestWebhook(t *testing.T) {
+	rcv := newReceiver(t)
+	w, err := NewWebhook(rcv.URL+"/hook", "put", map[string]string{"X-Token": "secret"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Notify(context.Background(), testEvent(EventUpdateAvailable)); err != nil {
+		t.Fatal(err)
+	}
+
+	var event Event
+	req := rcv.decode(t, &event)
+	if req.Method != http.MethodPut || req.Path != "/hook" || req.Header.Get("X-Token") != "secret" {
+		t.Errorf("got %s %s with headers %v", req.Method, req.Path, req.Header)
+	}
+	if req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got content type %q", req.Header.Get("Content-Type"))
+	}
+	if event.Type != EventUpdateAvailable || event.Target == nil || event.Target.Name != "web" || event.Status != "outdated" {
+		t.Errorf("got event %+v", event)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	for _, tt := range []struct {
+		template    string
+		body        string
+		contentType string
+	}{
+		{`{{ .Type }} {{ .Target.Name | upper }}`, "update_available WEB", "text/plain"},
+		{`{"text": {{ json .Target.Name }}}`, `{"text": "web"}`, "application/json"},
+	} {
+		rcv := newReceiver(t)
+		w, err := NewWebhook(rcv.URL, "", nil, tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Notify(context.Background(), testEvent(EventUpdateAvailable)); err != nil {
+			t.Fatal(err)
+		}
+
+		requests := rcv.received()
+		if len(requests) != 1 {
+			t.Fatalf("got %d requests", len(requests))
+		}
+		req := requests[0]
+		if req.Method != http.MethodPost || string(req.Body) != tt.body || req.Header.Get("Content-Type") != tt.contentType {
+			t.Errorf("%s: got %s %q as %s", tt.template, req.Method, req.Body, req.Header.Get("Content-Type"))
+		}
+	}
+
+	if _, err := NewWebhook("http://localhost", "", nil, "{{ .Type"); err == nil {
+		t.Error("want error for an invalid template")
+	}
+	if _, err := NewWebhook("", "", nil, ""); err == nil {
+		t.Error("want error without an url")
+	}
+}
+
+func TestWebhookError(t *testing.T) {
+	rcv := newReceiver(t)
+	rcv.status = http.StatusBadGateway
+	w, err := NewWebhook(rcv.URL, "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Notify(context.Background(), testEvent(EventUpdateFailed)); err == nil {
+		t.Error("want error for a 502 response")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	rcv := newReceiver(t)
+	w, err := NewWebhook(rcv.URL, "", nil, "{{ .Type }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, err := ParseEventTypes([]string{"update_failed", "", "run_summary"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := Filter(w, types...)
+	for _, eventType := range []EventType{EventUpdateAvailable, EventUpdateFailed, EventUpdateSucceeded, EventRunSummary} {
+		if err := n.Notify(context.Background(), testEvent(eventType)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for _, req := range rcv.received() {
+		got = append(got, string(req.Body))
+	}
+	if len(got) != 2 || got[0] != "update_failed" || got[1] != "run_summary" {
+		t.Errorf("got events %v, want update_failed and run_summary", got)
+	}
+
+	if Filter(w) != Notifier(w) {
+		t.Error("a filter without types should forward everything")
+	}
+	if _, err := ParseEventTypes([]string{"update_exploded"}); err == nil {
+		t.Error("want error for an unknown event type")
+	}
+}
+
+func TestWithInstance(t *testing.T) {
+	rcv := newReceiver(t)
+	w, err := NewWebhook(rcv.URL, "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := testTarget()
+	event := NewEvent(EventUpdateSucceeded, target)
+	if err := WithInstance(w, "prod").Notify(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Event
+	rcv.decode(t, &got)
+	if got.Instance != "prod" || got.Target.Instance != "prod" {
+		t.Errorf("got event %+v, want it labelled with the instance", got)
+	}
+	if target.Instance != "" {
+		t.Error("the target of the sender was changed")
+	}
+}
+
+// buffer counts the events and flushes it gets, failing flushes with err
+type buffer struct {
+	events  int
+	flushes int
+	err     error
+}
+
+func (b *buffer) Notify(context.Context, Event) error {
+	b.events++
+	return nil
+}
+
+func (b *buffer) Flush(context.Context) error {
+	b.flushes++
+	return b.err
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	failing := &buffer{err: errors.New("smtp down")}
+	filtered := &buffer{}
+	labelled := &buffer{}
+	rcv := newReceiver(t)
+	w, err := NewWebhook(rcv.URL, "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flushes reach buffering notifiers behind filters and instance labels,
+	// notifiers that don't buffer are skipped and errors don't stop the others
+	n := Multi(failing, w, Filter(filtered, EventRunSummary), WithInstance(labelled, "prod"))
+	if err := n.Notify(ctx, testEvent(EventUpdateFailed)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Flush(ctx, n); err == nil || !strings.Contains(err.Error(), "smtp down") {
+		t.Errorf("got error %v, want the failed flush", err)
+	}
+	for name, b := range map[string]*buffer{"failing": failing, "filtered": filtered, "labelled": labelled} {
+		if b.flushes != 1 {
+			t.Errorf("%s: got %d flushes, want 1", name, b.flushes)
+		}
+	}
+	if filtered.events != 0 || failing.events != 1 || labelled.events != 1 {
+		t.Errorf("got %d, %d and %d events", failing.events, filtered.events, labelled.events)
+	}
+
+	if err := Flush(ctx, w); err != nil {
+		t.Errorf("flushing a notifier that doesn't buffer: %s", err)
+	}
+}
@@ -0,0 +1,212 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// telegramAPI is the base url of the telegram bot api
+var telegramAPI = "https://api.telegram.org"
+
+const telegramTextLimit = 4096
+
+// Priority is how loudly a push notification is delivered
+type Priority int
+
+const (
+	PriorityOff Priority = iota
+	PriorityMin
+	PriorityLow
+	PriorityDefault
+	PriorityHigh
+	PriorityMax
+)
+
+var priorityNames = map[string]Priority{
+	"off":     PriorityOff,
+	"min":     PriorityMin,
+	"low":     PriorityLow,
+	"default": PriorityDefault,
+	"high":    PriorityHigh,
+	"max":     PriorityMax,
+}
+
+// ParsePriorities converts a map of event type to priority name such as
+// update_failed:high, events without an entry use the default priority
+func ParsePriorities(names map[string]string) (map[EventType]Priority, error) {
+	priorities := make(map[EventType]Priority, len(names))
+	for event, name := range names {
+		types, err := ParseEventTypes([]string{event})
+		if err != nil {
+			return nil, err
+		}
+
+		p, ok := priorityNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown priority: %s", name)
+		}
+
+		for _, t := range types {
+			priorities[t] = p
+		}
+	}
+	return priorities, nil
+}
+
+type pushSender func(ctx context.Context, m message, priority Priority) error
+
+// Push sends events to a phone push service with a priority per event type.
+// Events mapped to the off priority are dropped.
+type Push struct {
+	priorities map[EventType]Priority
+	send       pushSender
+}
+
+func (p *Push) Notify(ctx context.Context, event Event) error {
+	priority, ok := p.priorities[event.Type]
+	if !ok {
+		priority = PriorityDefault
+	}
+	if priority == PriorityOff {
+		return nil
+	}
+
+	m := newMessage(event)
+
+	// a summary of a run where everything was up to date isn't worth a message
+	if event.Type == EventRunSummary && len(m.Lines) == 0 {
+		return nil
+	}
+
+	return p.send(ctx, m, priority)
+}
+
+// NewNtfy returns a notifier publishing to an ntfy topic url such as
+// https://ntfy.sh/mytopic, token is optional
+func NewNtfy(topicURL, token string, priorities map[EventType]Priority) (*Push, error) {
+	if topicURL == "" {
+		return nil, errors.New("ntfy topic url is required")
+	}
+
+	client := &http.Client{Timeout: defaultWebhookTimeout}
+	return &Push{
+		priorities: priorities,
+		send: func(ctx context.Context, m message, priority Priority) error {
+			headers := map[string]string{
+				"Title":    m.Title,
+				"Priority": strconv.Itoa(int(priority)),
+				"Tags":     ntfyTags[m.Severity],
+			}
+			if token != "" {
+				headers["Authorization"] = "Bearer " + token
+			}
+			return postBody(ctx, client, http.MethodPost, topicURL, "text/plain", headers, []byte(m.Text()))
+		},
+	}, nil
+}
+
+var ntfyTags = map[Severity]string{
+	SeverityInfo:    "information_source",
+	SeveritySuccess: "white_check_mark",
+	SeverityWarning: "warning",
+	SeverityError:   "rotating_light",
+}
+
+type gotifyMessage struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+}
+
+// gotify priorities range from 0 to 10
+var gotifyPriorities = map[Priority]int{
+	PriorityMin:     0,
+	PriorityLow:     2,
+	PriorityDefault: 5,
+	PriorityHigh:    8,
+	PriorityMax:     10,
+}
+
+// NewGotify returns a notifier sending to a gotify server with an application token
+func NewGotify(serverURL, token string, priorities map[EventType]Priority) (*Push, error) {
+	if serverURL == "" {
+		return nil, errors.New("gotify url is required")
+	}
+	if token == "" {
+		return nil, errors.New("gotify application token is required")
+	}
+
+	client := &http.Client{Timeout: defaultWebhookTimeout}
+	endpoint := strings.TrimSuffix(serverURL, "/") + "/message"
+	return &Push{
+		priorities: priorities,
+		send: func(ctx context.Context, m message, priority Priority) error {
+			body, err := json.Marshal(gotifyMessage{
+				Title:    m.Title,
+				Message:  m.Text(),
+				Priority: gotifyPriorities[priority],
+			})
+			if err != nil {
+				return errors.Wrap(err, "marshalling gotify message to json")
+			}
+			headers := map[string]string{"X-Gotify-Key": token}
+			return postBody(ctx, client, http.MethodPost, endpoint, "application/json", headers, body)
+		},
+	}, nil
+}
+
+type telegramMessage struct {
+	ChatID              string `json:"chat_id"`
+	Text                string `json:"text"`
+	DisableNotification bool   `json:"disable_notification"`
+}
+
+// NewTelegram returns a notifier sending messages through a telegram bot,
+// messages below the default priority are delivered silently
+func NewTelegram(botToken, chatID string, priorities map[EventType]Priority) (*Push, error) {
+	if botToken == "" {
+		return nil, errors.New("telegram bot token is required")
+	}
+	if chatID == "" {
+		return nil, errors.New("telegram chat id is required")
+	}
+
+	client := &http.Client{Timeout: defaultWebhookTimeout}
+	endpoint := fmt.Sprintf("%s/bot%s/sendMessage", telegramAPI, url.PathEscape(botToken))
+	return &Push{
+		priorities: priorities,
+		send: func(ctx context.Context, m message, priority Priority) error {
+			var text bytes.Buffer
+			text.WriteString(m.Title)
+			if len(m.Lines) > 0 {
+				text.WriteString("\n\n")
+				text.WriteString(m.Text())
+			}
+
+			body, err := json.Marshal(telegramMessage{
+				ChatID:              chatID,
+				Text:                truncate(text.String(), telegramTextLimit),
+				DisableNotification: priority < PriorityDefault,
+			})
+			if err != nil {
+				return errors.Wrap(err, "marshalling telegram message to json")
+			}
+			err = postBody(ctx, client, http.MethodPost, endpoint, "application/json", nil, body)
+
+			// the request url contains the bot token, keep it out of the logs
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				return errors.Wrap(urlErr.Err, "sending telegram message")
+			}
+			return err
+		},
+	}, nil
+}
@@ -0,0 +1,158 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParsePriorities(t *testing.T) {
+	priorities, err := ParsePriorities(map[string]string{"update_failed": "HIGH", "update_available": "off"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priorities[EventUpdateFailed] != PriorityHigh || priorities[EventUpdateAvailable] != PriorityOff || len(priorities) != 2 {
+		t.Errorf("got priorities %v", priorities)
+	}
+
+	for _, invalid := range []map[string]string{{"update_failed": "urgent"}, {"update_exploded": "high"}} {
+		if _, err := ParsePriorities(invalid); err == nil {
+			t.Errorf("%v: want an error", invalid)
+		}
+	}
+}
+
+func TestNtfy(t *testing.T) {
+	rcv := newReceiver(t)
+	priorities := map[EventType]Priority{
+		EventUpdateFailed:    PriorityMax,
+		EventUpdateSucceeded: PriorityMin,
+		EventUpdateStarted:   PriorityOff,
+	}
+	n, err := NewNtfy(rcv.URL+"/updates", "tk_secret", priorities)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, eventType := range []EventType{EventUpdateFailed, EventUpdateSucceeded, EventUpdateStarted, EventUpdateAvailable} {
+		if err := n.Notify(ctx, testEvent(eventType)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ntfy priorities run from 1 to 5, off drops the event
+	requests := rcv.received()
+	want := []struct{ title, priority, tags string }{
+		{"Update of stack web failed", "5", "rotating_light"},
+		{"Updated stack web", "1", "white_check_mark"},
+		{"Update available for stack web", "3", "warning"},
+	}
+	if len(requests) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(requests), len(want))
+	}
+	for i, w := range want {
+		req := requests[i]
+		if req.Path != "/updates" || req.Header.Get("Authorization") != "Bearer tk_secret" {
+			t.Errorf("%d: got %s with authorization %q", i, req.Path, req.Header.Get("Authorization"))
+		}
+		if req.Header.Get("Title") != w.title || req.Header.Get("Priority") != w.priority || req.Header.Get("Tags") != w.tags {
+			t.Errorf("%d: got title %q, priority %q and tags %q", i, req.Header.Get("Title"), req.Header.Get("Priority"), req.Header.Get("Tags"))
+		}
+	}
+	if string(requests[0].Body) != "Endpoint: local\nStatus: outdated" {
+		t.Errorf("got body %q", requests[0].Body)
+	}
+}
+
+func TestGotify(t *testing.T) {
+	for priority, want := range map[Priority]int{
+		PriorityMin:     0,
+		PriorityLow:     2,
+		PriorityDefault: 5,
+		PriorityHigh:    8,
+		PriorityMax:     10,
+	} {
+		rcv := newReceiver(t)
+		n, err := NewGotify(rcv.URL+"/", "app-token", map[EventType]Priority{EventUpdateFailed: priority})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), testEvent(EventUpdateFailed)); err != nil {
+			t.Fatal(err)
+		}
+
+		var msg gotifyMessage
+		req := rcv.decode(t, &msg)
+		if req.Path != "/message" || req.Header.Get("X-Gotify-Key") != "app-token" {
+			t.Errorf("got %s with key %q", req.Path, req.Header.Get("X-Gotify-Key"))
+		}
+		if msg.Priority != want || msg.Title != "Update of stack web failed" || msg.Message != "Endpoint: local\nStatus: outdated" {
+			t.Errorf("priority %d: got message %+v", priority, msg)
+		}
+	}
+
+	if _, err := NewGotify("http://gotify", "", nil); err == nil {
+		t.Error("want error without a token")
+	}
+}
+
+func TestTelegram(t *testing.T) {
+	rcv := newReceiver(t)
+	api := telegramAPI
+	telegramAPI = rcv.URL
+	t.Cleanup(func() { telegramAPI = api })
+
+	n, err := NewTelegram("123:abc", "-100", map[EventType]Priority{EventUpdateSucceeded: PriorityLow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, eventType := range []EventType{EventUpdateSucceeded, EventUpdateFailed} {
+		if err := n.Notify(ctx, testEvent(eventType)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requests := rcv.received()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	if requests[0].Path != "/bot123:abc/sendMessage" {
+		t.Errorf("got path %s", requests[0].Path)
+	}
+
+	// below the default priority messages are sent silently
+	for i, silent := range []bool{true, false} {
+		var msg telegramMessage
+		if err := json.Unmarshal(requests[i].Body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ChatID != "-100" || msg.DisableNotification != silent {
+			t.Errorf("%d: got message %+v", i, msg)
+		}
+		if i == 1 && msg.Text != "Update of stack web failed\n\nEndpoint: local\nStatus: outdated" {
+			t.Errorf("got text %q", msg.Text)
+		}
+	}
+
+	// the bot token is kept out of errors
+	rcv.Close()
+	if err := n.Notify(ctx, testEvent(EventUpdateFailed)); err == nil || strings.Contains(err.Error(), "123:abc") {
+		t.Errorf("got error %v, want one without the bot token", err)
+	}
+}
+
+func TestPushError(t *testing.T) {
+	rcv := newReceiver(t)
+	rcv.status = http.StatusTooManyRequests
+	n, err := NewNtfy(rcv.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), testEvent(EventUpdateFailed)); err == nil {
+		t.Error("want error for a 429 response")
+	}
+}
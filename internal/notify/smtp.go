@@ -0,0 +1,274 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var digestTemplate = template.Must(template.New("digest").Parse(`Portainer autoupdater digest from {{ .Started.Format "2006-01-02 15:04 MST" }} to {{ .Finished.Format "2006-01-02 15:04 MST" }} ({{ .Runs }} run{{ if ne .Runs 1 }}s{{ end }})
+{{ if .Updated }}
+Updated:
+{{- range .Updated }}
+  - {{ .Kind }} {{ .Name }} (id {{ .ID }}) on endpoint {{ .EndpointName }} ({{ .EndpointID }}){{ if .Instance }} of {{ .Instance }}{{ end }}
+{{- end }}
+{{ end }}{{ if .Failed }}
+Failed:
+{{- range .Failed }}
+  - {{ .Kind }} {{ .Name }} (id {{ .ID }}) on endpoint {{ .EndpointName }} ({{ .EndpointID }}){{ if .Instance }} of {{ .Instance }}{{ end }}: {{ .Error }}
+{{- end }}
+{{ end }}{{ if .Errors }}
+Errors:
+{{- range .Errors }}
+  - {{ . }}
+{{- end }}
+{{ end }}{{ if .HeldBack }}
+Outdated but held back:
+{{- range .HeldBack }}
+  - {{ .Kind }} {{ .Name }} (id {{ .ID }}) on endpoint {{ .EndpointName }} ({{ .EndpointID }}){{ if .Instance }} of {{ .Instance }}{{ end }}: {{ .Reason }}
+{{- end }}
+{{ end }}`))
+
+type digest struct {
+	Started  time.Time
+	Finished time.Time
+	Runs     int
+	Updated  []Result
+	Failed   []Result
+	HeldBack []Result
+	Errors   []string
+}
+
+// SMTP collects run summaries and mails a digest of everything that was
+// updated, failed or held back, either after every run or once per period.
+type SMTP struct {
+	host   string
+	addr   string
+	auth   smtp.Auth
+	from   string
+	to     []string
+	period time.Duration
+
+	mu       sync.Mutex
+	runs     int
+	started  time.Time
+	finished time.Time
+	pending  map[string]Result
+	order    []string
+	errors   []string
+}
+
+// NewSMTP returns a digest notifier, a zero period sends one mail per run
+func NewSMTP(host string, port int, username, password, from string, to []string, period time.Duration) (*SMTP, error) {
+	if host == "" {
+		return nil, errors.New("smtp host is required")
+	}
+	if from == "" {
+		return nil, errors.New("smtp from address is required")
+	}
+	if len(to) == 0 {
+		return nil, errors.New("at least one smtp recipient is required")
+	}
+
+	n := &SMTP{
+		host:    host,
+		addr:    net.JoinHostPort(host, strconv.Itoa(port)),
+		from:    from,
+		to:      to,
+		period:  period,
+		pending: make(map[string]Result),
+	}
+	if username != "" {
+		n.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return n, nil
+}
+
+func (n *SMTP) Notify(ctx context.Context, event Event) error {
+	if event.Type != EventRunSummary || event.Summary == nil {
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.runs == 0 {
+		n.started = event.Summary.Started
+	}
+	n.runs++
+	n.finished = event.Summary.Finished
+
+	// keep only the latest result per target so a stack held back on every
+	// run of the period is listed once
+	for _, r := range event.Summary.Results {
+		if r.Outcome == OutcomeUpToDate {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s/%d/%s", r.Instance, r.Kind, r.EndpointID, r.ID)
+		if _, ok := n.pending[key]; !ok {
+			n.order = append(n.order, key)
+		}
+		n.pending[key] = r
+	}
+	for _, err := range event.Summary.Errors {
+		if event.Summary.Instance != "" {
+			err = event.Summary.Instance + ": " + err
+		}
+		if !slices.Contains(n.errors, err) {
+			n.errors = append(n.errors, err)
+		}
+	}
+
+	if n.period > 0 && n.finished.Sub(n.started) < n.period {
+		return nil
+	}
+	return n.flush(ctx)
+}
+
+// Flush sends the digest collected so far without waiting for the period to end
+func (n *SMTP) Flush(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.flush(ctx)
+}
+
+func (n *SMTP) flush(ctx context.Context) error {
+	d := digest{
+		Started:  n.started,
+		Finished: n.finished,
+		Runs:     n.runs,
+		Errors:   n.errors,
+	}
+	for _, key := range n.order {
+		r := n.pending[key]
+		switch r.Outcome {
+		case OutcomeUpdated:
+			d.Updated = append(d.Updated, r)
+		case OutcomeFailed:
+			d.Failed = append(d.Failed, r)
+		case OutcomeHeldBack:
+			d.HeldBack = append(d.HeldBack, r)
+		}
+	}
+
+	n.runs = 0
+	n.pending = make(map[string]Result)
+	n.order = nil
+	n.errors = nil
+
+	// nothing worth a mail
+	if len(d.Updated)+len(d.Failed)+len(d.HeldBack)+len(d.Errors) == 0 {
+		return nil
+	}
+
+	msg, err := n.message(d)
+	if err != nil {
+		return err
+	}
+
+	if err := n.send(ctx, msg); err != nil {
+		return errors.Wrap(err, "sending digest mail")
+	}
+	return nil
+}
+
+// smtpTimeout limits sending a mail when ctx has no deadline
+const smtpTimeout = 30 * time.Second
+
+// send delivers msg like smtp.SendMail does, giving up when ctx is done
+func (n *SMTP) send(ctx context.Context, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	// a cancelled ctx interrupts the conversation with the server
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+			return err
+		}
+	}
+	if n.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp server doesn't support authentication")
+		}
+		if err := c.Auth(n.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	for _, to := range n.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (n *SMTP) message(d digest) ([]byte, error) {
+	var body bytes.Buffer
+	if err := digestTemplate.Execute(&body, d); err != nil {
+		return nil, errors.Wrap(err, "executing digest template")
+	}
+
+	subject := fmt.Sprintf(
+		"Portainer autoupdater: %d updated, %d failed, %d held back",
+		len(d.Updated), len(d.Failed), len(d.HeldBack),
+	)
+	if len(d.Errors) > 0 {
+		subject += fmt.Sprintf(", %d errors", len(d.Errors))
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", d.Finished.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+	return msg.Bytes(), nil
+}
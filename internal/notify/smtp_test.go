@@ -0,0 +1,238 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mailServer accepts mails over plain smtp and keeps their data
+type mailServer struct {
+	ln net.Listener
+
+	mu    sync.Mutex
+	mails []string
+}
+
+func newMailServer(t *testing.T) *mailServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mailServer{ln: ln}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *mailServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.mails = append(s.mails, data.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *mailServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.mails...)
+}
+
+func newTestSMTP(t *testing.T, s *mailServer, period time.Duration) *SMTP {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	n, err := NewSMTP(host, p, "", "", "updater@example.com", []string{"ops@example.com"}, period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func result(id string, outcome Outcome) Result {
+	target := *testTarget()
+	target.ID = id
+	target.Name = "stack" + id
+	return Result{Target: target, Outcome: outcome}
+}
+
+func TestSMTPDigestPerRun(t *testing.T) {
+	s := newMailServer(t)
+	n := newTestSMTP(t, s, 0)
+	ctx := context.Background()
+
+	// events other than run summaries aren't mailed
+	if err := n.Notify(ctx, testEvent(EventUpdateFailed)); err != nil {
+		t.Fatal(err)
+	}
+	// nor are runs where everything was up to date
+	if err := n.Notify(ctx, testSummary(result("1", OutcomeUpToDate))); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.received()) != 0 {
+		t.Fatalf("got %d mails, want none", len(s.received()))
+	}
+
+	failed := result("2", OutcomeFailed)
+	failed.Error = "pull access denied"
+	excluded := result("3", OutcomeHeldBack)
+	excluded.Reason = "stack name is excluded"
+	event := testSummary(result("1", OutcomeUpdated), failed, excluded, result("4", OutcomeUpToDate))
+	event.Summary.Errors = []string{"listing services: timeout"}
+	if err := n.Notify(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	mails := s.received()
+	if len(mails) != 1 {
+		t.Fatalf("got %d mails, want 1", len(mails))
+	}
+	mail := mails[0]
+	for _, want := range []string{
+		"To: ops@example.com\r\n",
+		"Subject: Portainer autoupdater: 1 updated, 1 failed, 1 held back, 1 errors\r\n",
+		"Updated:\r\n  - stack stack1 (id 1) on endpoint local (2)\r\n",
+		"Failed:\r\n  - stack stack2 (id 2) on endpoint local (2): pull access denied\r\n",
+		"Errors:\r\n  - listing services: timeout\r\n",
+		"Outdated but held back:\r\n  - stack stack3 (id 3) on endpoint local (2): stack name is excluded\r\n",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail lacks %q:\n%s", want, mail)
+		}
+	}
+	if strings.Contains(mail, "stack4") {
+		t.Errorf("mail lists the up to date stack:\n%s", mail)
+	}
+}
+
+func TestSMTPDigestPeriod(t *testing.T) {
+	s := newMailServer(t)
+	n := newTestSMTP(t, s, time.Hour)
+	ctx := context.Background()
+
+	// a stack held back on every run is listed once, with its latest result
+	for i, reason := range []string{"outside maintenance window", "dry run"} {
+		heldBack := result("1", OutcomeHeldBack)
+		heldBack.Reason = reason
+		event := testSummary(heldBack)
+		event.Summary.Started = event.Summary.Started.Add(time.Duration(i) * 10 * time.Minute)
+		event.Summary.Finished = event.Summary.Started.Add(time.Minute)
+		if err := n.Notify(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.received()) != 0 {
+		t.Fatal("digest was sent before the period ended")
+	}
+
+	if err := n.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mails := s.received()
+	if len(mails) != 1 {
+		t.Fatalf("got %d mails, want 1", len(mails))
+	}
+	if !strings.Contains(mails[0], "(2 runs)") || strings.Count(mails[0], "stack1") != 1 || !strings.Contains(mails[0], ": dry run\r\n") {
+		t.Errorf("got digest:\n%s", mails[0])
+	}
+
+	// the digest starts over after it was sent
+	if err := n.Flush(ctx); err != nil || len(s.received()) != 1 {
+		t.Errorf("got %d mails and error %v flushing an empty digest", len(s.received()), err)
+	}
+}
+
+func TestSMTPContext(t *testing.T) {
+	// a server that accepts connections and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	n := newTestSMTP(t, &mailServer{ln: ln}, time.Hour)
+
+	if err := n.Notify(context.Background(), testSummary(result("1", OutcomeUpdated))); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := n.Flush(ctx); err == nil {
+		t.Error("want error from a server that doesn't answer")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("flush took %s, want it to give up with the context", elapsed)
+	}
+}
+
+func TestNewSMTP(t *testing.T) {
+	for name, f := range map[string]func() (*SMTP, error){
+		"host": func() (*SMTP, error) { return NewSMTP("", 25, "", "", "a@b", []string{"c@d"}, 0) },
+		"from": func() (*SMTP, error) { return NewSMTP("mail", 25, "", "", "", []string{"c@d"}, 0) },
+		"to":   func() (*SMTP, error) { return NewSMTP("mail", 25, "", "", "a@b", nil, 0) },
+	} {
+		if _, err := f(); err == nil {
+			t.Errorf("want error without %s", name)
+		}
+	}
+}
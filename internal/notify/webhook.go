@@ -0,0 +1,128 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var defaultWebhookTimeout = time.Second * 30
+
+// templateFuncs are available to all message templates
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// Webhook posts events to a generic HTTP endpoint. Without a template the
+// event is sent as JSON, otherwise the template is executed with the event.
+type Webhook struct {
+	client   *http.Client
+	url      string
+	method   string
+	headers  map[string]string
+	template *template.Template
+}
+
+// NewWebhook returns a webhook notifier, bodyTemplate and method are optional
+func NewWebhook(url, method string, headers map[string]string, bodyTemplate string) (*Webhook, error) {
+	if url == "" {
+		return nil, errors.New("webhook url is required")
+	}
+
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	w := &Webhook{
+		client:  &http.Client{Timeout: defaultWebhookTimeout},
+		url:     url,
+		method:  strings.ToUpper(method),
+		headers: headers,
+	}
+
+	if bodyTemplate != "" {
+		tmpl, err := template.New("webhook").Funcs(templateFuncs).Parse(bodyTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing webhook template")
+		}
+		w.template = tmpl
+	}
+
+	return w, nil
+}
+
+func (w *Webhook) Notify(ctx context.Context, event Event) error {
+	body, contentType, err := w.body(event)
+	if err != nil {
+		return err
+	}
+
+	return postBody(ctx, w.client, w.method, w.url, contentType, w.headers, body)
+}
+
+func (w *Webhook) body(event Event) ([]byte, string, error) {
+	if w.template == nil {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "marshalling event to json")
+		}
+		return body, "application/json", nil
+	}
+
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, event); err != nil {
+		return nil, "", errors.Wrap(err, "executing webhook template")
+	}
+
+	contentType := "text/plain"
+	if json.Valid(buf.Bytes()) {
+		contentType = "application/json"
+	}
+	return buf.Bytes(), contentType, nil
+}
+
+// postBody sends body to url and fails on any non 2xx response
+func postBody(
+	ctx context.Context,
+	client *http.Client,
+	method, url, contentType string,
+	headers map[string]string,
+	body []byte,
+) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("non 2xx response code received: %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package portainerapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sjafferali/portainer-autoupdater/internal/metrics"
+)
+
+var (
+	// jwtRefreshMargin is how long before expiry a token is renewed
+	jwtRefreshMargin = time.Minute * 5
+
+	// defaultJWTLifetime is used when the token expiry can't be read from the token itself
+	defaultJWTLifetime = time.Hour * 8
+)
+
+type authenticator interface {
+	// authorize adds the authentication headers to the request
+	authorize(ctx context.Context, req *http.Request) error
+	// invalidate drops any cached credentials and reports whether retrying the request could succeed
+	invalidate() bool
+}
+
+type apiKeyAuthenticator struct {
+	token string
+}
+
+func (a *apiKeyAuthenticator) authorize(_ context.Context, req *http.Request) error {
+	req.Header.Set("X-API-Key", a.token)
+	return nil
+}
+
+func (a *apiKeyAuthenticator) invalidate() bool {
+	return false
+}
+
+type jwtAuthenticator struct {
+	client   *http.Client
+	host     string
+	instance string
+	username string
+	password string
+
+	mu        sync.Mutex
+	jwt       string
+	expiresAt time.Time
+}
+
+type authenticateRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type authenticateResponse struct {
+	JWT string `json:"jwt"`
+}
+
+func (a *jwtAuthenticator) authorize(ctx context.Context, req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.jwt == "" || time.Now().Add(jwtRefreshMargin).After(a.expiresAt) {
+		if err := a.login(ctx); err != nil {
+			return errors.Wrap(err, "logging in to portainer")
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+a.jwt)
+	return nil
+}
+
+func (a *jwtAuthenticator) invalidate() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.jwt = ""
+	a.expiresAt = time.Time{}
+	return true
+}
+
+func (a *jwtAuthenticator) login(ctx context.Context) error {
+	body, err := json.Marshal(authenticateRequest{
+		Username: a.username,
+		Password: a.password,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshalling request body to json")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/api/auth", a.host), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	start := time.Now()
+	res, err := a.client.Do(req)
+	if err != nil {
+		metrics.ObserveAPIRequest(a.instance, http.MethodPost, "api/auth", 0, time.Since(start))
+		return err
+	}
+	metrics.ObserveAPIRequest(a.instance, http.MethodPost, "api/auth", res.StatusCode, time.Since(start))
+	defer func() {
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+	}()
+
+	respbody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return newAPIError(http.MethodPost, "api/auth", res, respbody)
+	}
+
+	result := new(authenticateResponse)
+	if err := json.Unmarshal(respbody, &result); err != nil {
+		return err
+	}
+	if result.JWT == "" {
+		return errors.New("no token in authentication response")
+	}
+
+	a.jwt = result.JWT
+	a.expiresAt = jwtExpiry(result.JWT)
+	return nil
+}
+
+// jwtExpiry reads the exp claim of the token without verifying it, falling
+// back to the default portainer session lifetime
+func jwtExpiry(token string) time.Time {
+	fallback := time.Now().Add(defaultJWTLifetime)
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fallback
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fallback
+	}
+
+	var claims struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ExpiresAt == 0 {
+		return fallback
+	}
+
+	return time.Unix(claims.ExpiresAt, 0)
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/pkg/errors"
 	portainer "github.com/portainer/portainer/api"
 	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/metrics"
 )
 
 var defaultRequestTimeout = time.Minute * 2
@@ -27,22 +28,85 @@ type Client interface {
 	StackFileContent(ctx context.Context, stackID int, ll zerolog.Logger) (string, error)
 	StackImageStatus(ctx context.Context, stackID int, ll zerolog.Logger) (string, error)
 	UpdateStack(ctx context.Context, stackID int, ll zerolog.Logger) error
+	UpdateStackFile(ctx context.Context, stackID int, fileContent string, pullImage bool, ll zerolog.Logger) error
 	UpdateService(ctx context.Context, serviceID string, endpoint int, ll zerolog.Logger) error
 	ContainersForStack(ctx context.Context, stack Stack, ll zerolog.Logger) ([]dockertypes.Container, error)
 	Containers(ctx context.Context, endpointID int, ll zerolog.Logger) ([]dockertypes.Container, error)
 	ContainerImageStatus(ctx context.Context, containerID string, endpoint int, ll zerolog.Logger) (string, error)
+	RecreateContainer(ctx context.Context, containerID string, endpoint int, ll zerolog.Logger) error
 	ServicesForStack(ctx context.Context, stack Stack, ll zerolog.Logger) ([]swarm.Service, error)
 	Services(ctx context.Context, endpointID int, ll zerolog.Logger) ([]swarm.Service, error)
+	Image(ctx context.Context, endpointID int, imageID string, ll zerolog.Logger) (*dockertypes.ImageInspect, error)
 	ServiceImageStatus(ctx context.Context, serviceID string, endpoint int, ll zerolog.Logger) (string, error)
+	Registries(ctx context.Context, ll zerolog.Logger) ([]portainer.Registry, error)
 }
 
 type PortainerAPI struct {
-	client *http.Client
-	token  string
-	host   string
+	client         *http.Client
+	auth           authenticator
+	host           string
+	instance       string
+	retry          RetryPolicy
+	gitCredentials GitCredentials
+}
+
+// Option configures a PortainerAPI client
+type Option func(*PortainerAPI)
+
+// WithRetries sets how failed reads are retried
+func WithRetries(policy RetryPolicy) Option {
+	return func(c *PortainerAPI) {
+		c.retry = policy
+	}
+}
+
+// WithTLS sets how the portainer server is verified, the system roots are
+// used otherwise
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *PortainerAPI) {
+		c.client.Transport = &http.Transport{TLSClientConfig: cfg}
+	}
+}
+
+// WithInstance sets the name of the portainer instance the metrics of the
+// client are labelled with
+func WithInstance(name string) Option {
+	return func(c *PortainerAPI) {
+		c.instance = name
+	}
+}
+
+// GitCredentials returns the username and password the repository of a git
+// stack is reached with, ok is false when there are none for the stack
+type GitCredentials func(stack Stack) (username, password string, ok bool)
+
+// WithGitCredentials sets where the credentials of git stacks come from when
+// portainer has no saved git credential for them. Portainer never returns the
+// passwords it stores, so these are the only passwords sent.
+func WithGitCredentials(lookup GitCredentials) Option {
+	return func(c *PortainerAPI) {
+		c.gitCredentials = lookup
+	}
 }
 
 func (c *PortainerAPI) do(ctx context.Context, method, endpoint string, queryMap map[string]string, body []byte, ll zerolog.Logger) (*http.Response, error) {
+	res, err := c.doOnce(ctx, method, endpoint, queryMap, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusUnauthorized || !c.auth.invalidate() {
+		return res, nil
+	}
+
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+
+	ll.Debug().Str("path", endpoint).Msg("request unauthorized, logging in again")
+	return c.doOnce(ctx, method, endpoint, queryMap, body)
+}
+
+func (c *PortainerAPI) doOnce(ctx context.Context, method, endpoint string, queryMap map[string]string, body []byte) (*http.Response, error) {
 	baseURL := fmt.Sprintf("%s/%s", c.host, endpoint)
 	req, err := http.NewRequestWithContext(ctx, method, baseURL, bytes.NewBuffer(body))
 	if err != nil {
@@ -57,13 +121,58 @@ func (c *PortainerAPI) do(ctx context.Context, method, endpoint string, queryMap
 
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("X-API-Key", c.token)
+	if err := c.auth.authorize(ctx, req); err != nil {
+		return nil, err
+	}
 
-	return c.client.Do(req)
+	start := time.Now()
+	res, err := c.client.Do(req)
+	code := 0
+	if res != nil {
+		code = res.StatusCode
+	}
+	metrics.ObserveAPIRequest(c.instance, method, endpoint, code, time.Since(start))
+	return res, err
 }
 
 func (c *PortainerAPI) put(ctx context.Context, endpoint string, body []byte, ll zerolog.Logger) ([]byte, error) {
-	res, err := c.do(ctx, http.MethodPut, endpoint, nil, body, ll)
+	return c.request(ctx, http.MethodPut, endpoint, nil, body, ll)
+}
+
+func (c *PortainerAPI) post(ctx context.Context, endpoint string, body []byte, ll zerolog.Logger) ([]byte, error) {
+	return c.request(ctx, http.MethodPost, endpoint, nil, body, ll)
+}
+
+func (c *PortainerAPI) get(ctx context.Context, endpoint string, queryMap map[string]string, ll zerolog.Logger) ([]byte, error) {
+	return c.request(ctx, http.MethodGet, endpoint, queryMap, nil, ll)
+}
+
+// request sends the request and returns the response body, retrying reads
+// that failed with a network error or a temporary server error
+func (c *PortainerAPI) request(ctx context.Context, method, endpoint string, queryMap map[string]string, body []byte, ll zerolog.Logger) ([]byte, error) {
+	retries := 0
+	if idempotent(method) {
+		retries = c.retry.Retries
+	}
+
+	for retry := 1; ; retry++ {
+		respbody, err := c.requestOnce(ctx, method, endpoint, queryMap, body, ll)
+		if err == nil || retry > retries || !retryable(ctx, err) {
+			return respbody, err
+		}
+
+		delay := c.retry.backoff(retry, err)
+		ll.Debug().Err(err).Int("retry", retry).Dur("delay", delay).Msg("request failed, retrying")
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *PortainerAPI) requestOnce(ctx context.Context, method, endpoint string, queryMap map[string]string, body []byte, ll zerolog.Logger) ([]byte, error) {
+	res, err := c.do(ctx, method, endpoint, queryMap, body, ll)
 	if err != nil {
 		return nil, err
 	}
@@ -78,41 +187,35 @@ func (c *PortainerAPI) put(ctx context.Context, endpoint string, body []byte, ll
 	}
 
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		return nil, fmt.Errorf("non 2xx response code received: %d", res.StatusCode)
+		return nil, newAPIError(method, endpoint, res, respbody)
 	}
 
 	return respbody, nil
 }
 
-func (c *PortainerAPI) get(ctx context.Context, endpoint string, queryMap map[string]string, ll zerolog.Logger) ([]byte, error) {
-	res, err := c.do(ctx, http.MethodGet, endpoint, queryMap, nil, ll)
+func (c *PortainerAPI) Endpoints(ctx context.Context, ll zerolog.Logger) ([]portainer.Endpoint, error) {
+	response, err := c.get(ctx, "api/endpoints", nil, ll)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		_, _ = io.Copy(io.Discard, res.Body)
-		_ = res.Body.Close()
-	}()
 
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
+	var results []portainer.Endpoint
+	if err := json.Unmarshal(response, &results); err != nil {
 		return nil, err
 	}
 
-	if res.StatusCode < 200 || res.StatusCode > 299 {
-		return nil, fmt.Errorf("non 2xx response code received: %d", res.StatusCode)
-	}
-
-	return body, nil
+	return results, nil
 }
 
-func (c *PortainerAPI) Endpoints(ctx context.Context, ll zerolog.Logger) ([]portainer.Endpoint, error) {
-	response, err := c.get(ctx, "api/endpoints", nil, ll)
+// Registries returns the registries configured in portainer including their
+// credentials, listing them needs an administrator
+func (c *PortainerAPI) Registries(ctx context.Context, ll zerolog.Logger) ([]portainer.Registry, error) {
+	response, err := c.get(ctx, "api/registries", nil, ll)
 	if err != nil {
 		return nil, err
 	}
 
-	var results []portainer.Endpoint
+	var results []portainer.Registry
 	if err := json.Unmarshal(response, &results); err != nil {
 		return nil, err
 	}
@@ -226,6 +329,7 @@ func (c *PortainerAPI) ContainersForStack(ctx context.Context, stack Stack, ll z
 	}
 
 	query["filters"] = filtersStr
+	query["all"] = "true"
 	response, err := c.get(ctx, fmt.Sprintf("api/endpoints/%d/docker/containers/json", stack.EndpointID), query, ll)
 	if err != nil {
 		return nil, err
@@ -267,6 +371,20 @@ func (c *PortainerAPI) Services(ctx context.Context, endpointID int, ll zerolog.
 	return result, nil
 }
 
+func (c *PortainerAPI) Image(ctx context.Context, endpointID int, imageID string, ll zerolog.Logger) (*dockertypes.ImageInspect, error) {
+	response, err := c.get(ctx, fmt.Sprintf("api/endpoints/%d/docker/images/%s/json", endpointID, imageID), nil, ll)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(dockertypes.ImageInspect)
+	if err := json.Unmarshal(response, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (c *PortainerAPI) ServicesForStack(ctx context.Context, stack Stack, ll zerolog.Logger) ([]swarm.Service, error) {
 	query := make(map[string]string)
 	args := filters.NewArgs(filters.Arg("label", fmt.Sprintf("com.docker.stack.namespace=%s", stack.Name)))
@@ -276,6 +394,7 @@ func (c *PortainerAPI) ServicesForStack(ctx context.Context, stack Stack, ll zer
 	}
 
 	query["filters"] = filtersStr
+	query["status"] = "true"
 	response, err := c.get(ctx, fmt.Sprintf("api/endpoints/%d/docker/services", stack.EndpointID), query, ll)
 	if err != nil {
 		return nil, err
@@ -302,22 +421,12 @@ type updateGitStackRequest struct {
 
 func (c *PortainerAPI) updateGitStack(ctx context.Context, stack *Stack, ll zerolog.Logger) error {
 	request := updateGitStackRequest{
-		Env:                       stack.Env,
-		Prune:                     true,
-		PullImage:                 true,
-		RepositoryAuthentication:  false,
-		RepositoryGitCredentialID: 0,
-		RepositoryPassword:        "",
-		RepositoryReferenceName:   stack.GitConfig.ReferenceName,
-		RepositoryUsername:        "",
-	}
-
-	if stack.GitConfig.Authentication != nil {
-		request.RepositoryAuthentication = true
-		request.RepositoryGitCredentialID = stack.GitConfig.Authentication.GitCredentialID
-		request.RepositoryPassword = stack.GitConfig.Authentication.Password
-		request.RepositoryUsername = stack.GitConfig.Authentication.Username
+		Env:                     stack.Env,
+		Prune:                   true,
+		PullImage:               true,
+		RepositoryReferenceName: stack.GitConfig.ReferenceName,
 	}
+	c.gitAuthentication(stack, &request, ll)
 
 	jsonRequest, err := json.Marshal(request)
 	if err != nil {
@@ -334,6 +443,37 @@ func (c *PortainerAPI) updateGitStack(ctx context.Context, stack *Stack, ll zero
 	return nil
 }
 
+// gitAuthentication sets the credentials a git stack is redeployed with.
+// Portainer replaces the stored credentials with the ones in the request, and
+// keeps the stored password when the password is left empty, so stored
+// credentials are referred to instead of being sent back redacted.
+func (c *PortainerAPI) gitAuthentication(stack *Stack, request *updateGitStackRequest, ll zerolog.Logger) {
+	auth := stack.GitConfig.Authentication
+	if auth != nil && auth.GitCredentialID != 0 {
+		ll.Debug().Int("git_credential_id", auth.GitCredentialID).Msg("redeploying with saved git credential")
+		request.RepositoryAuthentication = true
+		request.RepositoryGitCredentialID = auth.GitCredentialID
+		request.RepositoryUsername = auth.Username
+		return
+	}
+
+	if c.gitCredentials != nil {
+		if username, password, ok := c.gitCredentials(*stack); ok {
+			ll.Debug().Str("username", username).Msg("redeploying with supplied git credentials")
+			request.RepositoryAuthentication = true
+			request.RepositoryUsername = username
+			request.RepositoryPassword = password
+			return
+		}
+	}
+
+	if auth != nil {
+		ll.Debug().Str("username", auth.Username).Msg("redeploying with stored git credentials")
+		request.RepositoryAuthentication = true
+		request.RepositoryUsername = auth.Username
+	}
+}
+
 type updateFileStackRequest struct {
 	Env              []portainer.Pair `json:"env"`
 	Prune            bool             `json:"prune"`
@@ -348,10 +488,14 @@ func (c *PortainerAPI) updateFileStack(ctx context.Context, stack *Stack, ll zer
 		return errors.Wrap(err, "getting stack file contents")
 	}
 
+	return c.putStackFile(ctx, stack, fileContents, true, ll)
+}
+
+func (c *PortainerAPI) putStackFile(ctx context.Context, stack *Stack, fileContents string, pullImage bool, ll zerolog.Logger) error {
 	request := updateFileStackRequest{
 		Env:              stack.Env,
 		Prune:            true,
-		PullImage:        true,
+		PullImage:        pullImage,
 		StackFileContent: fileContents,
 		Webhook:          stack.Webhook,
 	}
@@ -371,6 +515,20 @@ func (c *PortainerAPI) updateFileStack(ctx context.Context, stack *Stack, ll zer
 	return nil
 }
 
+// UpdateStackFile redeploys a file based stack with new compose file contents
+func (c *PortainerAPI) UpdateStackFile(ctx context.Context, stackID int, fileContent string, pullImage bool, ll zerolog.Logger) error {
+	stack, err := c.Stack(ctx, stackID, ll)
+	if err != nil {
+		return err
+	}
+
+	if stack.GitConfig != nil {
+		return errors.New("file contents of git stacks can't be changed")
+	}
+
+	return c.putStackFile(ctx, stack, fileContent, pullImage, ll)
+}
+
 func (c *PortainerAPI) UpdateStack(ctx context.Context, stackID int, ll zerolog.Logger) error {
 	stack, err := c.Stack(ctx, stackID, ll)
 	if err != nil {
@@ -410,17 +568,68 @@ func (c *PortainerAPI) UpdateService(ctx context.Context, serviceID string, endp
 	return nil
 }
 
-func NewPortainerAPIClient(token, host string) *PortainerAPI {
-	httpClient := &http.Client{
-		Timeout: defaultRequestTimeout,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+type recreateContainerRequest struct {
+	PullImage bool `json:"PullImage"`
+}
+
+func (c *PortainerAPI) RecreateContainer(ctx context.Context, containerID string, endpointID int, ll zerolog.Logger) error {
+	request := recreateContainerRequest{
+		PullImage: true,
+	}
+
+	jsonRequest, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrap(err, "marshalling request body to json")
+	}
+
+	if _, err := c.post(ctx, fmt.Sprintf(
+		"api/docker/%d/containers/%s/recreate",
+		endpointID,
+		containerID,
+	), jsonRequest, ll); err != nil {
+		return errors.Wrap(err, "recreating container")
+	}
+	return nil
+}
+
+func newHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout:   defaultRequestTimeout,
+		Transport: &http.Transport{},
+	}
+}
+
+// NewPortainerAPIClient returns a client authenticating with a portainer API key
+func NewPortainerAPIClient(token, host string, opts ...Option) *PortainerAPI {
+	c := &PortainerAPI{
+		client: newHTTPClient(),
+		auth:   &apiKeyAuthenticator{token: token},
+		host:   host,
+		retry:  DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
+}
 
-	return &PortainerAPI{
-		client: httpClient,
-		token:  token,
+// NewPortainerAPIClientWithCredentials returns a client that logs in with a
+// username and password and renews its session token before it expires
+func NewPortainerAPIClientWithCredentials(username, password, host string, opts ...Option) *PortainerAPI {
+	c := &PortainerAPI{
+		client: newHTTPClient(),
 		host:   host,
+		retry:  DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.auth = &jwtAuthenticator{
+		client:   c.client,
+		host:     host,
+		instance: c.instance,
+		username: username,
+		password: password,
 	}
+	return c
 }
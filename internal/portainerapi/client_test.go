@@ -0,0 +1,430 @@
+package portainerapi_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	portainer "github.com/portainer/portainer/api"
+	gittypes "github.com/portainer/portainer/api/git/types"
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+)
+
+const apiKey = "test-key"
+
+var fastRetries = portainerapi.WithRetries(portainerapi.RetryPolicy{
+	Retries:  2,
+	Delay:    time.Millisecond,
+	MaxDelay: time.Millisecond * 5,
+})
+
+func newServer(t *testing.T) *fake.Server {
+	t.Helper()
+	srv := fake.NewServer(apiKey)
+	t.Cleanup(srv.Close)
+
+	srv.AddEndpoint(1, "local", false)
+	srv.AddStack(fake.Stack{
+		Stack: portainerapi.Stack{Stack: portainer.Stack{
+			ID:         1,
+			Name:       "web",
+			EndpointID: 1,
+			Type:       portainer.DockerComposeStack,
+			Env:        []portainer.Pair{{Name: "TAG", Value: "1.0"}},
+		}},
+		File: "services:\n  web:\n    image: nginx:1.25\n",
+	})
+	srv.AddStack(fake.Stack{
+		Stack: portainerapi.Stack{Stack: portainer.Stack{
+			ID:         2,
+			Name:       "git",
+			EndpointID: 1,
+			Type:       portainer.DockerComposeStack,
+			GitConfig: &gittypes.RepoConfig{
+				URL:           "https://example.com/repo.git",
+				ReferenceName: "refs/heads/main",
+			},
+		}},
+	})
+	return srv
+}
+
+func newClient(srv *fake.Server) *portainerapi.PortainerAPI {
+	return portainerapi.NewPortainerAPIClient(apiKey, srv.URL, fastRetries)
+}
+
+func TestStacks(t *testing.T) {
+	srv := newServer(t)
+	c := newClient(srv)
+	ctx := context.Background()
+
+	stacks, err := c.Stacks(ctx, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("listing stacks: %s", err)
+	}
+	if len(stacks) != 2 || stacks[0].Name != "web" || stacks[1].GitConfig == nil {
+		t.Fatalf("unexpected stacks: %+v", stacks)
+	}
+
+	content, err := c.StackFileContent(ctx, 1, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("getting stack file: %s", err)
+	}
+	if content != srv.StackFile(1) {
+		t.Errorf("got stack file %q, want %q", content, srv.StackFile(1))
+	}
+
+	srv.SetStackImageStatus(1, fake.StatusOutdated)
+	status, err := c.StackImageStatus(ctx, 1, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("getting image status: %s", err)
+	}
+	if status != fake.StatusOutdated {
+		t.Errorf("got status %q, want %q", status, fake.StatusOutdated)
+	}
+}
+
+func TestUpdateFileStack(t *testing.T) {
+	srv := newServer(t)
+	c := newClient(srv)
+
+	if err := c.UpdateStack(context.Background(), 1, zerolog.Nop()); err != nil {
+		t.Fatalf("updating stack: %s", err)
+	}
+
+	redeploys := srv.Redeploys()
+	if len(redeploys) != 1 {
+		t.Fatalf("got %d redeploys, want 1", len(redeploys))
+	}
+	r := redeploys[0]
+	if r.Kind != fake.KindStack || r.ID != "1" || r.EndpointID != 1 || r.Git {
+		t.Errorf("unexpected redeploy: %+v", r)
+	}
+
+	var body struct {
+		Env              []portainer.Pair `json:"env"`
+		PullImage        bool             `json:"pullImage"`
+		Prune            bool             `json:"prune"`
+		StackFileContent string           `json:"stackFileContent"`
+	}
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		t.Fatalf("decoding redeploy body: %s", err)
+	}
+	if !body.PullImage || !body.Prune {
+		t.Errorf("redeploy should pull images and prune: %s", r.Body)
+	}
+	if body.StackFileContent != "services:\n  web:\n    image: nginx:1.25\n" {
+		t.Errorf("stack file changed on redeploy: %q", body.StackFileContent)
+	}
+	if len(body.Env) != 1 || body.Env[0].Name != "TAG" {
+		t.Errorf("stack env not kept on redeploy: %+v", body.Env)
+	}
+}
+
+func TestUpdateStackFile(t *testing.T) {
+	srv := newServer(t)
+	c := newClient(srv)
+	ctx := context.Background()
+
+	content := "services:\n  web:\n    image: nginx:1.26\n"
+	if err := c.UpdateStackFile(ctx, 1, content, false, zerolog.Nop()); err != nil {
+		t.Fatalf("updating stack file: %s", err)
+	}
+	if got := srv.StackFile(1); got != content {
+		t.Errorf("got stack file %q, want %q", got, content)
+	}
+
+	if err := c.UpdateStackFile(ctx, 2, content, false, zerolog.Nop()); err == nil {
+		t.Error("changing the file of a git stack should fail")
+	}
+}
+
+func TestUpdateGitStack(t *testing.T) {
+	srv := newServer(t)
+	c := newClient(srv)
+
+	if err := c.UpdateStack(context.Background(), 2, zerolog.Nop()); err != nil {
+		t.Fatalf("updating stack: %s", err)
+	}
+
+	redeploys := srv.Redeploys()
+	if len(redeploys) != 1 || !redeploys[0].Git {
+		t.Fatalf("want one git redeploy, got %+v", redeploys)
+	}
+
+	var body struct {
+		RepositoryReferenceName string `json:"repositoryReferenceName"`
+		PullImage               bool   `json:"pullImage"`
+	}
+	if err := json.Unmarshal(redeploys[0].Body, &body); err != nil {
+		t.Fatalf("decoding redeploy body: %s", err)
+	}
+	if body.RepositoryReferenceName != "refs/heads/main" || !body.PullImage {
+		t.Errorf("unexpected redeploy body: %s", redeploys[0].Body)
+	}
+}
+
+func TestUpdateGitStackCredentials(t *testing.T) {
+	srv := newServer(t)
+	for id, auth := range map[int]*gittypes.GitAuthentication{
+		3: {Username: "robot", Password: "stored"},
+		4: {Username: "robot", GitCredentialID: 7},
+		5: nil,
+	} {
+		srv.AddStack(fake.Stack{
+			Stack: portainerapi.Stack{Stack: portainer.Stack{
+				ID:         portainer.StackID(id),
+				Name:       fmt.Sprintf("git-%d", id),
+				EndpointID: 1,
+				Type:       portainer.DockerComposeStack,
+				GitConfig: &gittypes.RepoConfig{
+					URL:            "https://example.com/private.git",
+					ReferenceName:  "refs/heads/main",
+					Authentication: auth,
+				},
+			}},
+		})
+	}
+
+	ctx := context.Background()
+	c := newClient(srv)
+	stack, err := c.Stack(ctx, 3, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("getting stack: %s", err)
+	}
+	if stack.GitConfig.Authentication.Password != "" {
+		t.Fatal("the fake server returned a stored password")
+	}
+
+	// stored credentials are kept, neither blanked out nor sent back
+	for _, id := range []int{3, 4} {
+		before := srv.StackGitAuthentication(id)
+		if err := c.UpdateStack(ctx, id, zerolog.Nop()); err != nil {
+			t.Fatalf("updating stack %d: %s", id, err)
+		}
+		if after := srv.StackGitAuthentication(id); after == nil || *after != *before {
+			t.Errorf("stack %d: got credentials %+v after redeploy, want %+v", id, after, before)
+		}
+	}
+	var body struct {
+		RepositoryAuthentication  bool   `json:"repositoryAuthentication"`
+		RepositoryPassword        string `json:"repositoryPassword"`
+		RepositoryGitCredentialID int    `json:"repositoryGitCredentialID"`
+	}
+	if err := json.Unmarshal(srv.Redeploys()[1].Body, &body); err != nil {
+		t.Fatalf("decoding redeploy body: %s", err)
+	}
+	if !body.RepositoryAuthentication || body.RepositoryGitCredentialID != 7 || body.RepositoryPassword != "" {
+		t.Errorf("got redeploy body %s, want the saved git credential", srv.Redeploys()[1].Body)
+	}
+
+	// supplied credentials are used where there's no saved git credential
+	c = portainerapi.NewPortainerAPIClient(apiKey, srv.URL, fastRetries, portainerapi.WithGitCredentials(
+		func(portainerapi.Stack) (string, string, bool) { return "deploy", "supplied", true },
+	))
+	for _, id := range []int{3, 4, 5} {
+		if err := c.UpdateStack(ctx, id, zerolog.Nop()); err != nil {
+			t.Fatalf("updating stack %d: %s", id, err)
+		}
+	}
+	if auth := srv.StackGitAuthentication(3); auth == nil || auth.Username != "deploy" || auth.Password != "supplied" {
+		t.Errorf("got credentials %+v, want the supplied ones", auth)
+	}
+	if auth := srv.StackGitAuthentication(4); auth == nil || auth.GitCredentialID != 7 {
+		t.Errorf("got credentials %+v, want the saved git credential kept", auth)
+	}
+	if auth := srv.StackGitAuthentication(5); auth == nil || auth.Password != "supplied" {
+		t.Errorf("got credentials %+v, want the supplied ones", auth)
+	}
+}
+
+func TestContainersForStack(t *testing.T) {
+	srv := newServer(t)
+	srv.AddContainer(fake.Container{
+		Container: dockertypes.Container{
+			ID:     "web-1",
+			Labels: map[string]string{"com.docker.compose.project": "web"},
+		},
+		EndpointID: 1,
+	})
+	srv.AddContainer(fake.Container{
+		Container: dockertypes.Container{
+			ID:     "other-1",
+			Labels: map[string]string{"com.docker.compose.project": "other"},
+		},
+		EndpointID: 1,
+	})
+	c := newClient(srv)
+
+	stack, err := c.Stack(context.Background(), 1, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("getting stack: %s", err)
+	}
+
+	containers, err := c.ContainersForStack(context.Background(), *stack, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("listing containers: %s", err)
+	}
+	if len(containers) != 1 || containers[0].ID != "web-1" {
+		t.Errorf("want only the stack's container, got %+v", containers)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	srv := newServer(t)
+	c := newClient(srv)
+
+	_, err := c.Stack(context.Background(), 42, zerolog.Nop())
+	if !portainerapi.IsNotFound(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+
+	var apiErr *portainerapi.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("want APIError, got %T", err)
+	}
+	if apiErr.Method != http.MethodGet || apiErr.Path != "api/stacks/42" || apiErr.Message == "" {
+		t.Errorf("unexpected error: %+v", apiErr)
+	}
+	if apiErr.Temporary() {
+		t.Error("not found shouldn't be temporary")
+	}
+	if got := len(srv.Requests()); got != 1 {
+		t.Errorf("not found was sent %d times, want once", got)
+	}
+}
+
+func TestRetryReads(t *testing.T) {
+	srv := newServer(t)
+	srv.Inject(fake.Fault{Method: http.MethodGet, Path: "/api/stacks", Status: http.StatusServiceUnavailable, Times: 2})
+	c := newClient(srv)
+
+	stacks, err := c.Stacks(context.Background(), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("listing stacks: %s", err)
+	}
+	if len(stacks) != 2 {
+		t.Errorf("got %d stacks, want 2", len(stacks))
+	}
+	if got := len(srv.Requests()); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	srv := newServer(t)
+	srv.Inject(fake.Fault{Path: "/api/endpoints", Status: http.StatusBadGateway})
+	c := newClient(srv)
+
+	_, err := c.Endpoints(context.Background(), zerolog.Nop())
+	var apiErr *portainerapi.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("want bad gateway error, got %v", err)
+	}
+	if got := len(srv.Requests()); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	srv := newServer(t)
+	srv.Inject(fake.Fault{Path: "/api/endpoints", Status: http.StatusTooManyRequests, RetryAfter: time.Second, Times: 1})
+	c := newClient(srv)
+
+	start := time.Now()
+	if _, err := c.Endpoints(context.Background(), zerolog.Nop()); err != nil {
+		t.Fatalf("listing endpoints: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want the second the server asked for", elapsed)
+	}
+}
+
+func TestNoRetryForRedeploys(t *testing.T) {
+	srv := newServer(t)
+	srv.Inject(fake.Fault{Method: http.MethodPut, Status: http.StatusServiceUnavailable})
+	c := newClient(srv)
+
+	if err := c.UpdateStack(context.Background(), 1, zerolog.Nop()); err == nil {
+		t.Fatal("want error for failed redeploy")
+	}
+
+	puts := 0
+	for _, r := range srv.Requests() {
+		if r.Method == http.MethodPut {
+			puts++
+		}
+	}
+	if puts != 1 {
+		t.Errorf("redeploy was sent %d times, want once", puts)
+	}
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	srv := newServer(t)
+	srv.Inject(fake.Fault{Path: "/api/stacks", Truncate: true})
+	c := newClient(srv)
+
+	_, err := c.Stacks(context.Background(), zerolog.Nop())
+	if err == nil {
+		t.Fatal("want error for truncated response")
+	}
+	var apiErr *portainerapi.APIError
+	if errors.As(err, &apiErr) {
+		t.Errorf("truncated response isn't an API error: %v", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	srv := newServer(t)
+	srv.Inject(fake.Fault{Path: "/api/stacks/1/images_status", Latency: time.Second})
+	c := newClient(srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	_, err := c.StackImageStatus(ctx, 1, zerolog.Nop())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+	if got := len(srv.Requests()); got != 1 {
+		t.Errorf("got %d requests after the deadline, want 1", got)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	srv := newServer(t)
+	srv.Username = "admin"
+	srv.Password = "secret"
+	c := portainerapi.NewPortainerAPIClientWithCredentials("admin", "secret", srv.URL, fastRetries)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Endpoints(ctx, zerolog.Nop()); err != nil {
+			t.Fatalf("listing endpoints: %s", err)
+		}
+	}
+	if got := srv.Logins(); got != 1 {
+		t.Errorf("got %d logins, want the session to be reused", got)
+	}
+
+	srv.ExpireSessions()
+	if _, err := c.Endpoints(ctx, zerolog.Nop()); err != nil {
+		t.Fatalf("listing endpoints after the session expired: %s", err)
+	}
+	if got := srv.Logins(); got != 2 {
+		t.Errorf("got %d logins, want a new login after the session expired", got)
+	}
+
+	wrong := portainerapi.NewPortainerAPIClientWithCredentials("admin", "wrong", srv.URL, fastRetries)
+	if _, err := wrong.Endpoints(ctx, zerolog.Nop()); err == nil {
+		t.Error("want error for wrong password")
+	}
+}
@@ -0,0 +1,91 @@
+package portainerapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maximum length of a non json error body kept in an APIError
+const maxErrorBodyLength = 512
+
+// APIError is returned for any non 2xx response from portainer
+type APIError struct {
+	StatusCode int
+	Method     string
+	Path       string
+	// Message and Details are taken from portainer's error response
+	Message string
+	Details string
+	// RetryAfter is the delay the server asked for, if any
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Details != "" && e.Details != e.Message {
+		msg += ": " + e.Details
+	}
+	return msg
+}
+
+// Temporary reports whether the request may succeed when sent again
+func (e *APIError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// IsNotFound reports whether err is a 404 from portainer
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func newAPIError(method, path string, res *http.Response, body []byte) *APIError {
+	apiErr := &APIError{
+		StatusCode: res.StatusCode,
+		Method:     method,
+		Path:       path,
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+
+	var payload struct {
+		Message string `json:"message"`
+		Details string `json:"details"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		apiErr.Message = payload.Message
+		apiErr.Details = payload.Details
+		return apiErr
+	}
+
+	details := strings.TrimSpace(string(body))
+	if len(details) > maxErrorBodyLength {
+		details = details[:maxErrorBodyLength] + "..."
+	}
+	apiErr.Details = details
+	return apiErr
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,837 @@
+// Package fake provides an in-process portainer server for tests. It models
+// endpoints, stacks, containers, services and their image statuses, records
+// the redeploys it receives and can inject faults into its responses.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	portainer "github.com/portainer/portainer/api"
+	gittypes "github.com/portainer/portainer/api/git/types"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+)
+
+// image statuses as reported by portainer
+const (
+	StatusOutdated = "outdated"
+	StatusUpdated  = "updated"
+	StatusSkipped  = "skipped"
+)
+
+// kinds of redeploys
+const (
+	KindStack     = "stack"
+	KindService   = "service"
+	KindContainer = "container"
+)
+
+// Stack is a stack along with its compose file and image status
+type Stack struct {
+	portainerapi.Stack
+	File        string
+	ImageStatus string
+	// RemoteHead is the commit the repository of a git stack is at, a
+	// redeploy deploys it and stores it as the config hash
+	RemoteHead string
+}
+
+// Container is a container on a docker endpoint
+type Container struct {
+	dockertypes.Container
+	EndpointID  int
+	ImageStatus string
+}
+
+// Service is a service on a swarm endpoint
+type Service struct {
+	swarm.Service
+	EndpointID  int
+	ImageStatus string
+}
+
+// Redeploy is a stack redeploy, service update or container recreate the
+// server received
+type Redeploy struct {
+	Kind       string
+	ID         string
+	EndpointID int
+	// Git is set for redeploys of git stacks
+	Git bool
+	// Body is the request body as sent by the client
+	Body json.RawMessage
+}
+
+// Request is any request the server received
+type Request struct {
+	Method string
+	Path   string
+}
+
+// Fault changes the responses to matching requests
+type Fault struct {
+	// Method and Path select the requests, Path is matched with path.Match
+	// against the path without query. Empty values match everything.
+	Method string
+	Path   string
+	// Latency delays the response
+	Latency time.Duration
+	// Status replaces the response with a portainer error of this status
+	Status int
+	// RetryAfter is sent along with Status
+	RetryAfter time.Duration
+	// Truncate cuts the JSON response body in half
+	Truncate bool
+	// Times is the number of requests affected, zero affects all of them
+	Times int
+}
+
+func (f *Fault) matches(r *http.Request) bool {
+	if f.Method != "" && f.Method != r.Method {
+		return false
+	}
+	if f.Path == "" {
+		return true
+	}
+	ok, _ := path.Match(f.Path, r.URL.Path)
+	return ok
+}
+
+// Server is a fake portainer. Add endpoints, stacks, containers and services
+// before pointing a client at URL.
+type Server struct {
+	*httptest.Server
+
+	// APIKey is accepted in the X-API-Key header
+	APIKey string
+	// Username and Password are accepted by api/auth
+	Username string
+	Password string
+
+	mu         sync.Mutex
+	endpoints  []portainer.Endpoint
+	stacks     []*Stack
+	containers []*Container
+	services   []*Service
+	images     map[string]dockertypes.ImageInspect
+	registries []portainer.Registry
+	sessions   map[string]bool
+	logins     int
+	faults     []*Fault
+	requests   []Request
+	redeploys  []Redeploy
+}
+
+// NewServer starts a fake portainer accepting apiKey, it's closed when the
+// caller calls Close
+func NewServer(apiKey string) *Server {
+	s := newServer(apiKey)
+	s.Server = httptest.NewServer(s.faulty(s.routes()))
+	return s
+}
+
+// NewTLSServer starts a fake portainer serving https with a self signed
+// certificate, see httptest.NewTLSServer
+func NewTLSServer(apiKey string) *Server {
+	s := newServer(apiKey)
+	s.Server = httptest.NewTLSServer(s.faulty(s.routes()))
+	return s
+}
+
+func newServer(apiKey string) *Server {
+	return &Server{
+		APIKey:   apiKey,
+		images:   make(map[string]dockertypes.ImageInspect),
+		sessions: make(map[string]bool),
+	}
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/auth", s.login)
+	mux.HandleFunc("GET /api/endpoints", s.authorized(s.listEndpoints))
+	mux.HandleFunc("GET /api/registries", s.authorized(s.listRegistries))
+	mux.HandleFunc("GET /api/stacks", s.authorized(s.listStacks))
+	mux.HandleFunc("GET /api/stacks/{id}", s.authorized(s.getStack))
+	mux.HandleFunc("PUT /api/stacks/{id}", s.authorized(s.redeployFileStack))
+	mux.HandleFunc("GET /api/stacks/{id}/file", s.authorized(s.getStackFile))
+	mux.HandleFunc("GET /api/stacks/{id}/images_status", s.authorized(s.stackImageStatus))
+	mux.HandleFunc("PUT /api/stacks/{id}/git/redeploy", s.authorized(s.redeployGitStack))
+	mux.HandleFunc("GET /api/docker/{endpoint}/containers/{id}/image_status", s.authorized(s.containerImageStatus))
+	mux.HandleFunc("POST /api/docker/{endpoint}/containers/{id}/recreate", s.authorized(s.recreateContainer))
+	mux.HandleFunc("GET /api/docker/{endpoint}/services/{id}/image_status", s.authorized(s.serviceImageStatus))
+	mux.HandleFunc("GET /api/endpoints/{endpoint}/docker/containers/json", s.authorized(s.listContainers))
+	mux.HandleFunc("GET /api/endpoints/{endpoint}/docker/services", s.authorized(s.listServices))
+	mux.HandleFunc("GET /api/endpoints/{endpoint}/docker/images/{id}/json", s.authorized(s.inspectImage))
+	mux.HandleFunc("PUT /api/endpoints/{endpoint}/forceupdateservice", s.authorized(s.forceUpdateService))
+	return mux
+}
+
+// AddEndpoint adds a docker or, with swarm set, a swarm endpoint
+func (s *Server) AddEndpoint(id int, name string, swarm bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.endpoints = append(s.endpoints, portainer.Endpoint{
+		ID:   portainer.EndpointID(id),
+		Name: name,
+		Type: portainer.DockerEnvironment,
+		URL:  fmt.Sprintf("tcp://%s:2375", name),
+		Snapshots: []portainer.DockerSnapshot{
+			{Swarm: swarm},
+		},
+	})
+}
+
+// AddStack adds a stack, its image status defaults to up to date
+func (s *Server) AddStack(stack Stack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stack.ImageStatus == "" {
+		stack.ImageStatus = StatusUpdated
+	}
+	if stack.GitConfig != nil {
+		// redeploys change the config hash
+		cfg := *stack.GitConfig
+		stack.GitConfig = &cfg
+	}
+	s.stacks = append(s.stacks, &stack)
+}
+
+// AddContainer adds a container, its image status defaults to up to date
+func (s *Server) AddContainer(container Container) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if container.ImageStatus == "" {
+		container.ImageStatus = StatusUpdated
+	}
+	s.containers = append(s.containers, &container)
+}
+
+// AddService adds a service, its image status defaults to up to date
+func (s *Server) AddService(service Service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if service.ImageStatus == "" {
+		service.ImageStatus = StatusUpdated
+	}
+	s.services = append(s.services, &service)
+}
+
+// AddImage adds an image that can be inspected on any endpoint
+func (s *Server) AddImage(image dockertypes.ImageInspect) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.images[image.ID] = image
+}
+
+// AddRegistry adds a registry, its credentials are listed as portainer lists
+// them to administrators
+func (s *Server) AddRegistry(registry portainer.Registry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.registries = append(s.registries, registry)
+}
+
+// SetStackImageStatus changes the image status of a stack
+func (s *Server) SetStackImageStatus(id int, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stack := s.stack(id); stack != nil {
+		stack.ImageStatus = status
+	}
+}
+
+// SetContainerImageStatus changes the image status of a container
+func (s *Server) SetContainerImageStatus(id, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, container := range s.containers {
+		if container.ID == id {
+			container.ImageStatus = status
+		}
+	}
+}
+
+// SetServiceImageStatus changes the image status of a service
+func (s *Server) SetServiceImageStatus(id, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, service := range s.services {
+		if service.ID == id {
+			service.ImageStatus = status
+		}
+	}
+}
+
+// SetStackRemoteHead moves the repository of a git stack to a new commit
+func (s *Server) SetStackRemoteHead(id int, head string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stack := s.stack(id); stack != nil {
+		stack.RemoteHead = head
+	}
+}
+
+// StackGitAuthentication returns the credentials stored for a git stack
+func (s *Server) StackGitAuthentication(id int) *gittypes.GitAuthentication {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stack := s.stack(id); stack != nil && stack.GitConfig != nil && stack.GitConfig.Authentication != nil {
+		auth := *stack.GitConfig.Authentication
+		return &auth
+	}
+	return nil
+}
+
+// StackFile returns the current compose file of a stack
+func (s *Server) StackFile(id int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stack := s.stack(id); stack != nil {
+		return stack.File
+	}
+	return ""
+}
+
+// Inject adds a fault, faults are matched in the order they were added
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all faults
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+}
+
+// ExpireSessions invalidates all tokens handed out by api/auth
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions = make(map[string]bool)
+}
+
+// Logins returns the number of successful logins
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.logins
+}
+
+// Requests returns the requests received so far
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// Redeploys returns the redeploys received so far
+func (s *Server) Redeploys() []Redeploy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Redeploy(nil), s.redeploys...)
+}
+
+// faulty records every request and applies the first matching fault
+func (s *Server) faulty(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path})
+		var fault *Fault
+		for i, f := range s.faults {
+			if !f.matches(r) {
+				continue
+			}
+			fault = f
+			if f.Times > 0 {
+				if f.Times--; f.Times == 0 {
+					s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+				}
+			}
+			break
+		}
+		s.mu.Unlock()
+
+		if fault == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if fault.Latency > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(fault.Latency):
+			}
+		}
+
+		if fault.Status != 0 {
+			if fault.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(fault.RetryAfter/time.Second)))
+			}
+			writeError(w, fault.Status, "injected fault")
+			return
+		}
+
+		if fault.Truncate {
+			rec := httptest.NewRecorder()
+			next.ServeHTTP(rec, r)
+			body := rec.Body.Bytes()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(rec.Code)
+			_, _ = w.Write(body[:len(body)/2])
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		ok := s.APIKey != "" && r.Header.Get("X-API-Key") == s.APIKey
+		if token, found := bearerToken(r); found && s.sessions[token] {
+			ok = true
+		}
+		s.mu.Unlock()
+
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || header[:len(prefix)] != prefix {
+		return "", false
+	}
+	return header[len(prefix):], true
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Username == "" || payload.Username != s.Username || payload.Password != s.Password {
+		writeError(w, http.StatusUnprocessableEntity, "Invalid credentials")
+		return
+	}
+
+	s.logins++
+	token := fmt.Sprintf("session-%d", s.logins)
+	s.sessions[token] = true
+	writeJSON(w, map[string]string{"jwt": token})
+}
+
+func (s *Server) listEndpoints(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	endpoints := append([]portainer.Endpoint{}, s.endpoints...)
+	writeJSON(w, endpoints)
+}
+
+func (s *Server) listRegistries(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	registries := append([]portainer.Registry{}, s.registries...)
+	writeJSON(w, registries)
+}
+
+func (s *Server) listStacks(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stacks := make([]portainerapi.Stack, 0, len(s.stacks))
+	for _, stack := range s.stacks {
+		stacks = append(stacks, redacted(stack.Stack))
+	}
+	writeJSON(w, stacks)
+}
+
+func (s *Server) getStack(w http.ResponseWriter, r *http.Request) {
+	s.withStack(w, r, func(stack *Stack) {
+		writeJSON(w, redacted(stack.Stack))
+	})
+}
+
+func (s *Server) getStackFile(w http.ResponseWriter, r *http.Request) {
+	s.withStack(w, r, func(stack *Stack) {
+		writeJSON(w, map[string]string{"StackFileContent": stack.File})
+	})
+}
+
+func (s *Server) stackImageStatus(w http.ResponseWriter, r *http.Request) {
+	s.withStack(w, r, func(stack *Stack) {
+		writeJSON(w, map[string]string{"Status": stack.ImageStatus})
+	})
+}
+
+func (s *Server) redeployFileStack(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	var payload struct {
+		StackFileContent string           `json:"stackFileContent"`
+		Env              []portainer.Pair `json:"env"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	s.withStack(w, r, func(stack *Stack) {
+		if stack.GitConfig != nil {
+			writeError(w, http.StatusBadRequest, "Stack is a git stack")
+			return
+		}
+		stack.File = payload.StackFileContent
+		stack.Env = payload.Env
+		stack.ImageStatus = StatusUpdated
+		s.redeploys = append(s.redeploys, Redeploy{
+			Kind:       KindStack,
+			ID:         strconv.Itoa(int(stack.ID)),
+			EndpointID: int(stack.EndpointID),
+			Body:       body,
+		})
+		writeJSON(w, stack.Stack)
+	})
+}
+
+func (s *Server) redeployGitStack(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	var payload struct {
+		RepositoryAuthentication  bool
+		RepositoryUsername        string
+		RepositoryPassword        string
+		RepositoryGitCredentialID int
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	s.withStack(w, r, func(stack *Stack) {
+		if stack.GitConfig == nil {
+			writeError(w, http.StatusBadRequest, "Stack is not a git stack")
+			return
+		}
+
+		// like portainer, the stored credentials are replaced by the ones
+		// sent, an empty password keeps the stored one
+		switch {
+		case !payload.RepositoryAuthentication:
+			stack.GitConfig.Authentication = nil
+		case payload.RepositoryGitCredentialID != 0:
+			stack.GitConfig.Authentication = &gittypes.GitAuthentication{
+				Username:        payload.RepositoryUsername,
+				GitCredentialID: payload.RepositoryGitCredentialID,
+			}
+		default:
+			password := payload.RepositoryPassword
+			if password == "" && stack.GitConfig.Authentication != nil {
+				password = stack.GitConfig.Authentication.Password
+			}
+			stack.GitConfig.Authentication = &gittypes.GitAuthentication{
+				Username: payload.RepositoryUsername,
+				Password: password,
+			}
+		}
+		stack.ImageStatus = StatusUpdated
+		if stack.RemoteHead != "" {
+			stack.GitConfig.ConfigHash = stack.RemoteHead
+		}
+		s.redeploys = append(s.redeploys, Redeploy{
+			Kind:       KindStack,
+			ID:         strconv.Itoa(int(stack.ID)),
+			EndpointID: int(stack.EndpointID),
+			Git:        true,
+			Body:       body,
+		})
+		writeJSON(w, redacted(stack.Stack))
+	})
+}
+
+// redacted returns stack without the password of its git credentials, which
+// portainer never sends
+func redacted(stack portainerapi.Stack) portainerapi.Stack {
+	if stack.GitConfig == nil || stack.GitConfig.Authentication == nil {
+		return stack
+	}
+	cfg := *stack.GitConfig
+	auth := *cfg.Authentication
+	auth.Password = ""
+	cfg.Authentication = &auth
+	stack.GitConfig = &cfg
+	return stack
+}
+
+// withStack calls fn with the stack named in the path while holding the lock
+func (s *Server) withStack(w http.ResponseWriter, r *http.Request, fn func(stack *Stack)) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid stack identifier route variable")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stack := s.stack(id)
+	if stack == nil {
+		writeError(w, http.StatusNotFound, "Unable to find a stack with the specified identifier inside the database")
+		return
+	}
+	fn(stack)
+}
+
+func (s *Server) stack(id int) *Stack {
+	for _, stack := range s.stacks {
+		if int(stack.ID) == id {
+			return stack
+		}
+	}
+	return nil
+}
+
+func (s *Server) containerImageStatus(w http.ResponseWriter, r *http.Request) {
+	s.withContainer(w, r, func(container *Container) {
+		writeJSON(w, map[string]string{"Status": container.ImageStatus})
+	})
+}
+
+func (s *Server) recreateContainer(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	s.withContainer(w, r, func(container *Container) {
+		container.ImageStatus = StatusUpdated
+		s.redeploys = append(s.redeploys, Redeploy{
+			Kind:       KindContainer,
+			ID:         container.ID,
+			EndpointID: container.EndpointID,
+			Body:       body,
+		})
+		writeJSON(w, container.Container)
+	})
+}
+
+func (s *Server) withContainer(w http.ResponseWriter, r *http.Request, fn func(container *Container)) {
+	endpointID, err := strconv.Atoi(r.PathValue("endpoint"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid environment identifier route variable")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, container := range s.containers {
+		if container.EndpointID == endpointID && container.ID == r.PathValue("id") {
+			fn(container)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "No such container")
+}
+
+func (s *Server) serviceImageStatus(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.Atoi(r.PathValue("endpoint"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid environment identifier route variable")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if service := s.service(endpointID, r.PathValue("id")); service != nil {
+		writeJSON(w, map[string]string{"Status": service.ImageStatus})
+		return
+	}
+	writeError(w, http.StatusNotFound, "No such service")
+}
+
+func (s *Server) forceUpdateService(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.Atoi(r.PathValue("endpoint"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid environment identifier route variable")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	var payload struct {
+		ServiceID string `json:"serviceID"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	service := s.service(endpointID, payload.ServiceID)
+	if service == nil {
+		writeError(w, http.StatusNotFound, "No such service")
+		return
+	}
+	service.ImageStatus = StatusUpdated
+	service.Version.Index++
+	s.redeploys = append(s.redeploys, Redeploy{
+		Kind:       KindService,
+		ID:         service.ID,
+		EndpointID: endpointID,
+		Body:       body,
+	})
+	writeJSON(w, map[string][]string{"Warnings": nil})
+}
+
+func (s *Server) service(endpointID int, id string) *Service {
+	for _, service := range s.services {
+		if service.EndpointID == endpointID && service.ID == id {
+			return service
+		}
+	}
+	return nil
+}
+
+func (s *Server) listContainers(w http.ResponseWriter, r *http.Request) {
+	endpointID, args, ok := endpointAndFilters(w, r)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	containers := make([]dockertypes.Container, 0)
+	for _, container := range s.containers {
+		if container.EndpointID == endpointID && args.MatchKVList("label", container.Labels) {
+			containers = append(containers, container.Container)
+		}
+	}
+	writeJSON(w, containers)
+}
+
+func (s *Server) listServices(w http.ResponseWriter, r *http.Request) {
+	endpointID, args, ok := endpointAndFilters(w, r)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	services := make([]swarm.Service, 0)
+	for _, service := range s.services {
+		if service.EndpointID == endpointID && args.MatchKVList("label", service.Spec.Labels) {
+			services = append(services, service.Service)
+		}
+	}
+	writeJSON(w, services)
+}
+
+func endpointAndFilters(w http.ResponseWriter, r *http.Request) (int, filters.Args, bool) {
+	endpointID, err := strconv.Atoi(r.PathValue("endpoint"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid environment identifier route variable")
+		return 0, filters.Args{}, false
+	}
+
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return 0, filters.Args{}, false
+	}
+	return endpointID, args, true
+}
+
+func (s *Server) inspectImage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	image, ok := s.images[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such image: "+r.PathValue("id"))
+		return
+	}
+	writeJSON(w, image)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds like portainer does for failed requests
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"message": message,
+		"details": http.StatusText(code),
+	})
+}
@@ -0,0 +1,76 @@
+package portainerapi
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy controls how often failed requests are sent again. Only reads
+// are retried: redeploying a stack or recreating a container may have gone
+// through even when the response was lost.
+type RetryPolicy struct {
+	// Retries is the number of retries after the first attempt
+	Retries int
+	// Delay is the backoff before the first retry, doubling on every retry
+	Delay time.Duration
+	// MaxDelay caps the backoff, a Retry-After sent by the server is honored
+	// even when it is longer
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used unless the client is created with WithRetries
+var DefaultRetryPolicy = RetryPolicy{
+	Retries:  3,
+	Delay:    time.Second,
+	MaxDelay: time.Second * 30,
+}
+
+// backoff returns the jittered delay before the given retry, starting at 1
+func (p RetryPolicy) backoff(retry int, err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+
+	d := p.Delay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	// spread retries of concurrent checks so they don't hit portainer at once
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryable reports whether a failed request may succeed when sent again
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+
+	// anything else failed on the way to portainer or back
+	return true
+}
@@ -0,0 +1,96 @@
+package portainerapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig controls how the portainer server is verified. The zero value
+// verifies the server against the system roots.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of CAs trusted in addition to the system roots
+	CAFile string
+	// CertFile and KeyFile are a client certificate sent for mutual TLS
+	CertFile string
+	KeyFile  string
+	// Fingerprint is the hex SHA-256 fingerprint of the server certificate.
+	// The pinned certificate is trusted even when no CA vouches for it, such
+	// as the self signed certificate portainer generates.
+	Fingerprint string
+	// Insecure disables verification of the server certificate
+	Insecure bool
+}
+
+// Build returns the tls config for connecting to portainer
+func (c TLSConfig) Build() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading ca file")
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in ca file %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.Fingerprint != "" {
+		pin, err := parseFingerprint(c.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		// the pin replaces the chain verification
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], pin) {
+				return errors.Errorf("server certificate fingerprint %s doesn't match the pinned fingerprint", hex.EncodeToString(sum[:]))
+			}
+			return nil
+		}
+	}
+
+	if c.Insecure {
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
+
+// parseFingerprint accepts the hex fingerprint with or without colons, as
+// printed by openssl x509 -fingerprint -sha256
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	pin, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, errors.Errorf("invalid sha256 fingerprint %q", fingerprint)
+	}
+	return pin, nil
+}
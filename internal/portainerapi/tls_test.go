@@ -0,0 +1,101 @@
+package portainerapi_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi"
+	"github.com/sjafferali/portainer-autoupdater/internal/portainerapi/fake"
+)
+
+func newTLSClient(t *testing.T, srv *fake.Server, cfg portainerapi.TLSConfig) *portainerapi.PortainerAPI {
+	t.Helper()
+	tlsConfig, err := cfg.Build()
+	if err != nil {
+		t.Fatalf("building tls config: %s", err)
+	}
+	return portainerapi.NewPortainerAPIClient(apiKey, srv.URL, fastRetries, portainerapi.WithTLS(tlsConfig))
+}
+
+func fingerprint(srv *fake.Server) string {
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func TestTLSVerifiesByDefault(t *testing.T) {
+	srv := fake.NewTLSServer(apiKey)
+	defer srv.Close()
+
+	c := newTLSClient(t, srv, portainerapi.TLSConfig{})
+	if _, err := c.Endpoints(context.Background(), zerolog.Nop()); err == nil {
+		t.Fatal("want error for a self signed certificate")
+	}
+	if got := len(srv.Requests()); got != 0 {
+		t.Errorf("got %d requests through an unverified connection", got)
+	}
+}
+
+func TestTLSCAFile(t *testing.T) {
+	srv := fake.NewTLSServer(apiKey)
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTLSClient(t, srv, portainerapi.TLSConfig{CAFile: caFile})
+	if _, err := c.Endpoints(context.Background(), zerolog.Nop()); err != nil {
+		t.Fatalf("listing endpoints: %s", err)
+	}
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	srv := fake.NewTLSServer(apiKey)
+	defer srv.Close()
+
+	c := newTLSClient(t, srv, portainerapi.TLSConfig{Fingerprint: fingerprint(srv)})
+	if _, err := c.Endpoints(context.Background(), zerolog.Nop()); err != nil {
+		t.Fatalf("listing endpoints with pinned certificate: %s", err)
+	}
+
+	other := strings.Repeat("ab", sha256.Size)
+	c = newTLSClient(t, srv, portainerapi.TLSConfig{Fingerprint: other})
+	if _, err := c.Endpoints(context.Background(), zerolog.Nop()); err == nil {
+		t.Fatal("want error for a certificate that doesn't match the pin")
+	}
+}
+
+func TestTLSInsecure(t *testing.T) {
+	srv := fake.NewTLSServer(apiKey)
+	defer srv.Close()
+
+	c := newTLSClient(t, srv, portainerapi.TLSConfig{Insecure: true})
+	if _, err := c.Endpoints(context.Background(), zerolog.Nop()); err != nil {
+		t.Fatalf("listing endpoints: %s", err)
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	for name, cfg := range map[string]portainerapi.TLSConfig{
+		"short fingerprint": {Fingerprint: "ab:cd"},
+		"missing key":       {CertFile: "client.pem"},
+		"missing ca file":   {CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if _, err := cfg.Build(); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
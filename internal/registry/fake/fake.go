@@ -0,0 +1,246 @@
+// Package fake provides an in-process OCI registry for tests. It serves
+// manifests for the tags pushed to it and can require basic or token
+// authentication like docker hub and most private registries do.
+package fake
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Auth is how the registry authenticates clients
+type Auth int
+
+const (
+	// AuthNone allows anonymous pulls
+	AuthNone Auth = iota
+	// AuthBasic requires the credentials in every request
+	AuthBasic
+	// AuthToken requires a bearer token from the registry's token endpoint,
+	// which hands out tokens for the credentials
+	AuthToken
+)
+
+const manifestType = "application/vnd.oci.image.index.v1+json"
+
+// Request is any request the registry received
+type Request struct {
+	Method string
+	Path   string
+}
+
+// Registry is a fake registry. Push tags before pointing a client at Host.
+type Registry struct {
+	*httptest.Server
+
+	// Auth, Username and Password protect the manifests
+	Auth     Auth
+	Username string
+	Password string
+	// OmitDigest leaves out the Docker-Content-Digest header
+	OmitDigest bool
+	// PageSize limits the number of tags listed per page
+	PageSize int
+
+	mu        sync.Mutex
+	manifests map[string][]byte
+	pushes    int
+	tokens    int
+	requests  []Request
+}
+
+// NewRegistry starts a fake registry serving plain http on the loopback
+// interface, it's closed when the caller calls Close
+func NewRegistry() *Registry {
+	r := &Registry{manifests: make(map[string][]byte)}
+	r.Server = httptest.NewServer(r.routes())
+	return r
+}
+
+func (r *Registry) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /token", r.token)
+	mux.HandleFunc("/v2/", r.v2)
+	return mux
+}
+
+// Host is the registry part of image references pointing at the registry
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+// Push points the tag of repository at a new manifest and returns its digest
+func (r *Registry) Push(repository, tag string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pushes++
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestType,
+		"annotations":   map[string]string{"push": fmt.Sprint(r.pushes)},
+	})
+	r.manifests[repository+":"+tag] = manifest
+	return digest(manifest)
+}
+
+// Tokens returns the number of tokens handed out
+func (r *Registry) Tokens() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tokens
+}
+
+// Requests returns all requests received so far
+func (r *Registry) Requests() []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Request(nil), r.requests...)
+}
+
+func (r *Registry) v2(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, Request{Method: req.Method, Path: req.URL.Path})
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	name, reference, isManifest := strings.Cut(path, "/manifests/")
+	if !isManifest {
+		name = strings.TrimSuffix(path, "/tags/list")
+	}
+	if name == path || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN")
+		return
+	}
+
+	if !r.authorized(req, name) {
+		switch r.Auth {
+		case AuthBasic:
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+		case AuthToken:
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer realm="%s/token",service="fake",scope="repository:%s:pull"`, r.URL, name))
+		}
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED")
+		return
+	}
+
+	if isManifest {
+		r.manifest(w, req, name, reference)
+	} else {
+		r.tags(w, req, name)
+	}
+}
+
+func (r *Registry) manifest(w http.ResponseWriter, req *http.Request, name, reference string) {
+	manifest, ok := r.manifests[name+":"+reference]
+	if !ok {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+		return
+	}
+
+	w.Header().Set("Content-Type", manifestType)
+	if !r.OmitDigest {
+		w.Header().Set("Docker-Content-Digest", digest(manifest))
+	}
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(manifest)
+	}
+}
+
+// tags lists the tags of a repository in pages of n tags, linking to the
+// next page like the distribution spec describes
+func (r *Registry) tags(w http.ResponseWriter, req *http.Request, name string) {
+	tags := make([]string, 0)
+	for key := range r.manifests {
+		if tag, ok := strings.CutPrefix(key, name+":"); ok {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN")
+		return
+	}
+	sort.Strings(tags)
+
+	if last := req.URL.Query().Get("last"); last != "" {
+		tags = tags[sort.SearchStrings(tags, last):]
+		if len(tags) > 0 && tags[0] == last {
+			tags = tags[1:]
+		}
+	}
+	n, err := strconv.Atoi(req.URL.Query().Get("n"))
+	if err != nil || n <= 0 || (r.PageSize > 0 && r.PageSize < n) {
+		n = r.PageSize
+	}
+	if n > 0 && n < len(tags) {
+		tags = tags[:n]
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`, name, n, url.QueryEscape(tags[n-1])))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": tags})
+}
+
+func (r *Registry) authorized(req *http.Request, name string) bool {
+	switch r.Auth {
+	case AuthBasic:
+		username, password, ok := req.BasicAuth()
+		return ok && username == r.Username && password == r.Password
+	case AuthToken:
+		return req.Header.Get("Authorization") == "Bearer "+tokenFor(name)
+	default:
+		return true
+	}
+}
+
+func (r *Registry) token(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if username, password, _ := req.BasicAuth(); username != r.Username || password != r.Password {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED")
+		return
+	}
+
+	scope := strings.Split(req.URL.Query().Get("scope"), ":")
+	if len(scope) != 3 || scope[0] != "repository" {
+		writeError(w, http.StatusBadRequest, "invalid scope")
+		return
+	}
+
+	r.tokens++
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      tokenFor(scope[1]),
+		"expires_in": 300,
+	})
+}
+
+// tokenFor returns the token that grants pulling the repository
+func tokenFor(repository string) string {
+	return "token-" + repository
+}
+
+func digest(manifest []byte) string {
+	sum := sha256.Sum256(manifest)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// writeError responds with a registry error, see the distribution spec
+func writeError(w http.ResponseWriter, code int, errorCode string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": errorCode, "message": strings.ToLower(errorCode)}},
+	})
+}
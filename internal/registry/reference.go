@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DockerHub is the registry of image references without a registry host
+const DockerHub = "docker.io"
+
+// Reference is an image reference split into its parts
+type Reference struct {
+	// Registry is the registry host, DockerHub when the reference has none
+	Registry string
+	// Repository is the path of the image in the registry, official docker
+	// hub images get their library/ prefix
+	Repository string
+	// Tag is "latest" when the reference has neither tag nor digest
+	Tag    string
+	Digest string
+}
+
+// ParseReference splits an image reference like nginx:1.25 or
+// ghcr.io/org/app:v2@sha256:... into its parts
+func ParseReference(image string) (Reference, error) {
+	var ref Reference
+	if strings.HasPrefix(image, "sha256:") {
+		return Reference{}, errors.Errorf("image %q is an image ID, not a reference", image)
+	}
+
+	name, digest, _ := strings.Cut(image, "@")
+	ref.Digest = digest
+
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+
+	ref.Registry = DockerHub
+	if host, path, ok := strings.Cut(name, "/"); ok && isRegistryHost(host) {
+		ref.Registry, name = host, path
+	}
+	if ref.Registry == "index.docker.io" {
+		ref.Registry = DockerHub
+	}
+	if name == "" {
+		return Reference{}, errors.Errorf("invalid image reference %q", image)
+	}
+	if ref.Registry == DockerHub && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	ref.Repository = name
+	return ref, nil
+}
+
+// isRegistryHost reports whether the first path component of a reference is
+// a registry host rather than a docker hub user, like docker decides it
+func isRegistryHost(host string) bool {
+	return strings.ContainsAny(host, ".:") || host == "localhost" || strings.ToLower(host) != host
+}
+
+// Name is the reference without tag and digest, including the registry
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,407 @@
+// Package registry resolves image tags to manifest digests and lists the tags
+// of repositories with the OCI distribution api, so outdated images can be
+// found without pulling them.
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var defaultRequestTimeout = time.Second * 30
+
+// manifest media types a tag may resolve to. Indexes come first: docker
+// records the digest of the index for multi platform images it pulled by tag.
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// default lifetime of a bearer token that doesn't state its expiry
+const defaultTokenLifetime = time.Minute
+
+// Credential is a username and password for a registry, the zero value pulls
+// anonymously
+type Credential struct {
+	Username string
+	Password string
+}
+
+// Credentials returns the credential to pull the image of ref with
+type Credentials func(ctx context.Context, ref Reference) (Credential, error)
+
+// Client resolves tags against registries. It is safe for concurrent use.
+type Client struct {
+	client      *http.Client
+	credentials Credentials
+	insecure    map[string]bool
+
+	mu sync.Mutex
+	// authorizations are the Authorization headers by repository
+	authorizations map[string]authorization
+}
+
+type authorization struct {
+	header  string
+	expires time.Time
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithCredentials sets how credentials are looked up, images are pulled
+// anonymously otherwise
+func WithCredentials(fn Credentials) Option {
+	return func(c *Client) {
+		c.credentials = fn
+	}
+}
+
+// WithInsecureRegistries sets the registry hosts reached over plain http,
+// loopback registries always are
+func WithInsecureRegistries(hosts []string) Option {
+	return func(c *Client) {
+		for _, host := range hosts {
+			c.insecure[host] = true
+		}
+	}
+}
+
+// NewClient returns a client for resolving tags
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		client:         &http.Client{Timeout: defaultRequestTimeout},
+		insecure:       make(map[string]bool),
+		authorizations: make(map[string]authorization),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Digest returns the digest the tag of ref currently points to
+func (c *Client) Digest(ctx context.Context, ref Reference) (string, error) {
+	if ref.Tag == "" {
+		return "", errors.Errorf("image %s has no tag", ref)
+	}
+
+	// registries aren't required to send the digest for HEAD requests, the
+	// manifest is fetched and hashed then
+	res, err := c.manifest(ctx, http.MethodHead, ref)
+	if err != nil {
+		return "", err
+	}
+	_ = res.Body.Close()
+	if digest := res.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	res, err = c.manifest(ctx, http.MethodGet, ref)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading manifest of %s", ref)
+	}
+	if digest := res.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// manifest requests the manifest of the tag of ref
+func (c *Client) manifest(ctx context.Context, method string, ref Reference) (*http.Response, error) {
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL(ref.Registry), ref.Repository, ref.Tag)
+	return c.request(ctx, method, u, strings.Join(manifestTypes, ", "), ref, "manifest of "+ref.String())
+}
+
+// maximum number of pages of tags followed, registries page with a Link
+// header that a broken registry could make loop
+const maxTagPages = 100
+
+type tagsResponse struct {
+	Tags []string `json:"tags"`
+}
+
+// Tags lists the tags of the repository of ref
+func (c *Client) Tags(ctx context.Context, ref Reference) ([]string, error) {
+	u := fmt.Sprintf("%s/v2/%s/tags/list?n=1000", c.baseURL(ref.Registry), ref.Repository)
+
+	var tags []string
+	for page := 0; u != "" && page < maxTagPages; page++ {
+		res, err := c.request(ctx, http.MethodGet, u, "application/json", ref, "tags of "+ref.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		var list tagsResponse
+		err = json.NewDecoder(res.Body).Decode(&list)
+		drain(res)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding tags of %s", ref.Name())
+		}
+		tags = append(tags, list.Tags...)
+
+		if u, err = nextPage(res); err != nil {
+			return nil, errors.Wrapf(err, "listing tags of %s", ref.Name())
+		}
+	}
+	return tags, nil
+}
+
+// nextPage returns the URL of the next page from the Link header
+func nextPage(res *http.Response) (string, error) {
+	link := res.Header.Get("Link")
+	target, params, ok := strings.Cut(link, ";")
+	if !ok || !strings.Contains(params, `rel="next"`) {
+		return "", nil
+	}
+
+	next, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+	if err != nil {
+		return "", err
+	}
+	return res.Request.URL.ResolveReference(next).String(), nil
+}
+
+// request sends a request for what, authenticating when the registry asks
+// for it. Only a 200 response is returned.
+func (c *Client) request(ctx context.Context, method, u, accept string, ref Reference, what string) (*http.Response, error) {
+	res, err := c.send(ctx, method, u, accept, ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "requesting %s", what)
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge := res.Header.Get("WWW-Authenticate")
+		drain(res)
+		if err := c.authenticate(ctx, challenge, ref); err != nil {
+			return nil, err
+		}
+		if res, err = c.send(ctx, method, u, accept, ref); err != nil {
+			return nil, errors.Wrapf(err, "requesting %s", what)
+		}
+	}
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return res, nil
+	case res.StatusCode == http.StatusNotFound:
+		drain(res)
+		return nil, errors.Errorf("%s not found", what)
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		drain(res)
+		return nil, errors.Errorf("access to %s denied by registry, add its credentials to portainer", ref.Name())
+	default:
+		drain(res)
+		return nil, errors.Errorf("requesting %s: %s", what, res.Status)
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, u, accept string, ref Reference) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	if header := c.authorization(ref); header != "" {
+		req.Header.Set("Authorization", header)
+	}
+	return c.client.Do(req)
+}
+
+func (c *Client) authorization(ref Reference) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	auth, ok := c.authorizations[ref.Name()]
+	if !ok || (!auth.expires.IsZero() && time.Now().After(auth.expires)) {
+		return ""
+	}
+	return auth.header
+}
+
+// authenticate answers the challenge of a registry, a basic challenge is
+// answered with the credential itself, a bearer challenge with a token from
+// the realm the registry names
+func (c *Client) authenticate(ctx context.Context, challenge string, ref Reference) error {
+	scheme, params := parseChallenge(challenge)
+
+	cred, err := c.credential(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	var auth authorization
+	switch scheme {
+	case "basic":
+		if cred == (Credential{}) {
+			return errors.Errorf("registry %s requires credentials, add them to portainer", ref.Registry)
+		}
+		auth.header = "Basic " + basicAuth(cred)
+	case "bearer":
+		if auth, err = c.token(ctx, params, cred, ref); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unsupported authentication challenge %q from registry %s", challenge, ref.Registry)
+	}
+
+	c.mu.Lock()
+	c.authorizations[ref.Name()] = auth
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) credential(ctx context.Context, ref Reference) (Credential, error) {
+	if c.credentials == nil {
+		return Credential{}, nil
+	}
+	cred, err := c.credentials(ctx, ref)
+	if err != nil {
+		return Credential{}, errors.Wrapf(err, "looking up credentials of %s", ref.Registry)
+	}
+	return cred, nil
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// token requests a pull token for ref from the realm of a bearer challenge
+func (c *Client) token(ctx context.Context, params map[string]string, cred Credential, ref Reference) (authorization, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return authorization{}, errors.Errorf("invalid token realm %q from registry %s", params["realm"], ref.Registry)
+	}
+
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", ref.Repository)
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return authorization{}, err
+	}
+	if cred != (Credential{}) {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return authorization{}, errors.Wrapf(err, "requesting token for %s", ref.Name())
+	}
+	defer drain(res)
+
+	if res.StatusCode != http.StatusOK {
+		return authorization{}, errors.Errorf("requesting token for %s: %s", ref.Name(), res.Status)
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return authorization{}, errors.Wrapf(err, "decoding token for %s", ref.Name())
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return authorization{}, errors.Errorf("registry sent no token for %s", ref.Name())
+	}
+
+	lifetime := defaultTokenLifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	return authorization{
+		header: "Bearer " + token.Token,
+		// leave some room for the request that uses the token
+		expires: time.Now().Add(lifetime * 9 / 10),
+	}, nil
+}
+
+// baseURL returns the URL the registry api is served on, insecure and
+// loopback registries are reached over plain http like docker does
+func (c *Client) baseURL(registry string) string {
+	if registry == DockerHub {
+		return "https://registry-1.docker.io"
+	}
+	if c.insecure[registry] {
+		return "http://" + registry
+	}
+
+	host, _, err := net.SplitHostPort(registry)
+	if err != nil {
+		host = registry
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return "http://" + registry
+	}
+	return "https://" + registry
+}
+
+// parseChallenge splits a WWW-Authenticate header like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := make(map[string]string)
+
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return strings.ToLower(scheme), params
+}
+
+func basicAuth(cred Credential) string {
+	return base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password))
+}
+
+func drain(res *http.Response) {
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+}
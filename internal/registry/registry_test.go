@@ -0,0 +1,177 @@
+package registry_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sjafferali/portainer-autoupdater/internal/registry"
+	"github.com/sjafferali/portainer-autoupdater/internal/registry/fake"
+)
+
+func TestParseReference(t *testing.T) {
+	for image, want := range map[string]registry.Reference{
+		"nginx":                        {Registry: "docker.io", Repository: "library/nginx", Tag: "latest"},
+		"nginx:1.25":                   {Registry: "docker.io", Repository: "library/nginx", Tag: "1.25"},
+		"grafana/grafana:10":           {Registry: "docker.io", Repository: "grafana/grafana", Tag: "10"},
+		"docker.io/library/redis:7":    {Registry: "docker.io", Repository: "library/redis", Tag: "7"},
+		"index.docker.io/nginx":        {Registry: "docker.io", Repository: "library/nginx", Tag: "latest"},
+		"ghcr.io/org/app:v2":           {Registry: "ghcr.io", Repository: "org/app", Tag: "v2"},
+		"localhost:5000/app":           {Registry: "localhost:5000", Repository: "app", Tag: "latest"},
+		"localhost/app:1":              {Registry: "localhost", Repository: "app", Tag: "1"},
+		"nginx@sha256:abc":             {Registry: "docker.io", Repository: "library/nginx", Digest: "sha256:abc"},
+		"quay.io/org/app:1.0@sha256:a": {Registry: "quay.io", Repository: "org/app", Tag: "1.0", Digest: "sha256:a"},
+	} {
+		got, err := registry.ParseReference(image)
+		if err != nil {
+			t.Errorf("%s: %s", image, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", image, got, want)
+		}
+	}
+
+	for _, image := range []string{"", "sha256:abc", "ghcr.io/"} {
+		if _, err := registry.ParseReference(image); err == nil {
+			t.Errorf("%q: want error", image)
+		}
+	}
+}
+
+func reference(t *testing.T, reg *fake.Registry, image string) registry.Reference {
+	t.Helper()
+	ref, err := registry.ParseReference(reg.Host() + "/" + image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func credentials(username, password string) registry.Option {
+	return registry.WithCredentials(func(context.Context, registry.Reference) (registry.Credential, error) {
+		return registry.Credential{Username: username, Password: password}, nil
+	})
+}
+
+func TestDigest(t *testing.T) {
+	reg := fake.NewRegistry()
+	defer reg.Close()
+	want := reg.Push("app", "1")
+
+	got, err := registry.NewClient().Digest(context.Background(), reference(t, reg, "app:1"))
+	if err != nil {
+		t.Fatalf("resolving tag: %s", err)
+	}
+	if got != want {
+		t.Errorf("got digest %s, want %s", got, want)
+	}
+
+	for _, r := range reg.Requests() {
+		if r.Method != http.MethodHead {
+			t.Errorf("got %s %s, want only HEAD requests", r.Method, r.Path)
+		}
+	}
+}
+
+func TestDigestWithoutHeader(t *testing.T) {
+	reg := fake.NewRegistry()
+	defer reg.Close()
+	reg.OmitDigest = true
+	want := reg.Push("app", "1")
+
+	got, err := registry.NewClient().Digest(context.Background(), reference(t, reg, "app:1"))
+	if err != nil {
+		t.Fatalf("resolving tag: %s", err)
+	}
+	if got != want {
+		t.Errorf("got digest %s of the manifest, want %s", got, want)
+	}
+}
+
+func TestDigestNotFound(t *testing.T) {
+	reg := fake.NewRegistry()
+	defer reg.Close()
+	reg.Push("app", "1")
+
+	if _, err := registry.NewClient().Digest(context.Background(), reference(t, reg, "app:2")); err == nil {
+		t.Fatal("want error for an unknown tag")
+	}
+}
+
+func TestDigestToken(t *testing.T) {
+	reg := fake.NewRegistry()
+	defer reg.Close()
+	reg.Auth = fake.AuthToken
+	reg.Username, reg.Password = "robot", "secret"
+	first := reg.Push("org/app", "1")
+	second := reg.Push("org/app", "2")
+
+	c := registry.NewClient(credentials("robot", "secret"))
+	for tag, want := range map[string]string{"1": first, "2": second} {
+		got, err := c.Digest(context.Background(), reference(t, reg, "org/app:"+tag))
+		if err != nil {
+			t.Fatalf("resolving tag %s: %s", tag, err)
+		}
+		if got != want {
+			t.Errorf("tag %s: got digest %s, want %s", tag, got, want)
+		}
+	}
+	if got := reg.Tokens(); got != 1 {
+		t.Errorf("got %d tokens, want the token reused", got)
+	}
+
+	c = registry.NewClient(credentials("robot", "wrong"))
+	if _, err := c.Digest(context.Background(), reference(t, reg, "org/app:1")); err == nil {
+		t.Fatal("want error for wrong credentials")
+	}
+}
+
+func TestDigestBasic(t *testing.T) {
+	reg := fake.NewRegistry()
+	defer reg.Close()
+	reg.Auth = fake.AuthBasic
+	reg.Username, reg.Password = "robot", "secret"
+	want := reg.Push("app", "1")
+
+	got, err := registry.NewClient(credentials("robot", "secret")).Digest(context.Background(), reference(t, reg, "app:1"))
+	if err != nil {
+		t.Fatalf("resolving tag: %s", err)
+	}
+	if got != want {
+		t.Errorf("got digest %s, want %s", got, want)
+	}
+
+	if _, err := registry.NewClient().Digest(context.Background(), reference(t, reg, "app:1")); err == nil {
+		t.Fatal("want error without credentials")
+	}
+}
+
+func TestTags(t *testing.T) {
+	reg := fake.NewRegistry()
+	defer reg.Close()
+	reg.Auth = fake.AuthToken
+	reg.Username, reg.Password = "robot", "secret"
+	reg.PageSize = 2
+	for _, tag := range []string{"15.4", "15.5", "16.1", "latest", "16.2"} {
+		reg.Push("postgres", tag)
+	}
+	reg.Push("other", "1")
+
+	got, err := registry.NewClient(credentials("robot", "secret")).Tags(context.Background(), reference(t, reg, "postgres:15.4"))
+	if err != nil {
+		t.Fatalf("listing tags: %s", err)
+	}
+	want := []string{"15.4", "15.5", "16.1", "16.2", "latest"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+	if got := reg.Tokens(); got != 1 {
+		t.Errorf("got %d tokens, want the token reused across pages", got)
+	}
+
+	if _, err := registry.NewClient(credentials("robot", "secret")).Tags(context.Background(), reference(t, reg, "missing:1")); err == nil {
+		t.Fatal("want error for an unknown repository")
+	}
+}
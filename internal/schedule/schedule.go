@@ -0,0 +1,257 @@
+// Package schedule parses cron expressions and maintenance windows.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+)
+
+// Cron is a parsed cron expression
+type Cron struct {
+	expr     string
+	schedule cron.Schedule
+}
+
+// ParseCron parses a standard five field cron expression or a descriptor
+// such as @daily. A timezone can be set with a CRON_TZ= prefix.
+func ParseCron(expr string) (*Cron, error) {
+	s, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing cron expression %q", expr)
+	}
+	return &Cron{expr: expr, schedule: s}, nil
+}
+
+// Next returns the first activation after t
+func (c *Cron) Next(t time.Time) time.Time {
+	return c.schedule.Next(t)
+}
+
+func (c *Cron) String() string {
+	return c.expr
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring weekly time range in which updates may be performed,
+// such as "Sun 02:00-05:00 Europe/Berlin". A window ending at or before its
+// start runs past midnight into the next day.
+type Window struct {
+	Name  string
+	spec  string
+	days  [7]bool
+	start time.Duration
+	end   time.Duration
+	loc   *time.Location
+}
+
+// ParseWindow parses a window in the form "[name=]days HH:MM-HH:MM [timezone]".
+// Days are a comma separated list of weekdays or weekday ranges such as
+// "Mon-Fri,Sun", or "*" or "daily" for every day. The timezone defaults to UTC.
+func ParseWindow(spec string) (Window, error) {
+	w := Window{spec: strings.TrimSpace(spec), loc: time.UTC}
+
+	rest := w.spec
+	if name, value, ok := strings.Cut(rest, "="); ok {
+		w.Name = strings.TrimSpace(name)
+		rest = strings.TrimSpace(value)
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 2 || len(fields) > 3 {
+		return Window{}, fmt.Errorf("invalid maintenance window %q: expected \"days HH:MM-HH:MM [timezone]\"", spec)
+	}
+
+	if err := w.parseDays(fields[0]); err != nil {
+		return Window{}, errors.Wrapf(err, "invalid maintenance window %q", spec)
+	}
+
+	from, to, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid maintenance window %q: expected a time range", spec)
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(from); err != nil {
+		return Window{}, errors.Wrapf(err, "invalid maintenance window %q", spec)
+	}
+	if w.end, err = parseTimeOfDay(to); err != nil {
+		return Window{}, errors.Wrapf(err, "invalid maintenance window %q", spec)
+	}
+
+	if len(fields) == 3 {
+		if w.loc, err = time.LoadLocation(fields[2]); err != nil {
+			return Window{}, errors.Wrapf(err, "invalid maintenance window %q", spec)
+		}
+	}
+
+	if w.Name == "" {
+		w.Name = rest
+	}
+	return w, nil
+}
+
+func (w *Window) parseDays(days string) error {
+	if days == "*" || strings.EqualFold(days, "daily") {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, part := range strings.Split(days, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return fmt.Errorf("unknown weekday %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[strings.ToLower(to)]; !ok {
+				return fmt.Errorf("unknown weekday %q", to)
+			}
+		}
+
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func (w Window) String() string {
+	return w.spec
+}
+
+// opening returns the start of the window that began on the day of t. The
+// times are wall clock times, so on days the clocks change the window is
+// shorter or longer than usual.
+func (w Window) opening(t time.Time) time.Time {
+	return atTimeOfDay(t, 0, w.start, w.loc)
+}
+
+// closing returns the end of the window that began on the day of t
+func (w Window) closing(t time.Time) time.Time {
+	if w.end <= w.start {
+		return atTimeOfDay(t, 1, w.end, w.loc)
+	}
+	return atTimeOfDay(t, 0, w.end, w.loc)
+}
+
+// atTimeOfDay returns the wall clock time of day on the date of t, days later
+func atTimeOfDay(t time.Time, days int, of time.Duration, loc *time.Location) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+days, int(of/time.Hour), int(of%time.Hour/time.Minute), 0, 0, loc)
+}
+
+// Contains reports whether t falls within the window
+func (w Window) Contains(t time.Time) bool {
+	t = t.In(w.loc)
+
+	// the window may have opened today or, when it runs past midnight, yesterday
+	for _, day := range []time.Time{t, t.AddDate(0, 0, -1)} {
+		open := w.opening(day)
+		if !w.days[open.Weekday()] {
+			continue
+		}
+		if !t.Before(open) && t.Before(w.closing(day)) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns t when it falls within the window, otherwise the time the
+// window opens next
+func (w Window) NextOpen(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+
+	t = t.In(w.loc)
+	for i := 0; i <= 7; i++ {
+		open := w.opening(t.AddDate(0, 0, i))
+		if w.days[open.Weekday()] && open.After(t) {
+			return open
+		}
+	}
+	return time.Time{}
+}
+
+// Windows is a set of maintenance windows, updates may run in any of them
+type Windows []Window
+
+// ParseWindows parses a semicolon separated list of windows
+func ParseWindows(specs string) (Windows, error) {
+	windows := make(Windows, 0)
+	for _, spec := range strings.Split(specs, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		w, err := ParseWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// Active returns the window t falls within
+func (ws Windows) Active(t time.Time) (Window, bool) {
+	for _, w := range ws {
+		if w.Contains(t) {
+			return w, true
+		}
+	}
+	return Window{}, false
+}
+
+// NextOpen returns t when any window is open, otherwise the earliest time one
+// of the windows opens
+func (ws Windows) NextOpen(t time.Time) (time.Time, Window) {
+	var next time.Time
+	var window Window
+	for _, w := range ws {
+		open := w.NextOpen(t)
+		if open.IsZero() {
+			continue
+		}
+		if next.IsZero() || open.Before(next) {
+			next = open
+			window = w
+		}
+	}
+	return next, window
+}
@@ -0,0 +1,232 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/sjafferali/portainer-autoupdater/internal/schedule"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2024, 3, 29, 10, 2, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		expr string
+		want time.Time
+	}{
+		{expr: "*/5 * * * *", want: time.Date(2024, 3, 29, 10, 5, 0, 0, time.UTC)},
+		{expr: "@daily", want: time.Date(2024, 3, 30, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 4 * * sun", want: time.Date(2024, 3, 31, 4, 0, 0, 0, time.UTC)},
+		{expr: "CRON_TZ=Europe/Berlin 0 12 * * *", want: time.Date(2024, 3, 29, 11, 0, 0, 0, time.UTC)},
+	} {
+		c, err := schedule.ParseCron(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %s", tc.expr, err)
+			continue
+		}
+		if got := c.Next(from); !got.Equal(tc.want) {
+			t.Errorf("%s: got next %s, want %s", tc.expr, got.UTC(), tc.want)
+		}
+		if c.String() != tc.expr {
+			t.Errorf("%s: got %q as string", tc.expr, c.String())
+		}
+	}
+
+	for _, expr := range []string{"", "* * *", "61 * * * *", "@fortnightly"} {
+		if _, err := schedule.ParseCron(expr); err == nil {
+			t.Errorf("%q: want error", expr)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		name string
+	}{
+		{spec: "weekend=Sun 02:00-05:00 Europe/Berlin", name: "weekend"},
+		{spec: "Mon-Fri 23:00-01:00", name: "Mon-Fri 23:00-01:00"},
+		{spec: " daily 00:00-24:00 UTC ", name: "daily 00:00-24:00 UTC"},
+		{spec: "Fri-Mon,wed 09:30-10:00", name: "Fri-Mon,wed 09:30-10:00"},
+		{spec: "* 22:00-02:00", name: "* 22:00-02:00"},
+	} {
+		w, err := schedule.ParseWindow(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %s", tc.spec, err)
+			continue
+		}
+		if w.Name != tc.name {
+			t.Errorf("%q: got name %q, want %q", tc.spec, w.Name, tc.name)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"Sun",
+		"Sun 02:00",
+		"Sun 02:00-05:00 UTC extra",
+		"Funday 02:00-05:00",
+		"Mon-Funday 02:00-05:00",
+		"Sun 2-5",
+		"Sun 25:00-05:00",
+		"Sun 24:30-05:00",
+		"Sun 02:60-05:00",
+		"Sun 02:00-05:00 Mars/Olympus",
+	} {
+		if _, err := schedule.ParseWindow(spec); err == nil {
+			t.Errorf("%q: want error", spec)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	berlin := mustLoad(t, "Europe/Berlin")
+	for _, tc := range []struct {
+		spec string
+		at   time.Time
+		want bool
+	}{
+		// 2024-03-29 is a Friday
+		{spec: "Fri 09:00-17:00", at: time.Date(2024, 3, 29, 9, 0, 0, 0, time.UTC), want: true},
+		{spec: "Fri 09:00-17:00", at: time.Date(2024, 3, 29, 17, 0, 0, 0, time.UTC), want: false},
+		{spec: "Fri 09:00-17:00", at: time.Date(2024, 3, 28, 12, 0, 0, 0, time.UTC), want: false},
+		{spec: "Mon-Fri 09:00-17:00", at: time.Date(2024, 3, 28, 12, 0, 0, 0, time.UTC), want: true},
+		{spec: "Fri-Mon 09:00-17:00", at: time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC), want: true},
+		{spec: "Fri-Mon 09:00-17:00", at: time.Date(2024, 3, 27, 12, 0, 0, 0, time.UTC), want: false},
+
+		// windows ending at or before their start run past midnight
+		{spec: "Fri 23:00-01:00", at: time.Date(2024, 3, 29, 23, 30, 0, 0, time.UTC), want: true},
+		{spec: "Fri 23:00-01:00", at: time.Date(2024, 3, 30, 0, 30, 0, 0, time.UTC), want: true},
+		{spec: "Fri 23:00-01:00", at: time.Date(2024, 3, 30, 1, 0, 0, 0, time.UTC), want: false},
+		{spec: "Fri 23:00-01:00", at: time.Date(2024, 3, 29, 0, 30, 0, 0, time.UTC), want: false},
+		{spec: "Sat 23:00-01:00", at: time.Date(2024, 3, 30, 0, 30, 0, 0, time.UTC), want: false},
+		{spec: "daily 00:00-24:00", at: time.Date(2024, 3, 30, 0, 0, 0, 0, time.UTC), want: true},
+		{spec: "daily 02:00-02:00", at: time.Date(2024, 3, 30, 1, 59, 0, 0, time.UTC), want: true},
+
+		// timezones
+		{spec: "Fri 09:00-17:00 Europe/Berlin", at: time.Date(2024, 3, 29, 8, 30, 0, 0, time.UTC), want: true},
+		{spec: "Fri 09:00-17:00 Europe/Berlin", at: time.Date(2024, 3, 29, 16, 30, 0, 0, time.UTC), want: false},
+		{spec: "Fri 09:00-17:00 America/New_York", at: time.Date(2024, 3, 29, 20, 30, 0, 0, time.UTC), want: true},
+
+		// clocks go forward at 02:00 on 2024-03-31 in Berlin, 03:00 is 01:00 UTC
+		{spec: "Sun 04:00-06:00 Europe/Berlin", at: time.Date(2024, 3, 31, 1, 59, 0, 0, time.UTC), want: false},
+		{spec: "Sun 04:00-06:00 Europe/Berlin", at: time.Date(2024, 3, 31, 2, 0, 0, 0, time.UTC), want: true},
+		{spec: "Sun 04:00-06:00 Europe/Berlin", at: time.Date(2024, 3, 31, 3, 59, 0, 0, time.UTC), want: true},
+		{spec: "Sun 04:00-06:00 Europe/Berlin", at: time.Date(2024, 3, 31, 4, 0, 0, 0, time.UTC), want: false},
+		{spec: "Sun 01:00-05:00 Europe/Berlin", at: time.Date(2024, 3, 31, 2, 59, 0, 0, time.UTC), want: true},
+		{spec: "Sun 01:00-05:00 Europe/Berlin", at: time.Date(2024, 3, 31, 3, 0, 0, 0, time.UTC), want: false},
+		{spec: "Sat 23:00-04:00 Europe/Berlin", at: time.Date(2024, 3, 31, 1, 59, 0, 0, time.UTC), want: true},
+		{spec: "Sat 23:00-04:00 Europe/Berlin", at: time.Date(2024, 3, 31, 2, 0, 0, 0, time.UTC), want: false},
+
+		// clocks go back at 03:00 on 2024-10-27 in Berlin, 02:00 is 01:00 UTC
+		{spec: "Sun 04:00-06:00 Europe/Berlin", at: time.Date(2024, 10, 27, 2, 59, 0, 0, time.UTC), want: false},
+		{spec: "Sun 04:00-06:00 Europe/Berlin", at: time.Date(2024, 10, 27, 3, 0, 0, 0, time.UTC), want: true},
+		{spec: "Sun 04:00-06:00 Europe/Berlin", at: time.Date(2024, 10, 27, 5, 0, 0, 0, time.UTC), want: false},
+		{spec: "Sun 01:00-05:00 Europe/Berlin", at: time.Date(2024, 10, 26, 23, 0, 0, 0, time.UTC), want: true},
+		{spec: "Sun 01:00-05:00 Europe/Berlin", at: time.Date(2024, 10, 27, 3, 59, 0, 0, time.UTC), want: true},
+		{spec: "Sun 01:00-05:00 Europe/Berlin", at: time.Date(2024, 10, 27, 4, 0, 0, 0, time.UTC), want: false},
+	} {
+		w, err := schedule.ParseWindow(tc.spec)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.spec, err)
+		}
+		if got := w.Contains(tc.at); got != tc.want {
+			t.Errorf("%q at %s (%s in Berlin): got %t, want %t", tc.spec, tc.at, tc.at.In(berlin).Format(time.TimeOnly), got, tc.want)
+		}
+	}
+}
+
+func TestWindowNextOpen(t *testing.T) {
+	berlin := mustLoad(t, "Europe/Berlin")
+	for _, tc := range []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{
+			spec: "Sun 02:00-05:00",
+			from: time.Date(2024, 3, 29, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 3, 31, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			// open windows return the time itself
+			spec: "Fri 09:00-17:00",
+			from: time.Date(2024, 3, 29, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 3, 29, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			// the same day a week later
+			spec: "Fri 09:00-10:00",
+			from: time.Date(2024, 3, 29, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 4, 5, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			spec: "Mon-Fri 23:00-01:00",
+			from: time.Date(2024, 3, 30, 1, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 4, 1, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			spec: "Sun 04:00-06:00 Europe/Berlin",
+			from: time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 3, 31, 4, 0, 0, 0, berlin),
+		},
+		{
+			spec: "Sun 04:00-06:00 Europe/Berlin",
+			from: time.Date(2024, 10, 26, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 10, 27, 4, 0, 0, 0, berlin),
+		},
+		{
+			// 02:30 doesn't exist when the clocks go forward, the window
+			// opens as the clocks reach 03:30
+			spec: "Sun 02:30-05:00 Europe/Berlin",
+			from: time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 3, 31, 1, 30, 0, 0, time.UTC),
+		},
+	} {
+		w, err := schedule.ParseWindow(tc.spec)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.spec, err)
+		}
+		if got := w.NextOpen(tc.from); !got.Equal(tc.want) {
+			t.Errorf("%q from %s: got %s, want %s", tc.spec, tc.from, got.UTC(), tc.want.UTC())
+		}
+	}
+}
+
+func TestWindows(t *testing.T) {
+	ws, err := schedule.ParseWindows("weekend=Sat,Sun 02:00-05:00; ;nightly=Mon-Fri 23:00-01:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ws) != 2 {
+		t.Fatalf("got %d windows, want 2", len(ws))
+	}
+
+	if w, ok := ws.Active(time.Date(2024, 3, 30, 0, 30, 0, 0, time.UTC)); !ok || w.Name != "nightly" {
+		t.Errorf("want nightly window active after friday night, got %q (%t)", w.Name, ok)
+	}
+	if _, ok := ws.Active(time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC)); ok {
+		t.Error("want no window active on saturday noon")
+	}
+
+	next, w := ws.NextOpen(time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC))
+	if want := time.Date(2024, 3, 31, 2, 0, 0, 0, time.UTC); !next.Equal(want) || w.Name != "weekend" {
+		t.Errorf("got next window %q at %s, want weekend at %s", w.Name, next, want)
+	}
+
+	if _, err := schedule.ParseWindows("Sun 02:00-05:00;bad"); err == nil {
+		t.Error("want error for an invalid window")
+	}
+	if next, _ := (schedule.Windows{}).NextOpen(time.Now()); !next.IsZero() {
+		t.Errorf("want no opening without windows, got %s", next)
+	}
+}
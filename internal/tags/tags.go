@@ -0,0 +1,158 @@
+// Package tags picks newer version tags of an image, such as 15.5 for an
+// image pinned to postgres:15.4, within a bump policy.
+package tags
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Policy limits how far a tag may be bumped
+type Policy string
+
+const (
+	// PolicyNone never bumps tags
+	PolicyNone Policy = ""
+	// PolicyPatch bumps 1.2.3 to 1.2.4, but not to 1.3.0
+	PolicyPatch Policy = "patch"
+	// PolicyMinor bumps 1.2.3 to 1.3.0, but not to 2.0.0
+	PolicyMinor Policy = "minor"
+	// PolicyMajor bumps to the newest version
+	PolicyMajor Policy = "major"
+)
+
+// fixedParts is the number of leading version parts a policy keeps
+var fixedParts = map[Policy]int{
+	PolicyPatch: 2,
+	PolicyMinor: 1,
+	PolicyMajor: 0,
+}
+
+// ParsePolicy reads a policy name, "none" and the empty string disable
+// bumping
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(strings.ToLower(strings.TrimSpace(name))); p {
+	case PolicyNone, "none":
+		return PolicyNone, nil
+	case PolicyPatch, PolicyMinor, PolicyMajor:
+		return p, nil
+	default:
+		return PolicyNone, errors.Errorf("unknown tag policy %q, use patch, minor, major or none", name)
+	}
+}
+
+var versionRe = regexp.MustCompile(`^(v?)(\d+(?:\.\d+){0,2})(-[0-9A-Za-z][0-9A-Za-z.-]*)?$`)
+
+// Version is a tag like 15.4, v1.2.3 or 3.19-alpine
+type Version struct {
+	prefix string
+	parts  []int
+	// suffix is a variant like -alpine, tags are only bumped to tags of the
+	// same variant
+	suffix string
+}
+
+// ParseVersion reads a version tag, tags like latest or stable aren't
+// versions
+func ParseVersion(tag string) (Version, bool) {
+	m := versionRe.FindStringSubmatch(tag)
+	if m == nil {
+		return Version{}, false
+	}
+
+	v := Version{prefix: m[1], suffix: m[3]}
+	for _, part := range strings.Split(m[2], ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return Version{}, false
+		}
+		v.parts = append(v.parts, n)
+	}
+	return v, true
+}
+
+// comparable reports whether tags of both versions follow the same scheme,
+// 15.4 and 15.5 do, while 15.4, 15.4.1, v15.5 and 15.5-alpine don't
+func (v Version) comparable(o Version) bool {
+	return v.prefix == o.prefix && v.suffix == o.suffix && len(v.parts) == len(o.parts)
+}
+
+// newer reports whether v is a higher version than o
+func (v Version) newer(o Version) bool {
+	for i := range v.parts {
+		if v.parts[i] != o.parts[i] {
+			return v.parts[i] > o.parts[i]
+		}
+	}
+	return false
+}
+
+// within reports whether bumping o to v is allowed by policy
+func (v Version) within(o Version, policy Policy) bool {
+	fixed, ok := fixedParts[policy]
+	if !ok {
+		return false
+	}
+	for i := 0; i < fixed && i < len(v.parts); i++ {
+		if v.parts[i] != o.parts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter narrows down the tags considered, nil expressions match everything
+type Filter struct {
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+}
+
+// ParseFilter compiles the include and exclude expressions, empty
+// expressions aren't applied
+func ParseFilter(include, exclude string) (Filter, error) {
+	var f Filter
+	var err error
+	if include != "" {
+		if f.Include, err = regexp.Compile(include); err != nil {
+			return Filter{}, errors.Wrap(err, "parsing tag include filter")
+		}
+	}
+	if exclude != "" {
+		if f.Exclude, err = regexp.Compile(exclude); err != nil {
+			return Filter{}, errors.Wrap(err, "parsing tag exclude filter")
+		}
+	}
+	return f, nil
+}
+
+// Match reports whether tag passes the filter
+func (f Filter) Match(tag string) bool {
+	if f.Include != nil && !f.Include.MatchString(tag) {
+		return false
+	}
+	return f.Exclude == nil || !f.Exclude.MatchString(tag)
+}
+
+// Newest returns the highest tag of candidates that current may be bumped to
+// under policy, and false when current is the newest or isn't a version
+func Newest(current string, candidates []string, policy Policy, filter Filter) (string, bool) {
+	cur, ok := ParseVersion(current)
+	if !ok || policy == PolicyNone {
+		return "", false
+	}
+
+	best, bestTag := cur, ""
+	for _, tag := range candidates {
+		v, ok := ParseVersion(tag)
+		if !ok || !v.comparable(cur) || !filter.Match(tag) {
+			continue
+		}
+		if v.newer(best) && v.within(cur, policy) {
+			best, bestTag = v, tag
+		}
+	}
+	return bestTag, bestTag != ""
+}
@@ -0,0 +1,67 @@
+package tags_test
+
+import (
+	"testing"
+
+	"github.com/sjafferali/portainer-autoupdater/internal/tags"
+)
+
+var postgres = []string{
+	"latest", "15", "15.4", "15.5", "15.6", "15.6-alpine", "15.7-alpine", "16", "16.1", "16.2",
+	"16.2-bookworm", "17beta1", "v16.3", "15.4.1", "15.4.2", "15.5.0", "16.0.1",
+}
+
+func TestNewest(t *testing.T) {
+	for _, tc := range []struct {
+		current string
+		policy  tags.Policy
+		include string
+		exclude string
+		want    string
+	}{
+		{current: "15.4", policy: tags.PolicyMajor, want: "16.2"},
+		{current: "15.4", policy: tags.PolicyMinor, want: "15.6"},
+		{current: "15.4", policy: tags.PolicyPatch, want: ""},
+		{current: "15.4.1", policy: tags.PolicyPatch, want: "15.4.2"},
+		{current: "15.4.1", policy: tags.PolicyMinor, want: "15.5.0"},
+		{current: "15.4.1", policy: tags.PolicyMajor, want: "16.0.1"},
+		{current: "15", policy: tags.PolicyMinor, want: ""},
+		{current: "15", policy: tags.PolicyMajor, want: "16"},
+		{current: "15.6-alpine", policy: tags.PolicyMinor, want: "15.7-alpine"},
+		{current: "16.2", policy: tags.PolicyMajor, want: ""},
+		{current: "latest", policy: tags.PolicyMajor, want: ""},
+		{current: "15.4", policy: tags.PolicyNone, want: ""},
+		{current: "15.4", policy: tags.PolicyMajor, exclude: `^16\.`, want: "15.6"},
+		{current: "15.4", policy: tags.PolicyMajor, include: `^15\.[45]$`, want: "15.5"},
+	} {
+		filter, err := tags.ParseFilter(tc.include, tc.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := tags.Newest(tc.current, postgres, tc.policy, filter)
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("%s with %q policy: got %q, want %q", tc.current, tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for name, want := range map[string]tags.Policy{
+		"":       tags.PolicyNone,
+		"none":   tags.PolicyNone,
+		"Patch":  tags.PolicyPatch,
+		"minor ": tags.PolicyMinor,
+		"major":  tags.PolicyMajor,
+	} {
+		got, err := tags.ParsePolicy(name)
+		if err != nil || got != want {
+			t.Errorf("%q: got %q (%v), want %q", name, got, err, want)
+		}
+	}
+	if _, err := tags.ParsePolicy("semver"); err == nil {
+		t.Error("want error for an unknown policy")
+	}
+	if _, err := tags.ParseFilter("(", ""); err == nil {
+		t.Error("want error for an invalid expression")
+	}
+}